@@ -1,18 +1,26 @@
 package api
 
 import (
+	"crypto/subtle"
+
 	"github.com/getsentry/sentry-go"
 	"net/http"
 
 	"github.com/sirupsen/logrus"
 	"github.com/turt2live/matrix-media-repo/api/auth_cache"
-	"github.com/turt2live/matrix-media-repo/common"
 	"github.com/turt2live/matrix-media-repo/common/config"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/matrix"
 	"github.com/turt2live/matrix-media-repo/util"
 )
 
+// isSharedSecret returns true if the shared secret is enabled and matches the access token. The
+// comparison takes constant time so the secret can't be guessed from response times.
+func isSharedSecret(accessToken string) bool {
+	conf := config.Get().SharedSecret
+	return conf.Enabled && conf.Token != "" && subtle.ConstantTimeCompare([]byte(accessToken), []byte(conf.Token)) == 1
+}
+
 type UserInfo struct {
 	UserId      string
 	AccessToken string
@@ -29,15 +37,17 @@ func AccessTokenRequiredRoute(next func(r *http.Request, rctx rcontext.RequestCo
 		accessToken := util.GetAccessTokenFromRequest(r)
 		if accessToken == "" {
 			rctx.Log.Error("Error: no token provided (required)")
-			return &ErrorResponse{common.ErrCodeMissingToken, "no token provided (required)", common.ErrCodeUnknownToken}
+			return MissingToken()
 		}
-		if config.Get().SharedSecret.Enabled && accessToken == config.Get().SharedSecret.Token {
+		if isSharedSecret(accessToken) {
 			log := rctx.Log.WithFields(logrus.Fields{"isRepoAdmin": true})
 			log.Info("User authed using shared secret")
 			return callUserNext(next, r, rctx, UserInfo{UserId: "@sharedsecret", AccessToken: accessToken, IsShared: true})
 		}
 		appserviceUserId := util.GetAppserviceUserIdFromRequest(r)
+		stopTiming := rctx.TimePhase("auth")
 		userId, err := auth_cache.GetUserId(rctx, accessToken, appserviceUserId)
+		stopTiming()
 		if err != nil || userId == "" {
 			if err == matrix.ErrGuestToken {
 				return GuestAuthFailed()
@@ -63,13 +73,15 @@ func AccessTokenOptionalRoute(next func(r *http.Request, rctx rcontext.RequestCo
 		if accessToken == "" {
 			return callUserNext(next, r, rctx, UserInfo{"", "", false})
 		}
-		if config.Get().SharedSecret.Enabled && accessToken == config.Get().SharedSecret.Token {
+		if isSharedSecret(accessToken) {
 			rctx = rctx.LogWithFields(logrus.Fields{"isRepoAdmin": true})
 			rctx.Log.Info("User authed using shared secret")
 			return callUserNext(next, r, rctx, UserInfo{UserId: "@sharedsecret", AccessToken: accessToken, IsShared: true})
 		}
 		appserviceUserId := util.GetAppserviceUserIdFromRequest(r)
+		stopTiming := rctx.TimePhase("auth")
 		userId, err := auth_cache.GetUserId(rctx, accessToken, appserviceUserId)
+		stopTiming()
 		if err != nil {
 			if err != matrix.ErrInvalidToken {
 				rctx.Log.Error("Error verifying token: ", err)
@@ -103,7 +115,7 @@ func RepoAdminRoute(next func(r *http.Request, rctx rcontext.RequestContext, use
 	return func(r *http.Request, rctx rcontext.RequestContext) interface{} {
 		if config.Get().SharedSecret.Enabled {
 			accessToken := util.GetAccessTokenFromRequest(r)
-			if accessToken == config.Get().SharedSecret.Token {
+			if isSharedSecret(accessToken) {
 				rctx = rctx.LogWithFields(logrus.Fields{"isRepoAdmin": true})
 				rctx.Log.Info("User authed using shared secret")
 				return callUserNext(next, r, rctx, UserInfo{UserId: "@sharedsecret", AccessToken: accessToken, IsShared: true})
@@ -0,0 +1,22 @@
+package auth_cache
+
+import (
+	"crypto/subtle"
+
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+)
+
+// GetAppservice returns the configured appservice the access token belongs to, or nil if the token
+// is not an appservice token.
+func GetAppservice(ctx rcontext.RequestContext, accessToken string) *config.AppserviceConfig {
+	if accessToken == "" {
+		return nil
+	}
+	for i, r := range ctx.Config.AccessTokens.Appservices {
+		if subtle.ConstantTimeCompare([]byte(r.AppserviceToken), []byte(accessToken)) == 1 {
+			return &ctx.Config.AccessTokens.Appservices[i]
+		}
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package auth_cache
 
 import (
+	"crypto/subtle"
 	"errors"
 	"fmt"
 	"regexp"
@@ -21,11 +22,13 @@ type cachedToken struct {
 	err    error
 }
 
-func cacheKey(accessToken string, appserviceUserId string) string {
+// cacheKey includes the server name as each homeserver validates its own tokens, and the same
+// token could (in theory) be valid on more than one of them.
+func cacheKey(serverName string, accessToken string, appserviceUserId string) string {
 	if appserviceUserId != "" {
-		return fmt.Sprintf("@@%s@@%s", accessToken, appserviceUserId)
+		return fmt.Sprintf("%s@@%s@@%s", serverName, accessToken, appserviceUserId)
 	}
-	return fmt.Sprintf("@@%s@@__NOOP__", accessToken)
+	return fmt.Sprintf("%s@@%s@@__NOOP__", serverName, accessToken)
 }
 
 func FlushCache() {
@@ -46,8 +49,8 @@ func InvalidateToken(ctx rcontext.RequestContext, accessToken string, appservice
 	}
 
 	rwLock.Lock()
-	tokenCache.Delete(cacheKey(accessToken, appserviceUserId))
-	tokenCache.Delete(cacheKey(accessToken, ""))
+	tokenCache.Delete(cacheKey(ctx.Request.Host, accessToken, appserviceUserId))
+	tokenCache.Delete(cacheKey(ctx.Request.Host, accessToken, ""))
 	rwLock.Unlock()
 	return nil
 }
@@ -87,7 +90,7 @@ func GetUserId(ctx rcontext.RequestContext, accessToken string, appserviceUserId
 	}
 
 	rwLock.Lock()
-	record, ok := tokenCache.Get(cacheKey(accessToken, appserviceUserId))
+	record, ok := tokenCache.Get(cacheKey(ctx.Request.Host, accessToken, appserviceUserId))
 	rwLock.Unlock()
 	if ok {
 		token := record.(cachedToken)
@@ -104,7 +107,7 @@ func GetUserId(ctx rcontext.RequestContext, accessToken string, appserviceUserId
 	}
 
 	for _, r := range ctx.Config.AccessTokens.Appservices {
-		if r.AppserviceToken != accessToken {
+		if subtle.ConstantTimeCompare([]byte(r.AppserviceToken), []byte(accessToken)) != 1 {
 			continue
 		}
 
@@ -139,7 +142,7 @@ func cacheToken(ctx rcontext.RequestContext, accessToken string, appserviceUserI
 	}
 	t := time.Duration(ctx.Config.AccessTokens.MaxCacheTimeSeconds) * time.Second
 	rwLock.Lock()
-	tokenCache.Set(cacheKey(accessToken, appserviceUserId), v, t)
+	tokenCache.Set(cacheKey(ctx.Request.Host, accessToken, appserviceUserId), v, t)
 	rwLock.Unlock()
 }
 
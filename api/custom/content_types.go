@@ -0,0 +1,111 @@
+package custom
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/maintenance_controller"
+	"github.com/turt2live/matrix-media-repo/storage"
+)
+
+type ContentTypeChange struct {
+	MxcUri         string `json:"mxc"`
+	OldContentType string `json:"old_content_type"`
+	NewContentType string `json:"new_content_type"`
+}
+
+type ContentTypeChangesResponse struct {
+	DryRun  bool                 `json:"dry_run"`
+	Changes []*ContentTypeChange `json:"changes"`
+}
+
+type ResniffTaskResponse struct {
+	TaskID int  `json:"task_id"`
+	DryRun bool `json:"dry_run"`
+}
+
+func parseDryRun(r *http.Request) (bool, error) {
+	dryRunStr := r.URL.Query().Get("dry_run")
+	if dryRunStr == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(dryRunStr)
+}
+
+func toChangesResponse(dryRun bool, changes []*maintenance_controller.ContentTypeChange) *ContentTypeChangesResponse {
+	resp := &ContentTypeChangesResponse{DryRun: dryRun, Changes: make([]*ContentTypeChange, 0)}
+	for _, c := range changes {
+		resp.Changes = append(resp.Changes, &ContentTypeChange{
+			MxcUri:         c.Media.MxcUri(),
+			OldContentType: c.OldContentType,
+			NewContentType: c.NewContentType,
+		})
+	}
+	return resp
+}
+
+func ResniffMediaContentType(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	dryRun, err := parseDryRun(r)
+	if err != nil {
+		return api.BadRequest("dry_run flag does not appear to be a boolean")
+	}
+
+	params := mux.Vars(r)
+
+	origin := params["server"]
+	mediaId := params["mediaId"]
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"origin":  origin,
+		"mediaId": mediaId,
+		"dryRun":  dryRun,
+	})
+
+	media, err := storage.GetDatabase().GetMediaStore(rctx).Get(origin, mediaId)
+	if err == sql.ErrNoRows {
+		return api.NotFoundError()
+	}
+	if err != nil {
+		return api.InternalServerError("failed to get media record").WithCause(err, rctx)
+	}
+
+	change, err := maintenance_controller.ResniffContentType(media, !dryRun, rctx)
+	if err != nil {
+		return api.InternalServerError("failed to detect content type").WithCause(err, rctx)
+	}
+
+	changes := make([]*maintenance_controller.ContentTypeChange, 0)
+	if change != nil {
+		changes = append(changes, change)
+	}
+
+	return &api.DoNotCacheResponse{Payload: toChangesResponse(dryRun, changes)}
+}
+
+func ResniffServerContentTypes(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	dryRun, err := parseDryRun(r)
+	if err != nil {
+		return api.BadRequest("dry_run flag does not appear to be a boolean")
+	}
+
+	params := mux.Vars(r)
+
+	serverName := params["serverName"]
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"serverName": serverName,
+		"dryRun":     dryRun,
+	})
+
+	task, err := maintenance_controller.StartServerResniff(serverName, !dryRun, rctx)
+	if err != nil {
+		return api.InternalServerError("failed to start detecting content types").WithCause(err, rctx)
+	}
+
+	return &api.DoNotCacheResponse{Payload: &ResniffTaskResponse{TaskID: task.ID, DryRun: dryRun}}
+}
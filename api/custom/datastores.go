@@ -1,7 +1,6 @@
 package custom
 
 import (
-	"github.com/getsentry/sentry-go"
 	"net/http"
 	"strconv"
 
@@ -24,17 +23,23 @@ type DatastoreMigration struct {
 func GetDatastores(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
 	datastores, err := storage.GetDatabase().GetMediaStore(rctx).GetAllDatastores()
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("Error getting datastores")
+		return api.InternalServerError("Error getting datastores").WithCause(err, rctx)
 	}
 
 	response := make(map[string]interface{})
+	unhealthy := datastore.UnhealthyDatastores()
 
 	for _, ds := range datastores {
+		if datastore.IsInlineDatastoreType(ds.Type) {
+			continue // internal to the thumbnailer
+		}
+
 		dsMap := make(map[string]interface{})
 		dsMap["type"] = ds.Type
 		dsMap["uri"] = ds.Uri
+		if reason, isUnhealthy := unhealthy[ds.DatastoreId]; isUnhealthy {
+			dsMap["unhealthy"] = reason
+		}
 		response[ds.DatastoreId] = dsMap
 	}
 
@@ -78,20 +83,19 @@ func MigrateBetweenDatastores(r *http.Request, rctx rcontext.RequestContext, use
 		rctx.Log.Error(err)
 		return api.BadRequest("Error getting target datastore. Does it exist?")
 	}
+	if datastore.IsInlineDatastoreType(targetDatastore.Type) {
+		return api.BadRequest("The inline datastore cannot be used as a target")
+	}
 
 	rctx.Log.Info("User ", user.UserId, " has started a datastore media transfer")
 	task, err := maintenance_controller.StartStorageMigration(sourceDatastore, targetDatastore, beforeTs, rctx)
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("Unexpected error starting migration")
+		return api.InternalServerError("Unexpected error starting migration").WithCause(err, rctx)
 	}
 
 	estimate, err := maintenance_controller.EstimateDatastoreSizeWithAge(beforeTs, sourceDsId, rctx)
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("Unexpected error getting storage estimate")
+		return api.InternalServerError("Unexpected error getting storage estimate").WithCause(err, rctx)
 	}
 
 	migration := &DatastoreMigration{
@@ -124,9 +128,7 @@ func GetDatastoreStorageEstimate(r *http.Request, rctx rcontext.RequestContext,
 
 	result, err := maintenance_controller.EstimateDatastoreSizeWithAge(beforeTs, datastoreId, rctx)
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("Unexpected error getting storage estimate")
+		return api.InternalServerError("Unexpected error getting storage estimate").WithCause(err, rctx)
 	}
 	return &api.DoNotCacheResponse{Payload: result}
 }
@@ -64,9 +64,7 @@ func ExportUserData(r *http.Request, rctx rcontext.RequestContext, user api.User
 	})
 	task, exportId, err := data_controller.StartUserExport(userId, s3urls, includeData, rctx)
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("fatal error starting export")
+		return api.InternalServerError("fatal error starting export").WithCause(err, rctx)
 	}
 
 	return &api.DoNotCacheResponse{Payload: &ExportStarted{
@@ -117,9 +115,7 @@ func ExportServerData(r *http.Request, rctx rcontext.RequestContext, user api.Us
 	})
 	task, exportId, err := data_controller.StartServerExport(serverName, s3urls, includeData, rctx)
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("fatal error starting export")
+		return api.InternalServerError("fatal error starting export").WithCause(err, rctx)
 	}
 
 	return &api.DoNotCacheResponse{Payload: &ExportStarted{
@@ -144,23 +140,17 @@ func ViewExport(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo
 
 	exportInfo, err := exportDb.GetExportMetadata(exportId)
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("failed to get metadata")
+		return api.InternalServerError("failed to get metadata").WithCause(err, rctx)
 	}
 
 	parts, err := exportDb.GetExportParts(exportId)
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("failed to get export parts")
+		return api.InternalServerError("failed to get export parts").WithCause(err, rctx)
 	}
 
 	template, err := templating.GetTemplate("view_export")
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("failed to get template")
+		return api.InternalServerError("failed to get template").WithCause(err, rctx)
 	}
 
 	model := &templating.ViewExportModel{
@@ -181,9 +171,7 @@ func ViewExport(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo
 	html := bytes.Buffer{}
 	err = template.Execute(&html, model)
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("failed to render template")
+		return api.InternalServerError("failed to render template").WithCause(err, rctx)
 	}
 
 	return &api.HtmlResponse{HTML: string(html.Bytes())}
@@ -205,16 +193,12 @@ func GetExportMetadata(r *http.Request, rctx rcontext.RequestContext, user api.U
 
 	exportInfo, err := exportDb.GetExportMetadata(exportId)
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("failed to get metadata")
+		return api.InternalServerError("failed to get metadata").WithCause(err, rctx)
 	}
 
 	parts, err := exportDb.GetExportParts(exportId)
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("failed to get export parts")
+		return api.InternalServerError("failed to get export parts").WithCause(err, rctx)
 	}
 
 	metadata := &ExportMetadata{
@@ -254,16 +238,12 @@ func DownloadExportPart(r *http.Request, rctx rcontext.RequestContext, user api.
 	db := storage.GetDatabase().GetExportStore(rctx)
 	part, err := db.GetExportPart(exportId, int(partId))
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("failed to get part")
+		return api.InternalServerError("failed to get part").WithCause(err, rctx)
 	}
 
 	s, err := datastore.DownloadStream(rctx, part.DatastoreID, part.Location)
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("failed to start download")
+		return api.InternalServerError("failed to start download").WithCause(err, rctx)
 	}
 
 	return &r0.DownloadMediaResponse{
@@ -293,18 +273,14 @@ func DeleteExport(r *http.Request, rctx rcontext.RequestContext, user api.UserIn
 	rctx.Log.Info("Getting information on which parts to delete")
 	parts, err := db.GetExportParts(exportId)
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("failed to delete export")
+		return api.InternalServerError("failed to delete export").WithCause(err, rctx)
 	}
 
 	for _, part := range parts {
 		rctx.Log.Info("Locating datastore: " + part.DatastoreID)
 		ds, err := datastore.LocateDatastore(rctx, part.DatastoreID)
 		if err != nil {
-			rctx.Log.Error(err)
-			sentry.CaptureException(err)
-			return api.InternalServerError("failed to delete export")
+			return api.InternalServerError("failed to delete export").WithCause(err, rctx)
 		}
 
 		rctx.Log.Info("Deleting object: " + part.Location)
@@ -318,9 +294,7 @@ func DeleteExport(r *http.Request, rctx rcontext.RequestContext, user api.UserIn
 	rctx.Log.Info("Purging export from database")
 	err = db.DeleteExportAndParts(exportId)
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("failed to delete export")
+		return api.InternalServerError("failed to delete export").WithCause(err, rctx)
 	}
 
 	return api.EmptyResponse{}
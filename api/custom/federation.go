@@ -2,9 +2,9 @@ package custom
 
 import (
 	"encoding/json"
-	"github.com/getsentry/sentry-go"
 	"io/ioutil"
 	"net/http"
+	"sort"
 
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
@@ -24,37 +24,43 @@ func GetFederationInfo(r *http.Request, rctx rcontext.RequestContext, user api.U
 
 	url, hostname, err := matrix.GetServerApiUrl(serverName)
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError(err.Error())
+		return api.InternalServerError(err.Error()).WithCause(err, rctx)
 	}
 
 	versionUrl := url + "/_matrix/federation/v1/version"
 	versionResponse, err := matrix.FederatedGet(versionUrl, hostname, rctx)
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError(err.Error())
+		return api.InternalServerError(err.Error()).WithCause(err, rctx)
 	}
 
 	c, err := ioutil.ReadAll(versionResponse.Body)
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError(err.Error())
+		return api.InternalServerError(err.Error()).WithCause(err, rctx)
 	}
 
 	out := make(map[string]interface{})
 	err = json.Unmarshal(c, &out)
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError(err.Error())
+		return api.InternalServerError(err.Error()).WithCause(err, rctx)
 	}
 
 	resp := make(map[string]interface{})
 	resp["base_url"] = url
 	resp["hostname"] = hostname
 	resp["versions_response"] = out
+
+	keys, err := matrix.GetServerSigningKeys(serverName, rctx)
+	if err != nil {
+		rctx.Log.Warn("Failed to get signing keys: ", err)
+		resp["signing_keys_error"] = err.Error()
+	} else {
+		keyIds := make([]string, 0, len(keys.VerifyKeys))
+		for keyId := range keys.VerifyKeys {
+			keyIds = append(keyIds, keyId)
+		}
+		sort.Strings(keyIds)
+		resp["signing_key_ids"] = keyIds
+		resp["signing_keys_valid_until_ts"] = keys.ValidUntilTs
+	}
 	return &api.DoNotCacheResponse{Payload: resp}
 }
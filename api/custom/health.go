@@ -2,9 +2,11 @@ package custom
 
 import (
 	"net/http"
+	"sort"
 
 	"github.com/turt2live/matrix-media-repo/api"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
 )
 
 type HealthzResponse struct {
@@ -12,6 +14,7 @@ type HealthzResponse struct {
 	Status string `json:"status"`
 }
 
+// GetHealthz is a liveness check: it succeeds for as long as the media repo can serve requests at all.
 func GetHealthz(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
 	return &api.DoNotCacheResponse{
 		Payload: &HealthzResponse{
@@ -20,3 +23,26 @@ func GetHealthz(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo
 		},
 	}
 }
+
+// GetReadyz is a readiness check: it fails while any datastore is failing its health checks. The
+// response doesn't say which datastores are unreachable as it is served to anyone. Administrators can
+// find them in the logs and the datastore list of the admin API.
+func GetReadyz(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	unhealthy := datastore.UnhealthyDatastores()
+	if len(unhealthy) > 0 {
+		ids := make([]string, 0)
+		for id := range unhealthy {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		rctx.Log.Warn("Reporting not ready because of unreachable datastores: ", ids)
+		return api.ServiceUnavailable("Some datastores are unreachable")
+	}
+
+	return &api.DoNotCacheResponse{
+		Payload: &HealthzResponse{
+			OK:     true,
+			Status: "Ready",
+		},
+	}
+}
@@ -1,7 +1,6 @@
 package custom
 
 import (
-	"github.com/getsentry/sentry-go"
 	"net/http"
 
 	"github.com/gorilla/mux"
@@ -24,9 +23,7 @@ func StartImport(r *http.Request, rctx rcontext.RequestContext, user api.UserInf
 	defer cleanup.DumpAndCloseStream(r.Body)
 	task, importId, err := data_controller.StartImport(r.Body, rctx)
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("fatal error starting import")
+		return api.InternalServerError("fatal error starting import").WithCause(err, rctx)
 	}
 
 	return &api.DoNotCacheResponse{Payload: &ImportStarted{
@@ -47,9 +44,7 @@ func AppendToImport(r *http.Request, rctx rcontext.RequestContext, user api.User
 	defer cleanup.DumpAndCloseStream(r.Body)
 	_, err := data_controller.AppendToImport(importId, r.Body, false)
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("fatal error appending to import")
+		return api.InternalServerError("fatal error appending to import").WithCause(err, rctx)
 	}
 
 	return &api.DoNotCacheResponse{Payload: &api.EmptyResponse{}}
@@ -66,9 +61,7 @@ func StopImport(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo
 
 	err := data_controller.StopImport(importId)
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("fatal error stopping import")
+		return api.InternalServerError("fatal error stopping import").WithCause(err, rctx)
 	}
 
 	return &api.DoNotCacheResponse{Payload: &api.EmptyResponse{}}
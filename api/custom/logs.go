@@ -0,0 +1,20 @@
+package custom
+
+import (
+	"net/http"
+
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common/logging"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+)
+
+func GetRecentLogs(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	limit, errRes := getPageLimit(r, 100)
+	if errRes != nil {
+		return errRes
+	}
+
+	return &api.DoNotCacheResponse{Payload: map[string]interface{}{
+		"entries": logging.RecentEntries(limit),
+	}}
+}
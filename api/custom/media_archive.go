@@ -0,0 +1,138 @@
+package custom
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/api/r0"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/download_controller"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+const maxArchiveFiles = 1000
+const maxArchiveBytes = 5368709120 // 5gb
+
+func DownloadMediaArchive(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	serverName := params["serverName"]
+	mxcs := r.URL.Query()["mxc"]
+	userId := r.URL.Query().Get("user_id")
+
+	includeQuarantined := false
+	includeQuarantinedStr := r.URL.Query().Get("include_quarantined")
+	if includeQuarantinedStr != "" {
+		parsed, err := strconv.ParseBool(includeQuarantinedStr)
+		if err != nil {
+			return api.BadRequest("Error parsing include_quarantined: " + err.Error())
+		}
+		includeQuarantined = parsed
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"serverName":         serverName,
+		"userId":             userId,
+		"includeQuarantined": includeQuarantined,
+	})
+
+	db := storage.GetDatabase().GetMediaStore(rctx)
+
+	var records []*types.Media
+	var err error
+	if len(mxcs) > 0 {
+		mediaIds := make([]string, 0)
+		for _, mxc := range mxcs {
+			o, i, err := util.SplitMxc(mxc)
+			if err != nil {
+				return api.BadRequest("Error parsing MXC " + mxc)
+			}
+			if o != serverName {
+				return api.BadRequest("MXC URIs must match the requested server")
+			}
+			mediaIds = append(mediaIds, i)
+		}
+		records, err = db.GetAllMediaInIds(serverName, mediaIds)
+	} else if userId != "" {
+		// A user's media is downloaded a page at a time. One extra record is requested to find out if
+		// there's another page.
+		records, err = db.GetMediaForServerUserPage(serverName, userId, r.URL.Query().Get("from"), maxArchiveFiles+1)
+	} else {
+		return api.BadRequest("Either mxc or user_id must be provided")
+	}
+	if err != nil {
+		return api.InternalServerError("Failed to get media records").WithCause(err, rctx)
+	}
+
+	included := make([]*types.Media, 0)
+	totalBytes := int64(0)
+	nextBatch := ""
+	quarantinedHashes := make(map[string]bool)
+	for i, media := range records {
+		if userId != "" && len(included) > 0 && (len(included) == maxArchiveFiles || totalBytes+media.SizeBytes > maxArchiveBytes) {
+			nextBatch = records[i-1].MediaId
+			break
+		}
+
+		if !includeQuarantined {
+			// The file may be quarantined through another record, or have its hash blocked
+			quarantined, checked := quarantinedHashes[media.Sha256Hash]
+			if !checked {
+				quarantined, err = isHashQuarantined(media.Sha256Hash, rctx)
+				if err != nil {
+					return api.InternalServerError("Failed to check if media is quarantined").WithCause(err, rctx)
+				}
+				quarantinedHashes[media.Sha256Hash] = quarantined
+			}
+			if media.Quarantined || quarantined {
+				rctx.Log.Info("Skipping quarantined media ", media.MxcUri())
+				continue
+			}
+		}
+
+		included = append(included, media)
+		totalBytes += media.SizeBytes
+	}
+	if userId != "" && nextBatch == "" && len(records) > maxArchiveFiles {
+		nextBatch = records[len(records)-1].MediaId
+	}
+
+	if len(included) == 0 {
+		return api.NotFoundError()
+	}
+	if len(included) > maxArchiveFiles {
+		return api.BadRequest(fmt.Sprintf("Too many files: at most %d can be downloaded at once", maxArchiveFiles))
+	}
+	if totalBytes > maxArchiveBytes {
+		return api.BadRequest(fmt.Sprintf("Too much media: at most %d bytes can be downloaded at once", maxArchiveBytes))
+	}
+
+	headers := make(map[string]string)
+	if nextBatch != "" {
+		headers[NextBatchHeader] = nextBatch
+	}
+
+	rctx.Log.Infof("Streaming archive of %d files (%d bytes)", len(included), totalBytes)
+	return &r0.DownloadMediaResponse{
+		ContentType:       "application/zip",
+		Filename:          serverName + ".zip",
+		Data:              download_controller.StreamZipArchive(included, rctx),
+		TargetDisposition: "attachment",
+		Headers:           headers,
+	}
+}
+
+func isHashQuarantined(sha256Hash string, rctx rcontext.RequestContext) (bool, error) {
+	db := storage.GetDatabase().GetMediaStore(rctx)
+	quarantined, err := db.IsQuarantined(sha256Hash)
+	if err != nil || quarantined {
+		return quarantined, err
+	}
+	return db.IsHashBlocked(sha256Hash)
+}
@@ -2,7 +2,6 @@ package custom
 
 import (
 	"encoding/json"
-	"github.com/getsentry/sentry-go"
 	"io/ioutil"
 	"net/http"
 
@@ -10,6 +9,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/turt2live/matrix-media-repo/api"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/download_controller"
 	"github.com/turt2live/matrix-media-repo/matrix"
 	"github.com/turt2live/matrix-media-repo/storage"
 	"github.com/turt2live/matrix-media-repo/types"
@@ -18,7 +18,12 @@ import (
 )
 
 type Attributes struct {
-	Purpose string `json:"purpose"`
+	Purpose         string `json:"purpose"`
+	CacheMaxAge     *int   `json:"cache_max_age,omitempty"`
+	Thumbnailable   *bool  `json:"thumbnailable,omitempty"`
+	MaxDownloads    *int   `json:"max_downloads,omitempty"`
+	DownloadCount   *int   `json:"download_count,omitempty"`
+	ForceAttachment *bool  `json:"force_attachment,omitempty"`
 }
 
 func canChangeAttributes(rctx rcontext.RequestContext, r *http.Request, origin string, user api.UserInfo) bool {
@@ -53,14 +58,23 @@ func GetAttributes(r *http.Request, rctx rcontext.RequestContext, user api.UserI
 
 	attrs, err := db.GetAttributes(origin, mediaId)
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("failed to get attributes")
+		return api.InternalServerError("failed to get attributes").WithCause(err, rctx)
 	}
 
-	return &api.DoNotCacheResponse{Payload: &Attributes{
-		Purpose: attrs.Purpose,
-	}}
+	resp := &Attributes{
+		Purpose:         attrs.Purpose,
+		Thumbnailable:   &attrs.Thumbnailable,
+		ForceAttachment: &attrs.ForceAttachment,
+	}
+	if attrs.CacheMaxAge != types.NoCacheMaxAge {
+		resp.CacheMaxAge = &attrs.CacheMaxAge
+	}
+	if attrs.MaxDownloads > 0 {
+		resp.MaxDownloads = &attrs.MaxDownloads
+		resp.DownloadCount = &attrs.DownloadCount
+	}
+
+	return &api.DoNotCacheResponse{Payload: resp}
 }
 
 func SetAttributes(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
@@ -81,37 +95,56 @@ func SetAttributes(r *http.Request, rctx rcontext.RequestContext, user api.UserI
 	defer cleanup.DumpAndCloseStream(r.Body)
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("failed to read attributes")
+		return api.InternalServerError("failed to read attributes").WithCause(err, rctx)
 	}
 
 	newAttrs := &Attributes{}
 	err = json.Unmarshal(b, &newAttrs)
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("failed to parse attributes")
+		return api.InternalServerError("failed to parse attributes").WithCause(err, rctx)
 	}
 
 	db := storage.GetDatabase().GetMediaAttributesStore(rctx)
 
 	attrs, err := db.GetAttributesDefaulted(origin, mediaId)
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("failed to get attributes")
+		return api.InternalServerError("failed to get attributes").WithCause(err, rctx)
 	}
 
+	// Downloads shouldn't keep using the old attributes, even if only some of them get updated
+	defer download_controller.ClearMediaAttributesCache(origin, mediaId)
+
 	if attrs.Purpose != newAttrs.Purpose {
 		if !util.ArrayContains(types.AllPurposes, newAttrs.Purpose) {
 			return api.BadRequest("unknown purpose")
 		}
 		err = db.UpsertPurpose(origin, mediaId, newAttrs.Purpose)
 		if err != nil {
-			rctx.Log.Error(err)
-			sentry.CaptureException(err)
-			return api.InternalServerError("failed to update attributes: purpose")
+			return api.InternalServerError("failed to update attributes: purpose").WithCause(err, rctx)
+		}
+	}
+
+	if newAttrs.CacheMaxAge != nil && attrs.CacheMaxAge != *newAttrs.CacheMaxAge {
+		if *newAttrs.CacheMaxAge < types.NoCacheMaxAge {
+			return api.BadRequest("invalid cache max age")
+		}
+		err = db.UpsertCacheMaxAge(origin, mediaId, *newAttrs.CacheMaxAge)
+		if err != nil {
+			return api.InternalServerError("failed to update attributes: cache_max_age").WithCause(err, rctx)
+		}
+	}
+
+	if newAttrs.Thumbnailable != nil && attrs.Thumbnailable != *newAttrs.Thumbnailable {
+		err = db.UpsertThumbnailable(origin, mediaId, *newAttrs.Thumbnailable)
+		if err != nil {
+			return api.InternalServerError("failed to update attributes: thumbnailable").WithCause(err, rctx)
+		}
+	}
+
+	if newAttrs.ForceAttachment != nil && attrs.ForceAttachment != *newAttrs.ForceAttachment {
+		err = db.UpsertForceAttachment(origin, mediaId, *newAttrs.ForceAttachment)
+		if err != nil {
+			return api.InternalServerError("failed to update attributes: force_attachment").WithCause(err, rctx)
 		}
 	}
 
@@ -0,0 +1,58 @@
+package custom
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common/config"
+)
+
+// Admin list endpoints are paginated the same way: the `limit` query parameter sets the page size,
+// and when there's another page the NextBatchHeader response header holds a token to pass as the
+// `from` query parameter. A header is used because most of these endpoints reply with a bare list
+// or map. The token is opaque to callers.
+const NextBatchHeader = "X-Next-Batch"
+
+// getPageLimit parses the `limit` query parameter of an admin list endpoint, clamping it to the
+// configured maximum page size.
+func getPageLimit(r *http.Request, defaultLimit int) (int, *api.ErrorResponse) {
+	limit := defaultLimit
+	limitStr := r.URL.Query().Get("limit")
+	if limitStr != "" {
+		parsed, err := strconv.Atoi(limitStr)
+		if err != nil || parsed <= 0 {
+			return 0, api.BadRequest("limit must be a positive integer")
+		}
+		limit = parsed
+	}
+
+	maxPageSize := config.Get().AdminApi.MaxPageSize
+	if maxPageSize > 0 && (limit > maxPageSize || limit <= 0) {
+		limit = maxPageSize
+	}
+	return limit, nil
+}
+
+// getPageOffset parses the `from` query parameter of an admin list endpoint which pages by offset.
+func getPageOffset(r *http.Request) (int, *api.ErrorResponse) {
+	fromStr := r.URL.Query().Get("from")
+	if fromStr == "" {
+		return 0, nil
+	}
+	offset, err := strconv.Atoi(fromStr)
+	if err != nil || offset < 0 {
+		return 0, api.BadRequest("from must be a token returned by a previous request")
+	}
+	return offset, nil
+}
+
+// pagedResponse creates the response for a page of an admin list endpoint, with the token for the
+// next page if there is one.
+func pagedResponse(payload interface{}, nextBatch string) *api.DoNotCacheResponse {
+	res := &api.DoNotCacheResponse{Payload: payload}
+	if nextBatch != "" {
+		res.Headers = map[string]string{NextBatchHeader: nextBatch}
+	}
+	return res
+}
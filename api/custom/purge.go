@@ -10,6 +10,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/turt2live/matrix-media-repo/api"
 	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/controllers/maintenance_controller"
 	"github.com/turt2live/matrix-media-repo/matrix"
@@ -39,9 +40,7 @@ func PurgeRemoteMedia(r *http.Request, rctx rcontext.RequestContext, user api.Us
 	// We don't bother clearing the cache because it's still probably useful there
 	removed, err := maintenance_controller.PurgeRemoteMediaBefore(beforeTs, rctx)
 	if err != nil {
-		rctx.Log.Error("Error purging remote media: " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("Error purging remote media")
+		return api.InternalServerError("Error purging remote media").WithCause(err, rctx)
 	}
 
 	return &api.DoNotCacheResponse{Payload: &MediaPurgedResponse{NumRemoved: removed}}
@@ -56,9 +55,20 @@ func PurgeIndividualRecord(r *http.Request, rctx rcontext.RequestContext, user a
 	server := params["server"]
 	mediaId := params["mediaId"]
 
+	hard := false
+	hardStr := r.URL.Query().Get("hard")
+	if hardStr != "" {
+		parsed, err := strconv.ParseBool(hardStr)
+		if err != nil {
+			return api.BadRequest("Error parsing hard: " + err.Error())
+		}
+		hard = parsed
+	}
+
 	rctx = rctx.LogWithFields(logrus.Fields{
 		"server":  server,
 		"mediaId": mediaId,
+		"hard":    hard,
 	})
 
 	// If the user is NOT a global admin, ensure they are speaking to the right server
@@ -74,9 +84,7 @@ func PurgeIndividualRecord(r *http.Request, rctx rcontext.RequestContext, user a
 				return api.NotFoundError()
 			}
 			if err != nil {
-				rctx.Log.Error("Error checking ownership of media: " + err.Error())
-				sentry.CaptureException(err)
-				return api.InternalServerError("error checking media ownership")
+				return api.InternalServerError("error checking media ownership").WithCause(err, rctx)
 			}
 			if m.UserId != user.UserId {
 				return api.AuthFailed()
@@ -84,19 +92,61 @@ func PurgeIndividualRecord(r *http.Request, rctx rcontext.RequestContext, user a
 		}
 	}
 
+	softDeletion := config.Get().SoftDeletion
+	if softDeletion.Enabled && !hard {
+		err := maintenance_controller.SoftDeleteMedia(server, mediaId, user.UserId, rctx)
+		if err == sql.ErrNoRows || err == common.ErrMediaNotFound {
+			return api.NotFoundError()
+		}
+		if err != nil {
+			return api.InternalServerError("error deleting media").WithCause(err, rctx)
+		}
+
+		restorableUntil := util.NowMillis() + (int64(softDeletion.GracePeriodHours) * 3600000)
+		return &api.DoNotCacheResponse{Payload: map[string]interface{}{"purged": true, "soft_deleted": true, "restorable_until_ts": restorableUntil}}
+	}
+
 	err := maintenance_controller.PurgeMedia(server, mediaId, rctx)
 	if err == sql.ErrNoRows || err == common.ErrMediaNotFound {
 		return api.NotFoundError()
 	}
 	if err != nil {
-		rctx.Log.Error("Error purging media: " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("error purging media")
+		return api.InternalServerError("error purging media").WithCause(err, rctx)
 	}
 
 	return &api.DoNotCacheResponse{Payload: map[string]interface{}{"purged": true}}
 }
 
+func RestoreDeletedMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	isGlobalAdmin, isLocalAdmin := getPurgeRequestInfo(r, rctx, user)
+
+	params := mux.Vars(r)
+
+	server := params["server"]
+	mediaId := params["mediaId"]
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"server":  server,
+		"mediaId": mediaId,
+	})
+
+	// Homeserver admins can only restore media on their own server
+	if !isGlobalAdmin && (!isLocalAdmin || server != r.Host) {
+		return api.AuthFailed()
+	}
+
+	err := maintenance_controller.RestoreMedia(server, mediaId, rctx)
+	if err == common.ErrMediaNotFound {
+		return api.NotFoundError()
+	}
+	if err != nil {
+		return api.InternalServerError("error restoring media").WithCause(err, rctx)
+	}
+	rctx.Log.Info("Deleted media has been restored")
+
+	return &api.DoNotCacheResponse{Payload: map[string]interface{}{"restored": true}}
+}
+
 func PurgeQuarantined(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
 	isGlobalAdmin, isLocalAdmin := getPurgeRequestInfo(r, rctx, user)
 	localServerName := r.Host
@@ -113,9 +163,7 @@ func PurgeQuarantined(r *http.Request, rctx rcontext.RequestContext, user api.Us
 	}
 
 	if err != nil {
-		rctx.Log.Error("Error purging media: " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("error purging media")
+		return api.InternalServerError("error purging media").WithCause(err, rctx)
 	}
 
 	mxcs := make([]string, 0)
@@ -154,9 +202,7 @@ func PurgeOldMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserI
 	affected, err := maintenance_controller.PurgeOldMedia(beforeTs, includeLocal, rctx)
 
 	if err != nil {
-		rctx.Log.Error("Error purging media: " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("error purging media")
+		return api.InternalServerError("error purging media").WithCause(err, rctx)
 	}
 
 	mxcs := make([]string, 0)
@@ -194,9 +240,7 @@ func PurgeUserMedia(r *http.Request, rctx rcontext.RequestContext, user api.User
 
 	_, userDomain, err := util.SplitUserId(userId)
 	if err != nil {
-		rctx.Log.Error("Error parsing user ID (" + userId + "): " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("error parsing user ID")
+		return api.InternalServerError("error parsing user ID").WithCause(err, rctx)
 	}
 
 	if !isGlobalAdmin && userDomain != r.Host {
@@ -206,9 +250,7 @@ func PurgeUserMedia(r *http.Request, rctx rcontext.RequestContext, user api.User
 	affected, err := maintenance_controller.PurgeUserMedia(userId, beforeTs, rctx)
 
 	if err != nil {
-		rctx.Log.Error("Error purging media: " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("error purging media")
+		return api.InternalServerError("error purging media").WithCause(err, rctx)
 	}
 
 	mxcs := make([]string, 0)
@@ -246,9 +288,7 @@ func PurgeRoomMedia(r *http.Request, rctx rcontext.RequestContext, user api.User
 
 	allMedia, err := matrix.ListMedia(rctx, r.Host, user.AccessToken, roomId, r.RemoteAddr)
 	if err != nil {
-		rctx.Log.Error("Error while listing media in the room: " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("error retrieving media in room")
+		return api.InternalServerError("error retrieving media in room").WithCause(err, rctx)
 	}
 
 	mxcs := make([]string, 0)
@@ -286,9 +326,7 @@ func PurgeRoomMedia(r *http.Request, rctx rcontext.RequestContext, user api.User
 	affected, err := maintenance_controller.PurgeRoomMedia(mxcs, beforeTs, rctx)
 
 	if err != nil {
-		rctx.Log.Error("Error purging media: " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("error purging media")
+		return api.InternalServerError("error purging media").WithCause(err, rctx)
 	}
 
 	mxcs = make([]string, 0)
@@ -331,9 +369,7 @@ func PurgeDomainMedia(r *http.Request, rctx rcontext.RequestContext, user api.Us
 	affected, err := maintenance_controller.PurgeDomainMedia(serverName, beforeTs, rctx)
 
 	if err != nil {
-		rctx.Log.Error("Error purging media: " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("error purging media")
+		return api.InternalServerError("error purging media").WithCause(err, rctx)
 	}
 
 	mxcs := make([]string, 0)
@@ -344,6 +380,52 @@ func PurgeDomainMedia(r *http.Request, rctx rcontext.RequestContext, user api.Us
 	return &api.DoNotCacheResponse{Payload: map[string]interface{}{"purged": true, "affected": mxcs}}
 }
 
+func PurgeExpiredServerMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	var err error
+	dryRun := false
+	dryRunStr := r.URL.Query().Get("dry_run")
+	if dryRunStr != "" {
+		dryRun, err = strconv.ParseBool(dryRunStr)
+		if err != nil {
+			return api.BadRequest("Error parsing dry_run: " + err.Error())
+		}
+	}
+
+	params := mux.Vars(r)
+
+	serverName := params["serverName"]
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"serverName": serverName,
+		"dryRun":     dryRun,
+	})
+
+	affected, bytesFreed, err := maintenance_controller.PurgeExpiredServerMedia(serverName, dryRun, rctx)
+	if err != nil {
+		if err == common.ErrRetentionNotEnabled {
+			return api.BadRequest("Purging all media is not enabled for this server")
+		}
+		if len(affected) == 0 {
+			return api.InternalServerError("error purging media").WithCause(err, rctx)
+		}
+	}
+
+	mxcs := make([]string, 0)
+	for _, a := range affected {
+		mxcs = append(mxcs, a.MxcUri())
+	}
+
+	payload := map[string]interface{}{"purged": !dryRun, "dry_run": dryRun, "affected": mxcs, "bytes_freed": bytesFreed}
+	if err != nil {
+		// Some media was purged before the failure: report it, along with the error
+		rctx.Log.Error("Error purging media: ", err)
+		sentry.CaptureException(err)
+		payload["errcode"] = common.ErrCodeUnknown
+		payload["error"] = "error purging media"
+	}
+	return &api.DoNotCacheResponse{Payload: payload}
+}
+
 func getPurgeRequestInfo(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) (bool, bool) {
 	isGlobalAdmin := util.IsGlobalAdmin(user.UserId) || user.IsShared
 	isLocalAdmin, err := matrix.IsUserAdmin(rctx, r.Host, user.AccessToken, r.RemoteAddr)
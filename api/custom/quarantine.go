@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"github.com/getsentry/sentry-go"
 	"net/http"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
@@ -40,9 +41,7 @@ func QuarantineRoomMedia(r *http.Request, rctx rcontext.RequestContext, user api
 
 	allMedia, err := matrix.ListMedia(rctx, r.Host, user.AccessToken, roomId, r.RemoteAddr)
 	if err != nil {
-		rctx.Log.Error("Error while listing media in the room: " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("error retrieving media in room")
+		return api.InternalServerError("error retrieving media in room").WithCause(err, rctx)
 	}
 
 	var mxcs []string
@@ -53,9 +52,7 @@ func QuarantineRoomMedia(r *http.Request, rctx rcontext.RequestContext, user api
 	for _, mxc := range mxcs {
 		server, mediaId, err := util.SplitMxc(mxc)
 		if err != nil {
-			rctx.Log.Error("Error parsing MXC URI (" + mxc + "): " + err.Error())
-			sentry.CaptureException(err)
-			return api.InternalServerError("error parsing mxc uri")
+			return api.InternalServerError("error parsing mxc uri").WithCause(err, rctx)
 		}
 
 		if !allowOtherHosts && r.Host != server {
@@ -91,9 +88,7 @@ func QuarantineUserMedia(r *http.Request, rctx rcontext.RequestContext, user api
 
 	_, userDomain, err := util.SplitUserId(userId)
 	if err != nil {
-		rctx.Log.Error("Error parsing user ID (" + userId + "): " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("error parsing user ID")
+		return api.InternalServerError("error parsing user ID").WithCause(err, rctx)
 	}
 
 	if !allowOtherHosts && userDomain != r.Host {
@@ -103,9 +98,7 @@ func QuarantineUserMedia(r *http.Request, rctx rcontext.RequestContext, user api
 	db := storage.GetDatabase().GetMediaStore(rctx)
 	userMedia, err := db.GetMediaByUser(userId)
 	if err != nil {
-		rctx.Log.Error("Error while listing media for the user: " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("error retrieving media for user")
+		return api.InternalServerError("error retrieving media for user").WithCause(err, rctx)
 	}
 
 	total := 0
@@ -143,9 +136,7 @@ func QuarantineDomainMedia(r *http.Request, rctx rcontext.RequestContext, user a
 	db := storage.GetDatabase().GetMediaStore(rctx)
 	userMedia, err := db.GetAllMediaForServer(serverName)
 	if err != nil {
-		rctx.Log.Error("Error while listing media for the server: " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("error retrieving media for server")
+		return api.InternalServerError("error retrieving media for server").WithCause(err, rctx)
 	}
 
 	total := 0
@@ -186,6 +177,55 @@ func QuarantineMedia(r *http.Request, rctx rcontext.RequestContext, user api.Use
 	return &api.DoNotCacheResponse{Payload: resp}
 }
 
+func QuarantineHash(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	canQuarantine, allowOtherHosts, isLocalAdmin := getQuarantineRequestInfo(r, rctx, user)
+	if !canQuarantine {
+		return api.AuthFailed()
+	}
+
+	params := mux.Vars(r)
+
+	sha256hash := strings.ToLower(params["hash"])
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"hash":       sha256hash,
+		"localAdmin": isLocalAdmin,
+	})
+
+	// The blocklist applies to every host, so only global admins may use it
+	if !allowOtherHosts {
+		return api.AuthFailed()
+	}
+
+	db := storage.GetDatabase().GetMediaStore(rctx)
+	err := db.BlockHash(sha256hash)
+	if err != nil {
+		return api.InternalServerError("error quarantining hash").WithCause(err, rctx)
+	}
+	rctx.Log.Warn("Hash has been blocked from future uploads")
+
+	hashMedia, err := db.GetByHash(sha256hash)
+	if err != nil {
+		return api.InternalServerError("error retrieving media for hash").WithCause(err, rctx)
+	}
+
+	// We reset the entire cache to avoid any lingering links floating around, such as thumbnails or other media.
+	internal_cache.Get().Reset()
+
+	total := 0
+	for _, media := range hashMedia {
+		err = db.SetQuarantined(media.Origin, media.MediaId, true)
+		if err != nil {
+			return api.InternalServerError("error quarantining media").WithCause(err, rctx)
+		}
+
+		total++
+		rctx.Log.Warn("Media has been quarantined: " + media.Origin + "/" + media.MediaId)
+	}
+
+	return &api.DoNotCacheResponse{Payload: &MediaQuarantinedResponse{NumQuarantined: total}}
+}
+
 func doQuarantine(ctx rcontext.RequestContext, origin string, mediaId string, allowOtherHosts bool) (interface{}, bool) {
 	db := storage.GetDatabase().GetMediaStore(ctx)
 	media, err := db.Get(origin, mediaId)
@@ -195,9 +235,7 @@ func doQuarantine(ctx rcontext.RequestContext, origin string, mediaId string, al
 			return &MediaQuarantinedResponse{0}, true
 		}
 
-		ctx.Log.Error("Error fetching media: " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("error quarantining media"), false
+		return api.InternalServerError("error quarantining media").WithCause(err, ctx), false
 	}
 
 	return doQuarantineOn(media, allowOtherHosts, ctx)
@@ -208,9 +246,7 @@ func doQuarantineOn(media *types.Media, allowOtherHosts bool, ctx rcontext.Reque
 	attrDb := storage.GetDatabase().GetMediaAttributesStore(ctx)
 	attr, err := attrDb.GetAttributesDefaulted(media.Origin, media.MediaId)
 	if err != nil {
-		ctx.Log.Error("Error while getting attributes for media: " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("Error quarantining media"), false
+		return api.InternalServerError("Error quarantining media").WithCause(err, ctx), false
 	}
 	if attr.Purpose == types.PurposePinned {
 		ctx.Log.Warn("Refusing to quarantine media due to it being pinned")
@@ -223,9 +259,7 @@ func doQuarantineOn(media *types.Media, allowOtherHosts bool, ctx rcontext.Reque
 
 	num, err := setMediaQuarantined(media, true, allowOtherHosts, ctx)
 	if err != nil {
-		ctx.Log.Error("Error quarantining media: " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("Error quarantining media"), false
+		return api.InternalServerError("Error quarantining media").WithCause(err, ctx), false
 	}
 
 	return &MediaQuarantinedResponse{NumQuarantined: num}, true
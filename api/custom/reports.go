@@ -0,0 +1,186 @@
+package custom
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/download_controller"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+const maxReportReasonLength = 1000
+
+// The largest report body which is read, leaving plenty of room for JSON escaping of the reason
+const maxReportBodyBytes = 16 * 1024
+
+type MediaReportRequest struct {
+	Reason string `json:"reason"`
+}
+
+type MediaReportEntry struct {
+	MxcUri   string `json:"mxc_uri"`
+	Reporter string `json:"reporter"`
+	Reason   string `json:"reason"`
+	ReportTs int64  `json:"report_ts"`
+}
+
+func ReportMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	server := params["server"]
+	mediaId := params["mediaId"]
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"server":   server,
+		"mediaId":  mediaId,
+		"reporter": user.UserId,
+	})
+
+	defer cleanup.DumpAndCloseStream(r.Body)
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, maxReportBodyBytes+1))
+	if err != nil {
+		return api.InternalServerError("failed to read report").WithCause(err, rctx)
+	}
+	if len(b) > maxReportBodyBytes {
+		return api.BadRequest("report is too large")
+	}
+
+	report := &MediaReportRequest{}
+	if len(b) > 0 {
+		err = json.Unmarshal(b, &report)
+		if err != nil {
+			return api.BadRequest("failed to parse report")
+		}
+	}
+	if len(report.Reason) > maxReportReasonLength {
+		return api.BadRequest("reason is too long")
+	}
+
+	media, err := storage.GetDatabase().GetMediaStore(rctx).Get(server, mediaId)
+	if err == sql.ErrNoRows {
+		return api.NotFoundError()
+	}
+	if err != nil {
+		return api.InternalServerError("failed to get media record").WithCause(err, rctx)
+	}
+
+	db := storage.GetDatabase().GetMetadataStore(rctx)
+
+	if rctx.Config.Quarantine.MaxReportsPerHour > 0 {
+		recent, err := db.GetReportCountForReporter(user.UserId, util.NowMillis()-3600000)
+		if err != nil {
+			return api.InternalServerError("failed to check recent reports").WithCause(err, rctx)
+		}
+		if recent >= rctx.Config.Quarantine.MaxReportsPerHour {
+			rctx.Log.Warn("User has made too many reports recently")
+			return api.RateLimitReached()
+		}
+	}
+
+	err = db.InsertMediaReport(&types.MediaReport{
+		Origin:   media.Origin,
+		MediaId:  media.MediaId,
+		Reporter: user.UserId,
+		Reason:   report.Reason,
+		ReportTs: util.NowMillis(),
+	})
+	if err != nil {
+		return api.InternalServerError("failed to record report").WithCause(err, rctx)
+	}
+	rctx.Log.Info("Media has been reported")
+
+	if rctx.Config.Quarantine.ReportThreshold > 0 && !media.Quarantined {
+		reporters, err := db.GetMediaReporterCount(media.Origin, media.MediaId)
+		if err != nil {
+			rctx.Log.Error(err)
+			sentry.CaptureException(err)
+		} else if reporters >= rctx.Config.Quarantine.ReportThreshold {
+			rctx.Log.Warnf("Media has been reported by %d different users: quarantining", reporters)
+			if err = quarantineReportedMedia(media, rctx); err != nil {
+				// The report itself was recorded, so don't fail the request
+				rctx.Log.Error("Failed to automatically quarantine media: ", err)
+				sentry.CaptureException(err)
+			}
+		}
+	}
+
+	return &api.DoNotCacheResponse{Payload: map[string]interface{}{}}
+}
+
+// quarantineReportedMedia quarantines only the reported media. Unlike an administrator's quarantine, other
+// media with the same contents is left alone: reports are made by ordinary users, so could otherwise be
+// used to take down media they can't see. Administrators can review the reports and quarantine the rest.
+func quarantineReportedMedia(media *types.Media, rctx rcontext.RequestContext) error {
+	attrs, err := storage.GetDatabase().GetMediaAttributesStore(rctx).GetAttributesDefaulted(media.Origin, media.MediaId)
+	if err != nil {
+		return err
+	}
+	if attrs.Purpose == types.PurposePinned {
+		rctx.Log.Warn("Not quarantining reported media because it is pinned")
+		return nil
+	}
+
+	err = storage.GetDatabase().GetMediaStore(rctx).SetQuarantined(media.Origin, media.MediaId, true)
+	if err != nil {
+		return err
+	}
+	download_controller.ClearMediaCache(media.Origin, media.MediaId)
+	rctx.Log.Warn("Media has been quarantined: " + media.Origin + "/" + media.MediaId)
+	return nil
+}
+
+func ListMediaReports(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	serverName := r.URL.Query().Get("server_name")
+
+	limit, errRes := getPageLimit(r, 100)
+	if errRes != nil {
+		return errRes
+	}
+
+	offset, errRes := getPageOffset(r)
+	if errRes != nil {
+		return errRes
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"serverName": serverName,
+		"limit":      limit,
+		"offset":     offset,
+	})
+
+	// One extra report is requested to find out if there's another page
+	reports, err := storage.GetDatabase().GetMetadataStore(rctx).GetMediaReports(serverName, limit+1, offset)
+	if err != nil {
+		return api.InternalServerError("failed to get reports").WithCause(err, rctx)
+	}
+
+	nextBatch := ""
+	if len(reports) > limit {
+		reports = reports[:limit]
+		nextBatch = strconv.Itoa(offset + limit)
+	}
+
+	entries := make([]*MediaReportEntry, 0)
+	for _, report := range reports {
+		entries = append(entries, &MediaReportEntry{
+			MxcUri:   "mxc://" + report.Origin + "/" + report.MediaId,
+			Reporter: report.Reporter,
+			Reason:   report.Reason,
+			ReportTs: report.ReportTs,
+		})
+	}
+
+	return pagedResponse(map[string]interface{}{"reports": entries}, nextBatch)
+}
@@ -0,0 +1,28 @@
+package custom
+
+import (
+	"net/http"
+
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+)
+
+func GetSchemaStatus(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	status, err := storage.GetDatabase().GetSchemaStatus()
+	if err != nil {
+		return api.InternalServerError("failed to get schema status").WithCause(err, rctx)
+	}
+
+	return &api.DoNotCacheResponse{Payload: status}
+}
+
+func ApplyMigrations(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	rctx.Log.Info("Applying database migrations")
+	status, err := storage.GetDatabase().ApplyMigrations()
+	if err != nil {
+		return api.InternalServerError("failed to apply migrations").WithCause(err, rctx)
+	}
+
+	return &api.DoNotCacheResponse{Payload: status}
+}
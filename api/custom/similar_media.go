@@ -0,0 +1,113 @@
+package custom
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/download_controller"
+	"github.com/turt2live/matrix-media-repo/controllers/info_controller"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+const maxSimilarMediaResults = 100
+
+type SimilarMediaEntry struct {
+	Sha256Hash     string   `json:"sha256_hash"`
+	PerceptualHash string   `json:"perceptual_hash"`
+	Distance       int      `json:"distance"`
+	Media          []string `json:"media"`
+}
+
+func GetSimilarMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	maxDistance := 6
+	maxDistanceStr := r.URL.Query().Get("max_distance")
+	if maxDistanceStr != "" {
+		parsed, err := strconv.Atoi(maxDistanceStr)
+		if err != nil || parsed < 0 || parsed > 64 {
+			return api.BadRequest("max_distance must be an integer between 0 and 64")
+		}
+		maxDistance = parsed
+	}
+
+	mxc := r.URL.Query().Get("mxc")
+	hashStr := r.URL.Query().Get("hash")
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"mxc":         mxc,
+		"hash":        hashStr,
+		"maxDistance": maxDistance,
+	})
+
+	var target uint64
+	if hashStr != "" {
+		parsed, err := strconv.ParseUint(hashStr, 16, 64)
+		if err != nil {
+			return api.BadRequest("hash must be a 64 bit perceptual hash, in hex")
+		}
+		target = parsed
+	} else if mxc != "" {
+		origin, mediaId, err := util.SplitMxc(mxc)
+		if err != nil {
+			return api.BadRequest("Invalid MXC URI")
+		}
+		media, err := download_controller.FindMediaRecord(origin, mediaId, false, rctx)
+		if err != nil {
+			if err == common.ErrMediaNotFound {
+				return api.NotFoundError()
+			}
+			return api.InternalServerError("Failed to get media record").WithCause(err, rctx)
+		}
+		target, err = info_controller.GetOrCalculatePerceptualHash(media, rctx)
+		if err != nil {
+			if err == common.ErrNotPerceptuallyHashable {
+				return api.BadRequest("Perceptual hashes can only be calculated for images")
+			} else if err == common.ErrMediaTooLarge {
+				return api.RequestTooLarge()
+			}
+			return api.InternalServerError("Failed to calculate perceptual hash").WithCause(err, rctx)
+		}
+	} else {
+		return api.BadRequest("Either an mxc or hash must be provided")
+	}
+
+	matches, err := storage.GetDatabase().GetMetadataStore(rctx).GetSimilarPerceptualHashes(target, maxDistance, maxSimilarMediaResults)
+	if err != nil {
+		return api.InternalServerError("Failed to search perceptual hashes").WithCause(err, rctx)
+	}
+
+	db := storage.GetDatabase().GetMediaStore(rctx)
+	entries := make([]*SimilarMediaEntry, 0)
+	for sha256Hash, dhash := range matches {
+		records, err := db.GetByHash(sha256Hash)
+		if err != nil {
+			return api.InternalServerError("Failed to get media records").WithCause(err, rctx)
+		}
+
+		mxcs := make([]string, 0)
+		for _, media := range records {
+			mxcs = append(mxcs, media.MxcUri())
+		}
+
+		entries = append(entries, &SimilarMediaEntry{
+			Sha256Hash:     sha256Hash,
+			PerceptualHash: fmt.Sprintf("%016x", dhash),
+			Distance:       info_controller.PerceptualHashDistance(target, dhash),
+			Media:          mxcs,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Distance < entries[j].Distance
+	})
+
+	return &api.DoNotCacheResponse{Payload: map[string]interface{}{
+		"perceptual_hash": fmt.Sprintf("%016x", target),
+		"similar":         entries,
+	}}
+}
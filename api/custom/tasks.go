@@ -1,7 +1,7 @@
 package custom
 
 import (
-	"github.com/getsentry/sentry-go"
+	"math"
 	"net/http"
 	"strconv"
 
@@ -39,9 +39,7 @@ func GetTask(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) i
 
 	task, err := db.GetBackgroundTask(taskId)
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("failed to get task information")
+		return api.InternalServerError("failed to get task information").WithCause(err, rctx)
 	}
 
 	return &api.DoNotCacheResponse{Payload: &TaskStatus{
@@ -55,45 +53,45 @@ func GetTask(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) i
 }
 
 func ListAllTasks(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
-	db := storage.GetDatabase().GetMetadataStore(rctx)
+	return listTasks(r, rctx, false)
+}
 
-	tasks, err := db.GetAllBackgroundTasks()
-	if err != nil {
-		logrus.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("Failed to get background tasks")
-	}
+func ListUnfinishedTasks(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	return listTasks(r, rctx, true)
+}
 
-	statusObjs := make([]*TaskStatus, 0)
-	for _, task := range tasks {
-		statusObjs = append(statusObjs, &TaskStatus{
-			TaskID:     task.ID,
-			Name:       task.Name,
-			Params:     task.Params,
-			StartTs:    task.StartTs,
-			EndTs:      task.EndTs,
-			IsFinished: task.EndTs > 0,
-		})
+func listTasks(r *http.Request, rctx rcontext.RequestContext, unfinishedOnly bool) interface{} {
+	limit, errRes := getPageLimit(r, 0)
+	if errRes != nil {
+		return errRes
+	}
+	afterId := 0
+	if fromStr := r.URL.Query().Get("from"); fromStr != "" {
+		parsed, err := strconv.Atoi(fromStr)
+		if err != nil || parsed < 0 {
+			return api.BadRequest("from must be a token returned by a previous request")
+		}
+		afterId = parsed
+	}
+	if limit <= 0 {
+		limit = math.MaxInt32
 	}
 
-	return &api.DoNotCacheResponse{Payload: statusObjs}
-}
-
-func ListUnfinishedTasks(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
 	db := storage.GetDatabase().GetMetadataStore(rctx)
 
-	tasks, err := db.GetAllBackgroundTasks()
+	// One extra task is requested to find out if there's another page
+	tasks, err := db.GetBackgroundTasksPage(afterId, unfinishedOnly, limit+1)
 	if err != nil {
-		logrus.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("Failed to get background tasks")
+		return api.InternalServerError("Failed to get background tasks").WithCause(err, rctx)
+	}
+	nextBatch := ""
+	if len(tasks) > limit {
+		tasks = tasks[:limit]
+		nextBatch = strconv.Itoa(tasks[limit-1].ID)
 	}
 
 	statusObjs := make([]*TaskStatus, 0)
 	for _, task := range tasks {
-		if task.EndTs > 0 {
-			continue
-		}
 		statusObjs = append(statusObjs, &TaskStatus{
 			TaskID:     task.ID,
 			Name:       task.Name,
@@ -104,5 +102,5 @@ func ListUnfinishedTasks(r *http.Request, rctx rcontext.RequestContext, user api
 		})
 	}
 
-	return &api.DoNotCacheResponse{Payload: statusObjs}
+	return pagedResponse(statusObjs, nextBatch)
 }
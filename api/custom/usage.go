@@ -1,8 +1,10 @@
 package custom
 
 import (
-	"github.com/getsentry/sentry-go"
+	"fmt"
+	"math"
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
@@ -24,18 +26,23 @@ type UsageInfo struct {
 }
 
 type CountsUsageResponse struct {
-	RawBytes  *UsageInfo `json:"raw_bytes"`
-	RawCounts *UsageInfo `json:"raw_counts"`
+	RawBytes      *UsageInfo `json:"raw_bytes"`
+	PhysicalBytes *UsageInfo `json:"physical_bytes"`
+	RawCounts     *UsageInfo `json:"raw_counts"`
 }
 
 type UserUsageEntry struct {
-	RawBytes     *MinimalUsageInfo `json:"raw_bytes"`
-	RawCounts    *MinimalUsageInfo `json:"raw_counts"`
-	UploadedMxcs []string          `json:"uploaded,flow"`
+	RawBytes      *MinimalUsageInfo `json:"raw_bytes"`
+	PhysicalBytes *MinimalUsageInfo `json:"physical_bytes"`
+	RawCounts     *MinimalUsageInfo `json:"raw_counts"`
+	UploadedMxcs  []string          `json:"uploaded,flow"`
+
+	hashes map[string]int64
 }
 
 type MediaUsageEntry struct {
 	SizeBytes         int64  `json:"size_bytes"`
+	PhysicalBytes     int64  `json:"physical_bytes"`
 	UploadedBy        string `json:"uploaded_by"`
 	DatastoreId       string `json:"datastore_id"`
 	DatastoreLocation string `json:"datastore_location"`
@@ -44,6 +51,16 @@ type MediaUsageEntry struct {
 	UploadName        string `json:"upload_name"`
 	ContentType       string `json:"content_type"`
 	CreatedTs         int64  `json:"created_ts"`
+	UserAgent         string `json:"user_agent,omitempty"`
+}
+
+const maxPopularMediaPageSize = 1000
+
+type PopularMediaEntry struct {
+	Sha256Hash   string   `json:"sha256_hash"`
+	AccessCount  int64    `json:"access_count"`
+	LastAccessTs int64    `json:"last_access_ts"`
+	Media        []string `json:"media"`
 }
 
 func GetDomainUsage(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
@@ -59,16 +76,17 @@ func GetDomainUsage(r *http.Request, rctx rcontext.RequestContext, user api.User
 
 	mediaBytes, thumbBytes, err := db.GetByteUsageForServer(serverName)
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("Failed to get byte usage for server")
+		return api.InternalServerError("Failed to get byte usage for server").WithCause(err, rctx)
+	}
+
+	physicalMediaBytes, physicalThumbBytes, err := db.GetPhysicalByteUsageForServer(serverName)
+	if err != nil {
+		return api.InternalServerError("Failed to get physical byte usage for server").WithCause(err, rctx)
 	}
 
 	mediaCount, thumbCount, err := db.GetCountUsageForServer(serverName)
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("Failed to get count usage for server")
+		return api.InternalServerError("Failed to get count usage for server").WithCause(err, rctx)
 	}
 
 	return &api.DoNotCacheResponse{
@@ -80,6 +98,13 @@ func GetDomainUsage(r *http.Request, rctx rcontext.RequestContext, user api.User
 				},
 				Thumbnails: thumbBytes,
 			},
+			PhysicalBytes: &UsageInfo{
+				MinimalUsageInfo: &MinimalUsageInfo{
+					Total: physicalMediaBytes + physicalThumbBytes,
+					Media: physicalMediaBytes,
+				},
+				Thumbnails: physicalThumbBytes,
+			},
 			RawCounts: &UsageInfo{
 				MinimalUsageInfo: &MinimalUsageInfo{
 					Total: mediaCount + thumbCount,
@@ -103,18 +128,35 @@ func GetUserUsage(r *http.Request, rctx rcontext.RequestContext, user api.UserIn
 
 	db := storage.GetDatabase().GetMediaStore(rctx)
 
-	var records []*types.Media
-	var err error
+	limit, errRes := getPageLimit(r, 0)
+	if errRes != nil {
+		return errRes
+	}
+
+	// Pages are made of users rather than media, so each user's usage is always complete
+	nextBatch := ""
 	if userIds == nil || len(userIds) == 0 {
-		records, err = db.GetAllMediaForServer(serverName)
-	} else {
-		records, err = db.GetAllMediaForServerUsers(serverName, userIds)
+		var err error
+		if limit > 0 {
+			// One extra user is requested to find out if there's another page
+			userIds, err = db.GetUsersForServerPage(serverName, r.URL.Query().Get("from"), limit+1)
+		} else {
+			userIds, err = db.GetUsersForServerPage(serverName, r.URL.Query().Get("from"), math.MaxInt32)
+		}
+		if err != nil {
+			return api.InternalServerError("Failed to get users for server").WithCause(err, rctx)
+		}
+		if limit > 0 && len(userIds) > limit {
+			userIds = userIds[:limit]
+			nextBatch = userIds[limit-1]
+		}
+	} else if limit > 0 && len(userIds) > limit {
+		return api.BadRequest(fmt.Sprintf("At most %d users can be requested at once", limit))
 	}
 
+	records, err := db.GetAllMediaForServerUsers(serverName, userIds)
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("Failed to get media records for users")
+		return api.InternalServerError("Failed to get media records for users").WithCause(err, rctx)
 	}
 
 	parsed := make(map[string]*UserUsageEntry)
@@ -133,6 +175,11 @@ func GetUserUsage(r *http.Request, rctx rcontext.RequestContext, user api.UserIn
 					Total: 0,
 					Media: 0,
 				},
+				PhysicalBytes: &MinimalUsageInfo{
+					Total: 0,
+					Media: 0,
+				},
+				hashes: make(map[string]int64),
 			}
 			parsed[media.UserId] = entry
 		}
@@ -143,9 +190,33 @@ func GetUserUsage(r *http.Request, rctx rcontext.RequestContext, user api.UserIn
 		entry.RawCounts.Media += 1
 
 		entry.UploadedMxcs = append(entry.UploadedMxcs, media.MxcUri())
+		entry.hashes[media.Sha256Hash] = media.SizeBytes
 	}
 
-	return &api.DoNotCacheResponse{Payload: parsed}
+	// Physical usage only counts each unique file once per user, with files shared between
+	// several users being split evenly between them.
+	hashes := make([]string, 0)
+	for _, entry := range parsed {
+		for hash := range entry.hashes {
+			hashes = append(hashes, hash)
+		}
+	}
+	refCounts, err := db.GetUserReferenceCounts(hashes)
+	if err != nil {
+		return api.InternalServerError("Failed to get reference counts for media").WithCause(err, rctx)
+	}
+	for _, entry := range parsed {
+		for hash, sizeBytes := range entry.hashes {
+			refs := refCounts[hash]
+			if refs < 1 {
+				refs = 1
+			}
+			entry.PhysicalBytes.Total += sizeBytes / refs
+			entry.PhysicalBytes.Media += sizeBytes / refs
+		}
+	}
+
+	return pagedResponse(parsed, nextBatch)
 }
 
 func GetUploadsUsage(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
@@ -160,18 +231,34 @@ func GetUploadsUsage(r *http.Request, rctx rcontext.RequestContext, user api.Use
 
 	db := storage.GetDatabase().GetMediaStore(rctx)
 
+	limit, errRes := getPageLimit(r, 0)
+	if errRes != nil {
+		return errRes
+	}
+
 	var records []*types.Media
 	var err error
+	nextBatch := ""
 	if mxcs == nil || len(mxcs) == 0 {
-		records, err = db.GetAllMediaForServer(serverName)
+		if limit > 0 {
+			// One extra record is requested to find out if there's another page
+			records, err = db.GetMediaForServerPage(serverName, r.URL.Query().Get("from"), limit+1)
+			if len(records) > limit {
+				records = records[:limit]
+				nextBatch = records[limit-1].MediaId
+			}
+		} else {
+			records, err = db.GetAllMediaForServer(serverName)
+		}
 	} else {
+		if limit > 0 && len(mxcs) > limit {
+			return api.BadRequest(fmt.Sprintf("At most %d MXC URIs can be requested at once", limit))
+		}
 		split := make([]string, 0)
 		for _, mxc := range mxcs {
 			o, i, err := util.SplitMxc(mxc)
 			if err != nil {
-				rctx.Log.Error(err)
-				sentry.CaptureException(err)
-				return api.InternalServerError("Error parsing MXC " + mxc)
+				return api.InternalServerError("Error parsing MXC "+mxc).WithCause(err, rctx)
 			}
 
 			if o != serverName {
@@ -184,16 +271,35 @@ func GetUploadsUsage(r *http.Request, rctx rcontext.RequestContext, user api.Use
 	}
 
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("Failed to get media records for users")
+		return api.InternalServerError("Failed to get media records for users").WithCause(err, rctx)
+	}
+
+	mediaIds := make([]string, 0, len(records))
+	hashes := make([]string, 0, len(records))
+	for _, media := range records {
+		mediaIds = append(mediaIds, media.MediaId)
+		hashes = append(hashes, media.Sha256Hash)
+	}
+	// Files shared between several media records have their size split evenly between them
+	refCounts, err := db.GetReferenceCounts(hashes)
+	if err != nil {
+		return api.InternalServerError("Failed to get reference counts for media").WithCause(err, rctx)
+	}
+	userAgents, err := storage.GetDatabase().GetMetadataStore(rctx).GetMediaUploadClients(serverName, mediaIds)
+	if err != nil {
+		return api.InternalServerError("Failed to get upload clients for media").WithCause(err, rctx)
 	}
 
 	parsed := make(map[string]*MediaUsageEntry)
 
 	for _, media := range records {
+		refs := refCounts[media.Sha256Hash]
+		if refs < 1 {
+			refs = 1
+		}
 		parsed[media.MxcUri()] = &MediaUsageEntry{
 			SizeBytes:         media.SizeBytes,
+			PhysicalBytes:     media.SizeBytes / refs,
 			UploadName:        media.UploadName,
 			ContentType:       media.ContentType,
 			CreatedTs:         media.CreationTs,
@@ -202,8 +308,63 @@ func GetUploadsUsage(r *http.Request, rctx rcontext.RequestContext, user api.Use
 			Quarantined:       media.Quarantined,
 			Sha256Hash:        media.Sha256Hash,
 			UploadedBy:        media.UserId,
+			UserAgent:         userAgents[media.MediaId],
 		}
 	}
 
-	return &api.DoNotCacheResponse{Payload: parsed}
+	return pagedResponse(parsed, nextBatch)
+}
+
+func GetPopularMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	limit, errRes := getPageLimit(r, 50)
+	if errRes != nil {
+		return errRes
+	}
+	if limit > maxPopularMediaPageSize {
+		// Each entry needs its own lookup, so this is capped even without a maximum page size
+		limit = maxPopularMediaPageSize
+	}
+	offset, errRes := getPageOffset(r)
+	if errRes != nil {
+		return errRes
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"limit":  limit,
+		"offset": offset,
+	})
+
+	// One extra entry is requested to find out if there's another page
+	stats, err := storage.GetDatabase().GetMetadataStore(rctx).GetMostAccessed(limit+1, offset)
+	if err != nil {
+		return api.InternalServerError("Failed to get access counts").WithCause(err, rctx)
+	}
+	nextBatch := ""
+	if len(stats) > limit {
+		stats = stats[:limit]
+		nextBatch = strconv.Itoa(offset + limit)
+	}
+
+	db := storage.GetDatabase().GetMediaStore(rctx)
+	entries := make([]*PopularMediaEntry, 0)
+	for _, stat := range stats {
+		records, err := db.GetByHash(stat.Sha256Hash)
+		if err != nil {
+			return api.InternalServerError("Failed to get media records").WithCause(err, rctx)
+		}
+
+		mxcs := make([]string, 0)
+		for _, media := range records {
+			mxcs = append(mxcs, media.MxcUri())
+		}
+
+		entries = append(entries, &PopularMediaEntry{
+			Sha256Hash:   stat.Sha256Hash,
+			AccessCount:  stat.AccessCount,
+			LastAccessTs: stat.LastAccessTs,
+			Media:        mxcs,
+		})
+	}
+
+	return pagedResponse(entries, nextBatch)
 }
@@ -1,10 +1,14 @@
 package r0
 
 import (
+	"fmt"
 	"github.com/getsentry/sentry-go"
 	"io"
 	"net/http"
+	"path"
 	"strconv"
+	"strings"
+	"unicode"
 
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
@@ -12,6 +16,10 @@ import (
 	"github.com/turt2live/matrix-media-repo/common"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/controllers/download_controller"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
 )
 
 type DownloadMediaResponse struct {
@@ -20,6 +28,26 @@ type DownloadMediaResponse struct {
 	SizeBytes         int64
 	Data              io.ReadCloser
 	TargetDisposition string
+	LastModifiedTs    int64
+	CacheControl      string
+	BytesPerSecond    int64
+
+	// ServeRanges advertises support for range requests, which are served when Data is seekable
+	ServeRanges bool
+
+	// Vary is the set of request headers the response was negotiated on, if any
+	Vary []string
+
+	// Etag is the entity tag for the response body, such as the file's hash. Not sent if empty.
+	Etag string
+
+	// Headers are any additional headers to send with the response
+	Headers map[string]string
+
+	// ConsumeDownload, if set, is called just before the whole of the media is sent, returning false
+	// if the media can't be downloaded any more. Range requests are answered with the whole media
+	// so that only complete downloads need counting.
+	ConsumeDownload func() (bool, error)
 }
 
 func DownloadMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
@@ -30,6 +58,16 @@ func DownloadMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserI
 	filename := params["filename"]
 	allowRemote := r.URL.Query().Get("allow_remote")
 
+	server, err := util.CanonicalServerName(server)
+	if err != nil {
+		return api.BadRequest("Invalid server name")
+	}
+
+	filename, ok := sanitizeFilename(filename)
+	if !ok {
+		return api.BadRequest("Invalid filename")
+	}
+
 	targetDisposition := r.URL.Query().Get("org.matrix.msc2702.asAttachment")
 	if targetDisposition == "true" {
 		targetDisposition = "attachment"
@@ -55,29 +93,227 @@ func DownloadMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserI
 		"allowRemote": downloadRemote,
 	})
 
-	streamedMedia, err := download_controller.GetMedia(server, mediaId, downloadRemote, false, rctx)
+	if rctx.Config.Downloads.RequireAuth && user.UserId == "" {
+		// Signed links allow the media to be downloaded without authentication
+		if !download_controller.IsDownloadTokenValid(server, mediaId, r.URL.Query().Get("io.t2bot.download_token"), rctx) {
+			rctx.Log.Warn("Rejecting unauthenticated request: downloads require authentication")
+			if user.AccessToken == "" {
+				return api.MissingToken()
+			}
+			return api.AuthFailed()
+		}
+		rctx.Log.Info("Allowing unauthenticated download with a valid download token")
+	}
+
+	if !download_controller.IsRefererAllowed(r.Header.Get("Referer"), rctx) {
+		rctx.Log.Warn("Rejecting request from disallowed referer: " + r.Header.Get("Referer"))
+		return api.Forbidden("Media cannot be embedded on this site")
+	}
+
+	if !download_controller.IsCountryAllowed(r.RemoteAddr, rctx) {
+		rctx.Log.Warn("Rejecting request from disallowed country")
+		return api.Forbidden("Media is not available in your region")
+	}
+
+	var streamedMedia *types.MinimalMedia
+	if r.Method == http.MethodHead {
+		streamedMedia, err = download_controller.GetMediaHeaders(server, mediaId, rctx)
+	} else {
+		streamedMedia, err = download_controller.GetMedia(server, mediaId, downloadRemote, false, rctx)
+	}
 	if err != nil {
 		if err == common.ErrMediaNotFound {
 			return api.NotFoundError()
 		} else if err == common.ErrMediaTooLarge {
 			return api.RequestTooLarge()
+		} else if err == common.ErrStorageFull {
+			return api.StorageFull()
 		} else if err == common.ErrMediaQuarantined {
 			return api.NotFoundError() // We lie for security
+		} else if err == common.ErrDatabaseUnavailable {
+			return api.ServiceUnavailable("The media repo is temporarily unavailable. Please try again later.")
 		}
-		rctx.Log.Error("Unexpected error locating media: " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("Unexpected Error")
+		return api.InternalServerError("Unexpected Error").WithCause(err, rctx)
 	}
 
 	if filename == "" {
 		filename = streamedMedia.UploadName
 	}
 
+	attrs := getMediaAttributes(server, mediaId, rctx)
+	if targetDisposition != "attachment" && isForcedAttachment(attrs) {
+		targetDisposition = "attachment"
+	}
+
+	lastModifiedTs := int64(0)
+	etag := ""
+	if streamedMedia.KnownMedia != nil {
+		lastModifiedTs = streamedMedia.KnownMedia.CreationTs
+		etag = streamedMedia.KnownMedia.Sha256Hash
+	}
+
+	bytesPerSecond := int64(0)
+	throttle := rctx.Config.Downloads.Throttle
+	if throttle.BytesPerSecond > 0 && streamedMedia.SizeBytes >= throttle.MinSizeBytes {
+		bytesPerSecond = throttle.BytesPerSecond
+	}
+
+	headers := getMetadataHeaders(streamedMedia.KnownMedia, user, rctx)
+	sizeBytes := streamedMedia.SizeBytes
+	data := streamedMedia.Stream
+	var vary []string
+	if km := streamedMedia.KnownMedia; km != nil && km.Encoding == datastore.EncodingGzip {
+		// Clients which accept gzip get the stored file as-is, saving decompressing it
+		vary = []string{"Accept-Encoding"}
+		if r.Header.Get("Range") == "" && acceptsEncoding(r, datastore.EncodingGzip) {
+			encoded := util.BytesToStream(nil)
+			if r.Method != http.MethodHead {
+				encoded, err = datastore.DownloadEncodedStream(rctx, km.DatastoreId, km.Location)
+			}
+			if err != nil {
+				rctx.Log.Warn("Error opening compressed file - serving it decompressed instead: ", err)
+			} else {
+				_ = data.Close()
+				data = encoded
+				sizeBytes = 0 // the compressed size isn't known
+				headers["Content-Encoding"] = datastore.EncodingGzip
+				etag = etag + "-" + datastore.EncodingGzip
+			}
+		}
+	}
+
 	return &DownloadMediaResponse{
 		ContentType:       streamedMedia.ContentType,
 		Filename:          filename,
-		SizeBytes:         streamedMedia.SizeBytes,
-		Data:              streamedMedia.Stream,
+		SizeBytes:         sizeBytes,
+		Data:              data,
 		TargetDisposition: targetDisposition,
+		LastModifiedTs:    lastModifiedTs,
+		CacheControl:      getCacheControl(streamedMedia.ContentType, attrs, rctx),
+		BytesPerSecond:    bytesPerSecond,
+		Vary:              vary,
+		Etag:              etag,
+		Headers:           headers,
+		ConsumeDownload:   getDownloadConsumer(server, mediaId, attrs, rctx),
+	}
+}
+
+// getDownloadConsumer returns a function to count a download of the media against its download
+// limit, or nil if the media has no download limit. Attributes which couldn't be loaded are
+// fetched again when counting the download.
+func getDownloadConsumer(origin string, mediaId string, attrs *types.MediaAttributes, rctx rcontext.RequestContext) func() (bool, error) {
+	if attrs != nil && attrs.MaxDownloads <= 0 {
+		return nil
+	}
+	return func() (bool, error) {
+		if attrs == nil {
+			var err error
+			attrs, err = storage.GetDatabase().GetMediaAttributesStore(rctx).GetAttributesDefaulted(origin, mediaId)
+			if err != nil {
+				return false, err
+			}
+		}
+		return download_controller.ConsumeDownload(attrs, rctx)
+	}
+}
+
+func getMetadataHeaders(media *types.Media, user api.UserInfo, rctx rcontext.RequestContext) map[string]string {
+	headers := make(map[string]string)
+	conf := rctx.Config.Downloads.MetadataHeaders
+	if !conf.Enabled || media == nil {
+		return headers
+	}
+
+	headers["X-Matrix-Media-Upload-Time"] = strconv.FormatInt(media.CreationTs, 10)
+	headers["X-Matrix-Media-Hash"] = media.Sha256Hash
+
+	// The uploader is only revealed to admins as it would otherwise link media to users
+	if conf.IncludeUploader && media.UserId != "" && (util.IsGlobalAdmin(user.UserId) || user.IsShared) {
+		headers["X-Matrix-Media-Uploader"] = media.UserId
+	}
+
+	return headers
+}
+
+// getMediaAttributes gets the attributes for the media, or nil if they couldn't be loaded.
+func getMediaAttributes(origin string, mediaId string, rctx rcontext.RequestContext) *types.MediaAttributes {
+	attrs, err := download_controller.GetMediaAttributes(origin, mediaId, rctx)
+	if err != nil {
+		rctx.Log.Warn("Failed to get media attributes: " + err.Error())
+		sentry.CaptureException(err)
+		return nil
+	}
+	return attrs
+}
+
+// isForcedAttachment returns true if the media must be downloaded as an attachment, including
+// when its attributes couldn't be loaded.
+func isForcedAttachment(attrs *types.MediaAttributes) bool {
+	return attrs == nil || attrs.ForceAttachment
+}
+
+// getCacheControl gets the Cache-Control header for the media, given its attributes (which may
+// be nil if they couldn't be loaded).
+func getCacheControl(contentType string, attrs *types.MediaAttributes, rctx rcontext.RequestContext) string {
+	maxAge := rctx.Config.Downloads.CacheMaxAgeSeconds
+	for _, override := range rctx.Config.Downloads.CacheMaxAgeOverrides {
+		if util.ContentTypeMatches(override.ContentType, contentType) {
+			maxAge = override.MaxAgeSeconds
+			break
+		}
+	}
+
+	if attrs != nil {
+		if attrs.MaxDownloads > 0 {
+			// Cached copies would be downloads which aren't counted
+			return "no-store"
+		}
+		if attrs.CacheMaxAge != types.NoCacheMaxAge {
+			maxAge = attrs.CacheMaxAge
+		}
+	}
+
+	return fmt.Sprintf("private, max-age=%d", maxAge)
+}
+
+// sanitizeFilename reduces a filename given in the path, which replaces the stored one in the
+// Content-Disposition header, to a plain file name. Returns false if nothing usable is left. An
+// empty filename is left empty so the stored one is used.
+func sanitizeFilename(filename string) (string, bool) {
+	if filename == "" {
+		return "", true
+	}
+	filename = path.Base(strings.ReplaceAll(filename, "\\", "/"))
+	if filename == "." || filename == ".." || filename == "/" || strings.IndexFunc(filename, unicode.IsControl) >= 0 {
+		return "", false
+	}
+	return filename, true
+}
+
+// acceptsEncoding returns true if the request's Accept-Encoding header allows the given content coding,
+// either by name or through a wildcard.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	accepted := false
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(header, ",") {
+			params := strings.Split(part, ";")
+			coding := strings.ToLower(strings.TrimSpace(params[0]))
+			if coding != encoding && coding != "*" {
+				continue
+			}
+			allowed := true
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					q, err := strconv.ParseFloat(param[2:], 64)
+					allowed = err == nil && q > 0
+				}
+			}
+			if coding == encoding {
+				return allowed // naming the coding overrides any wildcard
+			}
+			accepted = allowed
+		}
 	}
+	return accepted
 }
@@ -0,0 +1,46 @@
+package r0
+
+import (
+	"testing"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		expected string
+		ok       bool
+	}{
+		{"empty", "", "", true},
+		{"plain", "cat.png", "cat.png", true},
+		{"spaces and unicode", "my cät picture.png", "my cät picture.png", true},
+		{"forward slashes", "a/b/cat.png", "cat.png", true},
+		{"backslashes", "a\\b\\cat.png", "cat.png", true},
+		{"absolute path", "/etc/passwd", "passwd", true},
+		{"trailing slash", "cat.png/", "cat.png", true},
+		{"parent traversal", "../../cat.png", "cat.png", true},
+		{"windows traversal", "..\\..\\cat.png", "cat.png", true},
+		{"dot", ".", "", false},
+		{"dot dot", "..", "", false},
+		{"dot dot with slash", "../", "", false},
+		{"only slashes", "///", "", false},
+		{"only backslash", "\\", "", false},
+		{"newline", "cat\n.png", "", false},
+		{"carriage return", "cat.png\r", "", false},
+		{"null byte", "cat\x00.png", "", false},
+		{"escape", "\x1b[31mcat.png", "", false},
+		{"delete", "cat\x7f.png", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename, ok := sanitizeFilename(tt.filename)
+			if ok != tt.ok {
+				t.Fatalf("expected ok to be %t, got %t", tt.ok, ok)
+			}
+			if filename != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, filename)
+			}
+		})
+	}
+}
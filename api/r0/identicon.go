@@ -3,31 +3,51 @@ package r0
 import (
 	"bytes"
 	"crypto/md5"
-	"github.com/getsentry/sentry-go"
+	"encoding/hex"
 	"image/color"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/cupcake/sigil/gen"
 	"github.com/disintegration/imaging"
 	"github.com/gorilla/mux"
+	"github.com/patrickmn/go-cache"
 	"github.com/sirupsen/logrus"
 	"github.com/turt2live/matrix-media-repo/api"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
 )
 
 type IdenticonResponse struct {
-	Avatar io.Reader
+	Avatar      io.Reader
+	ContentType string
 }
 
+type proxiedIdenticon struct {
+	contentType string
+	data        []byte
+}
+
+const maxProxiedIdenticonBytes = 5242880 // 5mb
+
+var proxiedIdenticonCache = cache.New(1*time.Hour, 2*time.Hour)
+
 func Identicon(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
 	if !rctx.Config.Identicons.Enabled {
 		return api.NotFoundError()
 	}
 
 	params := mux.Vars(r)
-	seed := params["seed"]
+
+	// Leading and trailing whitespace is not significant, so an empty or whitespace-only seed
+	// always produces the same avatar as the empty seed.
+	seed := strings.TrimSpace(params["seed"])
 
 	var err error
 	width := 96
@@ -59,6 +79,10 @@ func Identicon(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo)
 	m.Write([]byte(seed))
 	hashed := m.Sum(nil)
 
+	if rctx.Config.Identicons.ProxyUrl != "" {
+		return proxyIdenticon(seed, hex.EncodeToString(hashed), width, height, rctx)
+	}
+
 	sig := &gen.Sigil{
 		Rows:       5,
 		Background: rgb(224, 224, 224),
@@ -84,12 +108,60 @@ func Identicon(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo)
 	imgData := &bytes.Buffer{}
 	err = imaging.Encode(imgData, img, imaging.PNG)
 	if err != nil {
-		rctx.Log.Error("Error generating image:" + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("error generating identicon")
+		return api.InternalServerError("error generating identicon").WithCause(err, rctx)
+	}
+
+	return &IdenticonResponse{Avatar: imgData, ContentType: "image/png"}
+}
+
+func proxyIdenticon(seed string, seedHash string, width int, height int, rctx rcontext.RequestContext) interface{} {
+	avatarUrl := strings.NewReplacer(
+		"{seed}", url.PathEscape(seed),
+		"{md5}", seedHash,
+		"{width}", strconv.Itoa(width),
+		"{height}", strconv.Itoa(height),
+	).Replace(rctx.Config.Identicons.ProxyUrl)
+
+	if item, found := proxiedIdenticonCache.Get(avatarUrl); found {
+		rctx.Log.Info("Using cached proxied identicon")
+		cached := item.(*proxiedIdenticon)
+		return &IdenticonResponse{Avatar: bytes.NewReader(cached.data), ContentType: cached.contentType}
+	}
+
+	rctx.Log.Info("Fetching identicon from proxy")
+	client := util.NewHttpClient(time.Duration(rctx.Config.TimeoutSeconds.ClientServer) * time.Second)
+	res, err := client.Get(avatarUrl)
+	if err != nil {
+		return api.BadGateway("error fetching identicon").WithCause(err, rctx)
+	}
+	defer cleanup.DumpAndCloseStream(res.Body)
+
+	if res.StatusCode != http.StatusOK {
+		rctx.Log.Warn("Unexpected status code fetching proxied identicon: ", res.StatusCode)
+		return api.BadGateway("error fetching identicon")
+	}
+
+	contentType := res.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "image/") {
+		rctx.Log.Warn("Proxied identicon is not an image: " + contentType)
+		return api.BadGateway("error fetching identicon")
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(res.Body, maxProxiedIdenticonBytes+1))
+	if err != nil {
+		return api.BadGateway("error fetching identicon").WithCause(err, rctx)
+	}
+	if len(b) > maxProxiedIdenticonBytes {
+		rctx.Log.Warn("Proxied identicon is too large")
+		return api.BadGateway("error fetching identicon")
+	}
+
+	cacheTime := time.Duration(rctx.Config.Identicons.ProxyCacheSeconds) * time.Second
+	if cacheTime > 0 {
+		proxiedIdenticonCache.Set(avatarUrl, &proxiedIdenticon{contentType: contentType, data: b}, cacheTime)
 	}
 
-	return &IdenticonResponse{Avatar: imgData}
+	return &IdenticonResponse{Avatar: bytes.NewReader(b), ContentType: contentType}
 }
 
 func rgb(r, g, b uint8) color.NRGBA {
@@ -0,0 +1,53 @@
+package r0
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/turt2live/matrix-media-repo/api"
+)
+
+func generateIdenticon(t *testing.T, seed string) []byte {
+	ctx := testRequestContext()
+	ctx.Config.Identicons.Enabled = true
+
+	r := httptest.NewRequest("GET", "/_matrix/media/v3/identicon/"+url.PathEscape(seed)+"?width=32", nil)
+	r = mux.SetURLVars(r, map[string]string{"seed": seed})
+
+	res := Identicon(r, ctx, api.UserInfo{})
+	identicon, ok := res.(*IdenticonResponse)
+	if !ok {
+		t.Fatalf("expected an identicon for seed %q, got %T", seed, res)
+	}
+	if identicon.ContentType != "image/png" {
+		t.Errorf("expected image/png, got %s", identicon.ContentType)
+	}
+	b, err := ioutil.ReadAll(identicon.Avatar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestIdenticonEmptySeedIsDeterministic(t *testing.T) {
+	empty := generateIdenticon(t, "")
+	if len(empty) == 0 {
+		t.Fatal("expected an identicon to be generated")
+	}
+
+	if again := generateIdenticon(t, ""); !bytes.Equal(empty, again) {
+		t.Error("expected the empty seed to generate the same identicon each time")
+	}
+	for _, seed := range []string{" ", "\t", "  \n "} {
+		if whitespace := generateIdenticon(t, seed); !bytes.Equal(empty, whitespace) {
+			t.Errorf("expected seed %q to generate the same identicon as the empty seed", seed)
+		}
+	}
+	if other := generateIdenticon(t, "@alice:example.org"); bytes.Equal(empty, other) {
+		t.Error("expected a different seed to generate a different identicon")
+	}
+}
@@ -1,7 +1,6 @@
 package r0
 
 import (
-	"github.com/getsentry/sentry-go"
 	"net/http"
 
 	"github.com/turt2live/matrix-media-repo/api"
@@ -12,9 +11,7 @@ import (
 func Logout(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
 	err := auth_cache.InvalidateToken(rctx, user.AccessToken, user.UserId)
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("unable to logout")
+		return api.InternalServerError("unable to logout").WithCause(err, rctx)
 	}
 	return api.EmptyResponse{}
 }
@@ -22,9 +19,7 @@ func Logout(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) in
 func LogoutAll(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
 	err := auth_cache.InvalidateAllTokens(rctx, user.AccessToken, user.UserId)
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("unable to logout")
+		return api.InternalServerError("unable to logout").WithCause(err, rctx)
 	}
 	return api.EmptyResponse{}
 }
@@ -1,15 +1,16 @@
 package r0
 
 import (
-	"github.com/getsentry/sentry-go"
 	"net/http"
 	"strconv"
 	"strings"
 
+	"github.com/gorilla/mux"
 	"github.com/turt2live/matrix-media-repo/api"
 	"github.com/turt2live/matrix-media-repo/common"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/controllers/preview_controller"
+	"github.com/turt2live/matrix-media-repo/types"
 	"github.com/turt2live/matrix-media-repo/util"
 )
 
@@ -27,10 +28,55 @@ type MatrixOpenGraph struct {
 }
 
 func PreviewUrl(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
-	if !rctx.Config.UrlPreviews.Enabled {
+	preview, errResp := getPreview(r, rctx, user)
+	if errResp != nil {
+		return errResp
+	}
+
+	return &MatrixOpenGraph{
+		Url:         preview.Url,
+		SiteName:    preview.SiteName,
+		Type:        preview.Type,
+		Description: preview.Description,
+		Title:       preview.Title,
+		ImageMxc:    preview.ImageMxc,
+		ImageType:   preview.ImageType,
+		ImageSize:   preview.ImageSize,
+		ImageWidth:  preview.ImageWidth,
+		ImageHeight: preview.ImageHeight,
+	}
+}
+
+// PreviewUrlThumbnail returns a thumbnail of the image for a URL preview, using the same query
+// parameters as PreviewUrl and ThumbnailMedia combined.
+func PreviewUrlThumbnail(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	preview, errResp := getPreview(r, rctx, user)
+	if errResp != nil {
+		return errResp
+	}
+
+	if preview.ImageMxc == "" {
 		return api.NotFoundError()
 	}
 
+	server, mediaId, err := util.SplitMxc(preview.ImageMxc)
+	if err != nil {
+		return api.InternalServerError("unexpected error during request").WithCause(err, rctx)
+	}
+
+	// The preview image is a regular media record, so hand off to the normal thumbnail pipeline
+	r = mux.SetURLVars(r, map[string]string{
+		"server":  server,
+		"mediaId": mediaId,
+	})
+	return ThumbnailMedia(r, rctx, user)
+}
+
+func getPreview(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) (*types.UrlPreview, interface{}) {
+	if !rctx.Config.UrlPreviews.Enabled {
+		return nil, api.NotFoundError()
+	}
+
 	params := r.URL.Query()
 
 	// Parse the parameters
@@ -42,16 +88,16 @@ func PreviewUrl(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo
 		ts, err = strconv.ParseInt(tsStr, 10, 64)
 		if err != nil {
 			rctx.Log.Error("Error parsing ts: " + err.Error())
-			return api.BadRequest(err.Error())
+			return nil, api.BadRequest(err.Error())
 		}
 	}
 
 	// Validate the URL
 	if urlStr == "" {
-		return api.BadRequest("No url provided")
+		return nil, api.BadRequest("No url provided")
 	}
 	if strings.Index(urlStr, "http://") != 0 && strings.Index(urlStr, "https://") != 0 {
-		return api.BadRequest("Scheme not accepted")
+		return nil, api.BadRequest("Scheme not accepted")
 	}
 
 	languageHeader := rctx.Config.UrlPreviews.DefaultLanguage
@@ -59,28 +105,22 @@ func PreviewUrl(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo
 		languageHeader = r.Header.Get("Accept-Language")
 	}
 
-	preview, err := preview_controller.GetPreview(urlStr, r.Host, user.UserId, ts, languageHeader, rctx)
+	var preview *types.UrlPreview
+	if origin, mediaId, ok := preview_controller.ParseLocalMediaUrl(urlStr, r.Host); ok {
+		rctx.Log.Info("URL is for media held by this media repo - using the stored media instead")
+		preview, err = preview_controller.GetLocalMediaPreview(origin, mediaId, urlStr, rctx)
+	} else {
+		preview, err = preview_controller.GetPreview(urlStr, r.Host, user.UserId, ts, languageHeader, rctx)
+	}
 	if err != nil {
 		if err == common.ErrMediaNotFound || err == common.ErrHostNotFound {
-			return api.NotFoundError()
+			return nil, api.NotFoundError()
 		} else if err == common.ErrInvalidHost || err == common.ErrHostBlacklisted {
-			return api.BadRequest(err.Error())
+			return nil, api.BadRequest(err.Error())
 		} else {
-			sentry.CaptureException(err)
-			return api.InternalServerError("unexpected error during request")
+			return nil, api.InternalServerError("unexpected error during request").WithCause(err, rctx)
 		}
 	}
 
-	return &MatrixOpenGraph{
-		Url:         preview.Url,
-		SiteName:    preview.SiteName,
-		Type:        preview.Type,
-		Description: preview.Description,
-		Title:       preview.Title,
-		ImageMxc:    preview.ImageMxc,
-		ImageType:   preview.ImageType,
-		ImageSize:   preview.ImageSize,
-		ImageWidth:  preview.ImageWidth,
-		ImageHeight: preview.ImageHeight,
-	}
+	return preview, nil
 }
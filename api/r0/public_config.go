@@ -7,8 +7,21 @@ import (
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 )
 
+type thumbnailPresetSize struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+type thumbnailPresets struct {
+	Sizes         []thumbnailPresetSize `json:"sizes"`
+	Methods       []string              `json:"methods"`
+	DynamicSizing bool                  `json:"dynamic_sizing"`
+	Animated      bool                  `json:"animated"`
+}
+
 type PublicConfigResponse struct {
-	UploadMaxSize int64 `json:"m.upload.size,omitempty"`
+	UploadMaxSize int64             `json:"m.upload.size,omitempty"`
+	Thumbnails    *thumbnailPresets `json:"io.t2bot.thumbnails,omitempty"`
 }
 
 func PublicConfig(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
@@ -21,7 +34,21 @@ func PublicConfig(r *http.Request, rctx rcontext.RequestContext, user api.UserIn
 		uploadSize = 0 // invokes the omitEmpty
 	}
 
+	var thumbnails *thumbnailPresets
+	if len(rctx.Config.Thumbnails.Sizes) > 0 {
+		thumbnails = &thumbnailPresets{
+			Sizes:         make([]thumbnailPresetSize, 0),
+			Methods:       []string{"crop", "scale"},
+			DynamicSizing: rctx.Config.Thumbnails.DynamicSizing,
+			Animated:      rctx.Config.Thumbnails.AllowAnimated,
+		}
+		for _, size := range rctx.Config.Thumbnails.Sizes {
+			thumbnails.Sizes = append(thumbnails.Sizes, thumbnailPresetSize{Width: size.Width, Height: size.Height})
+		}
+	}
+
 	return &PublicConfigResponse{
 		UploadMaxSize: uploadSize,
+		Thumbnails:    thumbnails,
 	}
 }
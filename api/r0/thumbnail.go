@@ -1,7 +1,9 @@
 package r0
 
 import (
-	"github.com/getsentry/sentry-go"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"strconv"
 
@@ -10,7 +12,12 @@ import (
 	"github.com/turt2live/matrix-media-repo/api"
 	"github.com/turt2live/matrix-media-repo/common"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/download_controller"
 	"github.com/turt2live/matrix-media-repo/controllers/thumbnail_controller"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
 )
 
 func ThumbnailMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
@@ -20,6 +27,11 @@ func ThumbnailMedia(r *http.Request, rctx rcontext.RequestContext, user api.User
 	mediaId := params["mediaId"]
 	allowRemote := r.URL.Query().Get("allow_remote")
 
+	server, err := util.CanonicalServerName(server)
+	if err != nil {
+		return api.BadRequest("Invalid server name")
+	}
+
 	downloadRemote := true
 	if allowRemote != "" {
 		parsedFlag, err := strconv.ParseBool(allowRemote)
@@ -35,6 +47,28 @@ func ThumbnailMedia(r *http.Request, rctx rcontext.RequestContext, user api.User
 		"allowRemote": downloadRemote,
 	})
 
+	if rctx.Config.Downloads.RequireAuth && user.UserId == "" {
+		// Signed links allow the media to be thumbnailed without authentication too
+		if !download_controller.IsDownloadTokenValid(server, mediaId, r.URL.Query().Get("io.t2bot.download_token"), rctx) {
+			rctx.Log.Warn("Rejecting unauthenticated request: downloads require authentication")
+			if user.AccessToken == "" {
+				return api.MissingToken()
+			}
+			return api.AuthFailed()
+		}
+		rctx.Log.Info("Allowing unauthenticated thumbnail with a valid download token")
+	}
+
+	if !download_controller.IsRefererAllowed(r.Header.Get("Referer"), rctx) {
+		rctx.Log.Warn("Rejecting request from disallowed referer: " + r.Header.Get("Referer"))
+		return api.Forbidden("Media cannot be embedded on this site")
+	}
+
+	if !download_controller.IsCountryAllowed(r.RemoteAddr, rctx) {
+		rctx.Log.Warn("Rejecting request from disallowed country")
+		return api.Forbidden("Media is not available in your region")
+	}
+
 	widthStr := r.URL.Query().Get("width")
 	heightStr := r.URL.Query().Get("height")
 	method := r.URL.Query().Get("method")
@@ -86,23 +120,79 @@ func ThumbnailMedia(r *http.Request, rctx rcontext.RequestContext, user api.User
 	if width <= 0 || height <= 0 {
 		return api.BadRequest("Width and height must be greater than zero")
 	}
+	minDimension := rctx.Config.Thumbnails.MinRequestDimension
+	maxDimension := rctx.Config.Thumbnails.MaxRequestDimension
+	if width < minDimension || height < minDimension {
+		return api.BadRequest(fmt.Sprintf("Width and height must be at least %d", minDimension))
+	}
+	if maxDimension > 0 && (width > maxDimension || height > maxDimension) {
+		return api.BadRequest(fmt.Sprintf("Width and height must be at most %d", maxDimension))
+	}
 
-	streamedThumbnail, err := thumbnail_controller.GetThumbnail(server, mediaId, width, height, animated, method, downloadRemote, rctx)
+	var streamedThumbnail *types.StreamedThumbnail
+	if r.Method == http.MethodHead {
+		streamedThumbnail, err = thumbnail_controller.GetThumbnailHeaders(server, mediaId, width, height, animated, method, rctx)
+	} else {
+		streamedThumbnail, err = thumbnail_controller.GetThumbnail(server, mediaId, width, height, animated, method, downloadRemote, rctx)
+	}
 	if err != nil {
 		if err == common.ErrMediaNotFound {
 			return api.NotFoundError()
 		} else if err == common.ErrMediaTooLarge {
 			return api.RequestTooLarge()
+		} else if err == common.ErrStorageFull {
+			return api.StorageFull()
+		} else if err == common.ErrMediaQuarantined {
+			return api.NotFoundError() // We lie for security
+		} else if err == common.ErrThumbnailQueueTimeout {
+			return api.RateLimitReached()
+		} else if err == common.ErrThumbnailsDisabled {
+			return api.BadRequest("Thumbnails are disabled for this type of media")
+		} else if err == common.ErrMediaNotThumbnailable {
+			return api.BadRequest("This media cannot be thumbnailed")
+		} else if err == common.ErrDatabaseUnavailable {
+			return api.ServiceUnavailable("The media repo is temporarily unavailable. Please try again later.")
+		}
+		return api.InternalServerError("Unexpected Error").WithCause(err, rctx)
+	}
+
+	var data io.ReadCloser = streamedThumbnail.Stream
+	if streamedThumbnail.Thumbnail.Animated && r.Header.Get("Range") != "" && r.Method != http.MethodHead {
+		// Animated thumbnails can be several megabytes, so serve the requested range from the datastore
+		seekable, _, err := datastore.DownloadSeekableStream(rctx, streamedThumbnail.Thumbnail.DatastoreId, streamedThumbnail.Thumbnail.Location)
+		if err != nil {
+			rctx.Log.Warn("Failed to open seekable stream for thumbnail, serving it whole: " + err.Error())
+		} else {
+			cleanup.DumpAndCloseStream(streamedThumbnail.Stream)
+			data = seekable
 		}
-		rctx.Log.Error("Unexpected error locating media: " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("Unexpected Error")
+	}
+
+	attrs := getMediaAttributes(server, mediaId, rctx)
+	targetDisposition := ""
+	if isForcedAttachment(attrs) {
+		targetDisposition = "attachment"
 	}
 
 	return &DownloadMediaResponse{
-		ContentType: streamedThumbnail.Thumbnail.ContentType,
-		SizeBytes:   streamedThumbnail.Thumbnail.SizeBytes,
-		Data:        streamedThumbnail.Stream,
-		Filename:    "thumbnail.png",
+		ContentType:       streamedThumbnail.Thumbnail.ContentType,
+		SizeBytes:         streamedThumbnail.Thumbnail.SizeBytes,
+		Data:              data,
+		Filename:          thumbnailFilename(streamedThumbnail.Thumbnail.ContentType),
+		TargetDisposition: targetDisposition,
+		LastModifiedTs:    streamedThumbnail.Thumbnail.CreationTs,
+		CacheControl:      getCacheControl(streamedThumbnail.Thumbnail.ContentType, attrs, rctx),
+		ServeRanges:       streamedThumbnail.Thumbnail.Animated,
+		Etag:              streamedThumbnail.Thumbnail.Sha256Hash,
+	}
+}
+
+// thumbnailFilename names the thumbnail after its own content type, which is not always PNG: it may be
+// in the format of the original, or be the original itself.
+func thumbnailFilename(contentType string) string {
+	ext := ""
+	if exts, err := mime.ExtensionsByType(contentType); err == nil && len(exts) > 0 {
+		ext = exts[0]
 	}
+	return "thumbnail" + ext
 }
@@ -0,0 +1,66 @@
+package r0
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+)
+
+func testRequestContext() rcontext.RequestContext {
+	return rcontext.RequestContext{
+		Context: context.Background(),
+		Log:     logrus.NewEntry(logrus.New()),
+		Config:  config.NewDefaultDomainConfig(),
+	}
+}
+
+func TestThumbnailDimensionBounds(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		message string
+	}{
+		{"missing width", "?height=32", "Width and height are required"},
+		{"missing height", "?width=32", "Width and height are required"},
+		{"zero width", "?width=0&height=32", "Width and height must be greater than zero"},
+		{"zero height", "?width=32&height=0", "Width and height must be greater than zero"},
+		{"negative width", "?width=-32&height=32", "Width and height must be greater than zero"},
+		{"negative height", "?width=32&height=-1", "Width and height must be greater than zero"},
+		{"below minimum", "?width=4&height=32", "Width and height must be at least 8"},
+		{"width over maximum", "?width=10001&height=32", "Width and height must be at most 10000"},
+		{"height over maximum", "?width=32&height=99999", "Width and height must be at most 10000"},
+		{"non-numeric width", "?width=abc&height=32", "Width does not appear to be an integer"},
+		{"non-numeric height", "?width=32&height=3.5", "Height does not appear to be an integer"},
+		{"overflowing width", "?width=99999999999999999999&height=32", "Width does not appear to be an integer"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testRequestContext()
+			ctx.Config.Thumbnails.MinRequestDimension = 8
+			ctx.Config.Thumbnails.MaxRequestDimension = 10000
+
+			r := httptest.NewRequest("GET", "/_matrix/media/v3/thumbnail/example.org/abc123"+tt.query, nil)
+			r = mux.SetURLVars(r, map[string]string{"server": "example.org", "mediaId": "abc123"})
+
+			res := ThumbnailMedia(r, ctx, api.UserInfo{})
+			errRes, ok := res.(*api.ErrorResponse)
+			if !ok {
+				t.Fatalf("expected an error response, got %T", res)
+			}
+			if errRes.InternalCode != common.ErrCodeBadRequest {
+				t.Errorf("expected %s, got %s", common.ErrCodeBadRequest, errRes.InternalCode)
+			}
+			if errRes.Message != tt.message {
+				t.Errorf("expected message %q, got %q", tt.message, errRes.Message)
+			}
+		})
+	}
+}
@@ -1,19 +1,27 @@
 package r0
 
 import (
+	"fmt"
 	"github.com/getsentry/sentry-go"
 	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"path/filepath"
+	"strconv"
 
 	"github.com/sirupsen/logrus"
 	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/api/auth_cache"
 	"github.com/turt2live/matrix-media-repo/common"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/controllers/info_controller"
+	"github.com/turt2live/matrix-media-repo/controllers/post_upload_controller"
 	"github.com/turt2live/matrix-media-repo/controllers/upload_controller"
 	"github.com/turt2live/matrix-media-repo/quota"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
 	"github.com/turt2live/matrix-media-repo/util/cleanup"
 )
 
@@ -35,44 +43,315 @@ func UploadMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInf
 		contentType = "application/octet-stream" // binary
 	}
 
-	if upload_controller.IsRequestTooLarge(r.ContentLength, r.Header.Get("Content-Length"), rctx) {
+	var body io.ReadCloser = r.Body
+	roomId := r.URL.Query().Get("io.t2bot.room_id")
+	var contentLength int64
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "multipart/form-data" {
+		// The size limits are enforced on the file part as it is read instead of on the whole body
+		upload, err := readMultipartUpload(r, rctx)
+		if err != nil {
+			io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+			return api.BadRequest("Invalid multipart upload: " + err.Error())
+		}
+		body = upload.File
+		contentLength = -1 // unknown
+		contentType = "application/octet-stream"
+		if upload.ContentType != "" {
+			contentType = upload.ContentType
+		}
+		if upload.Filename != "" {
+			filename = upload.Filename
+		}
+		if upload.RoomId != "" {
+			roomId = upload.RoomId
+		}
+		rctx = rctx.LogWithFields(logrus.Fields{
+			"multipart": true,
+			"filename":  filename,
+		})
+	} else {
+		if upload_controller.IsRequestTooLarge(r.ContentLength, r.Header.Get("Content-Length"), rctx) {
+			io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+			return api.RequestTooLarge()
+		}
+
+		if upload_controller.IsRequestTooSmall(r.ContentLength, r.Header.Get("Content-Length"), rctx) {
+			io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+			return api.RequestTooSmall()
+		}
+
+		contentLength = upload_controller.EstimateContentLength(r.ContentLength, r.Header.Get("Content-Length"))
+	}
+
+	if rctx.Config.Uploads.RejectEmpty {
+		var isEmpty bool
+		var err error
+		isEmpty, body, err = upload_controller.IsEmptyUpload(contentLength, body)
+		if err != nil {
+			io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+			// Multipart uploads enforce the size limits as the file is read
+			if err == common.ErrMediaTooLarge {
+				return api.RequestTooLarge()
+			} else if err == common.ErrMediaTooSmall {
+				return api.RequestTooSmall()
+			}
+			return api.InternalServerError("Unexpected Error").WithCause(err, rctx)
+		}
+		if isEmpty {
+			io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+			return api.BadRequest("Empty uploads are not permitted")
+		}
+	}
+
+	if upload_controller.IsStorageFull() {
 		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
-		return api.RequestTooLarge()
+		rctx.Log.Warn("Rejecting upload: the storage limit has been reached")
+		return api.StorageFull()
 	}
 
-	if upload_controller.IsRequestTooSmall(r.ContentLength, r.Header.Get("Content-Length"), rctx) {
+	releaseSlot, acquired := upload_controller.AcquireUploadSlot(user.UserId, rctx)
+	if !acquired {
 		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
-		return api.RequestTooSmall()
+		return api.RateLimitReached()
+	}
+	defer releaseSlot()
+
+	appservice := auth_cache.GetAppservice(rctx, user.AccessToken)
+	if appservice != nil {
+		rctx = rctx.LogWithFields(logrus.Fields{
+			"appserviceId": appservice.Id,
+		})
+	}
+
+	desiredMediaId := r.URL.Query().Get("io.t2bot.media_id")
+	if desiredMediaId != "" {
+		if !upload_controller.CanChooseMediaId(user.UserId, rctx) && !upload_controller.CanAppserviceChooseMediaId(appservice, desiredMediaId) {
+			io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+			return api.Forbidden("You are not permitted to choose a media ID")
+		}
+		if !upload_controller.IsValidMediaId(desiredMediaId) {
+			io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+			return api.BadRequest("Media IDs may only contain letters and numbers")
+		}
+		rctx = rctx.LogWithFields(logrus.Fields{
+			"desiredMediaId": desiredMediaId,
+		})
+	}
+
+	maxDownloads := 0
+	if maxDownloadsStr := r.URL.Query().Get("io.t2bot.max_downloads"); maxDownloadsStr != "" {
+		limits := rctx.Config.Uploads.DownloadLimits
+		if !limits.Enabled {
+			io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+			return api.BadRequest("Download limits are not enabled on this server")
+		}
+		parsed, err := strconv.Atoi(maxDownloadsStr)
+		if err != nil || parsed <= 0 {
+			io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+			return api.BadRequest("io.t2bot.max_downloads must be a positive integer")
+		}
+		if limits.MaxDownloads > 0 && parsed > limits.MaxDownloads {
+			io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+			return api.BadRequest(fmt.Sprintf("io.t2bot.max_downloads cannot be more than %d", limits.MaxDownloads))
+		}
+		maxDownloads = parsed
+		rctx = rctx.LogWithFields(logrus.Fields{
+			"maxDownloads": maxDownloads,
+		})
+	}
+
+	thumbnailable := true
+	if thumbnailableStr := r.URL.Query().Get("io.t2bot.thumbnailable"); thumbnailableStr != "" {
+		parsed, err := strconv.ParseBool(thumbnailableStr)
+		if err != nil {
+			io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+			return api.BadRequest("io.t2bot.thumbnailable must be true or false")
+		}
+		thumbnailable = parsed
+	}
+
+	contentType, body, err := upload_controller.ResolveContentType(contentType, body, rctx)
+	if err != nil {
+		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+		if err == common.ErrUnknownContentType {
+			return api.BadRequest("Unable to determine the content type of the upload")
+		} else if err == common.ErrMediaTooLarge {
+			return api.RequestTooLarge()
+		} else if err == common.ErrMediaTooSmall {
+			return api.RequestTooSmall()
+		}
+		return api.InternalServerError("Unexpected Error").WithCause(err, rctx)
+	}
+
+	allowed, err := upload_controller.IsUserAllowedToUpload(user.UserId, contentType, filename, contentLength, rctx)
+	if err != nil {
+		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+		return api.InternalServerError("Unexpected Error").WithCause(err, rctx)
+	}
+	if !allowed {
+		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+		return api.Forbidden("You are not permitted to upload media")
+	}
+
+	if rctx.Config.Uploads.RequireRoomId && !user.IsShared {
+		if roomId == "" {
+			io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+			return api.BadRequest("A room ID is required to upload media")
+		}
+		rctx = rctx.LogWithFields(logrus.Fields{
+			"roomId": roomId,
+		})
+		inRoom, err := upload_controller.IsUserInRoom(r.Host, user.AccessToken, roomId, r.RemoteAddr, rctx)
+		if err != nil {
+			io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+			return api.InternalServerError("Unexpected Error").WithCause(err, rctx)
+		}
+		if !inRoom {
+			io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+			return api.Forbidden("You are not joined to the room")
+		}
 	}
 
 	inQuota, err := quota.IsUserWithinQuota(rctx, user.UserId)
 	if err != nil {
 		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
-		rctx.Log.Error("Unexpected error checking quota: " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("Unexpected Error")
+		return api.InternalServerError("Unexpected Error").WithCause(err, rctx)
 	}
 	if !inQuota {
 		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
 		return api.QuotaExceeded()
 	}
-
-	contentLength := upload_controller.EstimateContentLength(r.ContentLength, r.Header.Get("Content-Length"))
-
-	media, err := upload_controller.UploadMedia(r.Body, contentLength, contentType, filename, user.UserId, r.Host, rctx)
+	inQuota, err = quota.IsAppserviceWithinQuota(rctx, appservice)
 	if err != nil {
 		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+		return api.InternalServerError("Unexpected Error").WithCause(err, rctx)
+	}
+	if !inQuota {
+		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+		return api.QuotaExceeded()
+	}
+
+	var media *types.Media
+	if desiredMediaId == "" && maxDownloads == 0 {
+		media, err = upload_controller.UploadByHash(upload_controller.ParseConditionalHash(r.Header.Get("If-None-Match")), contentType, filename, user.UserId, r.Host, rctx)
+		if err != nil {
+			// Not fatal: the client can still upload the file
+			rctx.Log.Warn("Unexpected error checking for existing media: " + err.Error())
+			sentry.CaptureException(err)
+			media = nil
+		}
+		if media != nil {
+			// We don't need the contents: close the body without reading it
+			_ = r.Body.Close()
+		}
+	}
+
+	if media == nil {
+		body, err = upload_controller.ValidateImage(contentType, body, rctx)
+		if err != nil {
+			io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+			if err == common.ErrInvalidImage {
+				return api.BadRequest("The uploaded image is corrupt or invalid")
+			} else if err == common.ErrMediaTooLarge {
+				return api.RequestTooLarge()
+			}
+			return api.InternalServerError("Unexpected Error").WithCause(err, rctx)
+		}
 
-		if err == common.ErrMediaQuarantined {
+		var polyglot bool
+		polyglot, body, err = upload_controller.DetectPolyglot(contentType, body, rctx)
+		if err != nil {
+			io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+			if err == common.ErrMediaTooLarge {
+				return api.RequestTooLarge()
+			}
+			return api.InternalServerError("Unexpected Error").WithCause(err, rctx)
+		}
+		if polyglot && rctx.Config.Uploads.PolyglotDetection.Mode == "reject" {
+			io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
 			return api.BadRequest("This file is not permitted on this server")
 		}
 
-		rctx.Log.Error("Unexpected error storing media: " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("Unexpected Error")
+		digest, err := util.GetExpectedDigest(r.Header)
+		if err != nil {
+			io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+			return api.BadRequest(err.Error())
+		}
+		if digest != nil {
+			body = digest.VerifyingReader(body)
+		}
+
+		// Attributes are stored along with the media so it is never served without them
+		var attrs *types.MediaAttributes
+		if maxDownloads > 0 || polyglot {
+			attrs = &types.MediaAttributes{
+				MaxDownloads: maxDownloads,
+				// Browsers won't run files which are downloaded as attachments
+				ForceAttachment: polyglot,
+			}
+		}
+
+		media, err = upload_controller.UploadMediaWithId(body, contentLength, contentType, filename, user.UserId, r.Host, desiredMediaId, attrs, rctx)
+		if err != nil {
+			io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+
+			if err == common.ErrMediaQuarantined {
+				return api.BadRequest("This file is not permitted on this server")
+			} else if err == common.ErrMediaIdTaken {
+				return api.MediaIdTaken()
+			} else if err == util.ErrDigestMismatch {
+				return api.BadRequest("The uploaded file does not match the supplied digest")
+			} else if err == common.ErrMediaTooLarge {
+				return api.RequestTooLarge()
+			} else if err == common.ErrMediaTooSmall {
+				return api.RequestTooSmall()
+			} else if err == common.ErrStorageFull {
+				return api.StorageFull()
+			}
+
+			return api.InternalServerError("Unexpected Error").WithCause(err, rctx)
+		}
+	}
+
+	if appservice != nil {
+		err = storage.GetDatabase().GetMetadataStore(rctx).TagAppserviceMedia(media.Origin, media.MediaId, appservice.Id)
+		if err != nil {
+			rctx.Log.Warn("Failed to record media as uploaded by appservice: " + err.Error())
+			sentry.CaptureException(err)
+		}
+	}
+
+	if userAgent := util.GetUserAgentFromRequest(r); userAgent != "" {
+		err = storage.GetDatabase().GetMetadataStore(rctx).SetMediaUploadClient(media.Origin, media.MediaId, userAgent)
+		if err != nil {
+			rctx.Log.Warn("Failed to record the client which uploaded the media: " + err.Error())
+			sentry.CaptureException(err)
+		}
+	}
+
+	if !thumbnailable {
+		// Fatal: the media would otherwise be thumbnailed against the uploader's wishes. Uploading the
+		// same file again returns the same media, and marks it again.
+		err = storage.GetDatabase().GetMediaAttributesStore(rctx).UpsertThumbnailable(media.Origin, media.MediaId, false)
+		if err != nil {
+			return api.InternalServerError("Failed to mark the media as not thumbnailable").WithCause(err, rctx)
+		}
+	}
+
+	upload_controller.QueueUploadWebhook(media, rctx)
+
+	generateBlurhash := rctx.Config.Features.MSC2448Blurhash.Enabled && r.URL.Query().Get("xyz.amorgan.generate_blurhash") == "true"
+
+	// Perceptual hashes and preset thumbnails are always calculated in the background. If the caller
+	// doesn't want to wait for post-processing, the blurhash is too and will be available from the
+	// info endpoint once calculated.
+	async := r.URL.Query().Get("io.t2bot.async_processing") == "true"
+	warmThumbnails := async || rctx.Config.Thumbnails.EagerGeneration
+	if !post_upload_controller.Queue(media, generateBlurhash && async, warmThumbnails, rctx) {
+		rctx.Log.Warn("Unable to queue post-upload processing - skipping")
 	}
 
-	if rctx.Config.Features.MSC2448Blurhash.Enabled && r.URL.Query().Get("xyz.amorgan.generate_blurhash") == "true" {
+	if generateBlurhash && !async {
 		hash, err := info_controller.GetOrCalculateBlurhash(media, rctx)
 		if err != nil {
 			rctx.Log.Warn("Failed to calculate blurhash: " + err.Error())
@@ -0,0 +1,121 @@
+package r0
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+)
+
+// The maximum size of a (non-file) form field, to avoid buffering large values.
+const maxMultipartFieldBytes = 4096
+
+type multipartUpload struct {
+	Filename    string
+	ContentType string
+	RoomId      string
+	File        io.ReadCloser
+}
+
+// readMultipartUpload reads the metadata fields of a multipart/form-data upload up to the file
+// part, which is returned as a stream for the caller to read. The file part is the first part
+// with a filename, or named "file". Fields after the file part are ignored, as reading them would
+// require buffering the file. Caption fields are rejected. The file is limited to the configured upload size limits, returning
+// common.ErrMediaTooLarge or common.ErrMediaTooSmall from reads if they are exceeded.
+func readMultipartUpload(r *http.Request, ctx rcontext.RequestContext) (*multipartUpload, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	upload := &multipartUpload{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, errors.New("no file provided in multipart upload")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if part.FileName() != "" || part.FormName() == "file" {
+			if upload.Filename == "" && part.FileName() != "" {
+				upload.Filename = filepath.Base(part.FileName())
+			}
+			if upload.ContentType == "" {
+				upload.ContentType = part.Header.Get("Content-Type")
+			}
+			upload.File = ioutil.NopCloser(&sizeLimitedReader{
+				r:        part,
+				minBytes: ctx.Config.Uploads.MinSizeBytes,
+				maxBytes: ctx.Config.Uploads.MaxSizeBytes,
+			})
+			return upload, nil
+		}
+
+		b, err := ioutil.ReadAll(io.LimitReader(part, maxMultipartFieldBytes+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > maxMultipartFieldBytes {
+			return nil, errors.New("multipart field " + part.FormName() + " is too long")
+		}
+		switch part.FormName() {
+		case "filename":
+			upload.Filename = filepath.Base(string(b))
+		case "content_type":
+			upload.ContentType = string(b)
+		case "room_id", "io.t2bot.room_id":
+			upload.RoomId = string(b)
+		case "caption":
+			// Captions belong in the event which references the media, and there is nowhere to keep
+			// them on the media, so they are rejected rather than silently dropped
+			return nil, errors.New("captions are not supported - send them in the event instead")
+		}
+	}
+}
+
+// sizeLimitedReader errors once more than maxBytes have been read, or if fewer than minBytes were
+// read by the end of the stream. Limits of zero or less are not enforced. The reader checks for
+// data beyond maxBytes itself so that the error is raised even when the caller stops reading at
+// the limit.
+type sizeLimitedReader struct {
+	r        io.Reader
+	read     int64
+	minBytes int64
+	maxBytes int64
+}
+
+func (s *sizeLimitedReader) Read(p []byte) (int, error) {
+	if s.maxBytes > 0 && int64(len(p)) > s.maxBytes-s.read {
+		p = p[:s.maxBytes-s.read]
+	}
+
+	n := 0
+	var err error
+	if len(p) > 0 {
+		n, err = s.r.Read(p)
+		s.read += int64(n)
+	}
+
+	if s.maxBytes > 0 && s.read >= s.maxBytes && err == nil {
+		probe := make([]byte, 1)
+		extra, probeErr := io.ReadFull(s.r, probe)
+		if extra > 0 {
+			return n, common.ErrMediaTooLarge
+		}
+		if probeErr != io.EOF && probeErr != io.ErrUnexpectedEOF {
+			return n, probeErr
+		}
+		err = io.EOF
+	}
+
+	if err == io.EOF && s.minBytes > 0 && s.read < s.minBytes {
+		return n, common.ErrMediaTooSmall
+	}
+	return n, err
+}
@@ -0,0 +1,107 @@
+package r0
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common"
+)
+
+func emptyMultipartUpload(t *testing.T) (io.Reader, string) {
+	buf := &bytes.Buffer{}
+	writer := multipart.NewWriter(buf)
+	_, err := writer.CreateFormFile("file", "empty.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf, writer.FormDataContentType()
+}
+
+func TestEmptyUploads(t *testing.T) {
+	tests := []struct {
+		name         string
+		multipart    bool
+		chunked      bool
+		minBytes     int64
+		internalCode string
+		message      string
+	}{
+		{"zero content length", false, false, 0, common.ErrCodeBadRequest, "Empty uploads are not permitted"},
+		{"zero content length below minimum", false, false, 100, common.ErrCodeMediaTooSmall, "Body too small or not provided"},
+		{"chunked", false, true, 0, common.ErrCodeBadRequest, "Empty uploads are not permitted"},
+		{"empty multipart file", true, false, 0, common.ErrCodeBadRequest, "Empty uploads are not permitted"},
+		{"empty multipart file below minimum", true, false, 100, common.ErrCodeMediaTooSmall, "Body too small or not provided"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testRequestContext()
+			ctx.Config.Uploads.RejectEmpty = true
+			ctx.Config.Uploads.MinSizeBytes = tt.minBytes
+
+			var r *http.Request
+			if tt.multipart {
+				body, contentType := emptyMultipartUpload(t)
+				r = httptest.NewRequest("POST", "/_matrix/media/v3/upload", body)
+				r.Header.Set("Content-Type", contentType)
+			} else {
+				r = httptest.NewRequest("POST", "/_matrix/media/v3/upload", strings.NewReader(""))
+				r.Header.Set("Content-Type", "text/plain")
+				if tt.chunked {
+					r.ContentLength = -1
+				} else {
+					r.Header.Set("Content-Length", "0")
+				}
+			}
+
+			res := UploadMedia(r, ctx, api.UserInfo{UserId: "@alice:example.org"})
+			errRes, ok := res.(*api.ErrorResponse)
+			if !ok {
+				t.Fatalf("expected an error response, got %T", res)
+			}
+			if errRes.InternalCode != tt.internalCode {
+				t.Errorf("expected %s, got %s (%s)", tt.internalCode, errRes.InternalCode, errRes.Message)
+			}
+			if errRes.Message != tt.message {
+				t.Errorf("expected message %q, got %q", tt.message, errRes.Message)
+			}
+		})
+	}
+}
+
+func TestMultipartUploadWithoutFile(t *testing.T) {
+	ctx := testRequestContext()
+	ctx.Config.Uploads.RejectEmpty = true
+
+	buf := &bytes.Buffer{}
+	writer := multipart.NewWriter(buf)
+	err := writer.WriteField("filename", "empty.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/_matrix/media/v3/upload", buf)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+
+	res := UploadMedia(r, ctx, api.UserInfo{UserId: "@alice:example.org"})
+	errRes, ok := res.(*api.ErrorResponse)
+	if !ok {
+		t.Fatalf("expected an error response, got %T", res)
+	}
+	if errRes.InternalCode != common.ErrCodeBadRequest {
+		t.Errorf("expected %s, got %s (%s)", common.ErrCodeBadRequest, errRes.InternalCode, errRes.Message)
+	}
+}
@@ -1,11 +1,16 @@
 package api
 
-import "github.com/turt2live/matrix-media-repo/common"
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+)
 
 type EmptyResponse struct{}
 
 type DoNotCacheResponse struct {
 	Payload interface{}
+	Headers map[string]string
 }
 
 type HtmlResponse struct {
@@ -16,44 +21,88 @@ type ErrorResponse struct {
 	Code         string `json:"errcode"`
 	Message      string `json:"error"`
 	InternalCode string `json:"mr_errcode"`
+
+	// Cause is the internal reason for the error. It is logged, but never sent to the client.
+	Cause error `json:"-"`
+	log   *logrus.Entry
+}
+
+// WithCause attaches the internal reason for the error to the response. When the response is sent,
+// the cause is logged with the request's log fields and reported to sentry, and only the code and
+// message are sent to the client.
+func (e *ErrorResponse) WithCause(err error, ctx rcontext.RequestContext) *ErrorResponse {
+	e.Cause = err
+	e.log = ctx.Log
+	return e
+}
+
+// CauseLog returns the logger the cause should be logged with, or nil if the cause was attached
+// without a request context.
+func (e *ErrorResponse) CauseLog() *logrus.Entry {
+	return e.log
 }
 
 func InternalServerError(message string) *ErrorResponse {
-	return &ErrorResponse{common.ErrCodeUnknown, message, common.ErrCodeUnknown}
+	return &ErrorResponse{Code: common.ErrCodeUnknown, Message: message, InternalCode: common.ErrCodeUnknown}
 }
 
 func MethodNotAllowed() *ErrorResponse {
-	return &ErrorResponse{common.ErrCodeUnknown, "Method Not Allowed", common.ErrCodeMethodNotAllowed}
+	return &ErrorResponse{Code: common.ErrCodeUnknown, Message: "Method Not Allowed", InternalCode: common.ErrCodeMethodNotAllowed}
 }
 
 func RateLimitReached() *ErrorResponse {
-	return &ErrorResponse{common.ErrCodeRateLimitExceeded, "Rate Limited", common.ErrCodeRateLimitExceeded}
+	return &ErrorResponse{Code: common.ErrCodeRateLimitExceeded, Message: "Rate Limited", InternalCode: common.ErrCodeRateLimitExceeded}
 }
 
 func NotFoundError() *ErrorResponse {
-	return &ErrorResponse{common.ErrCodeNotFound, "Not found", common.ErrCodeNotFound}
+	return &ErrorResponse{Code: common.ErrCodeNotFound, Message: "Not found", InternalCode: common.ErrCodeNotFound}
 }
 
 func RequestTooLarge() *ErrorResponse {
-	return &ErrorResponse{common.ErrCodeTooLarge, "Too Large", common.ErrCodeMediaTooLarge}
+	return &ErrorResponse{Code: common.ErrCodeTooLarge, Message: "Too Large", InternalCode: common.ErrCodeMediaTooLarge}
 }
 
 func RequestTooSmall() *ErrorResponse {
-	return &ErrorResponse{common.ErrCodeUnknown, "Body too small or not provided", common.ErrCodeMediaTooSmall}
+	return &ErrorResponse{Code: common.ErrCodeUnknown, Message: "Body too small or not provided", InternalCode: common.ErrCodeMediaTooSmall}
 }
 
 func AuthFailed() *ErrorResponse {
-	return &ErrorResponse{common.ErrCodeUnknownToken, "Authentication Failed", common.ErrCodeUnknownToken}
+	return &ErrorResponse{Code: common.ErrCodeUnknownToken, Message: "Authentication Failed", InternalCode: common.ErrCodeUnknownToken}
+}
+
+func MissingToken() *ErrorResponse {
+	return &ErrorResponse{Code: common.ErrCodeMissingToken, Message: "no token provided (required)", InternalCode: common.ErrCodeMissingToken}
 }
 
 func GuestAuthFailed() *ErrorResponse {
-	return &ErrorResponse{common.ErrCodeNoGuests, "Guests cannot use this endpoint", common.ErrCodeNoGuests}
+	return &ErrorResponse{Code: common.ErrCodeNoGuests, Message: "Guests cannot use this endpoint", InternalCode: common.ErrCodeNoGuests}
 }
 
 func BadRequest(message string) *ErrorResponse {
-	return &ErrorResponse{common.ErrCodeUnknown, message, common.ErrCodeBadRequest}
+	return &ErrorResponse{Code: common.ErrCodeUnknown, Message: message, InternalCode: common.ErrCodeBadRequest}
+}
+
+func Forbidden(message string) *ErrorResponse {
+	return &ErrorResponse{Code: common.ErrCodeForbidden, Message: message, InternalCode: common.ErrCodeForbidden}
+}
+
+func MediaIdTaken() *ErrorResponse {
+	return &ErrorResponse{Code: common.ErrCodeCannotOverwrite, Message: "The requested media ID is already in use", InternalCode: common.ErrCodeCannotOverwrite}
+}
+
+func ServiceUnavailable(message string) *ErrorResponse {
+	return &ErrorResponse{Code: common.ErrCodeUnknown, Message: message, InternalCode: common.ErrCodeUnavailable}
+}
+
+// BadGateway is for failures of an upstream service the request was proxied to.
+func BadGateway(message string) *ErrorResponse {
+	return &ErrorResponse{Code: common.ErrCodeUnknown, Message: message, InternalCode: common.ErrCodeBadGateway}
+}
+
+func StorageFull() *ErrorResponse {
+	return &ErrorResponse{Code: common.ErrCodeResourceLimitExceeded, Message: "The media repo has run out of storage space", InternalCode: common.ErrCodeStorageFull}
 }
 
 func QuotaExceeded() *ErrorResponse {
-	return &ErrorResponse{common.ErrCodeForbidden, "Quota Exceeded", common.ErrCodeQuotaExceeded}
+	return &ErrorResponse{Code: common.ErrCodeForbidden, Message: "Quota Exceeded", InternalCode: common.ErrCodeQuotaExceeded}
 }
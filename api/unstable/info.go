@@ -3,7 +3,6 @@ package unstable
 import (
 	"bytes"
 	"database/sql"
-	"github.com/getsentry/sentry-go"
 	"io/ioutil"
 	"net/http"
 	"strconv"
@@ -19,6 +18,7 @@ import (
 	"github.com/turt2live/matrix-media-repo/storage"
 	"github.com/turt2live/matrix-media-repo/thumbnailing"
 	"github.com/turt2live/matrix-media-repo/thumbnailing/i"
+	"github.com/turt2live/matrix-media-repo/util"
 	"github.com/turt2live/matrix-media-repo/util/cleanup"
 	"github.com/turt2live/matrix-media-repo/util/util_byte_seeker"
 )
@@ -45,6 +45,8 @@ type MediaInfoResponse struct {
 	NumTotalSamples int                   `json:"num_total_samples,omitempty"`
 	KeySamples      [][2]float64          `json:"key_samples,omitempty"`
 	NumChannels     int                   `json:"num_channels,omitempty"`
+	UploadedBy      string                `json:"uploaded_by,omitempty"`
+	UserAgent       string                `json:"user_agent,omitempty"`
 }
 
 func MediaInfo(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
@@ -69,26 +71,32 @@ func MediaInfo(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo)
 		"allowRemote": downloadRemote,
 	})
 
+	limited, err := download_controller.IsDownloadLimited(server, mediaId, rctx)
+	if err != nil {
+		return api.InternalServerError("Unexpected Error").WithCause(err, rctx)
+	}
+	if limited {
+		return api.BadRequest("Media with a download limit cannot be inspected")
+	}
+
 	streamedMedia, err := download_controller.GetMedia(server, mediaId, downloadRemote, true, rctx)
 	if err != nil {
 		if err == common.ErrMediaNotFound {
 			return api.NotFoundError()
 		} else if err == common.ErrMediaTooLarge {
 			return api.RequestTooLarge()
+		} else if err == common.ErrStorageFull {
+			return api.StorageFull()
 		} else if err == common.ErrMediaQuarantined {
 			return api.NotFoundError() // We lie for security
 		}
-		rctx.Log.Error("Unexpected error locating media: " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("Unexpected Error")
+		return api.InternalServerError("Unexpected Error").WithCause(err, rctx)
 	}
 	defer cleanup.DumpAndCloseStream(streamedMedia.Stream)
 
 	b, err := ioutil.ReadAll(streamedMedia.Stream)
 	if err != nil {
-		rctx.Log.Error("Unexpected error processing media: " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("Unexpected Error")
+		return api.InternalServerError("Unexpected Error").WithCause(err, rctx)
 	}
 
 	response := &MediaInfoResponse{
@@ -100,6 +108,16 @@ func MediaInfo(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo)
 		},
 	}
 
+	// Details about who uploaded the media are only shown to admins
+	if user.IsShared || util.IsGlobalAdmin(user.UserId) {
+		response.UploadedBy = streamedMedia.KnownMedia.UserId
+		userAgents, err := storage.GetDatabase().GetMetadataStore(rctx).GetMediaUploadClients(streamedMedia.KnownMedia.Origin, []string{streamedMedia.KnownMedia.MediaId})
+		if err != nil {
+			return api.InternalServerError("Unexpected Error").WithCause(err, rctx)
+		}
+		response.UserAgent = userAgents[streamedMedia.KnownMedia.MediaId]
+	}
+
 	img, err := imaging.Decode(bytes.NewBuffer(b))
 	if err == nil {
 		response.Width = img.Bounds().Max.X
@@ -109,9 +127,7 @@ func MediaInfo(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo)
 	thumbsDb := storage.GetDatabase().GetThumbnailStore(rctx)
 	thumbs, err := thumbsDb.GetAllForMedia(streamedMedia.KnownMedia.Origin, streamedMedia.KnownMedia.MediaId)
 	if err != nil && err != sql.ErrNoRows {
-		rctx.Log.Error("Unexpected error locating media: " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("Unexpected Error")
+		return api.InternalServerError("Unexpected Error").WithCause(err, rctx)
 	}
 
 	if thumbs != nil && len(thumbs) > 0 {
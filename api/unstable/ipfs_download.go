@@ -1,7 +1,6 @@
 package unstable
 
 import (
-	"github.com/getsentry/sentry-go"
 	"net/http"
 
 	"github.com/gorilla/mux"
@@ -34,9 +33,7 @@ func IPFSDownload(r *http.Request, rctx rcontext.RequestContext, user api.UserIn
 
 	obj, err := ipfs_proxy.GetObject(ipfsContentId, rctx)
 	if err != nil {
-		rctx.Log.Error(err)
-		sentry.CaptureException(err)
-		return api.InternalServerError("unexpected error")
+		return api.InternalServerError("unexpected error").WithCause(err, rctx)
 	}
 
 	return &r0.DownloadMediaResponse{
@@ -1,7 +1,6 @@
 package unstable
 
 import (
-	"github.com/getsentry/sentry-go"
 	"net/http"
 	"strconv"
 
@@ -40,18 +39,26 @@ func LocalCopy(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo)
 
 	// TODO: There's a lot of room for improvement here. Instead of re-uploading media, we should just update the DB.
 
+	limited, err := download_controller.IsDownloadLimited(server, mediaId, rctx)
+	if err != nil {
+		return api.InternalServerError("Unexpected Error").WithCause(err, rctx)
+	}
+	if limited {
+		return api.BadRequest("Media with a download limit cannot be copied")
+	}
+
 	streamedMedia, err := download_controller.GetMedia(server, mediaId, downloadRemote, true, rctx)
 	if err != nil {
 		if err == common.ErrMediaNotFound {
 			return api.NotFoundError()
 		} else if err == common.ErrMediaTooLarge {
 			return api.RequestTooLarge()
+		} else if err == common.ErrStorageFull {
+			return api.StorageFull()
 		} else if err == common.ErrMediaQuarantined {
 			return api.NotFoundError() // We lie for security
 		}
-		rctx.Log.Error("Unexpected error locating media: " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("Unexpected Error")
+		return api.InternalServerError("Unexpected Error").WithCause(err, rctx)
 	}
 	defer cleanup.DumpAndCloseStream(streamedMedia.Stream)
 
@@ -61,10 +68,10 @@ func LocalCopy(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo)
 	}
 
 	newMedia, err := upload_controller.UploadMedia(streamedMedia.Stream, streamedMedia.KnownMedia.SizeBytes, streamedMedia.KnownMedia.ContentType, streamedMedia.KnownMedia.UploadName, user.UserId, r.Host, rctx)
-	if err != nil {
-		rctx.Log.Error("Unexpected error storing media: " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("Unexpected Error")
+	if err == common.ErrStorageFull {
+		return api.StorageFull()
+	} else if err != nil {
+		return api.InternalServerError("Unexpected Error").WithCause(err, rctx)
 	}
 
 	return &r0.MediaUploadedResponse{ContentUri: newMedia.MxcUri()}
@@ -0,0 +1,77 @@
+package unstable
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/download_controller"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+type ShareLinkResponse struct {
+	Url       string `json:"url"`
+	ExpiresTs int64  `json:"expires_ts"`
+}
+
+// CreateShareLink mints a signed link which allows the media to be downloaded without
+// authentication for a limited time. Users may only create links for media they uploaded.
+func CreateShareLink(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	server := params["server"]
+	mediaId := params["mediaId"]
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"mediaId": mediaId,
+		"server":  server,
+	})
+
+	conf := rctx.Config.Downloads.SignedUrls
+	if !conf.Enabled || conf.Secret == "" {
+		return api.NotFoundError()
+	}
+
+	lifetimeSeconds := conf.MaxLifetimeSeconds
+	if lifetimeStr := r.URL.Query().Get("lifetime_seconds"); lifetimeStr != "" {
+		parsed, err := strconv.ParseInt(lifetimeStr, 10, 64)
+		if err != nil || parsed <= 0 {
+			return api.BadRequest("lifetime_seconds must be a positive integer")
+		}
+		if parsed > conf.MaxLifetimeSeconds {
+			return api.BadRequest("lifetime_seconds is longer than the server allows")
+		}
+		lifetimeSeconds = parsed
+	}
+
+	media, err := download_controller.FindMediaRecord(server, mediaId, false, rctx)
+	if err != nil {
+		if err == common.ErrMediaNotFound {
+			return api.NotFoundError()
+		}
+		return api.InternalServerError("Unexpected Error").WithCause(err, rctx)
+	}
+	if media.Quarantined {
+		return api.NotFoundError() // We lie for security
+	}
+
+	isAdmin := util.IsGlobalAdmin(user.UserId) || user.IsShared
+	if !isAdmin && media.UserId != user.UserId {
+		return api.Forbidden("You may only share media you uploaded")
+	}
+
+	expiresTs := util.NowMillis() + lifetimeSeconds*1000
+	token, err := download_controller.CreateDownloadToken(media.Origin, media.MediaId, expiresTs, rctx)
+	if err != nil {
+		return api.InternalServerError("Unexpected Error").WithCause(err, rctx)
+	}
+
+	return &api.DoNotCacheResponse{Payload: &ShareLinkResponse{
+		Url:       "https://" + r.Host + "/_matrix/media/r0/download/" + media.Origin + "/" + media.MediaId + "?io.t2bot.download_token=" + token,
+		ExpiresTs: expiresTs,
+	}}
+}
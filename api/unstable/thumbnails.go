@@ -0,0 +1,111 @@
+package unstable
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/download_controller"
+	"github.com/turt2live/matrix-media-repo/controllers/thumbnail_controller"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/thumbnailing"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+type thumbnailSetEntry struct {
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Method      string `json:"method"`
+	Animated    bool   `json:"animated"`
+	ContentType string `json:"content_type,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	Ready       bool   `json:"ready"`
+}
+
+type ThumbnailSetResponse struct {
+	ContentUri string               `json:"content_uri"`
+	Thumbnails []*thumbnailSetEntry `json:"thumbnails"`
+}
+
+// ListThumbnails lists the thumbnails which have already been generated for the media, followed
+// by the configured sizes which can be requested but have not been generated yet. Remote media is
+// never downloaded by this endpoint.
+func ListThumbnails(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	server := params["server"]
+	mediaId := params["mediaId"]
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"mediaId": mediaId,
+		"server":  server,
+	})
+
+	media, err := download_controller.FindMediaRecord(server, mediaId, false, rctx)
+	if err != nil {
+		if err == common.ErrMediaNotFound {
+			return api.NotFoundError()
+		}
+		return api.InternalServerError("Unexpected Error").WithCause(err, rctx)
+	}
+	if media.Quarantined {
+		return api.NotFoundError() // We lie for security
+	}
+
+	response := &ThumbnailSetResponse{
+		ContentUri: media.MxcUri(),
+		Thumbnails: make([]*thumbnailSetEntry, 0),
+	}
+
+	contentType := util.FixContentType(media.ContentType)
+	if !thumbnailing.IsSupported(contentType) || !thumbnail_controller.IsThumbnailingEnabled(contentType, rctx) {
+		return response
+	}
+
+	thumbs, err := storage.GetDatabase().GetThumbnailStore(rctx).GetAllForMedia(media.Origin, media.MediaId)
+	if err != nil && err != sql.ErrNoRows {
+		return api.InternalServerError("Unexpected Error").WithCause(err, rctx)
+	}
+
+	ready := make(map[string]bool)
+	for _, thumb := range thumbs {
+		if thumb.SourceSha256Hash != "" && thumb.SourceSha256Hash != media.Sha256Hash {
+			continue // stale thumbnail of a previous version of the media
+		}
+		ready[thumbnailSetKey(thumb.Width, thumb.Height, thumb.Method, thumb.Animated)] = true
+		response.Thumbnails = append(response.Thumbnails, &thumbnailSetEntry{
+			Width:       thumb.Width,
+			Height:      thumb.Height,
+			Method:      thumb.Method,
+			Animated:    thumb.Animated,
+			ContentType: thumb.ContentType,
+			Size:        thumb.SizeBytes,
+			Ready:       true,
+		})
+	}
+
+	for _, size := range rctx.Config.Thumbnails.Sizes {
+		for _, method := range []string{"crop", "scale"} {
+			if ready[thumbnailSetKey(size.Width, size.Height, method, false)] {
+				continue
+			}
+			response.Thumbnails = append(response.Thumbnails, &thumbnailSetEntry{
+				Width:  size.Width,
+				Height: size.Height,
+				Method: method,
+				Ready:  false,
+			})
+		}
+	}
+
+	return response
+}
+
+func thumbnailSetKey(width int, height int, method string, animated bool) string {
+	return fmt.Sprintf("%dx%d-%s-%t", width, height, method, animated)
+}
@@ -0,0 +1,73 @@
+package webserver
+
+import (
+	"github.com/turt2live/matrix-media-repo/common/config"
+)
+
+// concurrencyLimiter caps the number of requests being handled at once. Each limit is a semaphore,
+// and a nil semaphore is unlimited.
+type concurrencyLimiter struct {
+	requests  chan bool
+	downloads chan bool
+	uploads   chan bool
+}
+
+var concurrency = &concurrencyLimiter{}
+
+func newConcurrencyLimiter() *concurrencyLimiter {
+	conf := config.Get().ConcurrencyLimits
+	return &concurrencyLimiter{
+		requests:  newSemaphore(conf.MaxRequests),
+		downloads: newSemaphore(conf.MaxDownloads),
+		uploads:   newSemaphore(conf.MaxUploads),
+	}
+}
+
+func newSemaphore(size int) chan bool {
+	if size <= 0 {
+		return nil
+	}
+	return make(chan bool, size)
+}
+
+func tryAcquire(sem chan bool) bool {
+	if sem == nil {
+		return true
+	}
+	select {
+	case sem <- true:
+		return true
+	default:
+		return false
+	}
+}
+
+func release(sem chan bool) {
+	if sem != nil {
+		<-sem
+	}
+}
+
+// acquire takes a slot for the request, returning false if a limit has been reached. When true,
+// the returned function must be called once the request has finished.
+func (l *concurrencyLimiter) acquire(action string) (func(), bool) {
+	var specific chan bool
+	switch action {
+	case "download", "thumbnail":
+		specific = l.downloads
+	case "upload":
+		specific = l.uploads
+	}
+
+	if !tryAcquire(l.requests) {
+		return nil, false
+	}
+	if !tryAcquire(specific) {
+		release(l.requests)
+		return nil, false
+	}
+	return func() {
+		release(specific)
+		release(l.requests)
+	}, true
+}
@@ -0,0 +1,272 @@
+package webserver
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/common/version"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// The prefixes of the routes which are described. Each prefix is followed by an API version.
+var openApiPathPrefixes = []string{"/_matrix/media/", "/_matrix/client/"}
+
+// Actions which are part of the Matrix spec, and so are left out of the description.
+var specActions = []string{"upload", "download", "thumbnail", "url_preview", "config", "get_version", "logout", "logout_all"}
+
+type openApiQueryParam struct {
+	name        string
+	schemaType  string
+	repeated    bool
+	description string
+}
+
+var pageParams = []openApiQueryParam{
+	{"limit", "integer", false, "The maximum number of entries to return, capped at adminApi.maxPageSize"},
+	{"from", "string", false, "The X-Next-Batch header of the previous page"},
+}
+var beforeTsParam = openApiQueryParam{"before_ts", "integer", false, "Only include media created before this timestamp, in milliseconds"}
+var dryRunParam = openApiQueryParam{"dry_run", "boolean", false, "If true, report what would change without changing anything"}
+var allowRemoteParam = openApiQueryParam{"allow_remote", "boolean", false, "If false, remote media which isn't cached is not downloaded"}
+
+// The query parameters of each action.
+var openApiQueryParams = map[string][]openApiQueryParam{
+	"purge_remote_media": {beforeTsParam},
+	"purge_individual_media": {
+		{"hard", "boolean", false, "If true, delete the media outright rather than soft deleting it"},
+	},
+	"purge_old_media": {
+		beforeTsParam,
+		{"include_local", "boolean", false, "If true, local media is purged too"},
+	},
+	"purge_user_media":             {beforeTsParam},
+	"purge_room_media":             {beforeTsParam},
+	"purge_domain_media":           {beforeTsParam},
+	"purge_expired_server_media":   {dryRunParam},
+	"get_storage_estimate":         {beforeTsParam},
+	"datastore_transfer":           {beforeTsParam},
+	"resniff_content_type":         {dryRunParam},
+	"resniff_server_content_types": {dryRunParam},
+	"user_usage": append([]openApiQueryParam{
+		{"user_id", "string", true, "The users to report on. All users are listed, a page at a time, if not given"},
+	}, pageParams...),
+	"uploads_usage": append([]openApiQueryParam{
+		{"mxc", "string", true, "The media to report on. All media is listed, a page at a time, if not given"},
+	}, pageParams...),
+	"popular_media":                    pageParams,
+	"list_media_reports":               append([]openApiQueryParam{{"server_name", "string", false, "Only list reports of media from this server"}}, pageParams...),
+	"list_all_background_tasks":        pageParams,
+	"list_unfinished_background_tasks": pageParams,
+	"get_recent_logs":                  pageParams[:1],
+	"download_media_archive": {
+		{"mxc", "string", true, "The media to include"},
+		{"user_id", "string", false, "Include the media uploaded by this user"},
+		{"include_quarantined", "boolean", false, "If true, quarantined media is included"},
+		{"from", "string", false, "The X-Next-Batch header of the previous archive of the user's media"},
+	},
+	"similar_media": {
+		{"mxc", "string", false, "The media to find similar images to"},
+		{"hash", "string", false, "The perceptual hash to find similar images to, if mxc is not given"},
+		{"max_distance", "integer", false, "The maximum difference between the perceptual hashes"},
+	},
+	"export_user_data": {
+		{"include_data", "boolean", false, "If false, only the metadata is exported"},
+		{"s3_urls", "boolean", false, "If false, media is always exported through the media repo rather than as S3 URLs"},
+	},
+	"export_server_data": {
+		{"include_data", "boolean", false, "If false, only the metadata is exported"},
+		{"s3_urls", "boolean", false, "If false, media is always exported through the media repo rather than as S3 URLs"},
+	},
+	"identicon": {
+		{"width", "integer", false, "The width of the identicon"},
+		{"height", "integer", false, "The height of the identicon"},
+	},
+	"url_preview_thumbnail": {
+		{"url", "string", false, "The URL to preview"},
+		{"ts", "integer", false, "The preferred point in time to preview the URL at, in milliseconds"},
+	},
+	"local_copy":        {allowRemoteParam},
+	"info":              {allowRemoteParam},
+	"create_share_link": {{"lifetime_seconds", "integer", false, "How long the link works for"}},
+	"ipfs_download": {
+		{"org.matrix.msc2702.asAttachment", "boolean", false, "If true, the media is served as an attachment"},
+	},
+}
+
+var pathParamRegex = regexp.MustCompile(`{([^}:]+)(?::([^}]+))?}`)
+
+var openApiDocument map[string]interface{}
+
+func GetOpenApiDocument(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	return &api.DoNotCacheResponse{Payload: openApiDocument}
+}
+
+// openApiPath is a path which is served under one of the prefixes, for some of the API versions.
+type openApiPath struct {
+	prefix     string
+	versions   []string
+	operations map[string]interface{}
+}
+
+// buildOpenApiDocument describes the non-standard routes as an OpenAPI 3 document. The API version is a
+// variable of the server URL, as every version serves the same routes.
+func buildOpenApiDocument(routes []definedRoute, versions []string) map[string]interface{} {
+	// Match the longer versions first, as some versions are prefixes of others
+	sortedVersions := append([]string{}, versions...)
+	sort.Slice(sortedVersions, func(i int, j int) bool {
+		return len(sortedVersions[i]) > len(sortedVersions[j])
+	})
+
+	paths := make(map[string]*openApiPath)
+	operationIds := make(map[string]int)
+	for _, def := range routes {
+		if util.ArrayContains(specActions, def.route.handler.action) {
+			continue
+		}
+
+		prefix, apiVersion, subPath := splitOpenApiPath(def.path, sortedVersions)
+		if prefix == "" {
+			continue
+		}
+
+		path := pathParamRegex.ReplaceAllString(subPath, "{$1}")
+		p, ok := paths[path]
+		if !ok {
+			p = &openApiPath{prefix: prefix, versions: make([]string, 0), operations: make(map[string]interface{})}
+			paths[path] = p
+		}
+		if !util.ArrayContains(p.versions, apiVersion) {
+			p.versions = append(p.versions, apiVersion)
+		}
+
+		method := strings.ToLower(def.route.method)
+		if _, ok := p.operations[method]; ok {
+			continue // already described for another version
+		}
+
+		// Handlers can serve several paths, though operation IDs must be unique
+		operationId := def.route.handler.action
+		operationIds[operationId]++
+		if n := operationIds[operationId]; n > 1 {
+			operationId = operationId + "_" + strconv.Itoa(n)
+		}
+
+		tag := "unstable"
+		if strings.Contains(def.path, "/admin/") {
+			tag = "admin"
+		}
+
+		p.operations[method] = map[string]interface{}{
+			"operationId": operationId,
+			"tags":        []string{tag},
+			"parameters":  getOpenApiParameters(def),
+			"responses": map[string]interface{}{
+				"default": map[string]interface{}{
+					"description": "A JSON object, or a Matrix error response",
+				},
+			},
+		}
+	}
+
+	defaultServer := openApiServer(openApiPathPrefixes[0], versions)
+	pathItems := make(map[string]interface{})
+	for path, p := range paths {
+		item := make(map[string]interface{})
+		for method, operation := range p.operations {
+			item[method] = operation
+		}
+		if p.prefix != openApiPathPrefixes[0] || len(p.versions) != len(versions) {
+			item["servers"] = []map[string]interface{}{openApiServer(p.prefix, p.versions)}
+		}
+		pathItems[path] = item
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "matrix-media-repo",
+			"version": version.Version,
+		},
+		"servers": []map[string]interface{}{defaultServer},
+		"paths":   pathItems,
+		"components": map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"accessToken": map[string]interface{}{
+					"type":   "http",
+					"scheme": "bearer",
+				},
+			},
+		},
+		"security": []map[string]interface{}{
+			{"accessToken": []string{}},
+		},
+	}
+}
+
+// splitOpenApiPath splits a route's path into its prefix, API version, and the path within that version.
+// Returns empty strings if the route isn't under a described prefix.
+func splitOpenApiPath(path string, versions []string) (string, string, string) {
+	for _, prefix := range openApiPathPrefixes {
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		for _, v := range versions {
+			if strings.HasPrefix(path, prefix+v+"/") {
+				return prefix, v, path[len(prefix)+len(v):]
+			}
+		}
+	}
+	return "", "", ""
+}
+
+func openApiServer(prefix string, versions []string) map[string]interface{} {
+	defaultVersion := versions[0]
+	if util.ArrayContains(versions, "unstable") {
+		defaultVersion = "unstable"
+	}
+	return map[string]interface{}{
+		"url": prefix + "{version}",
+		"variables": map[string]interface{}{
+			"version": map[string]interface{}{
+				"enum":    versions,
+				"default": defaultVersion,
+			},
+		},
+	}
+}
+
+func getOpenApiParameters(def definedRoute) []map[string]interface{} {
+	params := make([]map[string]interface{}, 0)
+	for _, match := range pathParamRegex.FindAllStringSubmatch(def.path, -1) {
+		schema := map[string]interface{}{"type": "string"}
+		if match[2] != "" {
+			schema["pattern"] = "^" + match[2] + "$"
+		}
+		params = append(params, map[string]interface{}{
+			"name":     match[1],
+			"in":       "path",
+			"required": true,
+			"schema":   schema,
+		})
+	}
+
+	for _, q := range openApiQueryParams[def.route.handler.action] {
+		schema := map[string]interface{}{"type": q.schemaType}
+		if q.repeated {
+			schema = map[string]interface{}{"type": "array", "items": schema}
+		}
+		params = append(params, map[string]interface{}{
+			"name":        q.name,
+			"in":          "query",
+			"required":    false,
+			"description": q.description,
+			"schema":      schema,
+		})
+	}
+	return params
+}
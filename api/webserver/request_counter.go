@@ -1,14 +1,16 @@
 package webserver
 
-import "strconv"
+import (
+	"strconv"
+	"sync/atomic"
+)
 
 type requestCounter struct {
-	lastId uint64
+	nextId uint64
 }
 
 func (c *requestCounter) GetNextId() string {
-	strId := strconv.FormatUint(c.lastId, 10)
-	c.lastId = c.lastId + 1
-
-	return "REQ-" + strId
+	// Requests are served concurrently, so the counter must be incremented atomically
+	id := atomic.AddUint64(&c.nextId, 1) - 1
+	return "REQ-" + strconv.FormatUint(id, 10)
 }
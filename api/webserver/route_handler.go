@@ -13,11 +13,11 @@ import (
 	"mime"
 	"net"
 	"net/http"
-	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/alioygur/is"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sebest/xff"
 	"github.com/sirupsen/logrus"
@@ -27,9 +27,23 @@ import (
 	"github.com/turt2live/matrix-media-repo/common/config"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/metrics"
+	"github.com/turt2live/matrix-media-repo/storage"
 	"github.com/turt2live/matrix-media-repo/util"
 )
 
+// The number of characters of a body to log when general.logBodies.maxLength isn't set.
+const defaultLogBodyMaxLength = 4096
+
+// Actions which can be handled while the database is unavailable, such as by serving from the caches.
+var servableWithoutDatabase = []string{"download", "thumbnail", "identicon", "config", "get_version", "healthz", "options_request"}
+
+// Media actions which can require authentication, and so advertise how to authenticate when a token is missing.
+var authenticatedMediaActions = []string{"download", "thumbnail"}
+
+// mediaBodyActions are the actions which receive media (or archives of it) as the request body,
+// which is never logged.
+var mediaBodyActions = []string{"upload", "start_import", "append_to_import"}
+
 type handler struct {
 	h          func(r *http.Request, ctx rcontext.RequestContext) interface{}
 	action     string
@@ -37,6 +51,12 @@ type handler struct {
 	ignoreHost bool
 }
 
+// isAuthenticatedMediaRoute returns true for the client-server API media routes, which always
+// require an access token.
+func isAuthenticatedMediaRoute(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/_matrix/client/v1/media/")
+}
+
 func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	isUsingForwardedHost := false
 	if r.Header.Get("X-Forwarded-Host") != "" && config.Get().General.UseForwardedHost {
@@ -74,22 +94,83 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		"requestId":          h.reqCounter.GetNextId(),
 		"remoteAddr":         r.RemoteAddr,
 	})
-	contextLog.Info("Received request")
+
+	// In slow request mode, only requests which take too long are logged
+	startTime := time.Now()
+	timings := rcontext.NewTimings()
+	cw := &countingResponseWriter{ResponseWriter: w}
+	w = cw
+	slowRequests := config.Get().General.SlowRequests
+	logRequest := contextLog.Info
+	if slowRequests.Enabled {
+		logRequest = contextLog.Debug
+	}
+	defer func() {
+		duration := time.Since(startTime)
+		finishLog := contextLog.WithFields(timings.LogFields()).WithFields(logrus.Fields{
+			"durationMs":       duration.Milliseconds(),
+			"bytesTransferred": cw.bytesWritten,
+		})
+		if slowRequests.Enabled {
+			if duration >= time.Duration(slowRequests.ThresholdMs)*time.Millisecond {
+				finishLog.Warn("Slow request")
+			} else {
+				finishLog.Debug("Finished request")
+			}
+		} else {
+			finishLog.Info("Finished request")
+		}
+	}()
+
+	logRequest("Received request")
+
+	if config.Get().General.LogBodies.Enabled && r.Body != nil && h.isLoggableBody(r) {
+		maxLength := logBodyMaxLength()
+		peeked, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(maxLength)+1))
+		if err != nil {
+			contextLog.Warn("Failed to read request body for logging: " + err.Error())
+		} else {
+			contextLog.Info("Request body: " + util.GetLogSafeBody(string(peeked), maxLength))
+		}
+		r.Body = &peekedBody{Reader: io.MultiReader(bytes.NewReader(peeked), r.Body), Closer: r.Body}
+	}
 
 	// Send CORS and other basic headers
-	w.Header().Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept, Authorization")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Content-Security-Policy", "sandbox; default-src 'none'; script-src 'none'; plugin-types application/pdf; style-src 'unsafe-inline'; media-src 'self'; object-src 'self';")
+	setCorsHeaders(w, r)
+	csp := "sandbox; default-src 'none'; script-src 'none'; plugin-types application/pdf; style-src 'unsafe-inline'; media-src 'self'; object-src 'self';"
+	frameOptions := strings.ToUpper(config.Get().General.FrameOptions)
+	if frameOptions == "DENY" {
+		csp += " frame-ancestors 'none';"
+	} else if frameOptions == "SAMEORIGIN" {
+		csp += " frame-ancestors 'self';"
+	}
+	w.Header().Set("Content-Security-Policy", csp)
 	w.Header().Set("X-Content-Security-Policy", "sandbox;")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if frameOptions != "" {
+		w.Header().Set("X-Frame-Options", frameOptions)
+	}
+	w.Header().Set("Referrer-Policy", "no-referrer")
 	w.Header().Set("X-Robots-Tag", "noindex, nofollow, noarchive, noimageindex")
 	w.Header().Set("Server", "matrix-media-repo")
 
 	// Process response
 	var res interface{} = api.AuthFailed()
 	var rctx rcontext.RequestContext
-	if util.IsServerOurs(r.Host) || h.ignoreHost {
-		contextLog.Info("Host is valid - processing request")
+	done, acquired := concurrency.acquire(h.action)
+	if acquired {
+		defer done()
+	}
+	if !acquired {
+		metrics.ConcurrencyLimitRejections.With(prometheus.Labels{"action": h.action}).Inc()
+		contextLog.Warn("Too many requests are in progress - rejecting request")
+		w.Header().Set("Retry-After", strconv.Itoa(config.Get().ConcurrencyLimits.RetryAfterSeconds))
+		res = api.ServiceUnavailable("Too many requests are in progress. Please try again later.")
+	} else if !storage.IsDatabaseAvailable() && !util.ArrayContains(servableWithoutDatabase, h.action) {
+		contextLog.Warn("The database is unavailable - rejecting request")
+		res = api.ServiceUnavailable("The media repo is temporarily unavailable. Please try again later.")
+	} else if util.IsServerOurs(r.Host) || h.ignoreHost {
+		logRequest("Host is valid - processing request")
 		cfg := config.GetDomain(r.Host)
 		if h.ignoreHost {
 			dc := config.DomainConfigFrom(*config.Get())
@@ -103,6 +184,7 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		ctx = context.WithValue(ctx, "mr.logger", contextLog)
 		ctx = context.WithValue(ctx, "mr.serverConfig", cfg)
 		ctx = context.WithValue(ctx, "mr.request", r)
+		ctx = context.WithValue(ctx, "mr.timings", timings)
 		rctx = rcontext.RequestContext{Context: ctx, Log: contextLog, Config: *cfg, Request: r}
 		r = r.WithContext(rctx)
 
@@ -128,23 +210,44 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	switch result := res.(type) {
 	case *api.DoNotCacheResponse:
+		setExposedHeaders(w, result.Headers)
 		res = result.Payload
 		break
 	}
 
 	htmlRes, isHtml := res.(*api.HtmlResponse)
-	if isHtml {
-		contextLog.Info(fmt.Sprintf("Replying with result: %T %+v", res, fmt.Sprintf("<%d chars of html>", len(htmlRes.HTML))))
+	if config.Get().General.LogBodies.Enabled {
+		if isHtml {
+			contextLog.Info(fmt.Sprintf("Replying with result: %T %+v", res, fmt.Sprintf("<%d chars of html>", len(htmlRes.HTML))))
+		} else {
+			contextLog.Info(fmt.Sprintf("Replying with result: %T %s", res, util.GetLogSafeBody(fmt.Sprintf("%+v", res), logBodyMaxLength())))
+		}
+	} else if errRes, isError := res.(*api.ErrorResponse); isError {
+		logRequest(fmt.Sprintf("Replying with error: %s %s", errRes.Code, errRes.Message))
 	} else {
-		contextLog.Info(fmt.Sprintf("Replying with result: %T %+v", res, res))
+		logRequest(fmt.Sprintf("Replying with result: %T", res))
+	}
+	if errRes, isError := res.(*api.ErrorResponse); isError {
+		logErrorCause(errRes, contextLog)
 	}
 
 	statusCode := http.StatusOK
 	switch result := res.(type) {
 	case *api.ErrorResponse:
 		switch result.InternalCode {
+		case common.ErrCodeMissingToken:
+			statusCode = http.StatusUnauthorized
+			if isAuthenticatedMediaRoute(r) || util.ArrayContains(authenticatedMediaActions, h.action) {
+				w.Header().Set("WWW-Authenticate", "Bearer realm=\""+r.Host+"\"")
+			}
+			break
 		case common.ErrCodeUnknownToken:
+			// Clients treat a 401 as needing to log in again, so only the authenticated media
+			// routes distinguish a bad token (403) from a missing one
 			statusCode = http.StatusUnauthorized
+			if isAuthenticatedMediaRoute(r) {
+				statusCode = http.StatusForbidden
+			}
 			break
 		case common.ErrCodeNotFound:
 			statusCode = http.StatusNotFound
@@ -152,6 +255,9 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		case common.ErrCodeMediaTooLarge:
 			statusCode = http.StatusRequestEntityTooLarge
 			break
+		case common.ErrCodeMediaTooSmall:
+			statusCode = http.StatusBadRequest
+			break
 		case common.ErrCodeBadRequest:
 			statusCode = http.StatusBadRequest
 			break
@@ -161,18 +267,39 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		case common.ErrCodeForbidden:
 			statusCode = http.StatusForbidden
 			break
+		case common.ErrCodeCannotOverwrite:
+			statusCode = http.StatusConflict
+			break
+		case common.ErrCodeRateLimitExceeded:
+			statusCode = http.StatusTooManyRequests
+			break
+		case common.ErrCodeStorageFull:
+			statusCode = http.StatusInsufficientStorage
+			break
+		case common.ErrCodeBadGateway:
+			statusCode = http.StatusBadGateway
+			break
+		case common.ErrCodeUnavailable:
+			statusCode = http.StatusServiceUnavailable
+			if w.Header().Get("Retry-After") == "" && !storage.IsDatabaseAvailable() {
+				w.Header().Set("Retry-After", strconv.Itoa(config.Get().Database.CircuitBreaker.RetryAfterSeconds))
+			}
+			break
 		default: // Treat as unknown (a generic server error)
 			statusCode = http.StatusInternalServerError
 			break
 		}
 		break
 	case *r0.DownloadMediaResponse:
+		seeker, seekable := result.Data.(io.ReadSeeker)
+		serveContent := seekable && result.ServeRanges && result.ConsumeDownload == nil
+
 		// XXX: This range parsing isn't perfect, but works fine enough for now
 		rangeStart := int64(0)
 		rangeEnd := int64(0)
 		grabBytes := int64(0)
 		doRange := false
-		if r.Header.Get("Range") != "" && result.SizeBytes > 0 && rctx.Request != nil && config.Get().Redis.Enabled {
+		if r.Header.Get("Range") != "" && result.SizeBytes > 0 && rctx.Request != nil && config.Get().Redis.Enabled && !serveContent && result.ConsumeDownload == nil {
 			rnge := r.Header.Get("Range")
 			if !strings.HasPrefix(rnge, "bytes=") {
 				statusCode = http.StatusRequestedRangeNotSatisfiable
@@ -252,6 +379,66 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
+		cacheControl := result.CacheControl
+		if cacheControl == "" {
+			cacheControl = "private, max-age=259200" // 3 days
+		}
+
+		if vary := varyHeader(result.Vary); vary != "" {
+			w.Header().Set("Vary", vary)
+		}
+
+		notModified := false
+		ifNoneMatch := r.Header.Get("If-None-Match")
+		if result.Etag != "" && ifNoneMatch != "" && !doRange {
+			// If-None-Match takes precedence over If-Modified-Since when both are given
+			notModified = etagMatches(ifNoneMatch, result.Etag)
+		}
+		if result.LastModifiedTs > 0 {
+			lastModified := util.FromMillis(result.LastModifiedTs).UTC()
+			w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+
+			ifModifiedSince := r.Header.Get("If-Modified-Since")
+			if ifModifiedSince != "" && ifNoneMatch == "" && !doRange {
+				since, err := http.ParseTime(ifModifiedSince)
+				notModified = err == nil && !lastModified.Truncate(time.Second).After(since)
+			}
+		}
+		if notModified {
+			metrics.HttpResponses.With(prometheus.Labels{
+				"host":       r.Host,
+				"action":     h.action,
+				"method":     r.Method,
+				"statusCode": strconv.Itoa(http.StatusNotModified),
+			}).Inc()
+			w.Header().Set("Cache-Control", cacheControl)
+			if result.Etag != "" {
+				w.Header().Set("ETag", "\""+result.Etag+"\"")
+			}
+			w.WriteHeader(http.StatusNotModified)
+			result.Data.Close()
+			return // Prevent sending conflicting responses
+		}
+
+		if result.ConsumeDownload != nil && r.Method != http.MethodHead {
+			allowed, err := result.ConsumeDownload()
+			if err != nil || !allowed {
+				result.Data.Close()
+				w.Header().Del("Last-Modified")
+				if err != nil {
+					errRes := api.InternalServerError("Unexpected Error").WithCause(err, rctx)
+					logErrorCause(errRes, contextLog)
+					statusCode = http.StatusInternalServerError
+					res = errRes
+				} else {
+					contextLog.Warn("Media has reached its download limit")
+					statusCode = http.StatusNotFound
+					res = api.NotFoundError()
+				}
+				break
+			}
+		}
+
 		metrics.HttpResponses.With(prometheus.Labels{
 			"host":       r.Host,
 			"action":     h.action,
@@ -272,10 +459,10 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			contentType = mime.FormatMediaType(mediaType, params)
 		}
 
-		w.Header().Set("Cache-Control", "private, max-age=259200") // 3 days
+		w.Header().Set("Cache-Control", cacheControl)
 		w.Header().Set("Content-Type", contentType)
 		if result.SizeBytes > 0 {
-			if config.Get().Redis.Enabled {
+			if config.Get().Redis.Enabled || result.ServeRanges {
 				w.Header().Set("Accept-Ranges", "bytes")
 			}
 			w.Header().Set("Content-Length", fmt.Sprint(result.SizeBytes))
@@ -308,14 +495,39 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 			fname = "file" + ext
 		}
-		if is.ASCII(result.Filename) {
-			w.Header().Set("Content-Disposition", disposition+"; filename="+url.QueryEscape(fname))
-		} else {
-			w.Header().Set("Content-Disposition", disposition+"; filename*=utf-8''"+url.QueryEscape(fname))
+		w.Header().Set("Content-Disposition", disposition+"; "+util.ContentDispositionFilename(fname))
+		setExposedHeaders(w, result.Headers)
+		if result.Etag != "" {
+			w.Header().Set("ETag", "\""+result.Etag+"\"")
 		}
 
 		defer result.Data.Close()
 
+		if serveContent {
+			// ServeContent handles the Range (and conditional) headers for us
+			w.Header().Del("Content-Length")
+			var modTime time.Time
+			if result.LastModifiedTs > 0 {
+				modTime = util.FromMillis(result.LastModifiedTs)
+			}
+			if result.BytesPerSecond > 0 {
+				seeker = util.ThrottleReadSeeker(seeker, result.BytesPerSecond)
+			}
+			http.ServeContent(w, r, fname, modTime, seeker)
+			return // Prevent sending conflicting responses
+		}
+
+		if r.Method == http.MethodHead {
+			// Only the headers are sent in reply to a HEAD request
+			w.WriteHeader(http.StatusOK)
+			return // Prevent sending conflicting responses
+		}
+
+		var data io.Reader = result.Data
+		if result.BytesPerSecond > 0 {
+			data = util.ThrottleReader(result.Data, result.BytesPerSecond)
+		}
+
 		if doRange {
 			_, err = io.CopyN(ioutil.Discard, result.Data, rangeStart)
 			if err != nil {
@@ -327,7 +539,7 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", rangeStart, rangeEnd, result.SizeBytes))
 			w.Header().Set("Content-Length", fmt.Sprint(expectedBytes))
 			w.WriteHeader(http.StatusPartialContent)
-			b, err := io.CopyN(w, result.Data, expectedBytes)
+			b, err := io.CopyN(w, data, expectedBytes)
 			if err != nil {
 				// Should only blow up this request
 				panic(err)
@@ -341,7 +553,7 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				panic(errors.New("mismatch transfer size"))
 			}
 		} else {
-			writeResponseData(w, result.Data, result.SizeBytes)
+			writeResponseData(w, data, result.SizeBytes)
 		}
 		return // Prevent sending conflicting responses
 	case *r0.IdenticonResponse:
@@ -351,8 +563,12 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			"method":     r.Method,
 			"statusCode": strconv.Itoa(http.StatusOK),
 		}).Inc()
+		contentType := result.ContentType
+		if contentType == "" {
+			contentType = "image/png"
+		}
 		w.Header().Set("Cache-Control", "private, max-age=604800") // 7 days
-		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Type", contentType)
 		writeResponseData(w, result.Avatar, 0)
 		return // Prevent sending conflicting responses
 	case *api.HtmlResponse:
@@ -387,6 +603,44 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	encoder.Encode(res)
 }
 
+// logBodyMaxLength returns the number of characters of a body to log. Bodies are always truncated, as
+// the logged part of a request body is held in memory.
+func logBodyMaxLength() int {
+	maxLength := config.Get().General.LogBodies.MaxLength
+	if maxLength <= 0 {
+		return defaultLogBodyMaxLength
+	}
+	return maxLength
+}
+
+// setExposedHeaders sets the headers on the response, exposing them to browser-based clients which
+// can't otherwise read them.
+func setExposedHeaders(w http.ResponseWriter, headers map[string]string) {
+	exposed := make([]string, 0, len(headers))
+	for k, v := range headers {
+		w.Header().Set(k, v)
+		exposed = append(exposed, k)
+	}
+	if len(exposed) > 0 {
+		sort.Strings(exposed)
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(exposed, ", "))
+	}
+}
+
+func varyHeader(negotiated []string) string {
+	vary := make([]string, 0)
+	if corsRestricted() {
+		vary = append(vary, "Origin")
+	}
+	for _, h := range append(negotiated, config.Get().General.VaryHeaders...) {
+		h = http.CanonicalHeaderKey(strings.TrimSpace(h))
+		if h != "" && !util.ArrayContains(vary, h) {
+			vary = append(vary, h)
+		}
+	}
+	return strings.Join(vary, ", ")
+}
+
 func writeResponseData(w http.ResponseWriter, s io.Reader, expectedBytes int64) {
 	b, err := io.Copy(w, s)
 	if err != nil {
@@ -398,3 +652,117 @@ func writeResponseData(w http.ResponseWriter, s io.Reader, expectedBytes int64)
 		panic(errors.New("mismatch transfer size"))
 	}
 }
+
+// corsRestricted returns true if only some origins are allowed, in which case responses depend on the
+// request's Origin header.
+func corsRestricted() bool {
+	return !util.ArrayContains(config.Get().General.Cors.AllowedOrigins, "*")
+}
+
+// setCorsHeaders sets the CORS headers from the config. When only some origins are allowed, the request's
+// origin is echoed back if it is one of them, and no Access-Control-Allow-Origin header is sent otherwise.
+func setCorsHeaders(w http.ResponseWriter, r *http.Request) {
+	conf := config.Get().General.Cors
+	w.Header().Set("Access-Control-Allow-Headers", strings.Join(conf.AllowedHeaders, ", "))
+	if w.Header().Get("Access-Control-Allow-Methods") == "" {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+	}
+	if !corsRestricted() {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+
+	w.Header().Set("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	if origin != "" && util.ArrayContains(conf.AllowedOrigins, origin) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+}
+
+// optionsRoute answers preflight requests for a path with the methods registered for that path.
+type optionsRoute struct {
+	handler
+	methods []string
+}
+
+func (o optionsRoute) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	allowed := strings.Join(o.methods, ", ")
+	w.Header().Set("Access-Control-Allow-Methods", allowed)
+	w.Header().Set("Allow", allowed)
+	o.handler.ServeHTTP(w, r)
+}
+
+// countingResponseWriter tracks how many bytes of the response body have been written.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	bytesWritten int64
+}
+
+func (c *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(b)
+	c.bytesWritten += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps the underlying writer's ReadFrom, which lets files be sent with sendfile.
+func (c *countingResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := c.ResponseWriter.(io.ReaderFrom); ok {
+		n, err := rf.ReadFrom(r)
+		c.bytesWritten += n
+		return n, err
+	}
+	return io.Copy(struct{ io.Writer }{c}, r) // hide ReadFrom so io.Copy doesn't call back into it
+}
+
+func (c *countingResponseWriter) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// logErrorCause logs and reports the internal cause of an error response, if it has one.
+func logErrorCause(errRes *api.ErrorResponse, contextLog *logrus.Entry) {
+	if errRes.Cause == nil {
+		return
+	}
+	causeLog := errRes.CauseLog()
+	if causeLog == nil {
+		causeLog = contextLog
+	}
+	causeLog.Error(errRes.Message+": ", errRes.Cause)
+	sentry.CaptureException(errRes.Cause)
+}
+
+type peekedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// isLoggableBody determines if the request body is JSON which can be logged, rather than (for
+// example) media being uploaded.
+func (h handler) isLoggableBody(r *http.Request) bool {
+	if util.ArrayContains(mediaBodyActions, h.action) {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json"
+}
+
+// etagMatches returns true if an If-None-Match header value lists the entity tag. Weak comparison is
+// used, as is required for If-None-Match.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		candidate = strings.TrimPrefix(candidate, "W/")
+		if strings.Trim(candidate, "\"") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package webserver
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// stripTrailingSlashes removes trailing slashes from request paths before they are routed.
+func stripTrailingSlashes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.URL.Path) > 1 && strings.HasSuffix(r.URL.Path, "/") {
+			r.URL.Path = strings.TrimRight(r.URL.Path, "/")
+			if r.URL.Path == "" {
+				r.URL.Path = "/"
+			}
+			r.URL.RawPath = strings.TrimRight(r.URL.RawPath, "/")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// lowercaseServerNames lowercases the server names matched by a route, as hostnames aren't case
+// sensitive but the media repo stores and compares them as given. This is only safe when all of the
+// configured domains are lowercase.
+func lowercaseServerNames(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		changed := false
+		lowered := make(map[string]string)
+		for k, v := range vars {
+			if k == "server" || k == "serverName" {
+				if l := strings.ToLower(v); l != v {
+					v = l
+					changed = true
+				}
+			}
+			lowered[k] = v
+		}
+		if changed {
+			r = mux.SetURLVars(r, lowered)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
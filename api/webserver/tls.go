@@ -0,0 +1,126 @@
+package webserver
+
+import (
+	"crypto/tls"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certificateReloader serves the certificate from disk, re-reading it when the files change so
+// certificates can be rotated without a restart.
+type certificateReloader struct {
+	certPath string
+	keyPath  string
+
+	lock      sync.RWMutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newCertificateReloader(certPath string, keyPath string) (*certificateReloader, error) {
+	r := &certificateReloader{certPath: certPath, keyPath: keyPath}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certificateReloader) latestModTime() (time.Time, error) {
+	certStat, err := os.Stat(r.certPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	keyStat, err := os.Stat(r.keyPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if keyStat.ModTime().After(certStat.ModTime()) {
+		return keyStat.ModTime(), nil
+	}
+	return certStat.ModTime(), nil
+}
+
+func (r *certificateReloader) reload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.lastCheck = time.Now()
+	return nil
+}
+
+func (r *certificateReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.Lock()
+	shouldCheck := time.Since(r.lastCheck) > 10*time.Second
+	if shouldCheck {
+		r.lastCheck = time.Now()
+	}
+	modTime := r.modTime
+	r.lock.Unlock()
+
+	if shouldCheck {
+		latest, err := r.latestModTime()
+		if err == nil && latest.After(modTime) {
+			logrus.Info("TLS certificate changed on disk - reloading")
+			if err = r.reload(); err != nil {
+				// Keep serving the old certificate until the files are valid again
+				logrus.Error("Failed to reload TLS certificate: ", err)
+			}
+		}
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.cert, nil
+}
+
+// getTlsConfig builds the TLS config for the web server, or returns nil if TLS is not enabled.
+func getTlsConfig() (*tls.Config, error) {
+	conf := config.Get().General.Tls
+	if !conf.Enabled {
+		return nil, nil
+	}
+
+	if conf.Autocert.Enabled {
+		if len(conf.Autocert.Domains) == 0 {
+			return nil, errors.New("at least one domain is required for autocert")
+		}
+		// Only the TLS-ALPN-01 challenge is answered (the HTTP-01 handler is never mounted), and
+		// Let's Encrypt always connects to port 443 for it
+		if config.Get().General.Port != 443 {
+			logrus.Warn("Autocert is enabled but the media repo is not listening on port 443 - certificates can only be issued if port 443 is forwarded to the media repo without terminating TLS")
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(conf.Autocert.Domains...),
+			Cache:      autocert.DirCache(conf.Autocert.CacheDirectory),
+			Email:      conf.Autocert.Email,
+		}
+		return m.TLSConfig(), nil
+	}
+
+	reloader, err := newCertificateReloader(conf.Certificate, conf.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}, nil
+}
@@ -23,6 +23,7 @@ import (
 	"github.com/turt2live/matrix-media-repo/api/unstable"
 	"github.com/turt2live/matrix-media-repo/api/webserver/debug"
 	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/util"
 )
 
 type route struct {
@@ -42,12 +43,14 @@ var reload = false
 func Init() *sync.WaitGroup {
 	rtr := mux.NewRouter()
 	counter := &requestCounter{}
+	concurrency = newConcurrencyLimiter()
 
 	optionsHandler := handler{api.EmptyResponseHandler, "options_request", counter, false}
 	uploadHandler := handler{api.AccessTokenRequiredRoute(r0.UploadMedia), "upload", counter, false}
 	downloadHandler := handler{api.AccessTokenOptionalRoute(r0.DownloadMedia), "download", counter, false}
 	thumbnailHandler := handler{api.AccessTokenOptionalRoute(r0.ThumbnailMedia), "thumbnail", counter, false}
 	previewUrlHandler := handler{api.AccessTokenRequiredRoute(r0.PreviewUrl), "url_preview", counter, false}
+	previewUrlThumbnailHandler := handler{api.AccessTokenRequiredRoute(r0.PreviewUrlThumbnail), "url_preview_thumbnail", counter, false}
 	identiconHandler := handler{api.AccessTokenOptionalRoute(r0.Identicon), "identicon", counter, false}
 	purgeRemote := handler{api.RepoAdminRoute(custom.PurgeRemoteMedia), "purge_remote_media", counter, false}
 	purgeOneHandler := handler{api.AccessTokenRequiredRoute(custom.PurgeIndividualRecord), "purge_individual_media", counter, false}
@@ -56,24 +59,37 @@ func Init() *sync.WaitGroup {
 	purgeRoomHandler := handler{api.AccessTokenRequiredRoute(custom.PurgeRoomMedia), "purge_room_media", counter, false}
 	purgeDomainHandler := handler{api.AccessTokenRequiredRoute(custom.PurgeDomainMedia), "purge_domain_media", counter, false}
 	purgeOldHandler := handler{api.RepoAdminRoute(custom.PurgeOldMedia), "purge_old_media", counter, false}
+	purgeExpiredHandler := handler{api.RepoAdminRoute(custom.PurgeExpiredServerMedia), "purge_expired_server_media", counter, false}
+	restoreDeletedHandler := handler{api.AccessTokenRequiredRoute(custom.RestoreDeletedMedia), "restore_deleted_media", counter, false}
 	quarantineHandler := handler{api.AccessTokenRequiredRoute(custom.QuarantineMedia), "quarantine_media", counter, false}
 	quarantineRoomHandler := handler{api.AccessTokenRequiredRoute(custom.QuarantineRoomMedia), "quarantine_room", counter, false}
 	quarantineUserHandler := handler{api.AccessTokenRequiredRoute(custom.QuarantineUserMedia), "quarantine_user", counter, false}
 	quarantineDomainHandler := handler{api.AccessTokenRequiredRoute(custom.QuarantineDomainMedia), "quarantine_domain", counter, false}
+	quarantineHashHandler := handler{api.AccessTokenRequiredRoute(custom.QuarantineHash), "quarantine_hash", counter, false}
 	localCopyHandler := handler{api.AccessTokenRequiredRoute(unstable.LocalCopy), "local_copy", counter, false}
 	infoHandler := handler{api.AccessTokenRequiredRoute(unstable.MediaInfo), "info", counter, false}
+	thumbnailSetHandler := handler{api.AccessTokenRequiredRoute(unstable.ListThumbnails), "thumbnail_set", counter, false}
+	shareLinkHandler := handler{api.AccessTokenRequiredRoute(unstable.CreateShareLink), "create_share_link", counter, false}
 	configHandler := handler{api.AccessTokenRequiredRoute(r0.PublicConfig), "config", counter, false}
 	storageEstimateHandler := handler{api.RepoAdminRoute(custom.GetDatastoreStorageEstimate), "get_storage_estimate", counter, false}
 	datastoreListHandler := handler{api.RepoAdminRoute(custom.GetDatastores), "list_datastores", counter, false}
 	dsTransferHandler := handler{api.RepoAdminRoute(custom.MigrateBetweenDatastores), "datastore_transfer", counter, false}
 	fedTestHandler := handler{api.RepoAdminRoute(custom.GetFederationInfo), "federation_test", counter, false}
 	healthzHandler := handler{api.AccessTokenOptionalRoute(custom.GetHealthz), "healthz", counter, true}
+	readyzHandler := handler{api.AccessTokenOptionalRoute(custom.GetReadyz), "readyz", counter, true}
 	domainUsageHandler := handler{api.RepoAdminRoute(custom.GetDomainUsage), "domain_usage", counter, false}
 	userUsageHandler := handler{api.RepoAdminRoute(custom.GetUserUsage), "user_usage", counter, false}
 	uploadsUsageHandler := handler{api.RepoAdminRoute(custom.GetUploadsUsage), "uploads_usage", counter, false}
+	mediaArchiveHandler := handler{api.RepoAdminRoute(custom.DownloadMediaArchive), "download_media_archive", counter, false}
+	popularMediaHandler := handler{api.RepoAdminRoute(custom.GetPopularMedia), "popular_media", counter, false}
+	similarMediaHandler := handler{api.RepoAdminRoute(custom.GetSimilarMedia), "similar_media", counter, false}
+	resniffOneHandler := handler{api.RepoAdminRoute(custom.ResniffMediaContentType), "resniff_content_type", counter, false}
+	resniffServerHandler := handler{api.RepoAdminRoute(custom.ResniffServerContentTypes), "resniff_server_content_types", counter, false}
 	getBackgroundTaskHandler := handler{api.RepoAdminRoute(custom.GetTask), "get_background_task", counter, false}
 	listAllBackgroundTasksHandler := handler{api.RepoAdminRoute(custom.ListAllTasks), "list_all_background_tasks", counter, false}
 	listUnfinishedBackgroundTasksHandler := handler{api.RepoAdminRoute(custom.ListUnfinishedTasks), "list_unfinished_background_tasks", counter, false}
+	getSchemaStatusHandler := handler{api.RepoAdminRoute(custom.GetSchemaStatus), "get_schema_status", counter, false}
+	applyMigrationsHandler := handler{api.RepoAdminRoute(custom.ApplyMigrations), "apply_migrations", counter, false}
 	exportUserDataHandler := handler{api.AccessTokenRequiredRoute(custom.ExportUserData), "export_user_data", counter, false}
 	exportServerDataHandler := handler{api.AccessTokenRequiredRoute(custom.ExportServerData), "export_server_data", counter, false}
 	viewExportHandler := handler{api.AccessTokenOptionalRoute(custom.ViewExport), "view_export", counter, false}
@@ -84,6 +100,10 @@ func Init() *sync.WaitGroup {
 	appendToImportHandler := handler{api.RepoAdminRoute(custom.AppendToImport), "append_to_import", counter, false}
 	stopImportHandler := handler{api.RepoAdminRoute(custom.StopImport), "stop_import", counter, false}
 	versionHandler := handler{api.AccessTokenOptionalRoute(custom.GetVersion), "get_version", counter, false}
+	recentLogsHandler := handler{api.RepoAdminRoute(custom.GetRecentLogs), "get_recent_logs", counter, false}
+	reportMediaHandler := handler{api.AccessTokenRequiredRoute(custom.ReportMedia), "report_media", counter, false}
+	listReportsHandler := handler{api.RepoAdminRoute(custom.ListMediaReports), "list_media_reports", counter, false}
+	openApiHandler := handler{api.RepoAdminRoute(GetOpenApiDocument), "get_openapi_document", counter, false}
 	ipfsDownloadHandler := handler{api.AccessTokenOptionalRoute(unstable.IPFSDownload), "ipfs_download", counter, false}
 	logoutHandler := handler{api.AccessTokenRequiredRoute(r0.Logout), "logout", counter, false}
 	logoutAllHandler := handler{api.AccessTokenRequiredRoute(r0.LogoutAll), "logout_all", counter, false}
@@ -99,12 +119,27 @@ func Init() *sync.WaitGroup {
 	// Things that don't need a version
 	routes = append(routes, definedRoute{"/_matrix/media/version", route{"GET", versionHandler}})
 
+	// Client-server API media routes (Matrix 1.11+ authenticated media), which always require an access token
+	authedDownloadHandler := handler{api.AccessTokenRequiredRoute(r0.DownloadMedia), "download", counter, false}
+	authedThumbnailHandler := handler{api.AccessTokenRequiredRoute(r0.ThumbnailMedia), "thumbnail", counter, false}
+	routes = append(routes, definedRoute{"/_matrix/client/v1/media/config", route{"GET", configHandler}})
+	routes = append(routes, definedRoute{"/_matrix/client/v1/media/download/{server:[^/]+}/{mediaId:[^/]+}/{filename:.+}", route{"GET", authedDownloadHandler}})
+	routes = append(routes, definedRoute{"/_matrix/client/v1/media/download/{server:[^/]+}/{mediaId:[^/]+}", route{"GET", authedDownloadHandler}})
+	routes = append(routes, definedRoute{"/_matrix/client/v1/media/thumbnail/{server:[^/]+}/{mediaId:[^/]+}", route{"GET", authedThumbnailHandler}})
+	routes = append(routes, definedRoute{"/_matrix/client/v1/media/download/{server:[^/]+}/{mediaId:[^/]+}/{filename:.+}", route{"HEAD", authedDownloadHandler}})
+	routes = append(routes, definedRoute{"/_matrix/client/v1/media/download/{server:[^/]+}/{mediaId:[^/]+}", route{"HEAD", authedDownloadHandler}})
+	routes = append(routes, definedRoute{"/_matrix/client/v1/media/thumbnail/{server:[^/]+}/{mediaId:[^/]+}", route{"HEAD", authedThumbnailHandler}})
+	routes = append(routes, definedRoute{"/_matrix/client/v1/media/preview_url", route{"GET", previewUrlHandler}})
+
 	for _, version := range versions {
 		// Standard routes we have to handle
 		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/upload", route{"POST", uploadHandler}})
-		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/download/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}/{filename:.+}", route{"GET", downloadHandler}})
-		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/download/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}", route{"GET", downloadHandler}})
-		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/thumbnail/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}", route{"GET", thumbnailHandler}})
+		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/download/{server:[^/]+}/{mediaId:[^/]+}/{filename:.+}", route{"GET", downloadHandler}})
+		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/download/{server:[^/]+}/{mediaId:[^/]+}", route{"GET", downloadHandler}})
+		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/thumbnail/{server:[^/]+}/{mediaId:[^/]+}", route{"GET", thumbnailHandler}})
+		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/download/{server:[^/]+}/{mediaId:[^/]+}/{filename:.+}", route{"HEAD", downloadHandler}})
+		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/download/{server:[^/]+}/{mediaId:[^/]+}", route{"HEAD", downloadHandler}})
+		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/thumbnail/{server:[^/]+}/{mediaId:[^/]+}", route{"HEAD", thumbnailHandler}})
 		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/preview_url", route{"GET", previewUrlHandler}})
 		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/identicon/{seed:.*}", route{"GET", identiconHandler}})
 		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/config", route{"GET", configHandler}})
@@ -119,11 +154,14 @@ func Init() *sync.WaitGroup {
 		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/purge/room/{roomId:[^/]+}", route{"POST", purgeRoomHandler}})
 		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/purge/server/{serverName:[^/]+}", route{"POST", purgeDomainHandler}})
 		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/purge/old", route{"POST", purgeOldHandler}})
+		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/purge/expired/{serverName:[^/]+}", route{"POST", purgeExpiredHandler}})
 		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/purge/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}", route{"POST", purgeOneHandler}})
+		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/restore/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}", route{"POST", restoreDeletedHandler}})
 		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/room/{roomId:[^/]+}/quarantine", route{"POST", quarantineRoomHandler}}) // deprecated
 		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/quarantine/room/{roomId:[^/]+}", route{"POST", quarantineRoomHandler}})
 		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/quarantine/user/{userId:[^/]+}", route{"POST", quarantineUserHandler}})
 		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/quarantine/server/{serverName:[^/]+}", route{"POST", quarantineDomainHandler}})
+		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/quarantine/hash/{hash:[a-fA-F0-9]{64}}", route{"POST", quarantineHashHandler}})
 		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/quarantine/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}", route{"POST", quarantineHandler}})
 		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/datastores/{datastoreId:[^/]+}/size_estimate", route{"GET", storageEstimateHandler}})
 		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/datastores", route{"GET", datastoreListHandler}})
@@ -132,9 +170,20 @@ func Init() *sync.WaitGroup {
 		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/usage/{serverName:[a-zA-Z0-9.:\\-_]+}", route{"GET", domainUsageHandler}})
 		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/usage/{serverName:[a-zA-Z0-9.:\\-_]+}/users", route{"GET", userUsageHandler}})
 		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/usage/{serverName:[a-zA-Z0-9.:\\-_]+}/uploads", route{"GET", uploadsUsageHandler}})
+		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/logs/recent", route{"GET", recentLogsHandler}})
+		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/reports", route{"GET", listReportsHandler}})
+		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/openapi.json", route{"GET", openApiHandler}})
+		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/report/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}", route{"POST", reportMediaHandler}})
+		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/media/popular", route{"GET", popularMediaHandler}})
+		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/media/archive/{serverName:[a-zA-Z0-9.:\\-_]+}", route{"GET", mediaArchiveHandler}})
+		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/media/similar", route{"GET", similarMediaHandler}})
+		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/resniff/server/{serverName:[^/]+}", route{"POST", resniffServerHandler}})
+		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/resniff/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}", route{"POST", resniffOneHandler}})
 		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/tasks/{taskId:[0-9]+}", route{"GET", getBackgroundTaskHandler}})
 		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/tasks/all", route{"GET", listAllBackgroundTasksHandler}})
 		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/tasks/unfinished", route{"GET", listUnfinishedBackgroundTasksHandler}})
+		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/schema", route{"GET", getSchemaStatusHandler}})
+		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/schema/migrate", route{"POST", applyMigrationsHandler}})
 		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/user/{userId:[^/]+}/export", route{"POST", exportUserDataHandler}})
 		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/server/{serverName:[^/]+}/export", route{"POST", exportServerDataHandler}})
 		routes = append(routes, definedRoute{"/_matrix/media/" + version + "/admin/export/{exportId:[a-zA-Z0-9.:\\-_]+}/view", route{"GET", viewExportHandler}})
@@ -154,6 +203,9 @@ func Init() *sync.WaitGroup {
 		if strings.Index(version, "unstable") == 0 {
 			routes = append(routes, definedRoute{"/_matrix/media/" + version + "/local_copy/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}", route{"GET", localCopyHandler}})
 			routes = append(routes, definedRoute{"/_matrix/media/" + version + "/info/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}", route{"GET", infoHandler}})
+			routes = append(routes, definedRoute{"/_matrix/media/" + version + "/thumbnails/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}", route{"GET", thumbnailSetHandler}})
+			routes = append(routes, definedRoute{"/_matrix/media/" + version + "/share/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}", route{"POST", shareLinkHandler}})
+			routes = append(routes, definedRoute{"/_matrix/media/" + version + "/preview_url/thumbnail", route{"GET", previewUrlThumbnailHandler}})
 			routes = append(routes, definedRoute{"/_matrix/media/" + version + "/download/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}", route{"DELETE", purgeOneHandler}})
 		}
 	}
@@ -165,23 +217,41 @@ func Init() *sync.WaitGroup {
 		routes = append(routes, definedRoute{features.IPFSLiveDownloadRouteUnstable, route{"GET", ipfsDownloadHandler}})
 	}
 
+	openApiDocument = buildOpenApiDocument(routes, versions)
+
+	// Collect the methods for each path so preflight requests can report what is actually allowed
+	pathMethods := make(map[string][]string)
+	for _, def := range routes {
+		if _, ok := pathMethods[def.path]; !ok {
+			pathMethods[def.path] = []string{"OPTIONS"}
+		}
+		if !util.ArrayContains(pathMethods[def.path], def.route.method) {
+			pathMethods[def.path] = append(pathMethods[def.path], def.route.method)
+		}
+	}
+
 	for _, def := range routes {
 		logrus.Info("Registering route: " + def.route.method + " " + def.path)
+		pathOptions := optionsRoute{optionsHandler, pathMethods[def.path]}
 		rtr.Handle(def.path, def.route.handler).Methods(def.route.method)
-		rtr.Handle(def.path, optionsHandler).Methods("OPTIONS")
-
-		// This is a hack to a ensure that trailing slashes also match the routes correctly
-		rtr.Handle(def.path+"/", def.route.handler).Methods(def.route.method)
-		rtr.Handle(def.path+"/", optionsHandler).Methods("OPTIONS")
+		rtr.Handle(def.path, pathOptions).Methods("OPTIONS")
 	}
 
 	// Health check endpoints
 	rtr.Handle("/healthz", healthzHandler).Methods("OPTIONS", "GET", "HEAD")
+	rtr.Handle("/readyz", readyzHandler).Methods("OPTIONS", "GET", "HEAD")
 
 	rtr.NotFoundHandler = handler{api.NotFoundHandler, "not_found", counter, true}
 	rtr.MethodNotAllowedHandler = handler{api.MethodNotAllowedHandler, "method_not_allowed", counter, true}
 
 	var handler http.Handler = rtr
+	if !config.Get().General.StrictRouting {
+		if config.Get().General.LowercaseServerNames {
+			rtr.Use(lowercaseServerNames)
+		}
+		handler = stripTrailingSlashes(rtr)
+	}
+
 	if config.Get().RateLimit.Enabled {
 		logrus.Info("Enabling rate limit")
 		limiter := tollbooth.NewLimiter(0, nil)
@@ -194,7 +264,7 @@ func Init() *sync.WaitGroup {
 		limiter.SetMessage(string(b))
 		limiter.SetMessageContentType("application/json")
 
-		handler = tollbooth.LimitHandler(limiter, rtr)
+		handler = tollbooth.LimitHandler(limiter, handler)
 	}
 
 	address := net.JoinHostPort(config.Get().General.BindAddress, strconv.Itoa(config.Get().General.Port))
@@ -208,12 +278,25 @@ func Init() *sync.WaitGroup {
 	}
 
 	sentryHandler := sentryhttp.New(sentryhttp.Options{})
-	srv = &http.Server{Addr: address, Handler: sentryHandler.Handle(httpMux)}
+	tlsConfig, err := getTlsConfig()
+	if err != nil {
+		sentry.CaptureException(err)
+		logrus.Fatal(err)
+	}
+	srv = &http.Server{Addr: address, Handler: sentryHandler.Handle(httpMux), TLSConfig: tlsConfig}
 	reload = false
 
 	go func() {
-		logrus.WithField("address", address).Info("Started up. Listening at http://" + address)
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		var err error
+		if tlsConfig != nil {
+			// HTTP/2 is enabled automatically when serving TLS. The certificates come from the TLS config.
+			logrus.WithField("address", address).Info("Started up. Listening at https://" + address)
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			logrus.WithField("address", address).Info("Started up. Listening at http://" + address)
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
 			sentry.CaptureException(err)
 			logrus.Fatal(err)
 		}
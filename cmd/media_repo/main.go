@@ -9,10 +9,13 @@ import (
 	"github.com/turt2live/matrix-media-repo/common/assets"
 	"github.com/turt2live/matrix-media-repo/common/config"
 	"github.com/turt2live/matrix-media-repo/common/logging"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/common/runtime"
 	"github.com/turt2live/matrix-media-repo/common/version"
+	"github.com/turt2live/matrix-media-repo/controllers/maintenance_controller"
 	"github.com/turt2live/matrix-media-repo/internal_cache"
 	"github.com/turt2live/matrix-media-repo/metrics"
+	"github.com/turt2live/matrix-media-repo/storage"
 	"github.com/turt2live/matrix-media-repo/tasks"
 	"os"
 	"os/signal"
@@ -25,6 +28,9 @@ func main() {
 	templatesPath := flag.String("templates", config.DefaultTemplatesPath, "The absolute path for the templates folder")
 	assetsPath := flag.String("assets", config.DefaultAssetsPath, "The absolute path for the assets folder")
 	versionFlag := flag.Bool("version", false, "Prints the version and exits")
+	migrateFlag := flag.Bool("migrate", false, "Applies any pending database migrations and exits")
+	purgeExpiredFlag := flag.String("purgeExpired", "", "Purges all media older than purgeAllMediaAfterDays for the given server and exits")
+	dryRunFlag := flag.Bool("dryRun", false, "When used with -purgeExpired, reports what would be purged without deleting anything")
 	flag.Parse()
 
 	if *versionFlag {
@@ -64,8 +70,37 @@ func main() {
 		panic(err)
 	}
 
+	if *migrateFlag {
+		logrus.Info("Applying database migrations...")
+		status, err := storage.MigrateDatabase(config.Get().Database.Postgres)
+		if err != nil {
+			sentry.CaptureException(err)
+			logrus.Fatal(err)
+		}
+		logrus.Infof("Database schema is now at version %d", status.CurrentVersion)
+		return // exit 0
+	}
+
 	logrus.Info("Starting up...")
 	runtime.RunStartupSequence()
+
+	if *purgeExpiredFlag != "" {
+		ctx := rcontext.Initial().LogWithFields(logrus.Fields{"serverName": *purgeExpiredFlag, "dryRun": *dryRunFlag})
+		purged, bytesFreed, err := maintenance_controller.PurgeExpiredServerMedia(*purgeExpiredFlag, *dryRunFlag, ctx)
+		if err != nil {
+			sentry.CaptureException(err)
+			if len(purged) > 0 {
+				logrus.Warnf("Purged %d media records, freeing %d bytes, before failing", len(purged), bytesFreed)
+			}
+			logrus.Fatal(err)
+		}
+		if *dryRunFlag {
+			logrus.Infof("Would purge %d media records, freeing %d bytes", len(purged), bytesFreed)
+		} else {
+			logrus.Infof("Purged %d media records, freeing %d bytes", len(purged), bytesFreed)
+		}
+		return // exit 0
+	}
 	internal_cache.ReplaceInstance() // init the cache as we may be using Redis, and it'd be good to get going sooner
 
 	logrus.Info("Checking background tasks...")
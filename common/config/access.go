@@ -140,6 +140,10 @@ func reloadConfig() (*MainRepoConfig, map[string]*DomainRepoConfig, error) {
 	if err != nil {
 		return nil, nil, err
 	}
+	err = applyEnvOverrides(&c)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// Start building domain configs
 	dMaps := make(map[string]map[string]interface{})
@@ -149,6 +153,7 @@ func reloadConfig() (*MainRepoConfig, map[string]*DomainRepoConfig, error) {
 		dc.ClientServerApi = d.ClientServerApi
 		dc.BackoffAt = d.BackoffAt
 		dc.AdminApiKind = d.AdminApiKind
+		dc.PurgeAllMediaAfterDays = d.PurgeAllMediaAfterDays
 
 		m, err := objToMapYaml(dc)
 		if err != nil {
@@ -182,6 +187,10 @@ func reloadConfig() (*MainRepoConfig, map[string]*DomainRepoConfig, error) {
 		if err != nil {
 			return nil, nil, err
 		}
+		err = applyEnvOverrides(&drc)
+		if err != nil {
+			return nil, nil, err
+		}
 
 		// For good measure...
 		domainConfs[hs] = &drc
@@ -12,14 +12,41 @@ func NewDefaultDomainConfig() DomainRepoConfig {
 	return DomainRepoConfig{
 		MinimumRepoConfig: NewDefaultMinimumRepoConfig(),
 		HomeserverConfig: HomeserverConfig{
-			Name:            "UNDEFINED",
-			ClientServerApi: "https://UNDEFINED",
-			BackoffAt:       10,
-			AdminApiKind:    "matrix",
+			Name:                   "UNDEFINED",
+			ClientServerApi:        "https://UNDEFINED",
+			BackoffAt:              10,
+			AdminApiKind:           "matrix",
+			PurgeAllMediaAfterDays: 0,
 		},
 		Downloads: DownloadsConfig{
-			MaxSizeBytes:        104857600, // 100mb
-			FailureCacheMinutes: 15,
+			MaxSizeBytes:         104857600, // 100mb
+			FailureCacheMinutes:  15,
+			CacheMaxAgeSeconds:   259200, // 3 days
+			CacheMaxAgeOverrides: []CacheMaxAgeOverride{},
+			Throttle: DownloadThrottleConfig{
+				BytesPerSecond: 0,
+				MinSizeBytes:   10485760, // 10mb
+			},
+			Referers: DownloadReferersConfig{
+				Enabled:        false,
+				AllowedDomains: []string{},
+				AllowEmpty:     true,
+			},
+			SignedUrls: SignedUrlsConfig{
+				Enabled:            false,
+				Secret:             "",
+				MaxLifetimeSeconds: 604800, // 7 days
+			},
+			GeoBlocking: GeoBlockingConfig{
+				Enabled:          false,
+				DatabasePath:     "",
+				AllowedCountries: []string{},
+				BlockedCountries: []string{},
+			},
+			MetadataHeaders: MetadataHeadersConfig{
+				Enabled:         false,
+				IncludeUploader: false,
+			},
 		},
 		UrlPreviews: UrlPreviewsConfig{
 			Enabled:          true,
@@ -28,6 +55,7 @@ func NewDefaultDomainConfig() DomainRepoConfig {
 			MaxLength:        200,
 			MaxTitleLength:   150,
 			MaxPageSizeBytes: 10485760, // 10mb
+			MaxHtmlSizeBytes: 1048576,  // 1mb
 			FilePreviewTypes: []string{
 				"image/*",
 			},
@@ -45,13 +73,17 @@ func NewDefaultDomainConfig() DomainRepoConfig {
 			AllowedNetworks: []string{
 				"0.0.0.0/0", // "Everything"
 			},
-			DefaultLanguage: "en-US,en",
-			UserAgent:       "matrix-media-repo",
-			OEmbed:          false,
+			DefaultLanguage:   "en-US,en",
+			UserAgent:         "matrix-media-repo",
+			OEmbed:            false,
+			MaxImageSizeBytes: 10485760, // 10mb
+			MaxImagePixels:    32000000, // 32M
+			MaxRedirects:      10,
 		},
 		Thumbnails: ThumbnailsConfig{
 			MaxSourceBytes:      10485760, // 10mb
 			MaxAnimateSizeBytes: 10485760, // 10mb
+			MaxAnimateFrames:    500,
 			MaxPixels:           32000000, // 32M
 			AllowAnimated:       true,
 			DefaultAnimated:     false,
@@ -70,6 +102,15 @@ func NewDefaultDomainConfig() DomainRepoConfig {
 				"image/png",
 				"image/gif",
 			},
+			DisabledTypes:        []string{},
+			OutputTypes:          []ThumbnailOutputType{},
+			MinRequestDimension:  1,
+			MaxRequestDimension:  10000,
+			AudioWaveforms:       true,
+			EagerGeneration:      false,
+			InlineMaxBytes:       0,
+			AllowUpscaling:       false,
+			StaleWhileRevalidate: false,
 		},
 	}
 }
@@ -27,15 +27,60 @@ func NewDefaultMinimumRepoConfig() MinimumRepoConfig {
 				Enabled:    false,
 				UserQuotas: []QuotaUserConfig{},
 			},
+			Policy: UploadPolicyConfig{
+				Enabled:          false,
+				AllowedUsers:     []string{},
+				AuthorizationUrl: "",
+			},
+			CustomMediaIdUsers:   []string{},
+			MediaIdLength:        40,
+			VerifyWrites:         false,
+			RequireRoomId:        false,
+			RequireContentType:   false,
+			RejectEmpty:          false,
+			ValidateImages:       false,
+			MaxConcurrentPerUser: 0,
+			ConditionalUploads: ConditionalUploadsConfig{
+				Enabled:            false,
+				MaxChecksPerMinute: 10,
+			},
+			Compression: UploadCompressionConfig{
+				Enabled:  false,
+				Types:    []string{"text/*", "application/json", "image/svg+xml"},
+				MinBytes: 1024,
+			},
+			PerceptualHashes: PerceptualHashesConfig{
+				Enabled:   false,
+				MaxBytes:  10485760, // 10mb
+				MaxPixels: 32000000, // 32M
+			},
+			Webhook: UploadWebhookConfig{
+				Enabled:     false,
+				Url:         "",
+				Secret:      "",
+				MaxAttempts: 5,
+			},
+			DownloadLimits: DownloadLimitsConfig{
+				Enabled:      false,
+				MaxDownloads: 100,
+			},
+			PolyglotDetection: PolyglotDetectionConfig{
+				Mode:         "off",
+				CheckMarkers: true,
+			},
 		},
 		Identicons: IdenticonsConfig{
-			Enabled: true,
+			Enabled:           true,
+			ProxyUrl:          "",
+			ProxyCacheSeconds: 3600,
 		},
 		Quarantine: QuarantineConfig{
 			ReplaceThumbnails: true,
 			ReplaceDownloads:  false,
 			ThumbnailPath:     "",
 			AllowLocalAdmins:  true,
+			ReportThreshold:   0,
+			MaxReportsPerHour: 10,
 		},
 		TimeoutSeconds: TimeoutsConfig{
 			UrlPreviews:  10,
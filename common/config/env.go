@@ -0,0 +1,99 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+)
+
+// Environment variables which override the S3 credentials of every S3 datastore. Datastore
+// options are a free-form map so cannot be tagged like the other fields.
+const envS3AccessKeyId = "MEDIAREPO_S3_ACCESS_KEY_ID"
+const envS3Secret = "MEDIAREPO_S3_SECRET"
+
+// applyEnvOverrides sets any fields tagged with `env:"NAME"` to the value of that environment
+// variable, if set. Environment variables always take precedence over the config files.
+func applyEnvOverrides(ref interface{}) error {
+	err := applyEnvToValue(reflect.ValueOf(ref).Elem())
+	if err != nil {
+		return err
+	}
+
+	var datastores []DatastoreConfig
+	switch c := ref.(type) {
+	case *MainRepoConfig:
+		datastores = c.DataStores
+	case *DomainRepoConfig:
+		datastores = c.DataStores
+	}
+	for i := range datastores {
+		ds := &datastores[i]
+		if ds.Type != "s3" {
+			continue
+		}
+		if ds.Options == nil {
+			ds.Options = make(map[string]string)
+		}
+		if val, ok := os.LookupEnv(envS3AccessKeyId); ok {
+			ds.Options["accessKeyId"] = val
+		}
+		if val, ok := os.LookupEnv(envS3Secret); ok {
+			ds.Options["accessSecret"] = val
+		}
+	}
+
+	return nil
+}
+
+func applyEnvToValue(v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		fieldType := t.Field(i)
+
+		if name := fieldType.Tag.Get("env"); name != "" {
+			val, ok := os.LookupEnv(name)
+			if !ok {
+				continue
+			}
+			if err := setFromEnv(field, val); err != nil {
+				return fmt.Errorf("invalid value for %s: %s", name, err.Error())
+			}
+			continue
+		}
+
+		if field.Kind() == reflect.Struct {
+			if err := applyEnvToValue(field); err != nil {
+				return err
+			}
+		} else if field.Kind() == reflect.Ptr && !field.IsNil() && field.Elem().Kind() == reflect.Struct {
+			if err := applyEnvToValue(field.Elem()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func setFromEnv(field reflect.Value, val string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(val)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(i)
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Kind())
+	}
+	return nil
+}
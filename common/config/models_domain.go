@@ -17,35 +17,148 @@ type QuotasConfig struct {
 }
 
 type UploadsConfig struct {
-	MaxSizeBytes         int64        `yaml:"maxBytes"`
-	MinSizeBytes         int64        `yaml:"minBytes"`
-	ReportedMaxSizeBytes int64        `yaml:"reportedMaxBytes"`
-	Quota                QuotasConfig `yaml:"quotas"`
+	MaxSizeBytes         int64                    `yaml:"maxBytes"`
+	MinSizeBytes         int64                    `yaml:"minBytes"`
+	ReportedMaxSizeBytes int64                    `yaml:"reportedMaxBytes"`
+	Quota                QuotasConfig             `yaml:"quotas"`
+	Policy               UploadPolicyConfig       `yaml:"policy"`
+	CustomMediaIdUsers   []string                 `yaml:"customMediaIdUsers,flow"`
+	MediaIdLength        int                      `yaml:"mediaIdLength"`
+	VerifyWrites         bool                     `yaml:"verifyWrites"`
+	RequireRoomId        bool                     `yaml:"requireRoomId"`
+	RequireContentType   bool                     `yaml:"requireContentType"`
+	RejectEmpty          bool                     `yaml:"rejectEmpty"`
+	ValidateImages       bool                     `yaml:"validateImages"`
+	MaxConcurrentPerUser int                      `yaml:"maxConcurrentPerUser"`
+	ConditionalUploads   ConditionalUploadsConfig `yaml:"conditionalUploads"`
+	Compression          UploadCompressionConfig  `yaml:"compression"`
+	PerceptualHashes     PerceptualHashesConfig   `yaml:"perceptualHashes"`
+	Webhook              UploadWebhookConfig      `yaml:"webhook"`
+	DownloadLimits       DownloadLimitsConfig     `yaml:"downloadLimits"`
+	PolyglotDetection    PolyglotDetectionConfig  `yaml:"polyglotDetection"`
+}
+
+type PolyglotDetectionConfig struct {
+	Mode         string `yaml:"mode"`
+	CheckMarkers bool   `yaml:"checkMarkers"`
+}
+
+type DownloadLimitsConfig struct {
+	Enabled      bool `yaml:"enabled"`
+	MaxDownloads int  `yaml:"maxDownloads"`
+}
+
+type UploadWebhookConfig struct {
+	Enabled     bool   `yaml:"enabled"`
+	Url         string `yaml:"url"`
+	Secret      string `yaml:"secret"`
+	MaxAttempts int    `yaml:"maxAttempts"`
+}
+
+type PerceptualHashesConfig struct {
+	Enabled   bool  `yaml:"enabled"`
+	MaxBytes  int64 `yaml:"maxBytes"`
+	MaxPixels int   `yaml:"maxPixels"`
+}
+
+type UploadCompressionConfig struct {
+	Enabled  bool     `yaml:"enabled"`
+	Types    []string `yaml:"types,flow"`
+	MinBytes int64    `yaml:"minBytes"`
+}
+
+type ConditionalUploadsConfig struct {
+	Enabled            bool `yaml:"enabled"`
+	MaxChecksPerMinute int  `yaml:"maxChecksPerMinute"`
+}
+
+type UploadPolicyConfig struct {
+	Enabled          bool     `yaml:"enabled"`
+	AllowedUsers     []string `yaml:"allowedUsers,flow"`
+	AuthorizationUrl string   `yaml:"authorizationUrl"`
 }
 
 type DatastoreConfig struct {
-	Type       string            `yaml:"type"`
-	Enabled    bool              `yaml:"enabled"`
-	MediaKinds []string          `yaml:"forKinds,flow"`
-	Options    map[string]string `yaml:"opts,flow"`
+	Type         string            `yaml:"type"`
+	Enabled      bool              `yaml:"enabled"`
+	MediaKinds   []string          `yaml:"forKinds,flow"`
+	ContentTypes []string          `yaml:"forContentTypes,flow"`
+	Options      map[string]string `yaml:"opts,flow"`
 }
 
 type DownloadsConfig struct {
-	MaxSizeBytes               int64 `yaml:"maxBytes"`
-	FailureCacheMinutes        int   `yaml:"failureCacheMinutes"`
-	DefaultRangeChunkSizeBytes int64 `yaml:"defaultRangeChunkSizeBytes"`
+	MaxSizeBytes               int64                  `yaml:"maxBytes"`
+	FailureCacheMinutes        int                    `yaml:"failureCacheMinutes"`
+	DefaultRangeChunkSizeBytes int64                  `yaml:"defaultRangeChunkSizeBytes"`
+	RequireAuth                bool                   `yaml:"requireAuth"`
+	CacheMaxAgeSeconds         int                    `yaml:"cacheMaxAgeSeconds"`
+	CacheMaxAgeOverrides       []CacheMaxAgeOverride  `yaml:"cacheMaxAgeOverrides,flow"`
+	Throttle                   DownloadThrottleConfig `yaml:"throttle"`
+	Referers                   DownloadReferersConfig `yaml:"referers"`
+	SignedUrls                 SignedUrlsConfig       `yaml:"signedUrls"`
+	GeoBlocking                GeoBlockingConfig      `yaml:"geoBlocking"`
+	MetadataHeaders            MetadataHeadersConfig  `yaml:"metadataHeaders"`
+}
+
+type MetadataHeadersConfig struct {
+	Enabled         bool `yaml:"enabled"`
+	IncludeUploader bool `yaml:"includeUploader"`
+}
+
+type GeoBlockingConfig struct {
+	Enabled          bool     `yaml:"enabled"`
+	DatabasePath     string   `yaml:"databasePath"`
+	AllowedCountries []string `yaml:"allowedCountries,flow"`
+	BlockedCountries []string `yaml:"blockedCountries,flow"`
+}
+
+type SignedUrlsConfig struct {
+	Enabled            bool   `yaml:"enabled"`
+	Secret             string `yaml:"secret"`
+	MaxLifetimeSeconds int64  `yaml:"maxLifetimeSeconds"`
+}
+
+type DownloadThrottleConfig struct {
+	BytesPerSecond int64 `yaml:"bytesPerSecond"`
+	MinSizeBytes   int64 `yaml:"minBytes"`
+}
+
+type DownloadReferersConfig struct {
+	Enabled        bool     `yaml:"enabled"`
+	AllowedDomains []string `yaml:"allowedDomains,flow"`
+	AllowEmpty     bool     `yaml:"allowEmpty"`
+}
+
+type CacheMaxAgeOverride struct {
+	ContentType   string `yaml:"contentType"`
+	MaxAgeSeconds int    `yaml:"maxAgeSeconds"`
 }
 
 type ThumbnailsConfig struct {
-	MaxSourceBytes      int64           `yaml:"maxSourceBytes"`
-	MaxPixels           int             `yaml:"maxPixels"`
-	Types               []string        `yaml:"types,flow"`
-	MaxAnimateSizeBytes int64           `yaml:"maxAnimateSizeBytes"`
-	Sizes               []ThumbnailSize `yaml:"sizes,flow"`
-	DynamicSizing       bool            `yaml:"dynamicSizing"`
-	AllowAnimated       bool            `yaml:"allowAnimated"`
-	DefaultAnimated     bool            `yaml:"defaultAnimated"`
-	StillFrame          float32         `yaml:"stillFrame"`
+	MaxSourceBytes       int64                 `yaml:"maxSourceBytes"`
+	MaxPixels            int                   `yaml:"maxPixels"`
+	Types                []string              `yaml:"types,flow"`
+	DisabledTypes        []string              `yaml:"disabledTypes,flow"`
+	MaxAnimateSizeBytes  int64                 `yaml:"maxAnimateSizeBytes"`
+	MaxAnimateFrames     int                   `yaml:"maxAnimateFrames"`
+	Sizes                []ThumbnailSize       `yaml:"sizes,flow"`
+	DynamicSizing        bool                  `yaml:"dynamicSizing"`
+	AllowAnimated        bool                  `yaml:"allowAnimated"`
+	DefaultAnimated      bool                  `yaml:"defaultAnimated"`
+	StillFrame           float32               `yaml:"stillFrame"`
+	OutputTypes          []ThumbnailOutputType `yaml:"outputTypes,flow"`
+	MinRequestDimension  int                   `yaml:"minRequestDimension"`
+	MaxRequestDimension  int                   `yaml:"maxRequestDimension"`
+	AudioWaveforms       bool                  `yaml:"audioWaveforms"`
+	EagerGeneration      bool                  `yaml:"eagerGeneration"`
+	InlineMaxBytes       int64                 `yaml:"inlineMaxBytes"`
+	AllowUpscaling       bool                  `yaml:"allowUpscaling"`
+	StaleWhileRevalidate bool                  `yaml:"staleWhileRevalidate"`
+}
+
+type ThumbnailOutputType struct {
+	SourceType string `yaml:"sourceType"`
+	OutputType string `yaml:"outputType"`
 }
 
 type ThumbnailSize struct {
@@ -60,6 +173,7 @@ type UrlPreviewsConfig struct {
 	MaxLength          int      `yaml:"maxLength"`
 	MaxTitleLength     int      `yaml:"maxTitleLength"`
 	MaxPageSizeBytes   int64    `yaml:"maxPageSizeBytes"`
+	MaxHtmlSizeBytes   int64    `yaml:"maxHtmlSizeBytes"`
 	FilePreviewTypes   []string `yaml:"filePreviewTypes,flow"`
 	DisallowedNetworks []string `yaml:"disallowedNetworks,flow"`
 	AllowedNetworks    []string `yaml:"allowedNetworks,flow"`
@@ -67,10 +181,15 @@ type UrlPreviewsConfig struct {
 	DefaultLanguage    string   `yaml:"defaultLanguage"`
 	UserAgent          string   `yaml:"userAgent"`
 	OEmbed             bool     `yaml:"oEmbed"`
+	MaxImageSizeBytes  int64    `yaml:"maxImageSizeBytes"`
+	MaxImagePixels     int      `yaml:"maxImagePixels"`
+	MaxRedirects       int      `yaml:"maxRedirects"`
 }
 
 type IdenticonsConfig struct {
-	Enabled bool `yaml:"enabled"`
+	Enabled           bool   `yaml:"enabled"`
+	ProxyUrl          string `yaml:"proxyUrl"`
+	ProxyCacheSeconds int    `yaml:"proxyCacheSeconds"`
 }
 
 type QuarantineConfig struct {
@@ -78,6 +197,8 @@ type QuarantineConfig struct {
 	ReplaceDownloads  bool   `yaml:"replaceDownloads"`
 	ThumbnailPath     string `yaml:"thumbnailPath"`
 	AllowLocalAdmins  bool   `yaml:"allowLocalAdmins"`
+	ReportThreshold   int    `yaml:"reportThreshold"`
+	MaxReportsPerHour int    `yaml:"maxReportsPerHour"`
 }
 
 type TimeoutsConfig struct {
@@ -124,6 +245,8 @@ type AppserviceConfig struct {
 	AppserviceToken string                          `yaml:"asToken"`
 	SenderUserId    string                          `yaml:"senderUserId"`
 	UserNamespaces  []AppserviceUserNamespaceConfig `yaml:"userNamespaces,flow"`
+	MediaIdPrefix   string                          `yaml:"mediaIdPrefix"`
+	MaxBytes        int64                           `yaml:"maxBytes"`
 }
 
 type AppserviceUserNamespaceConfig struct {
@@ -1,25 +1,73 @@
 package config
 
 type GeneralConfig struct {
-	BindAddress      string `yaml:"bindAddress"`
-	Port             int    `yaml:"port"`
-	LogDirectory     string `yaml:"logDirectory"`
-	LogColors        bool   `yaml:"logColors"`
-	JsonLogs         bool   `yaml:"jsonLogs"`
-	TrustAnyForward  bool   `yaml:"trustAnyForwardedAddress"`
-	UseForwardedHost bool   `yaml:"useForwardedHost"`
+	BindAddress          string             `yaml:"bindAddress" env:"MEDIAREPO_BIND_ADDRESS"`
+	Port                 int                `yaml:"port" env:"MEDIAREPO_PORT"`
+	LogDirectory         string             `yaml:"logDirectory"`
+	LogColors            bool               `yaml:"logColors"`
+	JsonLogs             bool               `yaml:"jsonLogs"`
+	TrustAnyForward      bool               `yaml:"trustAnyForwardedAddress"`
+	UseForwardedHost     bool               `yaml:"useForwardedHost"`
+	FrameOptions         string             `yaml:"frameOptions"`
+	VaryHeaders          []string           `yaml:"varyHeaders,flow"`
+	StrictRouting        bool               `yaml:"strictRouting"`
+	LowercaseServerNames bool               `yaml:"lowercaseServerNames"`
+	LogBodies            LogBodiesConfig    `yaml:"logBodies"`
+	SlowRequests         SlowRequestsConfig `yaml:"slowRequests"`
+	Tls                  TlsConfig          `yaml:"tls"`
+	Cors                 CorsConfig         `yaml:"cors"`
+}
+
+type CorsConfig struct {
+	AllowedOrigins []string `yaml:"allowedOrigins,flow"`
+	AllowedHeaders []string `yaml:"allowedHeaders,flow"`
+}
+
+type TlsConfig struct {
+	Enabled     bool           `yaml:"enabled"`
+	Certificate string         `yaml:"certificate"`
+	PrivateKey  string         `yaml:"privateKey"`
+	Autocert    AutocertConfig `yaml:"autocert"`
+}
+
+type AutocertConfig struct {
+	Enabled        bool     `yaml:"enabled"`
+	Domains        []string `yaml:"domains,flow"`
+	CacheDirectory string   `yaml:"cacheDirectory"`
+	Email          string   `yaml:"email"`
+}
+
+type SlowRequestsConfig struct {
+	Enabled     bool `yaml:"enabled"`
+	ThresholdMs int  `yaml:"thresholdMs"`
+}
+
+type LogBodiesConfig struct {
+	Enabled   bool `yaml:"enabled"`
+	MaxLength int  `yaml:"maxLength"`
 }
 
 type HomeserverConfig struct {
-	Name            string `yaml:"name"`
-	ClientServerApi string `yaml:"csApi"`
-	BackoffAt       int    `yaml:"backoffAt"`
-	AdminApiKind    string `yaml:"adminApiKind"`
+	Name                   string `yaml:"name"`
+	ClientServerApi        string `yaml:"csApi"`
+	BackoffAt              int    `yaml:"backoffAt"`
+	AdminApiKind           string `yaml:"adminApiKind"`
+	PurgeAllMediaAfterDays int    `yaml:"purgeAllMediaAfterDays"`
 }
 
 type DatabaseConfig struct {
-	Postgres string        `yaml:"postgres"`
-	Pool     *DbPoolConfig `yaml:"pool"`
+	Postgres       string                 `yaml:"postgres" env:"MEDIAREPO_DATABASE_POSTGRES"`
+	Pool           *DbPoolConfig          `yaml:"pool"`
+	AutoMigrate    bool                   `yaml:"autoMigrate"`
+	CircuitBreaker DbCircuitBreakerConfig `yaml:"circuitBreaker"`
+}
+
+type DbCircuitBreakerConfig struct {
+	Enabled              bool `yaml:"enabled"`
+	CheckIntervalSeconds int  `yaml:"checkIntervalSeconds"`
+	TimeoutSeconds       int  `yaml:"timeoutSeconds"`
+	FailureThreshold     int  `yaml:"failureThreshold"`
+	RetryAfterSeconds    int  `yaml:"retryAfterSeconds"`
 }
 
 type DbPoolConfig struct {
@@ -28,21 +76,29 @@ type DbPoolConfig struct {
 }
 
 type MainDownloadsConfig struct {
-	DownloadsConfig `yaml:",inline"`
-	NumWorkers      int `yaml:"numWorkers"`
-	ExpireDays      int `yaml:"expireAfterDays"`
+	DownloadsConfig         `yaml:",inline"`
+	NumWorkers              int `yaml:"numWorkers"`
+	ExpireDays              int `yaml:"expireAfterDays"`
+	NotFoundCacheSeconds    int `yaml:"notFoundCacheSeconds"`
+	NotFoundCacheMaxEntries int `yaml:"notFoundCacheMaxEntries"`
+	AccessFlushSeconds      int `yaml:"accessFlushSeconds"`
 }
 
 type MainThumbnailsConfig struct {
-	ThumbnailsConfig `yaml:",inline"`
-	NumWorkers       int `yaml:"numWorkers"`
-	ExpireDays       int `yaml:"expireAfterDays"`
+	ThumbnailsConfig         `yaml:",inline"`
+	NumWorkers               int  `yaml:"numWorkers"`
+	ExpireDays               int  `yaml:"expireAfterDays"`
+	MaxConcurrentGenerations int  `yaml:"maxConcurrentGenerations"`
+	QueueTimeoutSeconds      int  `yaml:"generationQueueTimeoutSeconds"`
+	PurgeOldGenerations      bool `yaml:"purgeOldGenerations"`
 }
 
 type MainUrlPreviewsConfig struct {
 	UrlPreviewsConfig `yaml:",inline"`
 	NumWorkers        int `yaml:"numWorkers"`
 	ExpireDays        int `yaml:"expireAfterDays"`
+	MinCacheSeconds   int `yaml:"minCacheSeconds"`
+	MaxCacheSeconds   int `yaml:"maxCacheSeconds"`
 }
 
 type RateLimitConfig struct {
@@ -51,6 +107,36 @@ type RateLimitConfig struct {
 	BurstCount        int     `yaml:"burst"`
 }
 
+type OutboundHttpConfig struct {
+	MaxIdleConns           int `yaml:"maxIdleConns"`
+	MaxIdleConnsPerHost    int `yaml:"maxIdleConnsPerHost"`
+	IdleConnTimeoutSeconds int `yaml:"idleConnTimeoutSeconds"`
+	DialTimeoutSeconds     int `yaml:"dialTimeoutSeconds"`
+	KeepAliveSeconds       int `yaml:"keepAliveSeconds"`
+}
+
+type AdminApiConfig struct {
+	MaxPageSize int `yaml:"maxPageSize"`
+}
+
+type SoftDeletionConfig struct {
+	Enabled          bool `yaml:"enabled"`
+	GracePeriodHours int  `yaml:"gracePeriodHours"`
+}
+
+type StorageLimitConfig struct {
+	MaxBytes             int64 `yaml:"maxBytes"`
+	WarnBytes            int64 `yaml:"warnBytes"`
+	CheckIntervalSeconds int   `yaml:"checkIntervalSeconds"`
+}
+
+type ConcurrencyLimitsConfig struct {
+	MaxRequests       int `yaml:"maxRequests"`
+	MaxDownloads      int `yaml:"maxDownloads"`
+	MaxUploads        int `yaml:"maxUploads"`
+	RetryAfterSeconds int `yaml:"retryAfterSeconds"`
+}
+
 type MetricsConfig struct {
 	Enabled     bool   `yaml:"enabled"`
 	BindAddress string `yaml:"bindAddress"`
@@ -59,11 +145,30 @@ type MetricsConfig struct {
 
 type SharedSecretConfig struct {
 	Enabled bool   `yaml:"enabled"`
-	Token   string `yaml:"token"`
+	Token   string `yaml:"token" env:"MEDIAREPO_SHARED_SECRET"`
 }
 
 type FederationConfig struct {
-	BackoffAt int `yaml:"backoffAt"`
+	BackoffAt      int               `yaml:"backoffAt"`
+	AllowedServers []string          `yaml:"allowedServers,flow"`
+	DeniedServers  []string          `yaml:"deniedServers,flow"`
+	MaxRedirects   int               `yaml:"maxRedirects"`
+	KeyFetching    KeyFetchingConfig `yaml:"keyFetching"`
+}
+
+type KeyFetchingConfig struct {
+	MaxConcurrentFetches int `yaml:"maxConcurrentFetches"`
+	CacheTtlSeconds      int `yaml:"cacheTtlSeconds"`
+}
+
+type DatastoreRetryConfig struct {
+	Attempts  int `yaml:"attempts"`
+	BackoffMs int `yaml:"backoffMs"`
+}
+
+type DatastoreHealthConfig struct {
+	CheckIntervalSeconds int  `yaml:"checkIntervalSeconds"`
+	ReadFailover         bool `yaml:"readFailover"`
 }
 
 type PluginConfig struct {
@@ -73,7 +178,7 @@ type PluginConfig struct {
 
 type SentryConfig struct {
 	Enabled     bool   `yaml:"enabled"`
-	Dsn         string `yaml:"dsn"`
+	Dsn         string `yaml:"dsn" env:"MEDIAREPO_SENTRY_DSN"`
 	Environment string `yaml:"environment"`
 	Debug       bool   `yaml:"debug"`
 }
@@ -16,3 +16,8 @@ const ErrCodeRateLimitExceeded = "M_LIMIT_EXCEEDED"
 const ErrCodeUnknown = "M_UNKNOWN"
 const ErrCodeForbidden = "M_FORBIDDEN"
 const ErrCodeQuotaExceeded = "M_QUOTA_EXCEEDED"
+const ErrCodeCannotOverwrite = "M_CANNOT_OVERWRITE_MEDIA"
+const ErrCodeUnavailable = "M_UNAVAILABLE"
+const ErrCodeResourceLimitExceeded = "M_RESOURCE_LIMIT_EXCEEDED"
+const ErrCodeStorageFull = "M_STORAGE_FULL"
+const ErrCodeBadGateway = "M_BAD_GATEWAY"
@@ -6,7 +6,20 @@ import (
 
 var ErrMediaNotFound = errors.New("media not found")
 var ErrMediaTooLarge = errors.New("media too large")
+var ErrMediaTooSmall = errors.New("media too small")
 var ErrInvalidHost = errors.New("invalid host")
 var ErrHostNotFound = errors.New("host not found")
 var ErrHostBlacklisted = errors.New("host not allowed")
 var ErrMediaQuarantined = errors.New("media quarantined")
+var ErrThumbnailQueueTimeout = errors.New("timed out waiting to generate thumbnail")
+var ErrMediaIdTaken = errors.New("media ID already in use")
+var ErrThumbnailsDisabled = errors.New("thumbnails disabled for this content type")
+var ErrMediaNotThumbnailable = errors.New("media is marked as not thumbnailable")
+var ErrUnknownContentType = errors.New("content type could not be determined")
+var ErrNotPerceptuallyHashable = errors.New("perceptual hashes can only be calculated for images")
+var ErrRetentionNotEnabled = errors.New("purging all media is not enabled for this server")
+var ErrNotRegularFile = errors.New("datastore object is not a regular file")
+var ErrDatabaseUnavailable = errors.New("database unavailable")
+var ErrWriteVerificationFailed = errors.New("stored file does not match what was written")
+var ErrInvalidImage = errors.New("image could not be decoded")
+var ErrStorageFull = errors.New("storage limit reached")
@@ -39,6 +39,9 @@ func Setup(dir string, colors bool, json bool) error {
 	formatter := &utcFormatter{lineFormatter}
 	logrus.SetFormatter(formatter)
 	logrus.SetOutput(os.Stdout)
+	addRecentHookOnce.Do(func() {
+		logrus.AddHook(recentHook)
+	})
 
 	if dir == "" || dir == "-" {
 		return nil
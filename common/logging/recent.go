@@ -0,0 +1,88 @@
+package logging
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// The number of warnings and errors which are remembered for the admin API.
+const maxRecentEntries = 500
+
+type RecentEntry struct {
+	Time    time.Time         `json:"time"`
+	Level   string            `json:"level"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields"`
+}
+
+// recentEntriesHook keeps the most recent warnings and errors in a ring buffer.
+type recentEntriesHook struct {
+	lock    sync.Mutex
+	entries []*RecentEntry
+	next    int
+}
+
+var recentHook = &recentEntriesHook{entries: make([]*RecentEntry, 0, maxRecentEntries)}
+var addRecentHookOnce = &sync.Once{}
+
+func (h *recentEntriesHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.WarnLevel, logrus.ErrorLevel, logrus.FatalLevel, logrus.PanicLevel}
+}
+
+func (h *recentEntriesHook) Fire(entry *logrus.Entry) error {
+	recent := &RecentEntry{
+		Time:    entry.Time.UTC(),
+		Level:   entry.Level.String(),
+		Message: util.GetLogSafeBody(entry.Message, 0),
+		Fields:  make(map[string]string),
+	}
+	for k, v := range entry.Data {
+		if isSensitiveField(k) {
+			recent.Fields[k] = "redacted"
+		} else {
+			recent.Fields[k] = util.GetLogSafeBody(fmt.Sprint(v), 0)
+		}
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if len(h.entries) < maxRecentEntries {
+		h.entries = append(h.entries, recent)
+	} else {
+		h.entries[h.next] = recent
+	}
+	h.next = (h.next + 1) % maxRecentEntries
+	return nil
+}
+
+func isSensitiveField(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range []string{"token", "secret", "password", "authorization", "cookie"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// RecentEntries returns up to limit of the most recent warnings and errors, newest first.
+func RecentEntries(limit int) []*RecentEntry {
+	recentHook.lock.Lock()
+	defer recentHook.lock.Unlock()
+
+	count := len(recentHook.entries)
+	if limit > 0 && limit < count {
+		count = limit
+	}
+	result := make([]*RecentEntry, 0, count)
+	for i := 1; i <= count; i++ {
+		idx := (recentHook.next - i + len(recentHook.entries)) % len(recentHook.entries)
+		result = append(result, recentHook.entries[idx])
+	}
+	return result
+}
@@ -38,6 +38,17 @@ func (c RequestContext) populate() RequestContext {
 	return c
 }
 
+// Detached returns a copy of the context which is not tied to the lifetime of the request,
+// for work which continues after the response has been sent.
+func (c RequestContext) Detached() RequestContext {
+	return RequestContext{
+		Context: context.Background(),
+		Log:     c.Log,
+		Config:  c.Config,
+		Request: nil,
+	}.populate()
+}
+
 func (c RequestContext) ReplaceLogger(log *logrus.Entry) RequestContext {
 	ctx := context.WithValue(c.Context, "mr.logger", log)
 	return RequestContext{
@@ -0,0 +1,97 @@
+package rcontext
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Timings accumulates how long each phase of a request took, for logging once the request finishes.
+type Timings struct {
+	lock   sync.Mutex
+	phases map[string]time.Duration
+	order  []string
+}
+
+func NewTimings() *Timings {
+	return &Timings{phases: make(map[string]time.Duration)}
+}
+
+func (t *Timings) Add(phase string, duration time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, ok := t.phases[phase]; !ok {
+		t.order = append(t.order, phase)
+	}
+	t.phases[phase] += duration
+}
+
+// LogFields returns the recorded phases as "<phase>Ms" log fields.
+func (t *Timings) LogFields() logrus.Fields {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	fields := logrus.Fields{}
+	for _, phase := range t.order {
+		fields[phase+"Ms"] = t.phases[phase].Milliseconds()
+	}
+	return fields
+}
+
+// TimeReads returns the stream with the time spent reading from it added to the named phase of the
+// request, for phases (like reading from a datastore) which mostly happen while the response is sent.
+func (c RequestContext) TimeReads(phase string, stream io.ReadCloser) io.ReadCloser {
+	timings, ok := c.Context.Value("mr.timings").(*Timings)
+	if !ok || timings == nil {
+		return stream
+	}
+	return &timedReader{ReadCloser: stream, timings: timings, phase: phase}
+}
+
+// TimeSeekableReads is TimeReads for seekable streams.
+func (c RequestContext) TimeSeekableReads(phase string, stream io.ReadSeekCloser) io.ReadSeekCloser {
+	timings, ok := c.Context.Value("mr.timings").(*Timings)
+	if !ok || timings == nil {
+		return stream
+	}
+	return &timedReadSeeker{ReadSeekCloser: stream, timings: timings, phase: phase}
+}
+
+type timedReader struct {
+	io.ReadCloser
+	timings *Timings
+	phase   string
+}
+
+func (r *timedReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	defer func() { r.timings.Add(r.phase, time.Since(start)) }()
+	return r.ReadCloser.Read(p)
+}
+
+type timedReadSeeker struct {
+	io.ReadSeekCloser
+	timings *Timings
+	phase   string
+}
+
+func (r *timedReadSeeker) Read(p []byte) (int, error) {
+	start := time.Now()
+	defer func() { r.timings.Add(r.phase, time.Since(start)) }()
+	return r.ReadSeekCloser.Read(p)
+}
+
+// TimePhase starts timing the named phase of the request, returning a function which stops the
+// timer. Phases may be timed more than once, in which case the durations are summed. This is a
+// no-op for contexts which aren't tied to a request.
+func (c RequestContext) TimePhase(phase string) func() {
+	timings, ok := c.Context.Value("mr.timings").(*Timings)
+	if !ok || timings == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		timings.Add(phase, time.Since(start))
+	}
+}
@@ -10,12 +10,12 @@ import (
 	"errors"
 	"github.com/getsentry/sentry-go"
 	"io"
-	"net/http"
 	"sync"
 
 	"github.com/turt2live/matrix-media-repo/common"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/controllers/upload_controller"
+	"github.com/turt2live/matrix-media-repo/internal_cache"
 	"github.com/turt2live/matrix-media-repo/storage"
 	"github.com/turt2live/matrix-media-repo/storage/datastore"
 	"github.com/turt2live/matrix-media-repo/storage/datastore/ds_s3"
@@ -336,7 +336,7 @@ func doImport(updateChannel chan *importUpdate, taskId int, importId string, ctx
 			if found {
 				ctx.Log.Info("Using file from memory")
 				closer := util.BufferToStream(buf)
-				_, err := upload_controller.StoreDirect(nil, closer, record.SizeBytes, record.ContentType, record.FileName, userId, record.Origin, record.MediaId, kind, ctx, true)
+				_, err := upload_controller.StoreDirect(nil, closer, record.SizeBytes, record.ContentType, record.FileName, userId, record.Origin, record.MediaId, kind, ctx, true, nil)
 				if err != nil {
 					ctx.Log.Errorf("Error importing file: %s", err.Error())
 					doClear = false // don't clear things on error
@@ -413,6 +413,7 @@ func doImport(updateChannel chan *importUpdate, taskId int, importId string, ctx
 							break
 						}
 
+						internal_cache.ClearMediaMissing(media.Origin, media.MediaId)
 						ctx.Log.Infof("Media %s has been imported", media.MxcUri())
 						imported = true
 						break
@@ -421,14 +422,14 @@ func doImport(updateChannel chan *importUpdate, taskId int, importId string, ctx
 
 				if !imported {
 					ctx.Log.Info("No datastore found - trying to upload by downloading first")
-					r, err := http.DefaultClient.Get(record.S3Url)
+					r, err := util.NewHttpClient(0).Get(record.S3Url)
 					if err != nil {
 						ctx.Log.Errorf("Error trying to download file from S3 via HTTP: ", err.Error())
 						sentry.CaptureException(err)
 						continue
 					}
 
-					_, err = upload_controller.StoreDirect(nil, r.Body, r.ContentLength, record.ContentType, record.FileName, userId, record.Origin, record.MediaId, kind, ctx, true)
+					_, err = upload_controller.StoreDirect(nil, r.Body, r.ContentLength, record.ContentType, record.FileName, userId, record.Origin, record.MediaId, kind, ctx, true, nil)
 					if err != nil {
 						ctx.Log.Errorf("Error importing file: %s", err.Error())
 						sentry.CaptureException(err)
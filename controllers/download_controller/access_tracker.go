@@ -0,0 +1,55 @@
+package download_controller
+
+import (
+	"sync"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+type pendingAccess struct {
+	lastAccessTs int64
+	count        int64
+}
+
+var accessLock = &sync.Mutex{}
+var pendingAccesses = make(map[string]*pendingAccess)
+
+// TrackAccess records an access to the given hash (media or thumbnail). Accesses are buffered in
+// memory and written to the database by FlushAccesses rather than on every request.
+func TrackAccess(sha256Hash string) {
+	accessLock.Lock()
+	defer accessLock.Unlock()
+
+	access, ok := pendingAccesses[sha256Hash]
+	if !ok {
+		access = &pendingAccess{}
+		pendingAccesses[sha256Hash] = access
+	}
+	access.lastAccessTs = util.NowMillis()
+	access.count++
+}
+
+// FlushAccesses writes all buffered accesses to the database.
+func FlushAccesses(ctx rcontext.RequestContext) {
+	accessLock.Lock()
+	toFlush := pendingAccesses
+	pendingAccesses = make(map[string]*pendingAccess)
+	accessLock.Unlock()
+
+	if len(toFlush) == 0 {
+		return
+	}
+
+	ctx.Log.Infof("Flushing access counts for %d hashes", len(toFlush))
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	for hash, access := range toFlush {
+		err := db.UpsertAccessCount(hash, access.lastAccessTs, access.count)
+		if err != nil {
+			ctx.Log.Warn("Failed to update access count for ", hash, ": ", err)
+			sentry.CaptureException(err)
+		}
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"github.com/getsentry/sentry-go"
 	"io"
 	"io/ioutil"
 	"time"
@@ -73,7 +72,7 @@ func GetMedia(origin string, mediaId string, downloadRemote bool, blockForMedia
 				defer cleanup.DumpAndCloseStream(minMedia.Stream)
 
 				if ctx.Config.Quarantine.ReplaceDownloads {
-					ctx.Log.Info("Replacing thumbnail with a quarantined one")
+					ctx.Log.Info("Replacing media with a quarantined image")
 
 					img, err := quarantine_controller.GenerateQuarantineThumbnail(512, 512, ctx)
 					if err != nil {
@@ -97,12 +96,14 @@ func GetMedia(origin string, mediaId string, downloadRemote bool, blockForMedia
 				return nil, common.ErrMediaQuarantined
 			}
 
-			err = storage.GetDatabase().GetMetadataStore(ctx).UpsertLastAccess(media.Sha256Hash, util.NowMillis())
-			if err != nil {
-				sentry.CaptureException(err)
-				ctx.Log.Warn("Failed to upsert the last access time: ", err)
+			if media.SoftDeleted {
+				ctx.Log.Warn("Deleted media accessed")
+				cleanup.DumpAndCloseStream(minMedia.Stream)
+				return nil, common.ErrMediaNotFound
 			}
 
+			TrackAccess(media.Sha256Hash)
+
 			localCache.Set(origin+"/"+mediaId, media, cache.DefaultExpiration)
 		}
 
@@ -159,6 +160,37 @@ func GetMedia(origin string, mediaId string, downloadRemote bool, blockForMedia
 	return value, err
 }
 
+// GetMediaHeaders finds the media record for answering a HEAD request. Unlike GetMedia, remote media
+// which hasn't been cached is not downloaded and the file is not read. The returned stream is empty.
+func GetMediaHeaders(origin string, mediaId string, ctx rcontext.RequestContext) (*types.MinimalMedia, error) {
+	media, err := FindMediaRecord(origin, mediaId, false, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if media.Quarantined {
+		if ctx.Config.Quarantine.ReplaceDownloads {
+			// The replacement is generated without touching the media, so is cheap enough to describe
+			return GetMedia(origin, mediaId, false, false, ctx)
+		}
+		return nil, common.ErrMediaQuarantined
+	}
+
+	if media.SoftDeleted {
+		return nil, common.ErrMediaNotFound
+	}
+
+	return &types.MinimalMedia{
+		Origin:      media.Origin,
+		MediaId:     media.MediaId,
+		ContentType: media.ContentType,
+		UploadName:  media.UploadName,
+		SizeBytes:   media.SizeBytes,
+		Stream:      util.BytesToStream(nil),
+		KnownMedia:  media,
+	}, nil
+}
+
 func FindMinimalMediaRecord(origin string, mediaId string, downloadRemote bool, ctx rcontext.RequestContext) (*types.MinimalMedia, error) {
 	db := storage.GetDatabase().GetMediaStore(ctx)
 
@@ -167,12 +199,22 @@ func FindMinimalMediaRecord(origin string, mediaId string, downloadRemote bool,
 	if found {
 		media = item.(*types.Media)
 	} else {
+		if util.IsServerOurs(origin) && internal_cache.IsMediaKnownMissing(origin, mediaId) {
+			ctx.Log.Warn("Media not found (cached)")
+			return nil, common.ErrMediaNotFound
+		}
+
+		if !storage.IsDatabaseAvailable() {
+			return nil, common.ErrDatabaseUnavailable
+		}
+
 		ctx.Log.Info("Getting media record from database")
 		dbMedia, err := db.Get(origin, mediaId)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				if util.IsServerOurs(origin) {
 					ctx.Log.Warn("Media not found")
+					internal_cache.MarkMediaMissing(origin, mediaId)
 					return nil, common.ErrMediaNotFound
 				}
 			} else {
@@ -186,6 +228,11 @@ func FindMinimalMediaRecord(origin string, mediaId string, downloadRemote bool,
 				return nil, common.ErrMediaNotFound
 			}
 
+			if !IsRemoteServerAllowed(origin) {
+				ctx.Log.Warn("Remote server " + origin + " is not allowed for federation fetching")
+				return nil, common.ErrMediaNotFound
+			}
+
 			mediaChan := getResourceHandler().DownloadRemoteMedia(origin, mediaId, true)
 			defer close(mediaChan)
 
@@ -262,12 +309,22 @@ func FindMediaRecord(origin string, mediaId string, downloadRemote bool, ctx rco
 		if found {
 			media = item.(*types.Media)
 		} else {
+			if util.IsServerOurs(origin) && internal_cache.IsMediaKnownMissing(origin, mediaId) {
+				ctx.Log.Warn("Media not found (cached)")
+				return nil, common.ErrMediaNotFound
+			}
+
+			if !storage.IsDatabaseAvailable() {
+				return nil, common.ErrDatabaseUnavailable
+			}
+
 			ctx.Log.Info("Getting media record from database")
 			dbMedia, err := db.Get(origin, mediaId)
 			if err != nil {
 				if err == sql.ErrNoRows {
 					if util.IsServerOurs(origin) {
 						ctx.Log.Warn("Media not found")
+						internal_cache.MarkMediaMissing(origin, mediaId)
 						return nil, common.ErrMediaNotFound
 					}
 				} else {
@@ -281,6 +338,11 @@ func FindMediaRecord(origin string, mediaId string, downloadRemote bool, ctx rco
 					return nil, common.ErrMediaNotFound
 				}
 
+				if !IsRemoteServerAllowed(origin) {
+					ctx.Log.Warn("Remote server " + origin + " is not allowed for federation fetching")
+					return nil, common.ErrMediaNotFound
+				}
+
 				mediaChan := getResourceHandler().DownloadRemoteMedia(origin, mediaId, true)
 				defer close(mediaChan)
 
@@ -309,3 +371,30 @@ func FindMediaRecord(origin string, mediaId string, downloadRemote bool, ctx rco
 
 	return value, err
 }
+
+// GetMediaAttributes gets the (defaulted) attributes for the media, caching them alongside the
+// media record so a download only needs to look them up once.
+func GetMediaAttributes(origin string, mediaId string, ctx rcontext.RequestContext) (*types.MediaAttributes, error) {
+	cacheKey := "attrs:" + origin + "/" + mediaId
+	item, found := localCache.Get(cacheKey)
+	if found {
+		return item.(*types.MediaAttributes), nil
+	}
+
+	attrs, err := storage.GetDatabase().GetMediaAttributesStore(ctx).GetAttributesDefaulted(origin, mediaId)
+	if err != nil {
+		return nil, err
+	}
+	localCache.Set(cacheKey, attrs, cache.DefaultExpiration)
+	return attrs, nil
+}
+
+// ClearMediaCache forgets the cached media record, such as after it has been deleted or restored.
+func ClearMediaCache(origin string, mediaId string) {
+	localCache.Delete(origin + "/" + mediaId)
+}
+
+// ClearMediaAttributesCache forgets any cached attributes for the media, such as after they've been changed.
+func ClearMediaAttributesCache(origin string, mediaId string) {
+	localCache.Delete("attrs:" + origin + "/" + mediaId)
+}
@@ -0,0 +1,56 @@
+package download_controller
+
+import (
+	"database/sql"
+
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// ConsumeDownload counts a download of the media if it can only be downloaded a limited number of
+// times, returning false if the limit has already been reached. Once the final download has been
+// counted, the media is marked as deleted so it is cleaned up like any other deleted media.
+func ConsumeDownload(attrs *types.MediaAttributes, ctx rcontext.RequestContext) (bool, error) {
+	if attrs.MaxDownloads <= 0 {
+		return true, nil
+	}
+
+	origin := attrs.Origin
+	mediaId := attrs.MediaId
+	count, err := storage.GetDatabase().GetMediaAttributesStore(ctx).IncrementDownloadCount(origin, mediaId)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	ctx.Log.Infof("Media has been downloaded %d of %d times", count, attrs.MaxDownloads)
+	if count >= attrs.MaxDownloads {
+		err = storage.GetDatabase().GetMetadataStore(ctx).InsertMediaSoftDeletion(&types.MediaSoftDeletion{
+			Origin:    origin,
+			MediaId:   mediaId,
+			DeletedBy: "", // deleted by the media repo itself
+			DeletedTs: util.NowMillis(),
+		})
+		if err != nil {
+			// Not fatal: the download limit still prevents further downloads
+			ctx.Log.Warn("Failed to mark media as deleted after its final download: " + err.Error())
+		}
+		ClearMediaCache(origin, mediaId)
+	}
+
+	return true, nil
+}
+
+// IsDownloadLimited returns true if the media can only be downloaded a limited number of times. Such
+// media can only be downloaded through the regular download routes, where the downloads are counted.
+func IsDownloadLimited(origin string, mediaId string, ctx rcontext.RequestContext) (bool, error) {
+	attrs, err := GetMediaAttributes(origin, mediaId, ctx)
+	if err != nil {
+		return false, err
+	}
+	return attrs.MaxDownloads > 0, nil
+}
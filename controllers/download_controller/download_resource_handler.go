@@ -167,7 +167,7 @@ func downloadResourceWorkFn(request *resource_handler.WorkRequest) (resp *worker
 			return r
 		}
 
-		media, err := upload_controller.StoreDirect(nil, st, downloaded.ContentLength, downloaded.ContentType, downloaded.DesiredFilename, userId, info.origin, info.mediaId, common.KindRemoteMedia, ctx, true)
+		media, err := upload_controller.StoreDirect(nil, st, downloaded.ContentLength, downloaded.ContentType, downloaded.DesiredFilename, userId, info.origin, info.mediaId, common.KindRemoteMedia, ctx, true, nil)
 		if err != nil {
 			ctx.Log.Error("Error persisting file: ", err)
 			r.err = err
@@ -0,0 +1,51 @@
+package download_controller
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// CreateDownloadToken mints a token which allows the media to be downloaded without
+// authentication until the given time (in milliseconds).
+func CreateDownloadToken(origin string, mediaId string, expiresTs int64, ctx rcontext.RequestContext) (string, error) {
+	conf := ctx.Config.Downloads.SignedUrls
+	if !conf.Enabled || conf.Secret == "" {
+		return "", errors.New("signed download URLs are not enabled")
+	}
+	return fmt.Sprintf("%d.%s", expiresTs, signDownload(origin, mediaId, expiresTs, conf.Secret)), nil
+}
+
+// IsDownloadTokenValid checks that the token was minted for the media by CreateDownloadToken and has
+// not expired. Always returns false if signed download URLs are disabled.
+func IsDownloadTokenValid(origin string, mediaId string, token string, ctx rcontext.RequestContext) bool {
+	conf := ctx.Config.Downloads.SignedUrls
+	if !conf.Enabled || conf.Secret == "" || token == "" {
+		return false
+	}
+
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	expiresTs, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || expiresTs < util.NowMillis() {
+		return false
+	}
+	expected := signDownload(origin, mediaId, expiresTs, conf.Secret)
+	return subtle.ConstantTimeCompare([]byte(parts[1]), []byte(expected)) == 1
+}
+
+func signDownload(origin string, mediaId string, expiresTs int64, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("%s/%s/%d", origin, mediaId, expiresTs)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
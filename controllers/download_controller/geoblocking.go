@@ -0,0 +1,108 @@
+package download_controller
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/patrickmn/go-cache"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+)
+
+type geoIpRecord struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+var geoIpLock = &sync.Mutex{}
+var geoIpReaders = make(map[string]*maxminddb.Reader) // database path => reader
+var countryCache = cache.New(1*time.Hour, 2*time.Hour)
+
+// maxCachedCountries limits how many addresses have their country cached, as every address which
+// makes a request would otherwise stay in memory for an hour.
+const maxCachedCountries = 50000
+
+// IsCountryAllowed checks the country of a download or thumbnail request's address against the
+// configured allowed and blocked countries. Always returns true if geoblocking is disabled, or if
+// the address isn't in the database.
+func IsCountryAllowed(remoteAddr string, ctx rcontext.RequestContext) bool {
+	conf := ctx.Config.Downloads.GeoBlocking
+	if !conf.Enabled {
+		return true
+	}
+
+	country, err := lookupCountry(conf.DatabasePath, remoteAddr)
+	if err != nil {
+		ctx.Log.Error("Error looking up country for geoblocking: ", err)
+		sentry.CaptureException(err)
+		return false
+	}
+	if country == "" {
+		return true
+	}
+
+	for _, c := range conf.BlockedCountries {
+		if strings.EqualFold(c, country) {
+			return false
+		}
+	}
+	if len(conf.AllowedCountries) == 0 {
+		return true
+	}
+	for _, c := range conf.AllowedCountries {
+		if strings.EqualFold(c, country) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupCountry returns the ISO country code for the address, or an empty string if the address
+// isn't in the database.
+func lookupCountry(dbPath string, remoteAddr string) (string, error) {
+	cacheKey := dbPath + "|" + remoteAddr
+	if item, found := countryCache.Get(cacheKey); found {
+		return item.(string), nil
+	}
+
+	ip := net.ParseIP(remoteAddr)
+	if ip == nil {
+		return "", nil
+	}
+
+	reader, err := getGeoIpReader(dbPath)
+	if err != nil {
+		return "", err
+	}
+
+	record := &geoIpRecord{}
+	err = reader.Lookup(ip, record)
+	if err != nil {
+		return "", err
+	}
+
+	if countryCache.ItemCount() < maxCachedCountries {
+		countryCache.Set(cacheKey, record.Country.IsoCode, cache.DefaultExpiration)
+	}
+	return record.Country.IsoCode, nil
+}
+
+func getGeoIpReader(dbPath string) (*maxminddb.Reader, error) {
+	geoIpLock.Lock()
+	defer geoIpLock.Unlock()
+
+	if reader, ok := geoIpReaders[dbPath]; ok {
+		return reader, nil
+	}
+
+	reader, err := maxminddb.Open(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	geoIpReaders[dbPath] = reader
+	return reader, nil
+}
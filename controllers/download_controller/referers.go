@@ -0,0 +1,33 @@
+package download_controller
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/ryanuber/go-glob"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+)
+
+// IsRefererAllowed checks the Referer header of a download or thumbnail request against the
+// configured allowed domains. Always returns true if referer checking is disabled.
+func IsRefererAllowed(referer string, ctx rcontext.RequestContext) bool {
+	conf := ctx.Config.Downloads.Referers
+	if !conf.Enabled {
+		return true
+	}
+	if referer == "" {
+		return conf.AllowEmpty
+	}
+
+	parsed, err := url.Parse(referer)
+	if err != nil || parsed.Hostname() == "" {
+		return false
+	}
+	host := strings.ToLower(parsed.Hostname())
+	for _, g := range conf.AllowedDomains {
+		if glob.Glob(strings.ToLower(g), host) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,27 @@
+package download_controller
+
+import (
+	"github.com/ryanuber/go-glob"
+	"github.com/turt2live/matrix-media-repo/common/config"
+)
+
+// IsRemoteServerAllowed determines if media may be fetched over federation from the given server.
+// Servers matching the deny list are never allowed. If an allow list is configured, the server
+// must also match it.
+func IsRemoteServerAllowed(serverName string) bool {
+	fedConfig := config.Get().Federation
+	for _, g := range fedConfig.DeniedServers {
+		if glob.Glob(g, serverName) {
+			return false
+		}
+	}
+	if len(fedConfig.AllowedServers) == 0 {
+		return true
+	}
+	for _, g := range fedConfig.AllowedServers {
+		if glob.Glob(g, serverName) {
+			return true
+		}
+	}
+	return false
+}
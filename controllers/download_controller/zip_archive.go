@@ -0,0 +1,69 @@
+package download_controller
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+// StreamZipArchive returns a ZIP archive of the given media's files, which is written as the
+// stream is read. Errors part way through the archive cause the stream to fail.
+func StreamZipArchive(records []*types.Media, ctx rcontext.RequestContext) io.ReadCloser {
+	reader, writer := io.Pipe()
+
+	go func() {
+		archive := zip.NewWriter(writer)
+		for _, media := range records {
+			err := addToZipArchive(archive, media, ctx)
+			if err != nil {
+				ctx.Log.Error("Error adding ", media.MxcUri(), " to archive: ", err)
+				sentry.CaptureException(err)
+				_ = writer.CloseWithError(err)
+				return
+			}
+		}
+		_ = writer.CloseWithError(archive.Close())
+	}()
+
+	return reader
+}
+
+func addToZipArchive(archive *zip.Writer, media *types.Media, ctx rcontext.RequestContext) error {
+	stream, err := datastore.DownloadStream(ctx, media.DatastoreId, media.Location)
+	if err != nil {
+		return err
+	}
+	defer cleanup.DumpAndCloseStream(stream)
+
+	f, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     zipEntryName(media),
+		Method:   zip.Store, // most media is already compressed
+		Modified: util.FromMillis(media.CreationTs),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, stream)
+	return err
+}
+
+func zipEntryName(media *types.Media) string {
+	name := path.Base(media.UploadName)
+	if name == "." || name == "/" || name == ".." {
+		name = "file"
+		if exts, err := mime.ExtensionsByType(media.ContentType); err == nil && len(exts) > 0 {
+			name += exts[0]
+		}
+	}
+	return fmt.Sprintf("%s/%s-%s", media.Origin, media.MediaId, name)
+}
@@ -0,0 +1,104 @@
+package info_controller
+
+import (
+	"bytes"
+	"image"
+	"io/ioutil"
+	"math/bits"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/download_controller"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+// ShouldCalculatePerceptualHash returns true if perceptual hashes are enabled and the media can be hashed.
+func ShouldCalculatePerceptualHash(media *types.Media, ctx rcontext.RequestContext) bool {
+	return ctx.Config.Uploads.PerceptualHashes.Enabled && checkPerceptualHashable(media, ctx) == nil
+}
+
+func checkPerceptualHashable(media *types.Media, ctx rcontext.RequestContext) error {
+	if !strings.HasPrefix(media.ContentType, "image/") || strings.HasPrefix(media.ContentType, "image/svg") {
+		return common.ErrNotPerceptuallyHashable
+	}
+	maxBytes := ctx.Config.Uploads.PerceptualHashes.MaxBytes
+	if maxBytes > 0 && media.SizeBytes > maxBytes {
+		return common.ErrMediaTooLarge
+	}
+	return nil
+}
+
+// GetOrCalculatePerceptualHash returns the difference hash (dHash) of the media's image,
+// calculating and storing it if needed. Returns common.ErrNotPerceptuallyHashable for media
+// which isn't an image and common.ErrMediaTooLarge for images over the configured size or pixel limits.
+func GetOrCalculatePerceptualHash(media *types.Media, ctx rcontext.RequestContext) (uint64, error) {
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	cached, found, err := db.GetPerceptualHash(media.Sha256Hash)
+	if err != nil {
+		return 0, err
+	}
+	if found {
+		return cached, nil
+	}
+
+	if err = checkPerceptualHashable(media, ctx); err != nil {
+		return 0, err
+	}
+
+	ctx.Log.Info("Calculating perceptual hash")
+	minMedia, err := download_controller.FindMinimalMediaRecord(media.Origin, media.MediaId, true, ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer cleanup.DumpAndCloseStream(minMedia.Stream)
+
+	b, err := ioutil.ReadAll(minMedia.Stream)
+	if err != nil {
+		return 0, err
+	}
+
+	// Check the dimensions before decoding, as the decoded image can be far larger than the file
+	imgConfig, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+	maxPixels := ctx.Config.Uploads.PerceptualHashes.MaxPixels
+	if maxPixels > 0 && util.ExceedsPixelCount(imgConfig.Width, imgConfig.Height, maxPixels) {
+		return 0, common.ErrMediaTooLarge
+	}
+
+	img, err := imaging.Decode(bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+
+	// Compare the brightness of neighbouring pixels in a 9x8 greyscale version of the image
+	small := imaging.Grayscale(imaging.Resize(img, 9, 8, imaging.Lanczos))
+	hash := uint64(0)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if small.Pix[small.PixOffset(x, y)] < small.Pix[small.PixOffset(x+1, y)] {
+				hash |= 1
+			}
+		}
+	}
+
+	err = db.InsertPerceptualHash(media.Sha256Hash, hash)
+	if err != nil {
+		return 0, err
+	}
+
+	return hash, nil
+}
+
+// PerceptualHashDistance returns the number of bits which differ between the hashes. Images with
+// a distance of 6 or less (the default for similar image searches) are likely to be the same image.
+func PerceptualHashDistance(a uint64, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
@@ -0,0 +1,127 @@
+package maintenance_controller
+
+import (
+	"context"
+	"mime"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+type ContentTypeChange struct {
+	Media          *types.Media
+	OldContentType string
+	NewContentType string
+}
+
+// ResniffContentType detects the content type of the media's file, updating the media record if
+// apply is true. Returns nil if the stored content type already matches or the file could not be
+// identified.
+func ResniffContentType(media *types.Media, apply bool, ctx rcontext.RequestContext) (*ContentTypeChange, error) {
+	stream, err := datastore.DownloadStream(ctx, media.DatastoreId, media.Location)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup.DumpAndCloseStream(stream)
+
+	detected, err := mimetype.DetectReader(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	newType, _, err := mime.ParseMediaType(detected.String())
+	if err != nil || newType == "application/octet-stream" {
+		return nil, nil // unknown - leave it alone
+	}
+	oldType, _, err := mime.ParseMediaType(media.ContentType)
+	if err == nil && oldType == newType {
+		return nil, nil
+	}
+
+	change := &ContentTypeChange{
+		Media:          media,
+		OldContentType: media.ContentType,
+		NewContentType: detected.String(),
+	}
+
+	if apply {
+		ctx.Log.Info("Changing content type of ", media.Origin, "/", media.MediaId, " from ", change.OldContentType, " to ", change.NewContentType)
+		err = storage.GetDatabase().GetMediaStore(ctx).SetContentType(media.Origin, media.MediaId, change.NewContentType)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return change, nil
+}
+
+// StartServerResniff starts a background task to detect the content types of all the media for a
+// server, updating the media records if apply is true. The changes are logged as they are found.
+// Returns an error only if starting the background task failed.
+func StartServerResniff(serverName string, apply bool, ctx rcontext.RequestContext) (*types.BackgroundTask, error) {
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	task, err := db.CreateBackgroundTask("resniff_content_types", map[string]interface{}{
+		"server_name": serverName,
+		"dry_run":     !apply,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		// Use a new context in the goroutine
+		ctx.Context = context.Background()
+		ctx = ctx.LogWithFields(logrus.Fields{"taskId": task.ID})
+		ctx.Log.Info("Starting content type detection")
+
+		changes, err := resniffServerContentTypes(serverName, apply, ctx)
+		if err != nil {
+			ctx.Log.Error(err)
+			sentry.CaptureException(err)
+			return
+		}
+		ctx.Log.Infof("Found %d media with the wrong content type", len(changes))
+
+		err = storage.GetDatabase().GetMetadataStore(ctx).FinishedBackgroundTask(task.ID)
+		if err != nil {
+			ctx.Log.Error(err)
+			ctx.Log.Error("Failed to flag task as finished")
+			sentry.CaptureException(err)
+		}
+		ctx.Log.Info("Finished content type detection")
+	}()
+
+	return task, nil
+}
+
+func resniffServerContentTypes(serverName string, apply bool, ctx rcontext.RequestContext) ([]*ContentTypeChange, error) {
+	records, err := storage.GetDatabase().GetMediaStore(ctx).GetAllMediaForServer(serverName)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]*ContentTypeChange, 0)
+	for _, media := range records {
+		rctx := ctx.LogWithFields(logrus.Fields{"mediaId": media.MediaId})
+		change, err := ResniffContentType(media, apply, rctx)
+		if err != nil {
+			rctx.Log.Error("Error detecting content type: ", err)
+			sentry.CaptureException(err)
+			continue
+		}
+		if change != nil {
+			if !apply {
+				rctx.Log.Info("Content type of ", media.Origin, "/", media.MediaId, " would change from ", change.OldContentType, " to ", change.NewContentType)
+			}
+			changes = append(changes, change)
+		}
+	}
+
+	return changes, nil
+}
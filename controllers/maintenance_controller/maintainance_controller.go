@@ -37,7 +37,8 @@ func StartStorageMigration(sourceDs *datastore.DatastoreRef, targetDs *datastore
 				rctx := ctx.LogWithFields(logrus.Fields{"mediaSha256": record.Sha256Hash})
 
 				rctx.Log.Info("Starting transfer of media")
-				sourceStream, err := sourceDs.DownloadFile(record.Location)
+				// Compressed files are decompressed on the way through so the hash can be verified
+				sourceStream, err := datastore.DownloadStream(rctx, sourceDs.DatastoreId, record.Location)
 				if err != nil {
 					rctx.Log.Error(err)
 					rctx.Log.Error("Failed to start download from source datastore")
@@ -224,6 +225,17 @@ func PurgeRemoteMediaBefore(beforeTs int64, ctx rcontext.RequestContext) (int, e
 			continue
 		}
 		for _, thumb := range thumbs {
+			shared, err := thumbsDb.IsLocationShared(thumb)
+			if err != nil {
+				ctx.Log.Warn("Error checking if thumbnail for media " + media.Origin + "/" + media.MediaId + " is shared: " + err.Error())
+				sentry.CaptureException(err)
+				continue
+			}
+			if shared {
+				ctx.Log.Info("Not deleting thumbnail with hash ", thumb.Sha256Hash, ": it is shared with other media")
+				continue
+			}
+
 			ctx.Log.Info("Deleting thumbnail with hash: ", thumb.Sha256Hash)
 			ds, err := datastore.LocateDatastore(ctx, thumb.DatastoreId)
 			if err != nil {
@@ -403,6 +415,15 @@ func doPurge(media *types.Media, ctx rcontext.RequestContext) error {
 		return err
 	}
 	for _, thumb := range thumbs {
+		shared, err := thumbsDb.IsLocationShared(thumb)
+		if err != nil {
+			return err
+		}
+		if shared {
+			ctx.Log.Info("Not deleting thumbnail with hash ", thumb.Sha256Hash, ": it is shared with other media")
+			continue
+		}
+
 		ctx.Log.Info("Deleting thumbnail with hash: ", thumb.Sha256Hash)
 		ds, err := datastore.LocateDatastore(ctx, thumb.DatastoreId)
 		if err != nil {
@@ -460,6 +481,12 @@ func doPurge(media *types.Media, ctx rcontext.RequestContext) error {
 		}
 	}
 
+	// The files are gone, so the media can no longer be restored
+	err = metadataDb.DeleteMediaSoftDeletion(media.Origin, media.MediaId)
+	if err != nil {
+		return err
+	}
+
 	// Don't delete the media record itself if it is quarantined. If we delete it, the media
 	// becomes not-quarantined so we'll leave it and let it 404 in the datastores.
 	if media.Quarantined {
@@ -0,0 +1,102 @@
+package maintenance_controller
+
+import (
+	"fmt"
+
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// PurgeExpiredServerMedia deletes all media (local and remote) for the given server which is older
+// than the server's configured purgeAllMediaAfterDays, returning the affected media and an estimate
+// of how many bytes were freed. Servers which have not opted in result in common.ErrRetentionNotEnabled.
+// When dryRun is true, nothing is deleted. If purging fails part way through, the media purged so far
+// and the bytes they freed are returned along with the error.
+func PurgeExpiredServerMedia(serverName string, dryRun bool, ctx rcontext.RequestContext) ([]*types.Media, int64, error) {
+	domain := config.GetDomain(serverName)
+	if domain == nil || domain.PurgeAllMediaAfterDays <= 0 {
+		return nil, 0, common.ErrRetentionNotEnabled
+	}
+
+	beforeTs := util.NowMillis() - int64(domain.PurgeAllMediaAfterDays)*24*60*60*1000
+
+	mediaDb := storage.GetDatabase().GetMediaStore(ctx)
+	records, err := mediaDb.GetMediaByDomainBefore(serverName, beforeTs)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	bytesFreed, err := estimateBytesFreed(records, ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if dryRun {
+		ctx.Log.Info(fmt.Sprintf("Dry run: would purge %d media records (%d bytes) for %s", len(records), bytesFreed, serverName))
+		return records, bytesFreed, nil
+	}
+
+	ctx.Log.Info(fmt.Sprintf("Purging %d media records (%d bytes) for %s", len(records), bytesFreed, serverName))
+	for i, r := range records {
+		err = doPurge(r, ctx)
+		if err != nil {
+			ctx.Log.Warn(fmt.Sprintf("Purge stopped after %d of %d media records", i, len(records)))
+			return records[:i], partialBytesFreed(records[:i], ctx), err
+		}
+	}
+
+	return records, bytesFreed, nil
+}
+
+// partialBytesFreed estimates the bytes freed by the records purged before a failure. The purged
+// records are no longer in the database, so any remaining media sharing their files (including the
+// records which were not purged) keep those files from counting.
+func partialBytesFreed(purged []*types.Media, ctx rcontext.RequestContext) int64 {
+	bytesFreed, err := estimateBytesFreed(purged, ctx)
+	if err != nil {
+		ctx.Log.Warn("Error estimating the bytes freed by the partial purge: ", err)
+		return 0
+	}
+	return bytesFreed
+}
+
+// estimateBytesFreed counts the size of each file which is only referenced by the given media.
+// Files shared with other media are kept when purging, so don't count towards the total.
+func estimateBytesFreed(records []*types.Media, ctx rcontext.RequestContext) (int64, error) {
+	mediaDb := storage.GetDatabase().GetMediaStore(ctx)
+
+	purging := make(map[string]bool)
+	for _, r := range records {
+		purging[r.MxcUri()] = true
+	}
+
+	total := int64(0)
+	seenHashes := make(map[string]bool)
+	for _, r := range records {
+		if seenHashes[r.Sha256Hash] {
+			continue
+		}
+		seenHashes[r.Sha256Hash] = true
+
+		similar, err := mediaDb.GetByHash(r.Sha256Hash)
+		if err != nil {
+			return 0, err
+		}
+		shared := false
+		for _, m := range similar {
+			if !purging[m.MxcUri()] {
+				shared = true
+				break
+			}
+		}
+		if !shared {
+			total += r.SizeBytes
+		}
+	}
+
+	return total, nil
+}
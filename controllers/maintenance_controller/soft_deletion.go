@@ -0,0 +1,81 @@
+package maintenance_controller
+
+import (
+	"database/sql"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/download_controller"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// SoftDeleteMedia hides the media from downloads without removing it, so it can be restored
+// until the grace period has passed.
+func SoftDeleteMedia(origin string, mediaId string, deletedBy string, ctx rcontext.RequestContext) error {
+	media, err := download_controller.FindMediaRecord(origin, mediaId, false, ctx)
+	if err != nil {
+		return err
+	}
+
+	err = storage.GetDatabase().GetMetadataStore(ctx).InsertMediaSoftDeletion(&types.MediaSoftDeletion{
+		Origin:    media.Origin,
+		MediaId:   media.MediaId,
+		DeletedBy: deletedBy,
+		DeletedTs: util.NowMillis(),
+	})
+	if err != nil {
+		return err
+	}
+	download_controller.ClearMediaCache(media.Origin, media.MediaId)
+	return nil
+}
+
+// RestoreMedia undoes a soft deletion. Returns common.ErrMediaNotFound if the media is not soft
+// deleted.
+func RestoreMedia(origin string, mediaId string, ctx rcontext.RequestContext) error {
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	deletion, err := db.GetMediaSoftDeletion(origin, mediaId)
+	if err != nil {
+		return err
+	}
+	if deletion == nil {
+		return common.ErrMediaNotFound
+	}
+
+	err = db.DeleteMediaSoftDeletion(origin, mediaId)
+	if err != nil {
+		return err
+	}
+	download_controller.ClearMediaCache(origin, mediaId)
+	return nil
+}
+
+// PurgeSoftDeletedBefore permanently deletes media which was soft deleted before the given
+// timestamp, returning the number of media purged.
+func PurgeSoftDeletedBefore(beforeTs int64, ctx rcontext.RequestContext) (int, error) {
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	deletions, err := db.GetMediaSoftDeletionsBefore(beforeTs)
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, deletion := range deletions {
+		err = PurgeMedia(deletion.Origin, deletion.MediaId, ctx)
+		if err == sql.ErrNoRows || err == common.ErrMediaNotFound {
+			// Already gone, so just forget about it
+			err = db.DeleteMediaSoftDeletion(deletion.Origin, deletion.MediaId)
+		}
+		if err != nil {
+			ctx.Log.Error("Error purging deleted media "+deletion.Origin+"/"+deletion.MediaId+": ", err)
+			sentry.CaptureException(err)
+			continue
+		}
+		purged++
+	}
+
+	return purged, nil
+}
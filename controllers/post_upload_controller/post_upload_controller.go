@@ -0,0 +1,132 @@
+package post_upload_controller
+
+import (
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/info_controller"
+	"github.com/turt2live/matrix-media-repo/controllers/thumbnail_controller"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+const numWorkers = 5
+const queueSize = 1000
+const maxAttempts = 3
+const retryDelay = 30 * time.Second
+
+type postUploadJob struct {
+	media            *types.Media
+	generateBlurhash bool
+	warmThumbnails   bool
+	attempt          int
+	ctx              rcontext.RequestContext
+}
+
+var queue chan *postUploadJob
+var queueLock = &sync.Once{}
+
+// Queue schedules the post-upload processing (blurhash and perceptual hash calculation, and
+// thumbnail warming) for the media to happen in the background. Perceptual hashes are calculated
+// if enabled in the config, while the blurhash and preset thumbnails are only generated if asked
+// for. Returns false if the queue is full.
+func Queue(media *types.Media, generateBlurhash bool, warmThumbnails bool, ctx rcontext.RequestContext) bool {
+	if !generateBlurhash && !warmThumbnails && !info_controller.ShouldCalculatePerceptualHash(media, ctx) {
+		return true // nothing to do
+	}
+
+	queueLock.Do(func() {
+		queue = make(chan *postUploadJob, queueSize)
+		for i := 0; i < numWorkers; i++ {
+			go worker()
+		}
+	})
+
+	job := &postUploadJob{
+		media:            media,
+		generateBlurhash: generateBlurhash,
+		warmThumbnails:   warmThumbnails,
+		attempt:          1,
+		ctx: ctx.Detached().LogWithFields(logrus.Fields{
+			"postUpload": media.Origin + "/" + media.MediaId,
+		}),
+	}
+
+	select {
+	case queue <- job:
+		return true
+	default:
+		ctx.Log.Warn("Post-upload processing queue is full")
+		return false
+	}
+}
+
+func worker() {
+	for job := range queue {
+		err := process(job)
+		if err == nil {
+			continue
+		}
+
+		if job.attempt >= maxAttempts {
+			job.ctx.Log.Error("Giving up on post-upload processing: " + err.Error())
+			sentry.CaptureException(err)
+			continue
+		}
+
+		job.ctx.Log.Warn("Error during post-upload processing, will retry: " + err.Error())
+		job.attempt++
+		retryJob := job
+		time.AfterFunc(retryDelay, func() {
+			select {
+			case queue <- retryJob:
+			default:
+				retryJob.ctx.Log.Error("Post-upload processing queue is full - dropping retry")
+			}
+		})
+	}
+}
+
+func process(job *postUploadJob) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = util.PanicToError(r)
+		}
+	}()
+
+	ctx := job.ctx
+	ctx.Log.Info("Starting post-upload processing (attempt ", job.attempt, ")")
+
+	if job.generateBlurhash {
+		_, err = info_controller.GetOrCalculateBlurhash(job.media, ctx)
+		if err != nil {
+			return errors.Wrap(err, "blurhash")
+		}
+	}
+
+	if info_controller.ShouldCalculatePerceptualHash(job.media, ctx) {
+		_, err = info_controller.GetOrCalculatePerceptualHash(job.media, ctx)
+		if err == common.ErrMediaTooLarge {
+			// Too many pixels to hash, which retrying won't change
+			ctx.Log.Info("Not calculating perceptual hash: image is too large")
+			err = nil
+		} else if err != nil {
+			return errors.Wrap(err, "perceptual hash")
+		}
+	}
+
+	if job.warmThumbnails {
+		err = thumbnail_controller.GeneratePresetThumbnails(job.media, ctx)
+		if err != nil {
+			return errors.Wrap(err, "thumbnail")
+		}
+	}
+
+	ctx.Log.Info("Finished post-upload processing")
+	return nil
+}
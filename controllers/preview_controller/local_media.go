@@ -0,0 +1,73 @@
+package preview_controller
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/download_controller"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+var localMediaPathRegex = regexp.MustCompile(`^/_matrix/(?:media/[^/]+|client/v1/media)/(?:download|thumbnail)/([^/]+)/([^/]+)`)
+
+// ParseLocalMediaUrl returns the origin and media ID of the media if the URL is for a download or
+// thumbnail served by this media repo.
+func ParseLocalMediaUrl(urlStr string, onHost string) (string, string, bool) {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return "", "", false
+	}
+	if u.Hostname() != onHost && !util.IsServerOurs(u.Hostname()) {
+		return "", "", false
+	}
+
+	matches := localMediaPathRegex.FindStringSubmatch(u.Path)
+	if matches == nil {
+		return "", "", false
+	}
+	return matches[1], matches[2], true
+}
+
+// GetLocalMediaPreview builds a preview of media held by this media repo from its stored metadata,
+// rather than fetching the URL. Images are their own preview image.
+func GetLocalMediaPreview(origin string, mediaId string, urlStr string, ctx rcontext.RequestContext) (*types.UrlPreview, error) {
+	media, err := download_controller.FindMediaRecord(origin, mediaId, false, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if media.Quarantined {
+		return nil, common.ErrMediaNotFound
+	}
+
+	title := media.UploadName
+	if title == "" {
+		title = media.MediaId
+	}
+
+	preview := &types.UrlPreview{
+		Url:      urlStr,
+		SiteName: media.Origin,
+		Type:     openGraphType(media.ContentType),
+		Title:    title,
+	}
+	if strings.HasPrefix(media.ContentType, "image/") {
+		preview.ImageMxc = media.MxcUri()
+		preview.ImageType = media.ContentType
+		preview.ImageSize = media.SizeBytes
+	}
+
+	return preview, nil
+}
+
+func openGraphType(contentType string) string {
+	if strings.HasPrefix(contentType, "video/") {
+		return "video.other"
+	} else if strings.HasPrefix(contentType, "audio/") {
+		return "music.song"
+	}
+	return "website"
+}
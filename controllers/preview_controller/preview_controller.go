@@ -18,8 +18,7 @@ import (
 )
 
 func GetPreview(urlStr string, onHost string, forUserId string, atTs int64, languageHeader string, ctx rcontext.RequestContext) (*types.UrlPreview, error) {
-	atTs = stores.GetBucketTs(atTs)
-	cacheKey := fmt.Sprintf("%d_%s/%s", atTs, onHost, urlStr)
+	cacheKey := fmt.Sprintf("%d_%s/%s", stores.GetBucketTs(atTs), onHost, urlStr)
 	v, _, err := globals.DefaultRequestGroup.DoWithoutPost(cacheKey, func() (interface{}, error) {
 
 		ctx := ctx.LogWithFields(logrus.Fields{
@@ -1,11 +1,15 @@
 package preview_controller
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/getsentry/sentry-go"
+	"image"
+	"io"
+	"io/ioutil"
 	"sync"
+	"time"
 
-	"github.com/disintegration/imaging"
 	"github.com/sirupsen/logrus"
 	"github.com/turt2live/matrix-media-repo/common"
 	"github.com/turt2live/matrix-media-repo/common/config"
@@ -14,7 +18,6 @@ import (
 	"github.com/turt2live/matrix-media-repo/controllers/preview_controller/previewers"
 	"github.com/turt2live/matrix-media-repo/controllers/upload_controller"
 	"github.com/turt2live/matrix-media-repo/storage"
-	"github.com/turt2live/matrix-media-repo/storage/datastore"
 	"github.com/turt2live/matrix-media-repo/types"
 	"github.com/turt2live/matrix-media-repo/util"
 	"github.com/turt2live/matrix-media-repo/util/cleanup"
@@ -38,6 +41,11 @@ type urlPreviewResponse struct {
 	err     error
 }
 
+// The limits for preview images when urlPreviews.maxImageSizeBytes or maxImagePixels aren't set, as
+// the images are read into memory and decoded.
+const defaultMaxImageSizeBytes = 10485760 // 10mb
+const defaultMaxImagePixels = 32000000    // 32M
+
 var resHandlerInstance *urlResourceHandler
 var resHandlerSingletonLock = &sync.Once{}
 
@@ -130,46 +138,44 @@ func urlPreviewWorkFn(request *resource_handler.WorkRequest) (resp *urlPreviewRe
 
 	// Store the thumbnail, if there is one
 	if preview.Image != nil && !upload_controller.IsRequestTooLarge(preview.Image.ContentLength, preview.Image.ContentLengthHeader, ctx) {
-		contentLength := upload_controller.EstimateContentLength(preview.Image.ContentLength, preview.Image.ContentLengthHeader)
-
-		// UploadMedia will close the read stream for the thumbnail and dedupe the image
-		media, err := upload_controller.UploadMedia(preview.Image.Data, contentLength, preview.Image.ContentType, preview.Image.Filename, info.forUserId, info.onHost, ctx)
+		imgBytes, imgConfig, err := readPreviewImage(preview.Image, ctx)
 		if err != nil {
-			ctx.Log.Warn("Non-fatal error storing preview thumbnail: " + err.Error())
-			sentry.CaptureException(err)
+			ctx.Log.Warn("Non-fatal error reading preview thumbnail: " + err.Error())
+		} else if imgBytes == nil {
+			ctx.Log.Warn("Preview thumbnail is too large - skipping")
 		} else {
-			mediaStream, err := datastore.DownloadStream(ctx, media.DatastoreId, media.Location)
+			// UploadMedia will close the read stream for the thumbnail and dedupe the image
+			media, err := upload_controller.UploadMedia(util.BytesToStream(imgBytes), int64(len(imgBytes)), preview.Image.ContentType, preview.Image.Filename, info.forUserId, info.onHost, ctx)
 			if err != nil {
-				ctx.Log.Warn("Non-fatal error streaming datastore file: " + err.Error())
+				ctx.Log.Warn("Non-fatal error storing preview thumbnail: " + err.Error())
 				sentry.CaptureException(err)
 			} else {
-				defer cleanup.DumpAndCloseStream(mediaStream)
-				img, err := imaging.Decode(mediaStream)
-				if err != nil {
-					ctx.Log.Warn("Non-fatal error getting thumbnail dimensions: " + err.Error())
-					sentry.CaptureException(err)
-				} else {
-					result.ImageMxc = media.MxcUri()
-					result.ImageType = media.ContentType
-					result.ImageSize = media.SizeBytes
-					result.ImageWidth = img.Bounds().Max.X
-					result.ImageHeight = img.Bounds().Max.Y
-				}
+				result.ImageMxc = media.MxcUri()
+				result.ImageType = media.ContentType
+				result.ImageSize = media.SizeBytes
+				result.ImageWidth = imgConfig.Width
+				result.ImageHeight = imgConfig.Height
 			}
 		}
 	}
 
-	dbRecord := &types.CachedUrlPreview{
-		Preview:   result,
-		SearchUrl: info.urlPayload.UrlString,
-		ErrorCode: "",
-		FetchedTs: util.NowMillis(),
-	}
-	err = db.InsertPreview(dbRecord)
-	if err != nil {
-		ctx.Log.Warn("Error caching URL preview: " + err.Error())
-		sentry.CaptureException(err)
-		// Non-fatal: Just report it and move on. The worst that happens is we re-cache it.
+	if preview.Cache.NoStore {
+		ctx.Log.Info("Site asked for the page not to be stored - not caching URL preview")
+	} else {
+		now := util.NowMillis()
+		dbRecord := &types.CachedUrlPreview{
+			Preview:   result,
+			SearchUrl: info.urlPayload.UrlString,
+			ErrorCode: "",
+			FetchedTs: now,
+			ExpiresTs: now + cacheDuration(preview.Cache).Milliseconds(),
+		}
+		err = db.InsertPreview(dbRecord)
+		if err != nil {
+			ctx.Log.Warn("Error caching URL preview: " + err.Error())
+			sentry.CaptureException(err)
+			// Non-fatal: Just report it and move on. The worst that happens is we re-cache it.
+		}
 	}
 
 	resp.preview = result
@@ -193,3 +199,58 @@ func (h *urlResourceHandler) GeneratePreview(urlPayload *preview_types.UrlPayloa
 	}()
 	return resultChan
 }
+
+// readPreviewImage reads the preview image into memory, returning nil bytes if the image exceeds
+// the configured byte or pixel limits. Only the image header is decoded to check the dimensions.
+func readPreviewImage(img *preview_types.PreviewImage, ctx rcontext.RequestContext) ([]byte, image.Config, error) {
+	defer cleanup.DumpAndCloseStream(img.Data)
+
+	maxBytes := ctx.Config.UrlPreviews.MaxImageSizeBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxImageSizeBytes
+	}
+	if img.ContentLength > maxBytes {
+		return nil, image.Config{}, nil
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(img.Data, maxBytes+1))
+	if err != nil {
+		return nil, image.Config{}, err
+	}
+	if int64(len(b)) > maxBytes {
+		return nil, image.Config{}, nil
+	}
+
+	imgConfig, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, image.Config{}, err
+	}
+	maxPixels := ctx.Config.UrlPreviews.MaxImagePixels
+	if maxPixels <= 0 {
+		maxPixels = defaultMaxImagePixels
+	}
+	if util.ExceedsPixelCount(imgConfig.Width, imgConfig.Height, maxPixels) {
+		return nil, image.Config{}, nil
+	}
+
+	return b, imgConfig, nil
+}
+
+// cacheDuration returns how long a preview should be cached for, based on what the site asked
+// for and limited by the configured minimum and maximum.
+func cacheDuration(policy preview_types.CachePolicy) time.Duration {
+	d := time.Hour
+	if policy.MaxAge != nil {
+		d = *policy.MaxAge
+	}
+
+	minDuration := time.Duration(config.Get().UrlPreviews.MinCacheSeconds) * time.Second
+	maxDuration := time.Duration(config.Get().UrlPreviews.MaxCacheSeconds) * time.Second
+	if maxDuration > 0 && d > maxDuration {
+		d = maxDuration
+	}
+	if d < minDuration {
+		d = minDuration
+	}
+	return d
+}
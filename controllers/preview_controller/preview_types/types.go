@@ -4,6 +4,7 @@ import (
 	"errors"
 	"io"
 	"net/url"
+	"time"
 )
 
 type PreviewResult struct {
@@ -13,6 +14,13 @@ type PreviewResult struct {
 	Description string
 	Title       string
 	Image       *PreviewImage
+	Cache       CachePolicy
+}
+
+// CachePolicy is what the previewed site asked of caches through its response headers.
+type CachePolicy struct {
+	NoStore bool
+	MaxAge  *time.Duration // nil if the site didn't say
 }
 
 type PreviewImage struct {
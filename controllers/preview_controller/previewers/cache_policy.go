@@ -0,0 +1,69 @@
+package previewers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/controllers/preview_controller/preview_types"
+)
+
+// parseCachePolicy reads the Cache-Control and Expires headers of a response. Because previews
+// are shared between users, s-maxage takes priority over max-age, which takes priority over
+// Expires. Responses which must be revalidated (no-cache) are treated as already expired.
+func parseCachePolicy(header http.Header, now time.Time) preview_types.CachePolicy {
+	policy := preview_types.CachePolicy{}
+
+	var maxAge *time.Duration
+	var sharedMaxAge *time.Duration
+	noCache := false
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			parts := strings.SplitN(strings.TrimSpace(directive), "=", 2)
+			name := strings.ToLower(parts[0])
+			switch name {
+			case "no-store":
+				policy.NoStore = true
+			case "no-cache":
+				noCache = true
+			case "max-age", "s-maxage":
+				if len(parts) != 2 {
+					continue
+				}
+				seconds, err := strconv.ParseInt(strings.Trim(parts[1], "\""), 10, 64)
+				if err != nil || seconds < 0 {
+					continue
+				}
+				d := time.Duration(seconds) * time.Second
+				if name == "s-maxage" {
+					sharedMaxAge = &d
+				} else {
+					maxAge = &d
+				}
+			}
+		}
+	}
+
+	if noCache {
+		d := time.Duration(0)
+		policy.MaxAge = &d
+	} else if sharedMaxAge != nil {
+		policy.MaxAge = sharedMaxAge
+	} else if maxAge != nil {
+		policy.MaxAge = maxAge
+	} else if expiresStr := header.Get("Expires"); expiresStr != "" {
+		d := time.Duration(0) // invalid dates mean "already expired"
+		if expires, err := http.ParseTime(expiresStr); err == nil {
+			if date, err := http.ParseTime(header.Get("Date")); err == nil {
+				now = date
+			}
+			if expires.After(now) {
+				d = expires.Sub(now)
+			}
+		}
+		policy.MaxAge = &d
+	}
+
+	return policy
+}
@@ -0,0 +1,43 @@
+package previewers
+
+import (
+	"bytes"
+	"io"
+)
+
+// readHtml reads up to maxBytes of an HTML page (the whole page if zero or less), stopping early
+// if the page's <head> has the OpenGraph tags needed for a preview. The body is only needed for
+// the title, description, and image fallbacks when those tags are missing.
+func readHtml(body io.Reader, maxBytes int64) ([]byte, error) {
+	if maxBytes > 0 {
+		body = io.LimitReader(body, maxBytes)
+	}
+
+	buf := &bytes.Buffer{}
+	chunk := make([]byte, 32*1024)
+	headChecked := false
+	for {
+		n, err := body.Read(chunk)
+		buf.Write(chunk[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if !headChecked {
+			lower := bytes.ToLower(buf.Bytes())
+			end := bytes.Index(lower, []byte("</head>"))
+			if end >= 0 {
+				headChecked = true
+				head := lower[:end]
+				if bytes.Contains(head, []byte("og:title")) && bytes.Contains(head, []byte("og:description")) {
+					break
+				}
+			}
+		}
+	}
+
+	return buf.Bytes(), nil
+}
@@ -10,78 +10,113 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ryanuber/go-glob"
 	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
-	"github.com/turt2live/matrix-media-repo/controllers/preview_controller/acl"
 	"github.com/turt2live/matrix-media-repo/controllers/preview_controller/preview_types"
 	"github.com/turt2live/matrix-media-repo/util"
-	"github.com/turt2live/matrix-media-repo/util/cleanup"
+	"github.com/turt2live/matrix-media-repo/util/acl"
 )
 
-func doHttpGet(urlPayload *preview_types.UrlPayload, languageHeader string, ctx rcontext.RequestContext) (*http.Response, error) {
-	var client *http.Client
+type previewDialContextKey struct{}
+
+type previewDial struct {
+	urlPayload *preview_types.UrlPayload
+	ctx        rcontext.RequestContext
+}
+
+var previewTransports = util.NewTransportPool() // network restrictions => transport
+
+// getPreviewTransport returns the transport to reuse connections on. Connections are only made to
+// addresses permitted by the network restrictions, so they're only shared between requests under
+// the same restrictions.
+func getPreviewTransport(ctx rcontext.RequestContext) *http.Transport {
+	key := strings.Join(ctx.Config.UrlPreviews.AllowedNetworks, ",") + "|" + strings.Join(ctx.Config.UrlPreviews.DisallowedNetworks, ",")
+	return previewTransports.Get(key, func() *http.Transport {
+		tr := util.NewHttpTransport()
+		tr.DialContext = dialPreviewAddress
+		return tr
+	})
+}
+
+// dialPreviewAddress connects to the safe address for the request being dialed, as described by
+// the previewDial attached to the request's context.
+func dialPreviewAddress(ctx2 context.Context, network, addr string) (net.Conn, error) {
+	dial, ok := ctx2.Value(previewDialContextKey{}).(*previewDial)
+	if !ok {
+		return nil, errors.New("missing preview request: not safe to complete request")
+	}
+	urlPayload := dial.urlPayload
+	ctx := dial.ctx
+
+	if network != "tcp" {
+		return nil, errors.New("invalid network: expected tcp")
+	}
 
 	dialer := &net.Dialer{
 		Timeout:   time.Duration(ctx.Config.TimeoutSeconds.UrlPreviews) * time.Second,
-		KeepAlive: time.Duration(ctx.Config.TimeoutSeconds.UrlPreviews) * time.Second,
+		KeepAlive: time.Duration(config.Get().OutboundHttp.KeepAliveSeconds) * time.Second,
 		DualStack: true,
 	}
 
-	dialContext := func(ctx2 context.Context, network, addr string) (conn net.Conn, e error) {
-		if network != "tcp" {
-			return nil, errors.New("invalid network: expected tcp")
-		}
+	safeIp, safePort, err := acl.GetSafeAddress(addr, ctx)
+	if err != nil {
+		return nil, err
+	}
 
-		safeIp, safePort, err := acl.GetSafeAddress(addr, ctx)
-		if err != nil {
-			return nil, err
-		}
+	// Try and determine which port we're expecting a request to come in on. Because the
+	// http library follows redirects, we should also keep track of the alternate port
+	// so that redirects don't fail previews. We only support the alternate port if the
+	// default port for the scheme is used, however.
 
-		// Try and determine which port we're expecting a request to come in on. Because the
-		// http library follows redirects, we should also keep track of the alternate port
-		// so that redirects don't fail previews. We only support the alternate port if the
-		// default port for the scheme is used, however.
-
-		altPort := ""
-		if safePort == "" {
-			if urlPayload.ParsedUrl.Scheme == "http" {
-				safePort = "80"
-				altPort = "443"
-			} else if urlPayload.ParsedUrl.Scheme == "https" {
-				safePort = "443"
-				altPort = "80"
-			} else {
-				return nil, errors.New("unexpected scheme: cannot determine port")
-			}
+	altPort := ""
+	if safePort == "" {
+		if urlPayload.ParsedUrl.Scheme == "http" {
+			safePort = "80"
+			altPort = "443"
+		} else if urlPayload.ParsedUrl.Scheme == "https" {
+			safePort = "443"
+			altPort = "80"
+		} else {
+			return nil, errors.New("unexpected scheme: cannot determine port")
 		}
+	}
 
-		safeIpStr := safeIp.String()
-
-		expectedAddr := net.JoinHostPort(urlPayload.ParsedUrl.Host, safePort)
-		altAddr := net.JoinHostPort(urlPayload.ParsedUrl.Host, altPort)
+	safeIpStr := safeIp.String()
 
-		returnAddr := ""
-		if addr == expectedAddr {
-			returnAddr = net.JoinHostPort(safeIpStr, safePort)
-		} else if addr == altAddr && altPort != "" {
-			returnAddr = net.JoinHostPort(safeIpStr, altPort)
-		}
+	expectedAddr := net.JoinHostPort(urlPayload.ParsedUrl.Host, safePort)
+	altAddr := net.JoinHostPort(urlPayload.ParsedUrl.Host, altPort)
 
-		if returnAddr != "" {
-			return dialer.DialContext(ctx, network, returnAddr)
-		}
+	returnAddr := ""
+	if addr == expectedAddr {
+		returnAddr = net.JoinHostPort(safeIpStr, safePort)
+	} else if addr == altAddr && altPort != "" {
+		returnAddr = net.JoinHostPort(safeIpStr, altPort)
+	}
 
-		return nil, errors.New("unexpected host: not safe to complete request")
+	if returnAddr != "" {
+		return dialer.DialContext(ctx2, network, returnAddr)
 	}
 
+	return nil, errors.New("unexpected host: not safe to complete request")
+}
+
+func doHttpGet(urlPayload *preview_types.UrlPayload, languageHeader string, ctx rcontext.RequestContext) (*http.Response, error) {
+	var client *http.Client
+
+	checkRedirect := util.LimitRedirects(ctx.Config.UrlPreviews.MaxRedirects, func(req *http.Request) error {
+		return acl.CheckRedirect(req, ctx)
+	})
+
 	if ctx.Config.UrlPreviews.UnsafeCertificates {
 		ctx.Log.Warn("Ignoring any certificate errors while making request")
 		tr := &http.Transport{
 			DisableKeepAlives: true,
-			DialContext:       dialContext,
+			DialContext:       dialPreviewAddress,
 			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
 			// Based on https://github.com/matrix-org/gomatrixserverlib/blob/51152a681e69a832efcd934b60080b92bc98b286/client.go#L74-L90
 			DialTLS: func(network, addr string) (net.Conn, error) {
@@ -101,20 +136,20 @@ func doHttpGet(urlPayload *preview_types.UrlPayload, languageHeader string, ctx
 			},
 		}
 		client = &http.Client{
-			Transport: tr,
-			Timeout:   time.Duration(ctx.Config.TimeoutSeconds.UrlPreviews) * time.Second,
+			Transport:     tr,
+			Timeout:       time.Duration(ctx.Config.TimeoutSeconds.UrlPreviews) * time.Second,
+			CheckRedirect: checkRedirect,
 		}
 	} else {
 		client = &http.Client{
-			Timeout: time.Duration(ctx.Config.TimeoutSeconds.UrlPreviews) * time.Second,
-			Transport: &http.Transport{
-				DisableKeepAlives: true,
-				DialContext:       dialContext,
-			},
+			Timeout:       time.Duration(ctx.Config.TimeoutSeconds.UrlPreviews) * time.Second,
+			Transport:     getPreviewTransport(ctx),
+			CheckRedirect: checkRedirect,
 		}
 	}
 
-	req, err := http.NewRequest("GET", urlPayload.ParsedUrl.String(), nil)
+	dialCtx := context.WithValue(context.Background(), previewDialContextKey{}, &previewDial{urlPayload: urlPayload, ctx: ctx})
+	req, err := http.NewRequestWithContext(dialCtx, "GET", urlPayload.ParsedUrl.String(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -123,19 +158,30 @@ func doHttpGet(urlPayload *preview_types.UrlPayload, languageHeader string, ctx
 	return client.Do(req)
 }
 
-func downloadRawContent(urlPayload *preview_types.UrlPayload, supportedTypes []string, languageHeader string, ctx rcontext.RequestContext) ([]byte, string, string, string, error) {
-	ctx.Log.Info("Fetching remote content...")
+// openContent requests the page, checking the response can be previewed. The returned reader is
+// limited to the maximum page size, and the response body must be closed by the caller.
+func openContent(urlPayload *preview_types.UrlPayload, supportedTypes []string, languageHeader string, ctx rcontext.RequestContext) (*http.Response, io.Reader, error) {
 	resp, err := doHttpGet(urlPayload, languageHeader, ctx)
 	if err != nil {
-		return nil, "", "", "", err
+		return nil, nil, err
 	}
 	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
 		ctx.Log.Warn("Received status code " + strconv.Itoa(resp.StatusCode))
-		return nil, "", "", "", errors.New("error during transfer")
+		return nil, nil, errors.New("error during transfer")
 	}
 
 	if ctx.Config.UrlPreviews.MaxPageSizeBytes > 0 && resp.ContentLength >= 0 && resp.ContentLength > ctx.Config.UrlPreviews.MaxPageSizeBytes {
-		return nil, "", "", "", common.ErrMediaTooLarge
+		resp.Body.Close()
+		return nil, nil, common.ErrMediaTooLarge
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	for _, supportedType := range supportedTypes {
+		if !glob.Glob(supportedType, contentType) {
+			resp.Body.Close()
+			return nil, nil, preview_types.ErrPreviewUnsupported
+		}
 	}
 
 	var reader io.Reader
@@ -143,19 +189,21 @@ func downloadRawContent(urlPayload *preview_types.UrlPayload, supportedTypes []s
 	if ctx.Config.UrlPreviews.MaxPageSizeBytes > 0 {
 		reader = io.LimitReader(resp.Body, ctx.Config.UrlPreviews.MaxPageSizeBytes)
 	}
+	return resp, reader, nil
+}
 
-	bytes, err := ioutil.ReadAll(reader)
+func downloadRawContent(urlPayload *preview_types.UrlPayload, supportedTypes []string, languageHeader string, ctx rcontext.RequestContext) ([]byte, string, string, string, preview_types.CachePolicy, error) {
+	ctx.Log.Info("Fetching remote content...")
+	resp, reader, err := openContent(urlPayload, supportedTypes, languageHeader, ctx)
 	if err != nil {
-		return nil, "", "", "", err
+		return nil, "", "", "", preview_types.CachePolicy{}, err
 	}
+	// Close without draining so anything past the size limit is never downloaded
+	defer resp.Body.Close()
 
-	defer cleanup.DumpAndCloseStream(resp.Body)
-
-	contentType := resp.Header.Get("Content-Type")
-	for _, supportedType := range supportedTypes {
-		if !glob.Glob(supportedType, contentType) {
-			return nil, "", "", "", preview_types.ErrPreviewUnsupported
-		}
+	bytes, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, "", "", "", preview_types.CachePolicy{}, err
 	}
 
 	disposition := resp.Header.Get("Content-Disposition")
@@ -165,16 +213,26 @@ func downloadRawContent(urlPayload *preview_types.UrlPayload, supportedTypes []s
 		filename = params["filename"]
 	}
 
-	return bytes, filename, contentType, resp.Header.Get("Content-Length"), nil
+	return bytes, filename, resp.Header.Get("Content-Type"), resp.Header.Get("Content-Length"), parseCachePolicy(resp.Header, time.Now()), nil
 }
 
-func downloadHtmlContent(urlPayload *preview_types.UrlPayload, supportedTypes []string, languageHeader string, ctx rcontext.RequestContext) (string, error) {
-	raw, _, contentType, _, err := downloadRawContent(urlPayload, supportedTypes, languageHeader, ctx)
-	html := ""
-	if raw != nil {
-		html = util.ToUtf8(string(raw), contentType)
+func downloadHtmlContent(urlPayload *preview_types.UrlPayload, supportedTypes []string, languageHeader string, ctx rcontext.RequestContext) (string, preview_types.CachePolicy, error) {
+	ctx.Log.Info("Fetching remote HTML...")
+	resp, reader, err := openContent(urlPayload, supportedTypes, languageHeader, ctx)
+	if err != nil {
+		return "", preview_types.CachePolicy{}, err
+	}
+	// Close without draining so anything we don't read is never downloaded
+	defer resp.Body.Close()
+
+	raw, err := readHtml(reader, ctx.Config.UrlPreviews.MaxHtmlSizeBytes)
+	if err != nil {
+		return "", preview_types.CachePolicy{}, err
+	}
+	if ctx.Config.UrlPreviews.MaxHtmlSizeBytes > 0 && int64(len(raw)) >= ctx.Config.UrlPreviews.MaxHtmlSizeBytes {
+		ctx.Log.Info("Page is larger than the HTML size limit - generating the preview from what was read")
 	}
-	return html, err
+	return util.ToUtf8(string(raw), resp.Header.Get("Content-Type")), parseCachePolicy(resp.Header, time.Now()), nil
 }
 
 func downloadImage(urlPayload *preview_types.UrlPayload, languageHeader string, ctx rcontext.RequestContext) (*preview_types.PreviewImage, error) {
@@ -18,7 +18,7 @@ import (
 var ogSupportedTypes = []string{"text/*"}
 
 func GenerateOpenGraphPreview(urlPayload *preview_types.UrlPayload, languageHeader string, ctx rcontext.RequestContext) (preview_types.PreviewResult, error) {
-	html, err := downloadHtmlContent(urlPayload, ogSupportedTypes, languageHeader, ctx)
+	html, cache, err := downloadHtmlContent(urlPayload, ogSupportedTypes, languageHeader, ctx)
 	if err != nil {
 		ctx.Log.Error("Error downloading content: " + err.Error())
 
@@ -58,6 +58,7 @@ func GenerateOpenGraphPreview(urlPayload *preview_types.UrlPayload, languageHead
 		Title:       og.Title,
 		Description: og.Description,
 		SiteName:    og.SiteName,
+		Cache:       cache,
 	}
 
 	if og.Images != nil && len(og.Images) > 0 {
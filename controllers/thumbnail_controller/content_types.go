@@ -0,0 +1,22 @@
+package thumbnail_controller
+
+import (
+	"github.com/ryanuber/go-glob"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// IsThumbnailingEnabled determines if the config allows media of the given content type to be
+// thumbnailed: the type must be listed in the thumbnail types and not match any of the disabled
+// types. This does not check if the media repo is capable of thumbnailing the type.
+func IsThumbnailingEnabled(contentType string, ctx rcontext.RequestContext) bool {
+	if !util.ArrayContains(ctx.Config.Thumbnails.Types, contentType) {
+		return false
+	}
+	for _, disabled := range ctx.Config.Thumbnails.DisabledTypes {
+		if glob.Glob(disabled, contentType) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,53 @@
+package thumbnail_controller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+)
+
+// thumbnailGenerationSettings are the parts of the thumbnail config which change what a thumbnail
+// of a given size looks like. Sizes aren't included because thumbnails are stored by size anyway.
+type thumbnailGenerationSettings struct {
+	OutputTypes    []config.ThumbnailOutputType
+	StillFrame     float32
+	AudioWaveforms bool
+	AllowUpscaling bool
+}
+
+// generationOf returns an identifier for the thumbnail config. Thumbnails generated with a different
+// generation are considered stale and are regenerated when requested.
+func generationOf(conf config.ThumbnailsConfig) string {
+	b, err := json.Marshal(&thumbnailGenerationSettings{
+		OutputTypes:    conf.OutputTypes,
+		StillFrame:     conf.StillFrame,
+		AudioWaveforms: conf.AudioWaveforms,
+		AllowUpscaling: conf.AllowUpscaling,
+	})
+	if err != nil {
+		panic(err) // should never happen
+	}
+	hash := sha256.Sum256(b)
+	return hex.EncodeToString(hash[:])[:16]
+}
+
+// legacyGeneration is the generation of thumbnails made before generations were tracked. We don't
+// know which config made them, so they are treated as current rather than being regenerated or purged.
+const legacyGeneration = ""
+
+func currentGeneration(ctx rcontext.RequestContext) string {
+	return generationOf(ctx.Config.Thumbnails)
+}
+
+// CurrentGenerations returns the thumbnail generations for the main config and every domain, as
+// well as the legacy generation.
+func CurrentGenerations() []string {
+	generations := []string{legacyGeneration, generationOf(config.Get().Thumbnails.ThumbnailsConfig)}
+	for _, domain := range config.AllDomains() {
+		generations = append(generations, generationOf(domain.Thumbnails))
+	}
+	return generations
+}
@@ -0,0 +1,69 @@
+package thumbnail_controller
+
+import (
+	"sync"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/metrics"
+)
+
+var generationSlots chan bool
+var generationSlotsLock = &sync.Mutex{}
+
+func withGenerationSlot(ctx rcontext.RequestContext, fn func() error) error {
+	slots, err := acquireGenerationSlot(ctx)
+	if err != nil {
+		return err
+	}
+	defer releaseGenerationSlot(slots)
+	return fn()
+}
+
+// getGenerationSlots gets the slots for the configured limit, or nil if there is no limit. The
+// limit is read each time so config changes apply to new generations: when it changes, generations
+// which are already running keep (and release) their slots in the old set.
+func getGenerationSlots() chan bool {
+	generationSlotsLock.Lock()
+	defer generationSlotsLock.Unlock()
+
+	limit := config.Get().Thumbnails.MaxConcurrentGenerations
+	if limit <= 0 {
+		generationSlots = nil
+	} else if generationSlots == nil || cap(generationSlots) != limit {
+		generationSlots = make(chan bool, limit)
+	}
+	return generationSlots
+}
+
+func acquireGenerationSlot(ctx rcontext.RequestContext) (chan bool, error) {
+	slots := getGenerationSlots()
+	if slots == nil {
+		return nil, nil // no limit
+	}
+
+	metrics.ThumbnailQueueDepth.Inc()
+	defer metrics.ThumbnailQueueDepth.Dec()
+
+	timeoutSeconds := config.Get().Thumbnails.QueueTimeoutSeconds
+	if timeoutSeconds <= 0 {
+		slots <- true
+		return slots, nil
+	}
+
+	select {
+	case slots <- true:
+		return slots, nil
+	case <-time.After(time.Duration(timeoutSeconds) * time.Second):
+		ctx.Log.Warn("Timed out waiting for a thumbnail generation slot")
+		return nil, common.ErrThumbnailQueueTimeout
+	}
+}
+
+func releaseGenerationSlot(slots chan bool) {
+	if slots != nil {
+		<-slots
+	}
+}
@@ -0,0 +1,109 @@
+package thumbnail_controller
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/pkg/errors"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/thumbnailing"
+	"github.com/turt2live/matrix-media-repo/thumbnailing/i"
+	"github.com/turt2live/matrix-media-repo/thumbnailing/m"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// GeneratePresetThumbnails generates (static) thumbnails for all of the configured thumbnail sizes
+// of the media, skipping any which already exist. Where possible, the source image is decoded only
+// once for all of the sizes.
+func GeneratePresetThumbnails(media *types.Media, ctx rcontext.RequestContext) error {
+	contentType := util.FixContentType(media.ContentType)
+	if !thumbnailing.IsSupported(contentType) || !IsThumbnailingEnabled(contentType, ctx) {
+		return nil
+	}
+	if media.Quarantined {
+		return nil
+	}
+	if ctx.Config.Thumbnails.MaxSourceBytes > 0 && media.SizeBytes > ctx.Config.Thumbnails.MaxSourceBytes {
+		ctx.Log.Info("Media too large to generate preset thumbnails for")
+		return nil
+	}
+	if thumbnailable, err := isThumbnailable(media, ctx); err != nil || !thumbnailable {
+		return err
+	}
+
+	db := storage.GetDatabase().GetThumbnailStore(ctx)
+	presets := make([]i.Preset, 0)
+	seen := make(map[string]bool)
+	for _, size := range ctx.Config.Thumbnails.Sizes {
+		for _, method := range []string{"crop", "scale"} {
+			width, height, method, err := pickThumbnailDimensions(size.Width, size.Height, method, ctx)
+			if err != nil {
+				return err
+			}
+			key := fmt.Sprintf("%dx%d-%s", width, height, method)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			_, err = db.Get(media.Origin, media.MediaId, width, height, method, false, media.Sha256Hash, currentGeneration(ctx))
+			if err == nil {
+				continue // already generated
+			} else if err != sql.ErrNoRows {
+				return err
+			}
+			presets = append(presets, i.Preset{Width: width, Height: height, Method: method})
+		}
+	}
+	if len(presets) == 0 {
+		return nil
+	}
+
+	if !thumbnailing.SupportsPresets(contentType) {
+		// Fall back to generating each size individually
+		for _, preset := range presets {
+			_, err := GetOrGenerateThumbnail(media, preset.Width, preset.Height, false, preset.Method, ctx)
+			if err != nil {
+				return errors.Wrap(err, fmt.Sprintf("%dx%d %s", preset.Width, preset.Height, preset.Method))
+			}
+		}
+		return nil
+	}
+
+	ctx.Log.Infof("Generating %d preset thumbnails", len(presets))
+	var thumbs []*m.Thumbnail
+	err := withGenerationSlot(ctx, func() error {
+		mediaStream, err := datastore.DownloadStream(ctx, media.DatastoreId, media.Location)
+		if err != nil {
+			return err
+		}
+		thumbs, err = thumbnailing.GeneratePresetThumbnails(mediaStream, contentType, presets, ctx)
+		return err
+	})
+	if err != nil {
+		if err == common.ErrMediaTooLarge {
+			ctx.Log.Info("Media too large to generate preset thumbnails for")
+			return nil
+		}
+		return err
+	}
+
+	for idx, preset := range presets {
+		generated, err := storeThumbnail(media, thumbs[idx], preset.Width, preset.Height, preset.Method, false, ctx)
+		if err == nil {
+			_, err = insertThumbnailRecord(media, preset.Width, preset.Height, preset.Method, currentGeneration(ctx), generated, ctx)
+		}
+		if err != nil {
+			// Keep going: the thumbnail will be generated on request instead
+			ctx.Log.Warn("Failed to store preset thumbnail: " + err.Error())
+			sentry.CaptureException(err)
+		}
+	}
+
+	return nil
+}
@@ -5,7 +5,10 @@ import (
 	"database/sql"
 	"fmt"
 	"github.com/getsentry/sentry-go"
+	"image"
+	"io"
 	"io/ioutil"
+	"strings"
 	"time"
 
 	"github.com/disintegration/imaging"
@@ -26,6 +29,16 @@ import (
 
 var localCache = cache.New(30*time.Second, 60*time.Second)
 
+// The dimensions of original images, by hash, for deciding whether they can be served as thumbnails
+var originalDimensionsCache = cache.New(1*time.Hour, 2*time.Hour)
+
+type originalDimensions struct {
+	width     int
+	height    int
+	decodable bool
+	animated  bool
+}
+
 func GetThumbnail(origin string, mediaId string, desiredWidth int, desiredHeight int, animated bool, method string, downloadRemote bool, ctx rcontext.RequestContext) (*types.StreamedThumbnail, error) {
 	media, err := download_controller.FindMediaRecord(origin, mediaId, downloadRemote, ctx)
 	if err != nil {
@@ -39,9 +52,9 @@ func GetThumbnail(origin string, mediaId string, desiredWidth int, desiredHeight
 		return nil, errors.New("cannot generate thumbnail for this media's content type")
 	}
 
-	if !util.ArrayContains(ctx.Config.Thumbnails.Types, mediaContentType) {
-		ctx.Log.Warn("Cannot generate thumbnail for " + mediaContentType + " because it is not listed in the config")
-		return nil, errors.New("cannot generate thumbnail for this media's content type")
+	if !IsThumbnailingEnabled(mediaContentType, ctx) {
+		ctx.Log.Warn("Cannot generate thumbnail for " + mediaContentType + " because it is disabled in the config")
+		return nil, common.ErrThumbnailsDisabled
 	}
 
 	if media.Quarantined {
@@ -78,38 +91,64 @@ func GetThumbnail(origin string, mediaId string, desiredWidth int, desiredHeight
 		return nil, common.ErrMediaQuarantined
 	}
 
-	if animated && ctx.Config.Thumbnails.MaxAnimateSizeBytes > 0 && ctx.Config.Thumbnails.MaxAnimateSizeBytes < media.SizeBytes {
-		ctx.Log.Warn("Attempted to animate a media record that is too large. Assuming animated=false")
-		animated = false
-	}
-
-	if animated && !thumbnailing.IsAnimationSupported(mediaContentType) {
-		ctx.Log.Warn("Attempted to animate a media record that isn't an animated type. Assuming animated=false")
-		animated = false
-	}
-
-	if ctx.Config.Thumbnails.MaxSourceBytes > 0 && media.SizeBytes > ctx.Config.Thumbnails.MaxSourceBytes {
-		ctx.Log.Warn("Media too large to thumbnail")
-		return nil, common.ErrMediaTooLarge
-	}
-
-	width, height, method, err := pickThumbnailDimensions(desiredWidth, desiredHeight, method, ctx)
+	width, height, method, animated, err := getThumbnailParams(media, desiredWidth, desiredHeight, method, animated, ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	cacheKey := fmt.Sprintf("%s/%s?w=%d&h=%d&m=%s&a=%t", media.Origin, media.MediaId, width, height, method, animated)
+	outputType := thumbnailing.PickOutputType(mediaContentType, ctx)
+	generation := currentGeneration(ctx)
+	cacheKey := fmt.Sprintf("%s/%s?w=%d&h=%d&m=%s&a=%t&t=%s&s=%s&g=%s", media.Origin, media.MediaId, width, height, method, animated, outputType, media.Sha256Hash, generation)
 
 	v, _, err := globals.DefaultRequestGroup.Do(cacheKey, func() (interface{}, error) {
 		db := storage.GetDatabase().GetThumbnailStore(ctx)
 
 		var thumbnail *types.Thumbnail
+		stale := false
 		item, found := localCache.Get(cacheKey)
 		if found {
 			thumbnail = item.(*types.Thumbnail)
 		} else {
+			if !storage.IsDatabaseAvailable() {
+				return nil, common.ErrDatabaseUnavailable
+			}
+
+			thumbnailable, err := isThumbnailable(media, ctx)
+			if err != nil {
+				return nil, err
+			}
+			if !thumbnailable {
+				ctx.Log.Warn("Media is marked as not thumbnailable")
+				return nil, common.ErrMediaNotThumbnailable
+			}
+
 			ctx.Log.Info("Getting thumbnail record from database")
-			dbThumb, err := db.Get(media.Origin, media.MediaId, width, height, method, animated)
+			dbThumb, err := db.Get(media.Origin, media.MediaId, width, height, method, animated, media.Sha256Hash, generation)
+			if err == sql.ErrNoRows {
+				dbThumb, err = db.Get(media.Origin, media.MediaId, width, height, method, animated, media.Sha256Hash, legacyGeneration)
+				// Legacy thumbnails don't record the output types they were made with, so are only
+				// served if they are in the type clients of this config expect
+				if err == nil && outputType != "" && dbThumb.ContentType != outputType {
+					err = sql.ErrNoRows
+				}
+			}
+			if err == sql.ErrNoRows {
+				dbThumb, err = shareThumbnailFromSource(media, width, height, method, animated, ctx)
+			}
+			if err == sql.ErrNoRows {
+				dbThumb, err = useOriginalAsThumbnail(media, width, height, method, animated, generation, ctx)
+			}
+			if err == sql.ErrNoRows && ctx.Config.Thumbnails.StaleWhileRevalidate {
+				dbThumb, err = db.GetLatestOfAnyGeneration(media.Origin, media.MediaId, width, height, method, animated, media.Sha256Hash)
+				if err == nil && outputType != "" && dbThumb.ContentType != outputType {
+					err = sql.ErrNoRows // generate rather than serve the wrong type
+				}
+				if err == nil {
+					ctx.Log.Info("Serving thumbnail from an older thumbnail config while it is regenerated")
+					stale = true
+					regenerateInBackground(media, width, height, method, animated, generation, ctx)
+				}
+			}
 			if err != nil {
 				if err == sql.ErrNoRows {
 					ctx.Log.Info("Thumbnail does not exist, attempting to generate it")
@@ -132,12 +171,11 @@ func GetThumbnail(origin string, mediaId string, desiredWidth int, desiredHeight
 			return nil, common.ErrMediaNotFound
 		}
 
-		err = storage.GetDatabase().GetMetadataStore(ctx).UpsertLastAccess(thumbnail.Sha256Hash, util.NowMillis())
-		if err != nil {
-			ctx.Log.Warn("Failed to upsert the last access time: ", err)
-		}
+		download_controller.TrackAccess(thumbnail.Sha256Hash)
 
-		localCache.Set(cacheKey, thumbnail, cache.DefaultExpiration)
+		if !stale {
+			localCache.Set(cacheKey, thumbnail, cache.DefaultExpiration)
+		}
 
 		cached, err := internal_cache.Get().GetMedia(thumbnail.Sha256Hash, internal_cache.StreamerForThumbnail(thumbnail), ctx)
 		if err != nil {
@@ -186,9 +224,101 @@ func GetThumbnail(origin string, mediaId string, desiredWidth int, desiredHeight
 	return value, err
 }
 
+// GetThumbnailHeaders finds the thumbnail record for answering a HEAD request. Unlike GetThumbnail,
+// remote media which hasn't been cached is not downloaded and thumbnails are not generated: only
+// thumbnails which already exist are described. The returned stream is empty.
+func GetThumbnailHeaders(origin string, mediaId string, desiredWidth int, desiredHeight int, animated bool, method string, ctx rcontext.RequestContext) (*types.StreamedThumbnail, error) {
+	media, err := download_controller.FindMediaRecord(origin, mediaId, false, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	mediaContentType := util.FixContentType(media.ContentType)
+	if !thumbnailing.IsSupported(mediaContentType) {
+		return nil, errors.New("cannot generate thumbnail for this media's content type")
+	}
+	if !IsThumbnailingEnabled(mediaContentType, ctx) {
+		return nil, common.ErrThumbnailsDisabled
+	}
+
+	if media.Quarantined {
+		if ctx.Config.Quarantine.ReplaceThumbnails {
+			// The replacement is generated without touching the media, so is cheap enough to describe
+			return GetThumbnail(origin, mediaId, desiredWidth, desiredHeight, animated, method, false, ctx)
+		}
+		return nil, common.ErrMediaQuarantined
+	}
+
+	width, height, method, animated, err := getThumbnailParams(media, desiredWidth, desiredHeight, method, animated, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	thumbnailable, err := isThumbnailable(media, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !thumbnailable {
+		return nil, common.ErrMediaNotThumbnailable
+	}
+
+	db := storage.GetDatabase().GetThumbnailStore(ctx)
+	thumbnail, err := db.Get(media.Origin, media.MediaId, width, height, method, animated, media.Sha256Hash, currentGeneration(ctx))
+	if err == sql.ErrNoRows {
+		thumbnail, err = db.Get(media.Origin, media.MediaId, width, height, method, animated, media.Sha256Hash, legacyGeneration)
+	}
+	if err == sql.ErrNoRows && media.Sha256Hash != "" {
+		thumbnail, err = db.GetBySourceHash(media.Sha256Hash, width, height, method, animated, currentGeneration(ctx))
+	}
+	if err == sql.ErrNoRows && ctx.Config.Thumbnails.StaleWhileRevalidate {
+		thumbnail, err = db.GetLatestOfAnyGeneration(media.Origin, media.MediaId, width, height, method, animated, media.Sha256Hash)
+	}
+	if err == sql.ErrNoRows {
+		ctx.Log.Info("Thumbnail has not been generated yet")
+		return nil, common.ErrMediaNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.StreamedThumbnail{Thumbnail: thumbnail, Stream: util.BytesToStream(nil)}, nil
+}
+
+// getThumbnailParams checks that a thumbnail of the media can be served, returning the dimensions,
+// method, and animation of the thumbnail to use for the request.
+func getThumbnailParams(media *types.Media, desiredWidth int, desiredHeight int, method string, animated bool, ctx rcontext.RequestContext) (int, int, string, bool, error) {
+	if media.SoftDeleted {
+		ctx.Log.Warn("Deleted media accessed")
+		return 0, 0, "", false, common.ErrMediaNotFound
+	}
+
+	mediaContentType := util.FixContentType(media.ContentType)
+	if animated && ctx.Config.Thumbnails.MaxAnimateSizeBytes > 0 && ctx.Config.Thumbnails.MaxAnimateSizeBytes < media.SizeBytes {
+		ctx.Log.Warn("Attempted to animate a media record that is too large. Assuming animated=false")
+		animated = false
+	}
+
+	if animated && !thumbnailing.IsAnimationSupported(mediaContentType) {
+		ctx.Log.Warn("Attempted to animate a media record that isn't an animated type. Assuming animated=false")
+		animated = false
+	}
+
+	if ctx.Config.Thumbnails.MaxSourceBytes > 0 && media.SizeBytes > ctx.Config.Thumbnails.MaxSourceBytes {
+		ctx.Log.Warn("Media too large to thumbnail")
+		return 0, 0, "", false, common.ErrMediaTooLarge
+	}
+
+	width, height, method, err := pickThumbnailDimensions(desiredWidth, desiredHeight, method, ctx)
+	if err != nil {
+		return 0, 0, "", false, err
+	}
+	return width, height, method, animated, nil
+}
+
 func GetOrGenerateThumbnail(media *types.Media, width int, height int, animated bool, method string, ctx rcontext.RequestContext) (*types.Thumbnail, error) {
+	generation := currentGeneration(ctx)
 	db := storage.GetDatabase().GetThumbnailStore(ctx)
-	thumbnail, err := db.Get(media.Origin, media.MediaId, width, height, method, animated)
+	thumbnail, err := db.Get(media.Origin, media.MediaId, width, height, method, animated, media.Sha256Hash, generation)
 	if err != nil && err != sql.ErrNoRows {
 		return nil, err
 	}
@@ -198,14 +328,30 @@ func GetOrGenerateThumbnail(media *types.Media, width int, height int, animated
 	}
 
 	ctx.Log.Info("Generating thumbnail")
+	defer ctx.TimePhase("thumbnailGeneration")()
 
-	thumbnailChan := getResourceHandler().GenerateThumbnail(media, width, height, method, animated)
+	thumbnailChan := getResourceHandler().GenerateThumbnail(media, width, height, method, animated, generation)
 	defer close(thumbnailChan)
 
 	result := <-thumbnailChan
 	return result.thumbnail, result.err
 }
 
+// regenerateInBackground generates the thumbnail for the current thumbnail config without waiting
+// for it. Requests for the same thumbnail which arrive while it is being generated share the work.
+func regenerateInBackground(media *types.Media, width int, height int, method string, animated bool, generation string, ctx rcontext.RequestContext) {
+	go func() {
+		thumbnailChan := getResourceHandler().GenerateThumbnail(media, width, height, method, animated, generation)
+		defer close(thumbnailChan)
+
+		result := <-thumbnailChan
+		if result.err != nil {
+			ctx.Log.Warn("Error regenerating thumbnail in the background: ", result.err)
+			sentry.CaptureException(result.err)
+		}
+	}()
+}
+
 func pickThumbnailDimensions(desiredWidth int, desiredHeight int, desiredMethod string, ctx rcontext.RequestContext) (int, int, string, error) {
 	if desiredWidth <= 0 {
 		return 0, 0, "", errors.New("width must be positive")
@@ -266,3 +412,134 @@ func pickThumbnailDimensions(desiredWidth int, desiredHeight int, desiredMethod
 
 	return targetWidth, targetHeight, desiredMethod, nil
 }
+
+// isThumbnailable returns false if the media has been marked as never needing thumbnails, such as
+// for encrypted files. Media with a download limit is never thumbnailed either, as thumbnails (or
+// the original, when served as its own thumbnail) would be downloads which aren't counted.
+func isThumbnailable(media *types.Media, ctx rcontext.RequestContext) (bool, error) {
+	attrs, err := download_controller.GetMediaAttributes(media.Origin, media.MediaId, ctx)
+	if err != nil {
+		return false, err
+	}
+	return attrs.Thumbnailable && attrs.MaxDownloads <= 0, nil
+}
+
+// useOriginalAsThumbnail returns a thumbnail record for the original media if it can be served as the
+// thumbnail unchanged, saving a pointless decode and encode. The record is not stored in the database.
+// Returns sql.ErrNoRows if a thumbnail needs generating.
+func useOriginalAsThumbnail(media *types.Media, width int, height int, method string, animated bool, generation string, ctx rcontext.RequestContext) (*types.Thumbnail, error) {
+	contentType := util.FixContentType(media.ContentType)
+	if !strings.HasPrefix(contentType, "image/") {
+		return nil, sql.ErrNoRows
+	}
+
+	if !thumbnailing.OutputKeepsFormat(contentType, ctx) {
+		// Thumbnails are converted to another format, which the original isn't in
+		return nil, sql.ErrNoRows
+	}
+
+	attrs, err := download_controller.GetMediaAttributes(media.Origin, media.MediaId, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if attrs.ForceAttachment {
+		// The original might be a polyglot: generating a thumbnail re-encodes it as a plain image
+		return nil, sql.ErrNoRows
+	}
+
+	dimensions, err := getOriginalDimensions(media, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !dimensions.decodable || !thumbnailing.IsOriginalSuitable(dimensions.width, dimensions.height, width, height, ctx) {
+		return nil, sql.ErrNoRows
+	}
+	if dimensions.animated && !animated {
+		// A still thumbnail was asked for, so the first frame needs extracting
+		return nil, sql.ErrNoRows
+	}
+
+	ctx.Log.Info("Original media is no larger than the requested thumbnail - serving it directly")
+	return &types.Thumbnail{
+		Origin:           media.Origin,
+		MediaId:          media.MediaId,
+		Width:            width,
+		Height:           height,
+		Method:           method,
+		Animated:         animated,
+		ContentType:      contentType,
+		SizeBytes:        media.SizeBytes,
+		DatastoreId:      media.DatastoreId,
+		Location:         media.Location,
+		CreationTs:       media.CreationTs,
+		Sha256Hash:       media.Sha256Hash,
+		SourceSha256Hash: media.Sha256Hash,
+		Generation:       generation,
+	}, nil
+}
+
+// getOriginalDimensions returns the dimensions of the original image, reading them from the start of
+// the file the first time they are needed for the file's contents. Images of a type which can be
+// animated are read in full to find out whether they are.
+func getOriginalDimensions(media *types.Media, ctx rcontext.RequestContext) (*originalDimensions, error) {
+	cacheKey := media.Sha256Hash
+	if cacheKey == "" {
+		cacheKey = media.Origin + "/" + media.MediaId
+	}
+	if item, found := originalDimensionsCache.Get(cacheKey); found {
+		return item.(*originalDimensions), nil
+	}
+
+	stream, err := datastore.DownloadStream(ctx, media.DatastoreId, media.Location)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	contentType := util.FixContentType(media.ContentType)
+	var reader io.Reader = stream
+	var b []byte
+	if thumbnailing.IsAnimationSupported(contentType) {
+		b, err = ioutil.ReadAll(stream)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	dimensions := &originalDimensions{}
+	conf, _, err := image.DecodeConfig(reader)
+	if err == nil {
+		dimensions.width = conf.Width
+		dimensions.height = conf.Height
+		dimensions.decodable = true
+		dimensions.animated = b != nil && thumbnailing.IsAnimated(b, contentType)
+	}
+	originalDimensionsCache.Set(cacheKey, dimensions, cache.DefaultExpiration)
+	return dimensions, nil
+}
+
+// shareThumbnailFromSource looks for an existing thumbnail of other media with the same contents,
+// copying the record over to the given media. The thumbnail file itself is shared between them.
+func shareThumbnailFromSource(media *types.Media, width int, height int, method string, animated bool, ctx rcontext.RequestContext) (*types.Thumbnail, error) {
+	if media.Sha256Hash == "" {
+		return nil, sql.ErrNoRows
+	}
+
+	db := storage.GetDatabase().GetThumbnailStore(ctx)
+	existing, err := db.GetBySourceHash(media.Sha256Hash, width, height, method, animated, currentGeneration(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx.Log.Info("Reusing thumbnail of ", existing.Origin, "/", existing.MediaId, " which has the same source media")
+	thumbnail := *existing
+	thumbnail.Origin = media.Origin
+	thumbnail.MediaId = media.MediaId
+	thumbnail.CreationTs = util.NowMillis()
+	err = db.Insert(&thumbnail)
+	if err != nil {
+		return nil, err
+	}
+	return &thumbnail, nil
+}
@@ -0,0 +1,111 @@
+package thumbnail_controller
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"testing"
+
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/upload_controller"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/tests/test_internals"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// uploadTestImage uploads a PNG of random pixels, so each test has its own contents.
+func uploadTestImage(t *testing.T, width int, height int, ctx rcontext.RequestContext) *types.Media {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(rand.Intn(256)), G: uint8(rand.Intn(256)), B: uint8(rand.Intn(256)), A: 255})
+		}
+	}
+	buf := &bytes.Buffer{}
+	err := png.Encode(buf, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	media, err := upload_controller.UploadMedia(util.BufferToStream(buf), int64(buf.Len()), "image/png", "test.png", "@alice:localhost", "localhost", ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return media
+}
+
+func assertOriginalServed(t *testing.T, media *types.Media, width int, height int, ctx rcontext.RequestContext) {
+	thumbnail, err := GetThumbnail(media.Origin, media.MediaId, width, height, false, "scale", false, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer thumbnail.Stream.Close()
+
+	if thumbnail.Thumbnail.Location != media.Location || thumbnail.Thumbnail.Sha256Hash != media.Sha256Hash {
+		t.Errorf("expected the original media to be served, got %s with hash %s", thumbnail.Thumbnail.Location, thumbnail.Thumbnail.Sha256Hash)
+	}
+	if thumbnail.Thumbnail.ContentType != "image/png" {
+		t.Errorf("expected image/png, got %s", thumbnail.Thumbnail.ContentType)
+	}
+
+	records, err := storage.GetDatabase().GetThumbnailStore(ctx).GetAllForMedia(media.Origin, media.MediaId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) > 0 {
+		t.Errorf("expected no thumbnail records, found %d", len(records))
+	}
+}
+
+func TestSmallOriginalServedAsThumbnail(t *testing.T) {
+	ctx := test_internals.SetupDatabase(t)
+	media := uploadTestImage(t, 16, 16, ctx)
+
+	assertOriginalServed(t, media, 320, 240, ctx)
+
+	// The dimensions are remembered so later requests don't need to read the original
+	item, found := originalDimensionsCache.Get(media.Sha256Hash)
+	if !found {
+		t.Fatal("expected the original's dimensions to be cached")
+	}
+	if dimensions := item.(*originalDimensions); !dimensions.decodable || dimensions.width != 16 || dimensions.height != 16 {
+		t.Errorf("expected cached dimensions of 16x16, got %+v", dimensions)
+	}
+	assertOriginalServed(t, media, 640, 480, ctx)
+}
+
+func TestSmallOriginalServedWithMatchingOutputType(t *testing.T) {
+	ctx := test_internals.SetupDatabase(t)
+	ctx.Config.Thumbnails.OutputTypes = []config.ThumbnailOutputType{
+		{SourceType: "image/png", OutputType: "image/png"},
+		{SourceType: "image/*", OutputType: "image/jpeg"},
+	}
+	media := uploadTestImage(t, 16, 16, ctx)
+
+	assertOriginalServed(t, media, 320, 240, ctx)
+}
+
+func TestSmallOriginalNotServedWithOtherOutputType(t *testing.T) {
+	ctx := test_internals.SetupDatabase(t)
+	ctx.Config.Thumbnails.OutputTypes = []config.ThumbnailOutputType{
+		{SourceType: "image/*", OutputType: "image/jpeg"},
+	}
+	media := uploadTestImage(t, 16, 16, ctx)
+
+	thumbnail, err := GetThumbnail(media.Origin, media.MediaId, 320, 240, false, "scale", false, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer thumbnail.Stream.Close()
+
+	if thumbnail.Thumbnail.Location == media.Location {
+		t.Error("expected a thumbnail to be generated instead of serving the original")
+	}
+	if thumbnail.Thumbnail.ContentType != "image/jpeg" {
+		t.Errorf("expected image/jpeg, got %s", thumbnail.Thumbnail.ContentType)
+	}
+}
@@ -13,10 +13,12 @@ import (
 	"github.com/turt2live/matrix-media-repo/common"
 	"github.com/turt2live/matrix-media-repo/common/config"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/upload_controller"
 	"github.com/turt2live/matrix-media-repo/metrics"
 	"github.com/turt2live/matrix-media-repo/storage"
 	"github.com/turt2live/matrix-media-repo/storage/datastore"
 	"github.com/turt2live/matrix-media-repo/thumbnailing"
+	"github.com/turt2live/matrix-media-repo/thumbnailing/m"
 	"github.com/turt2live/matrix-media-repo/types"
 	"github.com/turt2live/matrix-media-repo/util"
 	"github.com/turt2live/matrix-media-repo/util/resource_handler"
@@ -27,11 +29,12 @@ type thumbnailResourceHandler struct {
 }
 
 type thumbnailRequest struct {
-	media    *types.Media
-	width    int
-	height   int
-	method   string
-	animated bool
+	media      *types.Media
+	width      int
+	height     int
+	method     string
+	animated   bool
+	generation string
 }
 
 type thumbnailResponse struct {
@@ -97,7 +100,6 @@ func thumbnailWorkFn(request *resource_handler.WorkRequest) (resp *thumbnailResp
 		return &thumbnailResponse{err: err}
 	}
 
-
 	if info.animated != generated.Animated {
 		ctx.Log.Warn("Animation state changed to ", generated.Animated)
 
@@ -105,25 +107,8 @@ func thumbnailWorkFn(request *resource_handler.WorkRequest) (resp *thumbnailResp
 		generated.Animated = info.animated
 	}
 
-	newThumb := &types.Thumbnail{
-		Origin:      info.media.Origin,
-		MediaId:     info.media.MediaId,
-		Width:       info.width,
-		Height:      info.height,
-		Method:      info.method,
-		Animated:    generated.Animated,
-		CreationTs:  util.NowMillis(),
-		ContentType: generated.ContentType,
-		DatastoreId: generated.DatastoreId,
-		Location:    generated.DatastoreLocation,
-		SizeBytes:   generated.SizeBytes,
-		Sha256Hash:  generated.Sha256Hash,
-	}
-
-	db := storage.GetDatabase().GetThumbnailStore(ctx)
-	err = db.Insert(newThumb)
+	newThumb, err := insertThumbnailRecord(info.media, info.width, info.height, info.method, info.generation, generated, ctx)
 	if err != nil {
-		ctx.Log.Error("Unexpected error caching thumbnail: " + err.Error())
 		resp.err = err
 	} else {
 		resp.thumbnail = newThumb
@@ -132,16 +117,45 @@ func thumbnailWorkFn(request *resource_handler.WorkRequest) (resp *thumbnailResp
 	return resp
 }
 
-func (h *thumbnailResourceHandler) GenerateThumbnail(media *types.Media, width int, height int, method string, animated bool) chan *thumbnailResponse {
+func insertThumbnailRecord(media *types.Media, width int, height int, method string, generation string, generated *GeneratedThumbnail, ctx rcontext.RequestContext) (*types.Thumbnail, error) {
+	newThumb := &types.Thumbnail{
+		Origin:           media.Origin,
+		MediaId:          media.MediaId,
+		Width:            width,
+		Height:           height,
+		Method:           method,
+		Animated:         generated.Animated,
+		CreationTs:       util.NowMillis(),
+		ContentType:      generated.ContentType,
+		DatastoreId:      generated.DatastoreId,
+		Location:         generated.DatastoreLocation,
+		SizeBytes:        generated.SizeBytes,
+		Sha256Hash:       generated.Sha256Hash,
+		SourceSha256Hash: media.Sha256Hash,
+		Generation:       generation,
+	}
+
+	db := storage.GetDatabase().GetThumbnailStore(ctx)
+	err := db.Insert(newThumb)
+	if err != nil {
+		ctx.Log.Error("Unexpected error caching thumbnail: " + err.Error())
+		return nil, err
+	}
+	return newThumb, nil
+}
+
+func (h *thumbnailResourceHandler) GenerateThumbnail(media *types.Media, width int, height int, method string, animated bool, generation string) chan *thumbnailResponse {
 	resultChan := make(chan *thumbnailResponse)
 	go func() {
-		reqId := fmt.Sprintf("thumbnail_%s_%s_%d_%d_%s_%t", media.Origin, media.MediaId, width, height, method, animated)
+		// The generation covers the configured output types, so different output types never share a request
+		reqId := fmt.Sprintf("thumbnail_%s_%s_%d_%d_%s_%t_%s_%s", media.Origin, media.MediaId, width, height, method, animated, media.Sha256Hash, generation)
 		c := h.resourceHandler.GetResource(reqId, &thumbnailRequest{
-			media:    media,
-			width:    width,
-			height:   height,
-			method:   method,
-			animated: animated,
+			media:      media,
+			width:      width,
+			height:     height,
+			method:     method,
+			animated:   animated,
+			generation: generation,
 		})
 		defer close(c)
 		result := <-c
@@ -154,20 +168,34 @@ func GenerateThumbnail(media *types.Media, width int, height int, method string,
 	allowAnimated := ctx.Config.Thumbnails.AllowAnimated
 	animated = animated && allowAnimated
 
-	mediaStream, err := datastore.DownloadStream(ctx, media.DatastoreId, media.Location)
-	if err != nil {
-		ctx.Log.Error("Error getting file: ", err)
-		return nil, err
-	}
-
 	mediaContentType := util.FixContentType(media.ContentType)
 
-	thumbImg, err := thumbnailing.GenerateThumbnail(mediaStream, mediaContentType, width, height, method, animated, ctx)
+	var thumbImg *m.Thumbnail
+	err := withGenerationSlot(ctx, func() error {
+		mediaStream, err := datastore.DownloadStream(ctx, media.DatastoreId, media.Location)
+		if err != nil {
+			ctx.Log.Error("Error getting file: ", err)
+			return err
+		}
+
+		thumbImg, err = thumbnailing.GenerateThumbnail(mediaStream, mediaContentType, width, height, method, animated, ctx)
+		if err != nil {
+			ctx.Log.Error("Error generating thumbnail: ", err)
+		}
+		return err
+	})
 	if err != nil {
-		ctx.Log.Error("Error generating thumbnail: ", err)
 		return nil, err
 	}
 
+	return storeThumbnail(media, thumbImg, width, height, method, animated, ctx)
+}
+
+// storeThumbnail uploads the generated thumbnail to a datastore. If thumbImg is nil, the source
+// media is used as the thumbnail.
+func storeThumbnail(media *types.Media, thumbImg *m.Thumbnail, width int, height int, method string, animated bool, ctx rcontext.RequestContext) (*GeneratedThumbnail, error) {
+	mediaContentType := util.FixContentType(media.ContentType)
+
 	metric := metrics.ThumbnailsGenerated.With(prometheus.Labels{
 		"width":    strconv.Itoa(width),
 		"height":   strconv.Itoa(height),
@@ -198,7 +226,18 @@ func GenerateThumbnail(media *types.Media, width int, height int, method string,
 		return nil, err
 	}
 
-	ds, err := datastore.PickDatastore(common.KindThumbnails, ctx)
+	if upload_controller.IsStorageFull() {
+		ctx.Log.Warn("Not storing thumbnail: the storage limit has been reached")
+		return nil, common.ErrStorageFull
+	}
+
+	var ds *datastore.DatastoreRef
+	if ctx.Config.Thumbnails.InlineMaxBytes > 0 && int64(len(b)) <= ctx.Config.Thumbnails.InlineMaxBytes {
+		ctx.Log.Info("Storing thumbnail in the database")
+		ds, err = datastore.GetInlineDatastore(ctx)
+	} else {
+		ds, err = datastore.PickDatastoreForContentType(common.KindThumbnails, thumbImg.ContentType, ctx)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -214,6 +253,7 @@ func GenerateThumbnail(media *types.Media, width int, height int, method string,
 	thumb.ContentType = thumbImg.ContentType
 	thumb.SizeBytes = info.SizeBytes
 	thumb.Sha256Hash = info.Sha256Hash
+	upload_controller.AddStoredBytes(info.SizeBytes)
 
 	metric.Inc()
 	return thumb, nil
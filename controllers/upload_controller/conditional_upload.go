@@ -0,0 +1,190 @@
+package upload_controller
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/internal_cache"
+	"github.com/turt2live/matrix-media-repo/plugins"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+var sha256Regex = regexp.MustCompile("^[a-f0-9]{64}$")
+
+var conditionalChecks = cache.New(1*time.Minute, 2*time.Minute)
+
+// ParseConditionalHash extracts the SHA-256 hash from an If-None-Match header value, returning an
+// empty string if the value isn't a single hash.
+func ParseConditionalHash(header string) string {
+	hash := strings.ToLower(strings.Trim(strings.TrimSpace(header), "\""))
+	if !sha256Regex.MatchString(hash) {
+		return ""
+	}
+	return hash
+}
+
+// UploadByHash creates a media record for the user from an already stored file with the given
+// SHA-256 hash, without the contents needing to be uploaded again. Returns nil if the file is not
+// known or cannot be used, or if the user has run out of checks for the minute: in these cases the
+// caller should fall back to a regular upload. Users cannot tell the difference between a file
+// being unknown and not being usable, and the number of checks is limited, to avoid the endpoint
+// being used to probe for arbitrary files. Only local media which isn't quarantined or deleted is
+// used, and the stored file is held to the same limits and validation as a regular upload.
+func UploadByHash(hash string, contentType string, filename string, userId string, origin string, ctx rcontext.RequestContext) (*types.Media, error) {
+	if !ctx.Config.Uploads.ConditionalUploads.Enabled || hash == "" {
+		return nil, nil
+	}
+	if plugins.IsSpamCheckingEnabled() {
+		// Antispam plugins need the contents of the upload, so we can't skip the upload
+		return nil, nil
+	}
+
+	if err := conditionalChecks.Add(userId, 1, cache.DefaultExpiration); err != nil {
+		count, _ := conditionalChecks.IncrementInt(userId, 1)
+		if count > ctx.Config.Uploads.ConditionalUploads.MaxChecksPerMinute {
+			ctx.Log.Warn("User has run out of conditional upload checks")
+			return nil, nil
+		}
+	}
+
+	db := storage.GetDatabase().GetMediaStore(ctx)
+	blocked, err := db.IsHashBlocked(hash)
+	if err != nil {
+		return nil, err
+	}
+	if blocked {
+		return nil, nil
+	}
+
+	allRecords, err := db.GetByHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]*types.Media, 0, len(allRecords))
+	for _, record := range allRecords {
+		if record.Quarantined {
+			return nil, nil
+		}
+		if !util.IsServerOurs(record.Origin) || record.SoftDeleted {
+			continue
+		}
+		records = append(records, record)
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	// The limits are checked against the stored file as the request has no contents. When the file
+	// isn't allowed, the regular upload will be rejected for the same reason.
+	sizeBytes := records[0].SizeBytes
+	if ctx.Config.Uploads.MaxSizeBytes > 0 && sizeBytes > ctx.Config.Uploads.MaxSizeBytes {
+		return nil, nil
+	}
+	if ctx.Config.Uploads.MinSizeBytes > 0 && sizeBytes < ctx.Config.Uploads.MinSizeBytes {
+		return nil, nil
+	}
+	allowed, err := IsUserAllowedToUpload(userId, contentType, filename, sizeBytes, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		return nil, nil
+	}
+
+	// The contents aren't sent, so the polyglot checks have to rely on an earlier upload of them
+	var attrs *types.MediaAttributes
+	polyglot, checked, err := GetPolyglotVerdict(hash, contentType, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !checked {
+		ctx.Log.Info("Contents have not been checked for polyglots - requiring upload")
+		return nil, nil
+	}
+	if polyglot {
+		if ctx.Config.Uploads.PolyglotDetection.Mode == "reject" {
+			// The regular upload will reject the contents
+			return nil, nil
+		}
+		attrs = &types.MediaAttributes{ForceAttachment: true}
+	}
+
+	for _, record := range records {
+		if record.UserId == userId && record.Origin == origin && record.ContentType == contentType {
+			ctx.Log.Info("User has already uploaded this media before - returning unaltered media record")
+			err = applyForceAttachment(record, attrs, ctx)
+			if err != nil {
+				return nil, err
+			}
+			trackUploadAsLastAccess(ctx, record)
+			return record, nil
+		}
+	}
+
+	record := records[0]
+	ds, err := datastore.LocateDatastore(ctx, record.DatastoreId)
+	if err != nil {
+		return nil, err
+	}
+	if !ds.ObjectExists(record.Location) {
+		ctx.Log.Warn("Media record exists for hash but the file is missing - requiring upload")
+		return nil, nil
+	}
+
+	valid, err := validateStoredImage(record, contentType, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !valid {
+		return nil, nil
+	}
+
+	mediaId, err := generateMediaId(origin, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx.Log.Info("Creating media record from existing file with hash ", hash)
+	media := *record
+	media.Origin = origin
+	media.MediaId = mediaId
+	media.UserId = userId
+	media.UploadName = filename
+	media.ContentType = contentType
+	media.CreationTs = util.NowMillis()
+	err = insertMedia(db, &media, attrs, true, ctx)
+	if err != nil {
+		return nil, err
+	}
+	internal_cache.ClearMediaMissing(origin, media.MediaId)
+
+	trackUploadAsLastAccess(ctx, &media)
+	return &media, nil
+}
+
+// validateStoredImage runs the image validation for regular uploads on a stored file, as it would
+// be if the file were uploaded with the given content type.
+func validateStoredImage(record *types.Media, contentType string, ctx rcontext.RequestContext) (bool, error) {
+	if !ctx.Config.Uploads.ValidateImages || !util.ArrayContains(validatedImageTypes, contentType) {
+		return true, nil
+	}
+
+	stream, err := datastore.DownloadStream(ctx, record.DatastoreId, record.Location)
+	if err != nil {
+		return false, err
+	}
+	defer stream.Close()
+
+	_, err = ValidateImage(contentType, stream, ctx)
+	if err == common.ErrInvalidImage || err == common.ErrMediaTooLarge {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,86 @@
+package upload_controller
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+// The number of bytes mimetype looks at by default when detecting a content type
+const sniffBytes = 3072
+
+type sniffedBody struct {
+	io.Reader
+	io.Closer
+}
+
+func isRecognizedContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType != "application/octet-stream"
+}
+
+// ResolveContentType returns the content type to store the upload with. When uploads.requireContentType
+// is enabled and the given content type is missing or unusable, the start of the upload is inspected
+// to determine the type instead, returning common.ErrUnknownContentType if that fails too. The
+// returned reader must be used in place of contents as part of the upload may have been consumed.
+func ResolveContentType(contentType string, contents io.ReadCloser, ctx rcontext.RequestContext) (string, io.ReadCloser, error) {
+	if !ctx.Config.Uploads.RequireContentType || isRecognizedContentType(contentType) {
+		return contentType, contents, nil
+	}
+
+	head := make([]byte, sniffBytes)
+	n, err := io.ReadFull(contents, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", contents, err
+	}
+	head = head[:n]
+	body := &sniffedBody{Reader: io.MultiReader(bytes.NewReader(head), contents), Closer: contents}
+
+	detected := mimetype.Detect(head).String()
+	if !isRecognizedContentType(detected) {
+		return "", body, common.ErrUnknownContentType
+	}
+
+	ctx.Log.Info("Detected content type of upload as ", detected, " (client said '", contentType, "')")
+	return detected, body, nil
+}
+
+// IsEmptyUpload returns true if the upload has no content. When the length of the upload is unknown,
+// such as for chunked or multipart uploads, the first byte is read to find out: the returned body
+// must be used in place of the given one.
+func IsEmptyUpload(contentLength int64, contents io.ReadCloser) (bool, io.ReadCloser, error) {
+	if contentLength >= 0 {
+		return contentLength == 0, contents, nil
+	}
+
+	head := make([]byte, 1)
+	n, err := io.ReadFull(contents, head)
+	if err != nil && err != io.EOF {
+		return false, contents, err
+	}
+	return n == 0, &sniffedBody{Reader: io.MultiReader(bytes.NewReader(head[:n]), contents), Closer: contents}, nil
+}
+
+// readUpload reads the whole upload into memory for inspection, returning common.ErrMediaTooLarge
+// if it is larger than the maximum upload size. The upload is closed afterwards.
+func readUpload(contents io.ReadCloser, ctx rcontext.RequestContext) ([]byte, error) {
+	defer cleanup.DumpAndCloseStream(contents)
+	var reader io.Reader = contents
+	if ctx.Config.Uploads.MaxSizeBytes > 0 {
+		reader = io.LimitReader(contents, ctx.Config.Uploads.MaxSizeBytes+1)
+	}
+	b, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if ctx.Config.Uploads.MaxSizeBytes > 0 && int64(len(b)) > ctx.Config.Uploads.MaxSizeBytes {
+		return nil, common.ErrMediaTooLarge
+	}
+	return b, nil
+}
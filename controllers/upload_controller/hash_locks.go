@@ -0,0 +1,38 @@
+package upload_controller
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/internal_cache"
+)
+
+// Uploads of the same contents are serialized so that concurrent uploads don't both store a copy of
+// the file: the later upload will instead see the earlier one's media record and reuse its file. A
+// fixed number of locks is used to avoid tracking every hash within the process, and the lock is
+// shared through Redis (when enabled) with the other processes of the cluster.
+var hashLocks [64]sync.Mutex
+
+// How long the shared lock is held for if the process holding it goes away.
+const sharedHashLockTtl = 2 * time.Minute
+
+func lockHash(sha256Hash string, ctx rcontext.RequestContext) func() {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(sha256Hash))
+	l := &hashLocks[h.Sum32()%uint32(len(hashLocks))]
+	l.Lock()
+
+	unlockShared, shared, err := internal_cache.AcquireSharedLock("upload_hash:"+sha256Hash, sharedHashLockTtl, ctx)
+	if err != nil {
+		// Not fatal: the upload still can't race uploads in this process
+		ctx.Log.Warn("Failed to take the shared upload lock - only locking within this process: ", err)
+	}
+	return func() {
+		if shared {
+			unlockShared()
+		}
+		l.Unlock()
+	}
+}
@@ -0,0 +1,61 @@
+package upload_controller
+
+import (
+	"bytes"
+	"image"
+	"image/gif"
+	"io"
+	"io/ioutil"
+
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/thumbnailing/i"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// Image types which can be fully decoded without external tools.
+var validatedImageTypes = []string{"image/png", "image/apng", "image/jpeg", "image/jpg", "image/gif", "image/webp"}
+
+// ValidateImage fully decodes image uploads when image validation is enabled, returning
+// common.ErrInvalidImage if the image is corrupt. The upload is read into memory to do this: the
+// returned body must be used in place of the given one.
+func ValidateImage(contentType string, contents io.ReadCloser, ctx rcontext.RequestContext) (io.ReadCloser, error) {
+	if !ctx.Config.Uploads.ValidateImages || !util.ArrayContains(validatedImageTypes, contentType) {
+		return contents, nil
+	}
+
+	b, err := readUpload(contents, ctx)
+	if err != nil {
+		return nil, err
+	}
+	body := ioutil.NopCloser(bytes.NewReader(b))
+
+	imgConfig, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		ctx.Log.Warn("Rejecting image upload which could not be decoded: ", err)
+		return body, common.ErrInvalidImage
+	}
+	maxPixels := ctx.Config.Thumbnails.MaxPixels
+	if maxPixels > 0 && util.ExceedsPixelCount(imgConfig.Width, imgConfig.Height, maxPixels) {
+		ctx.Log.Info("Image has too many pixels to validate - skipping validation")
+		return body, nil
+	}
+
+	if contentType == "image/gif" {
+		_, err = gif.DecodeAll(bytes.NewReader(b))
+	} else if contentType == "image/webp" {
+		var animated bool
+		animated, err = i.DecodeAnimatedWebp(b)
+		if err == nil && !animated {
+			_, _, err = image.Decode(bytes.NewReader(b))
+		}
+	} else {
+		_, _, err = image.Decode(bytes.NewReader(b))
+	}
+	if err != nil {
+		ctx.Log.Warn("Rejecting image upload which could not be decoded: ", err)
+		return body, common.ErrInvalidImage
+	}
+
+	return body, nil
+}
@@ -0,0 +1,131 @@
+package upload_controller
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// Types which browsers will run as a web page or script, and so must not be hiding inside media
+var scriptableContentTypes = []string{
+	"text/html",
+	"text/xml",
+	"text/javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/javascript",
+	"application/x-php",
+	"image/svg+xml",
+}
+
+// Markers of web page or script content embedded in a file, in lowercase. Short markers are left out
+// as they would turn up by chance in large binary files.
+var polyglotMarkers = [][]byte{
+	[]byte("<script"),
+	[]byte("<!doctype html"),
+	[]byte("<iframe"),
+	[]byte("<object"),
+	[]byte("<embed"),
+	[]byte("javascript:"),
+	[]byte("onerror="),
+	[]byte("onload="),
+}
+
+// DetectPolyglot returns true if an image, audio, or video upload contains content which browsers
+// could treat as a web page or script, when polyglot detection is enabled. The upload is read into
+// memory to do this: the returned body must be used in place of the given one. The verdict is
+// recorded against the contents' hash so it can be applied to uploads which skip sending them.
+func DetectPolyglot(contentType string, contents io.ReadCloser, ctx rcontext.RequestContext) (bool, io.ReadCloser, error) {
+	if !shouldCheckPolyglot(contentType, ctx) {
+		return false, contents, nil
+	}
+
+	b, err := readUpload(contents, ctx)
+	if err != nil {
+		return false, nil, err
+	}
+	body := ioutil.NopCloser(bytes.NewReader(b))
+
+	reason := getPolyglotReason(b, contentType, ctx.Config.Uploads.PolyglotDetection.CheckMarkers)
+	polyglot := reason != ""
+	if polyglot {
+		ctx.Log.Warn("Upload appears to be a polyglot file: " + reason)
+	}
+
+	hash := sha256.Sum256(b)
+	err = storage.GetDatabase().GetMediaStore(ctx).SetPolyglotVerdict(hex.EncodeToString(hash[:]), polyglot)
+	if err != nil {
+		return false, nil, err
+	}
+
+	return polyglot, body, nil
+}
+
+// GetPolyglotVerdict returns the recorded polyglot verdict for the contents with the given hash.
+// checked is false if polyglot detection applies to the upload but the contents have not been
+// checked yet, in which case they must be uploaded again to be checked.
+func GetPolyglotVerdict(sha256hash string, contentType string, ctx rcontext.RequestContext) (polyglot bool, checked bool, err error) {
+	if !shouldCheckPolyglot(contentType, ctx) {
+		return false, true, nil
+	}
+
+	polyglot, err = storage.GetDatabase().GetMediaStore(ctx).GetPolyglotVerdict(sha256hash)
+	if err == sql.ErrNoRows {
+		return false, false, nil
+	} else if err != nil {
+		return false, false, err
+	}
+	return polyglot, true, nil
+}
+
+func shouldCheckPolyglot(contentType string, ctx rcontext.RequestContext) bool {
+	mode := ctx.Config.Uploads.PolyglotDetection.Mode
+	return (mode == "attachment" || mode == "reject") && util.HasAnyPrefix(contentType, []string{"image/", "audio/", "video/"})
+}
+
+// getPolyglotReason describes why the file looks like a polyglot, or returns an empty string if it
+// doesn't.
+func getPolyglotReason(b []byte, contentType string, checkMarkers bool) string {
+	declared, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		declared = contentType
+	}
+
+	// What a browser sniffing the content would treat the file as
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(b))
+	if sniffed != declared && util.ArrayContains(scriptableContentTypes, sniffed) {
+		return "browsers would sniff it as " + sniffed
+	}
+
+	// What the file's magic bytes say it is
+	detected := mimetype.Detect(b)
+	if !detected.Is(declared) {
+		for t := detected; t != nil; t = t.Parent() {
+			mediaType, _, _ := mime.ParseMediaType(t.String())
+			if util.ArrayContains(scriptableContentTypes, mediaType) {
+				return "its contents are " + mediaType
+			}
+		}
+	}
+
+	if checkMarkers {
+		lower := bytes.ToLower(b)
+		for _, marker := range polyglotMarkers {
+			if bytes.Contains(lower, marker) {
+				return "it contains " + string(marker)
+			}
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,50 @@
+package upload_controller
+
+import (
+	"sync/atomic"
+
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+)
+
+// The total size of stored files as of the last check plus anything stored since, or -1 if it hasn't
+// been calculated yet
+var storedBytes int64 = -1
+
+// UpdateStoredBytes recalculates how much is stored, warning if the configured threshold has been passed.
+func UpdateStoredBytes(ctx rcontext.RequestContext) error {
+	total, err := storage.GetDatabase().GetMetadataStore(ctx).GetTotalStoredBytes()
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&storedBytes, total)
+
+	conf := config.Get().StorageLimit
+	if conf.MaxBytes > 0 && total >= conf.MaxBytes {
+		ctx.Log.Errorf("Storage limit reached: %d of %d bytes used. New files will not be stored until space is freed.", total, conf.MaxBytes)
+	} else if conf.WarnBytes > 0 && total >= conf.WarnBytes {
+		ctx.Log.Warnf("Storage is running low: %d bytes used, passing the warning threshold of %d bytes", total, conf.WarnBytes)
+	}
+	return nil
+}
+
+// AddStoredBytes counts a newly stored file towards the total, so that the limit applies between the
+// (expensive) recalculations. Deleted files are only accounted for by the next recalculation.
+func AddStoredBytes(sizeBytes int64) {
+	for {
+		current := atomic.LoadInt64(&storedBytes)
+		if current < 0 {
+			return // not calculated yet, so the next calculation will include the file
+		}
+		if atomic.CompareAndSwapInt64(&storedBytes, current, current+sizeBytes) {
+			return
+		}
+	}
+}
+
+// IsStorageFull returns true if the storage limit has been reached, as of the last check.
+func IsStorageFull() bool {
+	maxBytes := config.Get().StorageLimit.MaxBytes
+	return maxBytes > 0 && atomic.LoadInt64(&storedBytes) >= maxBytes
+}
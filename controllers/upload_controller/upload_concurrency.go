@@ -0,0 +1,39 @@
+package upload_controller
+
+import (
+	"sync"
+
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+var activeUploadsLock = &sync.Mutex{}
+var activeUploads = make(map[string]int)
+
+// AcquireUploadSlot reserves one of the user's concurrent uploads, returning false if the user
+// already has the maximum number of uploads in progress. Global admins are not limited. When a
+// slot is acquired, the returned function must be called once the upload has finished.
+func AcquireUploadSlot(userId string, ctx rcontext.RequestContext) (func(), bool) {
+	if ctx.Config.Uploads.MaxConcurrentPerUser <= 0 || util.IsGlobalAdmin(userId) {
+		return func() {}, true
+	}
+
+	activeUploadsLock.Lock()
+	defer activeUploadsLock.Unlock()
+
+	if activeUploads[userId] >= ctx.Config.Uploads.MaxConcurrentPerUser {
+		ctx.Log.Warn("User has too many uploads in progress")
+		return nil, false
+	}
+	activeUploads[userId]++
+
+	return func() {
+		activeUploadsLock.Lock()
+		defer activeUploadsLock.Unlock()
+
+		activeUploads[userId]--
+		if activeUploads[userId] <= 0 {
+			delete(activeUploads, userId)
+		}
+	}, true
+}
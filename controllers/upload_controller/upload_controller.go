@@ -1,22 +1,30 @@
 package upload_controller
 
 import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"fmt"
 	"github.com/getsentry/sentry-go"
 	"io"
 	"io/ioutil"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/patrickmn/go-cache"
 	"github.com/pkg/errors"
+	"github.com/ryanuber/go-glob"
 	"github.com/sirupsen/logrus"
 	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/internal_cache"
 	"github.com/turt2live/matrix-media-repo/plugins"
 	"github.com/turt2live/matrix-media-repo/storage"
 	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/storage/stores"
 	"github.com/turt2live/matrix-media-repo/types"
 	"github.com/turt2live/matrix-media-repo/util"
 	"github.com/turt2live/matrix-media-repo/util/cleanup"
@@ -25,8 +33,19 @@ import (
 
 const NoApplicableUploadUser = ""
 
+var mediaIdRegex = regexp.MustCompile("^[a-zA-Z0-9]+$")
+
+// The shortest media ID which will be generated, regardless of config. 20 alphanumeric characters
+// is over 119 bits of randomness.
+const minMediaIdLength = 20
+
 var recentMediaIds = cache.New(30*time.Second, 60*time.Second)
 
+// Commits a pending object once its media is recorded. Replaced by tests to simulate failures.
+var commitObject = func(ds *datastore.DatastoreRef, location string) error {
+	return ds.CommitObject(location)
+}
+
 type AlreadyUploadedFile struct {
 	DS         *datastore.DatastoreRef
 	ObjectInfo *types.ObjectInfo
@@ -92,7 +111,38 @@ func EstimateContentLength(contentLength int64, contentLengthHeader string) int6
 	return -1 // unknown
 }
 
+func IsValidMediaId(mediaId string) bool {
+	return mediaIdRegex.MatchString(mediaId)
+}
+
+func CanChooseMediaId(userId string, ctx rcontext.RequestContext) bool {
+	if util.IsGlobalAdmin(userId) {
+		return true
+	}
+	for _, g := range ctx.Config.Uploads.CustomMediaIdUsers {
+		if glob.Glob(g, userId) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAppserviceChooseMediaId determines if the appservice may use the given media ID, which must
+// be within the appservice's configured media ID prefix.
+func CanAppserviceChooseMediaId(appservice *config.AppserviceConfig, mediaId string) bool {
+	return appservice != nil && appservice.MediaIdPrefix != "" && strings.HasPrefix(mediaId, appservice.MediaIdPrefix)
+}
+
 func UploadMedia(contents io.ReadCloser, contentLength int64, contentType string, filename string, userId string, origin string, ctx rcontext.RequestContext) (*types.Media, error) {
+	return UploadMediaWithId(contents, contentLength, contentType, filename, userId, origin, "", nil, ctx)
+}
+
+// UploadMediaWithId is the same as UploadMedia, though uses the given media ID instead of a random
+// one if not empty. Callers are expected to have validated the media ID and the user's permission
+// to choose it. Returns common.ErrMediaIdTaken if the media ID is already in use. If attrs is not
+// nil, they are stored along with the media. Media with a download limit is always created as new
+// rather than returning the user's earlier upload of the same file.
+func UploadMediaWithId(contents io.ReadCloser, contentLength int64, contentType string, filename string, userId string, origin string, desiredMediaId string, attrs *types.MediaAttributes, ctx rcontext.RequestContext) (*types.Media, error) {
 	defer cleanup.DumpAndCloseStream(contents)
 
 	var data io.ReadCloser
@@ -106,44 +156,47 @@ func UploadMedia(contents io.ReadCloser, contentLength int64, contentType string
 	if err != nil {
 		return nil, err
 	}
+	if verifier, ok := contents.(util.DigestVerifier); ok {
+		// Checked here rather than at the end of the stream, as the size limit may stop it early
+		err = verifier.VerifyDigest()
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	metadataDb := storage.GetDatabase().GetMetadataStore(ctx)
 
-	mediaTaken := true
-	var mediaId string
-	attempts := 0
-	for mediaTaken {
-		attempts += 1
-		if attempts > 10 {
-			return nil, errors.New("failed to generate a media ID after 10 rounds")
+	mediaTaken := desiredMediaId == ""
+	mediaId := desiredMediaId
+	if desiredMediaId != "" {
+		if _, present := recentMediaIds.Get(mediaId); present {
+			return nil, common.ErrMediaIdTaken
 		}
-
-		mediaId, err = util.GenerateRandomString(64)
+		reserved, err := metadataDb.IsReserved(origin, mediaId)
 		if err != nil {
 			return nil, err
 		}
-		mediaId, err = util.GetSha1OfString(mediaId + strconv.FormatInt(util.NowMillis(), 10))
-		if err != nil {
-			return nil, err
+		if reserved {
+			return nil, common.ErrMediaIdTaken
 		}
-
-		// Because we use the current time in the media ID, we don't need to worry about
-		// collisions from the database.
-		if _, present := recentMediaIds.Get(mediaId); present {
-			mediaTaken = true
-			continue
+		_, err = storage.GetDatabase().GetMediaStore(ctx).Get(origin, mediaId)
+		if err == nil {
+			return nil, common.ErrMediaIdTaken
+		} else if err != sql.ErrNoRows {
+			return nil, err
 		}
-
-		mediaTaken, err = metadataDb.IsReserved(origin, mediaId)
+	}
+	if mediaTaken {
+		mediaId, err = generateMediaId(origin, ctx)
 		if err != nil {
 			return nil, err
 		}
+	} else {
+		_ = recentMediaIds.Add(mediaId, true, cache.DefaultExpiration)
 	}
 
-	_ = recentMediaIds.Add(mediaId, true, cache.DefaultExpiration)
-
 	var existingFile *AlreadyUploadedFile = nil
-	ds, err := datastore.PickDatastore(common.KindLocalMedia, ctx)
+	ds, err := datastore.PickDatastoreForContentType(common.KindLocalMedia, contentType, ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -157,10 +210,15 @@ func UploadMedia(contents io.ReadCloser, contentLength int64, contentType string
 			DS:         ds,
 			ObjectInfo: info,
 		}
-		mediaId = fmt.Sprintf("ipfs:%s", info.Location[len("ipfs/"):])
+		if desiredMediaId == "" {
+			mediaId = fmt.Sprintf("ipfs:%s", info.Location[len("ipfs/"):])
+		}
 	}
 
-	m, err := StoreDirect(existingFile, util_byte_seeker.NewByteSeeker(dataBytes), contentLength, contentType, filename, userId, origin, mediaId, common.KindLocalMedia, ctx, true)
+	// Don't hand back an existing upload when a specific media ID (or a download limit) was asked for
+	filterUserDuplicates := desiredMediaId == "" && (attrs == nil || attrs.MaxDownloads == 0)
+	generatedId := mediaTaken && existingFile == nil
+	m, err := storeDirect(existingFile, util_byte_seeker.NewByteSeeker(dataBytes), contentLength, contentType, filename, userId, origin, mediaId, generatedId, common.KindLocalMedia, ctx, filterUserDuplicates, attrs)
 	if err != nil {
 		return m, err
 	}
@@ -173,6 +231,84 @@ func UploadMedia(contents io.ReadCloser, contentLength int64, contentType string
 	return m, err
 }
 
+// generateMediaId picks a random, unused, media ID for the origin. The media ID is reserved for a
+// short while to avoid it being picked again before the media is stored.
+func generateMediaId(origin string, ctx rcontext.RequestContext) (string, error) {
+	metadataDb := storage.GetDatabase().GetMetadataStore(ctx)
+
+	attempts := 0
+	for {
+		attempts += 1
+		if attempts > 10 {
+			return "", errors.New("failed to generate a media ID after 10 rounds")
+		}
+
+		length := ctx.Config.Uploads.MediaIdLength
+		if length < minMediaIdLength {
+			length = minMediaIdLength
+		}
+		mediaId, err := util.GenerateRandomAlphanumeric(length)
+		if err != nil {
+			return "", err
+		}
+		if !IsValidMediaId(mediaId) {
+			return "", errors.New("generated media ID is not valid: " + mediaId)
+		}
+
+		// Collisions with existing media are unlikely, so are only handled when the media is
+		// inserted (see insertMedia), but we do check for recently picked and reserved IDs.
+		if _, present := recentMediaIds.Get(mediaId); present {
+			continue
+		}
+
+		reserved, err := metadataDb.IsReserved(origin, mediaId)
+		if err != nil {
+			return "", err
+		}
+		if reserved {
+			continue
+		}
+
+		_ = recentMediaIds.Add(mediaId, true, cache.DefaultExpiration)
+		return mediaId, nil
+	}
+}
+
+// insertMedia stores the media record, along with its attributes if there are any. If generatedId
+// is true and the media ID is already in use, a new media ID is generated for the media and the
+// insert is tried again.
+func insertMedia(db *stores.MediaStore, media *types.Media, attrs *types.MediaAttributes, generatedId bool, ctx rcontext.RequestContext) error {
+	attempts := 0
+	for {
+		attempts += 1
+
+		var err error
+		if attrs == nil {
+			err = db.Insert(media)
+		} else {
+			err = db.InsertWithAttributes(media, attrs)
+		}
+		if err == nil || !generatedId || !stores.IsUniqueViolation(err) || attempts >= 10 {
+			return err
+		}
+
+		ctx.Log.Warn("Generated media ID is already in use - picking another")
+		media.MediaId, err = generateMediaId(media.Origin, ctx)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// applyForceAttachment marks existing media as needing to be downloaded as an attachment if the
+// attributes for the new upload of it ask for that.
+func applyForceAttachment(media *types.Media, attrs *types.MediaAttributes, ctx rcontext.RequestContext) error {
+	if attrs == nil || !attrs.ForceAttachment {
+		return nil
+	}
+	return storage.GetDatabase().GetMediaAttributesStore(ctx).UpsertForceAttachment(media.Origin, media.MediaId, true)
+}
+
 func trackUploadAsLastAccess(ctx rcontext.RequestContext, media *types.Media) {
 	err := storage.GetDatabase().GetMetadataStore(ctx).UpsertLastAccess(media.Sha256Hash, util.NowMillis())
 	if err != nil {
@@ -193,13 +329,24 @@ func checkSpam(contents []byte, filename string, contentType string, userId stri
 	return nil
 }
 
-func StoreDirect(f *AlreadyUploadedFile, contents io.ReadCloser, expectedSize int64, contentType string, filename string, userId string, origin string, mediaId string, kind string, ctx rcontext.RequestContext, filterUserDuplicates bool) (*types.Media, error) {
+func StoreDirect(f *AlreadyUploadedFile, contents io.ReadCloser, expectedSize int64, contentType string, filename string, userId string, origin string, mediaId string, kind string, ctx rcontext.RequestContext, filterUserDuplicates bool, attrs *types.MediaAttributes) (*types.Media, error) {
+	return storeDirect(f, contents, expectedSize, contentType, filename, userId, origin, mediaId, false, kind, ctx, filterUserDuplicates, attrs)
+}
+
+// storeDirect is StoreDirect, though if generatedId is true the media ID was generated by
+// generateMediaId and is replaced with another if it turns out to already be in use.
+func storeDirect(f *AlreadyUploadedFile, contents io.ReadCloser, expectedSize int64, contentType string, filename string, userId string, origin string, mediaId string, generatedId bool, kind string, ctx rcontext.RequestContext, filterUserDuplicates bool, attrs *types.MediaAttributes) (*types.Media, error) {
 	var err error
 	var ds *datastore.DatastoreRef
 	var info *types.ObjectInfo
 	var contentBytes []byte
 	if f == nil {
-		dsPicked, err := datastore.PickDatastore(kind, ctx)
+		if IsStorageFull() {
+			ctx.Log.Warn("Not storing media: the storage limit has been reached")
+			return nil, common.ErrStorageFull
+		}
+
+		dsPicked, err := datastore.PickDatastoreForContentType(kind, contentType, ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -210,11 +357,22 @@ func StoreDirect(f *AlreadyUploadedFile, contents io.ReadCloser, expectedSize in
 			return nil, err
 		}
 
-		fInfo, err := ds.UploadFile(util.BytesToStream(contentBytes), expectedSize, ctx)
+		// The file is only committed once the media has been recorded in the database, so that
+		// a crash part way through doesn't leave a record pointing at an incomplete file.
+		fInfo, err := ds.UploadPendingFile(util.BytesToStream(contentBytes), expectedSize, ctx)
 		if err != nil {
 			return nil, err
 		}
 		info = fInfo
+
+		if ctx.Config.Uploads.VerifyWrites {
+			hash := sha256.Sum256(contentBytes)
+			err = ds.VerifyObject(info.Location, hex.EncodeToString(hash[:]), int64(len(contentBytes)))
+			if err != nil {
+				ds.DeleteObject(info.Location) // delete temp object
+				return nil, err
+			}
+		}
 	} else {
 		ds = f.DS
 		info = f.ObjectInfo
@@ -230,7 +388,21 @@ func StoreDirect(f *AlreadyUploadedFile, contents io.ReadCloser, expectedSize in
 		}
 	}
 
+	unlock := lockHash(info.Sha256Hash, ctx)
+	defer unlock()
+
 	db := storage.GetDatabase().GetMediaStore(ctx)
+	blocked, err := db.IsHashBlocked(info.Sha256Hash)
+	if err != nil {
+		ds.DeleteObject(info.Location) // delete temp object
+		return nil, err
+	}
+	if blocked {
+		ds.DeleteObject(info.Location) // delete temp object
+		ctx.Log.Warn("User attempted to upload blocked content - rejecting")
+		return nil, common.ErrMediaQuarantined
+	}
+
 	records, err := db.GetByHash(info.Sha256Hash)
 	if err != nil {
 		ds.DeleteObject(info.Location) // delete temp object
@@ -246,12 +418,17 @@ func StoreDirect(f *AlreadyUploadedFile, contents io.ReadCloser, expectedSize in
 		if filterUserDuplicates && userId != NoApplicableUploadUser {
 			for _, record := range records {
 				if record.Quarantined {
+					ds.DeleteObject(info.Location) // delete temp object
 					ctx.Log.Warn("User attempted to upload quarantined content - rejecting")
 					return nil, common.ErrMediaQuarantined
 				}
 				if record.UserId == userId && record.Origin == origin && record.ContentType == contentType {
 					ctx.Log.Info("User has already uploaded this media before - returning unaltered media record")
 					ds.DeleteObject(info.Location) // delete temp object
+					err = applyForceAttachment(record, attrs, ctx)
+					if err != nil {
+						return nil, err
+					}
 					trackUploadAsLastAccess(ctx, record)
 					return record, nil
 				}
@@ -277,6 +454,10 @@ func StoreDirect(f *AlreadyUploadedFile, contents io.ReadCloser, expectedSize in
 			if knownRecord.Origin == origin && knownRecord.MediaId == mediaId {
 				ctx.Log.Info("Duplicate media record found - returning unaltered record")
 				ds.DeleteObject(info.Location) // delete temp object
+				err = applyForceAttachment(knownRecord, attrs, ctx)
+				if err != nil {
+					return nil, err
+				}
 				trackUploadAsLastAccess(ctx, knownRecord)
 				return knownRecord, nil
 			}
@@ -290,15 +471,20 @@ func StoreDirect(f *AlreadyUploadedFile, contents io.ReadCloser, expectedSize in
 		media.ContentType = contentType
 		media.CreationTs = util.NowMillis()
 
-		err = db.Insert(media)
+		err = insertMedia(db, media, attrs, generatedId, ctx)
 		if err != nil {
 			ds.DeleteObject(info.Location) // delete temp object
+			if stores.IsUniqueViolation(err) {
+				return nil, common.ErrMediaIdTaken
+			}
 			return nil, err
 		}
+		mediaId = media.MediaId
+		internal_cache.ClearMediaMissing(origin, mediaId)
 
 		// If the media's file exists, we'll delete the temp file
 		// If the media's file doesn't exist, we'll move the temp file to where the media expects it to be
-		if media.DatastoreId != ds.DatastoreId && media.Location != info.Location {
+		if media.DatastoreId != ds.DatastoreId || media.Location != ds.FinalLocation(info.Location) {
 			ds2, err := datastore.LocateDatastore(ctx, media.DatastoreId)
 			if err != nil {
 				ds.DeleteObject(info.Location) // delete temp object
@@ -307,11 +493,15 @@ func StoreDirect(f *AlreadyUploadedFile, contents io.ReadCloser, expectedSize in
 			if !ds2.ObjectExists(media.Location) {
 				stream, err := ds.DownloadFile(info.Location)
 				if err != nil {
+					ds.DeleteObject(info.Location) // delete temp object
 					return nil, err
 				}
 
-				ds2.OverwriteObject(media.Location, stream, ctx)
+				err = ds2.OverwriteObject(media.Location, stream, ctx)
 				ds.DeleteObject(info.Location)
+				if err != nil {
+					return nil, err
+				}
 			} else {
 				ds.DeleteObject(info.Location)
 			}
@@ -334,6 +524,38 @@ func StoreDirect(f *AlreadyUploadedFile, contents io.ReadCloser, expectedSize in
 		return nil, err
 	}
 
+	encoding := ""
+	if contentBytes != nil && ds.Type != "ipfs" && datastore.ShouldCompress(contentType, info.SizeBytes, ctx) {
+		cInfo, err := ds.UploadCompressedPendingFile(contentBytes, ctx)
+		if err != nil {
+			ds.DeleteObject(info.Location) // delete temp object
+			return nil, err
+		}
+		if cInfo != nil {
+			ds.DeleteObject(info.Location) // delete uncompressed temp object
+			if ctx.Config.Uploads.VerifyWrites {
+				err = ds.VerifyObject(cInfo.Location, cInfo.Sha256Hash, cInfo.SizeBytes)
+				if err != nil {
+					ds.DeleteObject(cInfo.Location)
+					return nil, err
+				}
+			}
+			err = datastore.MarkCompressed(ctx, ds.DatastoreId, ds.FinalLocation(cInfo.Location), cInfo.SizeBytes)
+			if err != nil {
+				ds.DeleteObject(cInfo.Location)
+				return nil, err
+			}
+
+			// The media describes the uncompressed contents
+			encoding = datastore.EncodingGzip
+			info = &types.ObjectInfo{
+				Location:   cInfo.Location,
+				Sha256Hash: info.Sha256Hash,
+				SizeBytes:  info.SizeBytes,
+			}
+		}
+	}
+
 	ctx.Log.Info("Persisting new media record")
 
 	media := &types.Media{
@@ -345,15 +567,34 @@ func StoreDirect(f *AlreadyUploadedFile, contents io.ReadCloser, expectedSize in
 		Sha256Hash:  info.Sha256Hash,
 		SizeBytes:   info.SizeBytes,
 		DatastoreId: ds.DatastoreId,
-		Location:    info.Location,
+		Location:    ds.FinalLocation(info.Location),
 		CreationTs:  util.NowMillis(),
+		Encoding:    encoding,
 	}
 
-	err = db.Insert(media)
+	err = insertMedia(db, media, attrs, generatedId, ctx)
 	if err != nil {
 		ds.DeleteObject(info.Location) // delete temp object
+		if stores.IsUniqueViolation(err) {
+			return nil, common.ErrMediaIdTaken
+		}
+		return nil, err
+	}
+	mediaId = media.MediaId
+
+	err = commitObject(ds, info.Location)
+	if err != nil {
+		// Roll back the record so it doesn't point at a file which doesn't exist
+		ctx.Log.Error("Error committing uploaded file: " + err.Error())
+		if err2 := db.Delete(origin, mediaId); err2 != nil {
+			ctx.Log.Error("Error rolling back media record: " + err2.Error())
+			sentry.CaptureException(err2)
+		}
+		ds.DeleteObject(info.Location)
 		return nil, err
 	}
+	internal_cache.ClearMediaMissing(origin, mediaId)
+	AddStoredBytes(media.SizeBytes)
 
 	trackUploadAsLastAccess(ctx, media)
 	return media, nil
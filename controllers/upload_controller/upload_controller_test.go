@@ -0,0 +1,118 @@
+package upload_controller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/storage/datastore/ds_file"
+	"github.com/turt2live/matrix-media-repo/tests/test_internals"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+func randomContents(t *testing.T) ([]byte, string) {
+	s, err := util.GenerateRandomString(512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := []byte(s)
+	hash := sha256.Sum256(b)
+	return b, hex.EncodeToString(hash[:])
+}
+
+func assertNoPendingFiles(t *testing.T) {
+	pending, err := ds_file.GetPendingFiles(test_internals.DatastorePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) > 0 {
+		t.Errorf("expected no pending files, found %d", len(pending))
+	}
+}
+
+func TestUploadRollsBackOnCommitFailure(t *testing.T) {
+	ctx := test_internals.SetupDatabase(t)
+
+	commitErr := errors.New("commit failed")
+	defer func(original func(*datastore.DatastoreRef, string) error) {
+		commitObject = original
+	}(commitObject)
+	commitObject = func(ds *datastore.DatastoreRef, location string) error {
+		return commitErr
+	}
+
+	contents, hash := randomContents(t)
+	media, err := UploadMedia(util.BytesToStream(contents), int64(len(contents)), "application/octet-stream", "test.bin", "@alice:localhost", "localhost", ctx)
+	if err != commitErr {
+		t.Fatalf("expected the commit error, got %v", err)
+	}
+	if media != nil {
+		t.Errorf("expected no media, got %s", media.MxcUri())
+	}
+
+	records, err := storage.GetDatabase().GetMediaStore(ctx).GetByHash(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) > 0 {
+		t.Errorf("expected no media records, found %d", len(records))
+	}
+	assertNoPendingFiles(t)
+}
+
+func TestConcurrentIdenticalUploads(t *testing.T) {
+	ctx := test_internals.SetupDatabase(t)
+
+	const uploads = 8
+	contents, hash := randomContents(t)
+
+	type result struct {
+		userId string
+		err    error
+	}
+	results := make(chan result, uploads)
+	for i := 0; i < uploads; i++ {
+		userId := "@user" + string(rune('a'+i)) + ":localhost"
+		go func() {
+			_, err := UploadMedia(util.BytesToStream(contents), int64(len(contents)), "application/octet-stream", "test.bin", userId, "localhost", ctx)
+			results <- result{userId, err}
+		}()
+	}
+	for i := 0; i < uploads; i++ {
+		r := <-results
+		if r.err != nil {
+			t.Fatalf("upload for %s failed: %v", r.userId, r.err)
+		}
+	}
+
+	records, err := storage.GetDatabase().GetMediaStore(ctx).GetByHash(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != uploads {
+		t.Fatalf("expected %d media records, found %d", uploads, len(records))
+	}
+
+	users := make(map[string]bool)
+	for _, record := range records {
+		users[record.UserId] = true
+		if record.DatastoreId != records[0].DatastoreId || record.Location != records[0].Location {
+			t.Errorf("expected all records to share one object, %s is at %s/%s instead of %s/%s", record.MxcUri(), record.DatastoreId, record.Location, records[0].DatastoreId, records[0].Location)
+		}
+	}
+	if len(users) != uploads {
+		t.Errorf("expected one record per user, found records for %d users", len(users))
+	}
+
+	ds, err := datastore.LocateDatastore(ctx, records[0].DatastoreId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ds.ObjectExists(records[0].Location) {
+		t.Errorf("expected the shared object %s to exist", records[0].Location)
+	}
+	assertNoPendingFiles(t)
+}
@@ -0,0 +1,81 @@
+package upload_controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ryanuber/go-glob"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+type uploadPolicyRequest struct {
+	UserId      string `json:"user_id"`
+	ContentType string `json:"content_type"`
+	Filename    string `json:"filename"`
+	Size        int64  `json:"size"`
+}
+
+func IsUserAllowedToUpload(userId string, contentType string, filename string, contentLength int64, ctx rcontext.RequestContext) (bool, error) {
+	policy := ctx.Config.Uploads.Policy
+	if !policy.Enabled {
+		return true, nil
+	}
+
+	if len(policy.AllowedUsers) > 0 {
+		allowed := false
+		for _, g := range policy.AllowedUsers {
+			if glob.Glob(g, userId) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			ctx.Log.Warn("User is not in the upload allowlist")
+			return false, nil
+		}
+	}
+
+	if policy.AuthorizationUrl == "" {
+		return true, nil
+	}
+
+	b, err := json.Marshal(&uploadPolicyRequest{
+		UserId:      userId,
+		ContentType: contentType,
+		Filename:    filename,
+		Size:        contentLength,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequest("POST", policy.AuthorizationUrl, bytes.NewBuffer(b))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("User-Agent", "matrix-media-repo")
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+
+	client := util.NewHttpClient(time.Duration(ctx.Config.TimeoutSeconds.ClientServer) * time.Second)
+	res, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer cleanup.DumpAndCloseStream(res.Body)
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		ctx.Log.Warn("Upload denied by the authorization URL")
+		return false, nil
+	default:
+		return false, errors.New(fmt.Sprintf("unexpected status code from upload authorization URL: %d", res.StatusCode))
+	}
+}
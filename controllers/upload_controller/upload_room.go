@@ -0,0 +1,32 @@
+package upload_controller
+
+import (
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/matrix"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+var joinedRoomsCache = cache.New(1*time.Minute, 2*time.Minute)
+
+// IsUserInRoom checks with the homeserver whether the user behind the access token is joined to
+// the room. The user's joined rooms are cached briefly to avoid asking on every upload.
+func IsUserInRoom(serverName string, accessToken string, roomId string, ipAddr string, ctx rcontext.RequestContext) (bool, error) {
+	cacheKey := serverName + "/" + accessToken
+
+	var rooms []string
+	if cached, found := joinedRoomsCache.Get(cacheKey); found {
+		rooms = cached.([]string)
+	} else {
+		joined, err := matrix.GetJoinedRooms(ctx, serverName, accessToken, "", ipAddr)
+		if err != nil {
+			return false, err
+		}
+		rooms = joined
+		joinedRoomsCache.Set(cacheKey, rooms, cache.DefaultExpiration)
+	}
+
+	return util.ArrayContains(rooms, roomId), nil
+}
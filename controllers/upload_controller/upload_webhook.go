@@ -0,0 +1,160 @@
+package upload_controller
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+const webhookWorkers = 2
+const webhookQueueSize = 1000
+const webhookRetryDelay = 30 * time.Second
+
+type uploadWebhookPayload struct {
+	Origin      string `json:"origin"`
+	MediaId     string `json:"media_id"`
+	ContentUri  string `json:"content_uri"`
+	UserId      string `json:"user_id"`
+	SizeBytes   int64  `json:"size_bytes"`
+	ContentType string `json:"content_type"`
+	Sha256Hash  string `json:"sha256_hash"`
+	UploadTs    int64  `json:"upload_ts"`
+}
+
+type uploadWebhookJob struct {
+	payload []byte
+	attempt int
+	ctx     rcontext.RequestContext
+}
+
+var webhookQueue chan *uploadWebhookJob
+var webhookQueueLock = &sync.Once{}
+
+// QueueUploadWebhook schedules the configured upload webhook, if any, to be called for the media in
+// the background. Failed calls are retried up to the configured number of attempts.
+func QueueUploadWebhook(media *types.Media, ctx rcontext.RequestContext) {
+	conf := ctx.Config.Uploads.Webhook
+	if !conf.Enabled || conf.Url == "" {
+		return
+	}
+	if conf.Secret == "" {
+		ctx.Log.Warn("Upload webhook is enabled without a secret - not calling the unsigned webhook")
+		return
+	}
+
+	webhookQueueLock.Do(func() {
+		webhookQueue = make(chan *uploadWebhookJob, webhookQueueSize)
+		for i := 0; i < webhookWorkers; i++ {
+			go webhookWorker()
+		}
+	})
+
+	b, err := json.Marshal(&uploadWebhookPayload{
+		Origin:      media.Origin,
+		MediaId:     media.MediaId,
+		ContentUri:  media.MxcUri(),
+		UserId:      media.UserId,
+		SizeBytes:   media.SizeBytes,
+		ContentType: media.ContentType,
+		Sha256Hash:  media.Sha256Hash,
+		UploadTs:    media.CreationTs,
+	})
+	if err != nil {
+		ctx.Log.Error("Error building upload webhook payload: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+
+	job := &uploadWebhookJob{
+		payload: b,
+		attempt: 1,
+		ctx: ctx.Detached().LogWithFields(logrus.Fields{
+			"uploadWebhook": media.Origin + "/" + media.MediaId,
+		}),
+	}
+
+	select {
+	case webhookQueue <- job:
+	default:
+		ctx.Log.Warn("Upload webhook queue is full - not calling the webhook for this upload")
+	}
+}
+
+func webhookWorker() {
+	for job := range webhookQueue {
+		err := callUploadWebhook(job)
+		if err == nil {
+			continue
+		}
+
+		if job.attempt >= job.ctx.Config.Uploads.Webhook.MaxAttempts {
+			job.ctx.Log.Error("Giving up on upload webhook: " + err.Error())
+			sentry.CaptureException(err)
+			continue
+		}
+
+		job.ctx.Log.Warn("Error calling upload webhook, will retry: " + err.Error())
+		job.attempt++
+		retryJob := job
+		time.AfterFunc(webhookRetryDelay*time.Duration(job.attempt-1), func() {
+			select {
+			case webhookQueue <- retryJob:
+			default:
+				retryJob.ctx.Log.Error("Upload webhook queue is full - dropping retry")
+			}
+		})
+	}
+}
+
+func callUploadWebhook(job *uploadWebhookJob) error {
+	conf := job.ctx.Config.Uploads.Webhook
+
+	req, err := http.NewRequest("POST", conf.Url, bytes.NewBuffer(job.payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "matrix-media-repo")
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+
+	// Each attempt is signed with its own timestamp, so retries are as fresh as the first attempt
+	ts := strconv.FormatInt(util.NowMillis(), 10)
+	req.Header.Set("X-Media-Repo-Timestamp", ts)
+	req.Header.Set("X-Media-Repo-Signature", "sha256="+signUploadWebhook(conf.Secret, ts, job.payload))
+
+	client := util.NewHttpClient(time.Duration(job.ctx.Config.TimeoutSeconds.ClientServer) * time.Second)
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer cleanup.DumpAndCloseStream(res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return errors.New(fmt.Sprintf("unexpected status code from upload webhook: %d", res.StatusCode))
+	}
+	job.ctx.Log.Info("Called upload webhook")
+	return nil
+}
+
+// signUploadWebhook returns the hex HMAC-SHA256 of the timestamp and payload, joined by a period.
+// Covering the timestamp stops receivers from accepting an old request which was replayed.
+func signUploadWebhook(secret string, ts string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
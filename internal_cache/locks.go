@@ -0,0 +1,41 @@
+package internal_cache
+
+import (
+	"errors"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+)
+
+const sharedLockRetryInterval = 50 * time.Millisecond
+
+// AcquireSharedLock takes a lock which is shared with the other processes using the same Redis
+// cache, waiting up to the ttl for it to be released elsewhere. Returns false if Redis isn't
+// enabled, in which case callers should rely on a process-local lock.
+func AcquireSharedLock(key string, ttl time.Duration, ctx rcontext.RequestContext) (func(), bool, error) {
+	rc, ok := Get().(*RedisCache)
+	if !ok {
+		return nil, false, nil
+	}
+
+	key = "lock:" + key
+	deadline := time.Now().Add(ttl)
+	for {
+		token, acquired, err := rc.redis.TryLock(ctx, key, ttl)
+		if err != nil {
+			return nil, false, err
+		}
+		if acquired {
+			return func() {
+				// The request may have ended by now, but the lock still needs releasing
+				if err := rc.redis.Unlock(ctx.Detached(), key, token); err != nil {
+					ctx.Log.Warn("Failed to release shared lock (it will expire): ", err)
+				}
+			}, true, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, false, errors.New("timed out waiting for shared lock " + key)
+		}
+		time.Sleep(sharedLockRetryInterval)
+	}
+}
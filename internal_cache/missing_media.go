@@ -0,0 +1,95 @@
+package internal_cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/common/config"
+)
+
+// The missing media cache is a small LRU of (origin, media ID) pairs which are known to not
+// exist locally, used to avoid hitting the database for repeated requests for bad media IDs.
+
+type missingMediaEntry struct {
+	key       string
+	expiresAt time.Time
+}
+
+var missingLock = &sync.Mutex{}
+var missingList = list.New()
+var missingEntries = make(map[string]*list.Element)
+
+func missingMediaKey(origin string, mediaId string) string {
+	return origin + "/" + mediaId
+}
+
+func missingMediaCacheEnabled() bool {
+	cnf := config.Get().Downloads
+	return cnf.NotFoundCacheSeconds > 0 && cnf.NotFoundCacheMaxEntries > 0
+}
+
+// MarkMediaMissing records that the given media does not exist.
+func MarkMediaMissing(origin string, mediaId string) {
+	if !missingMediaCacheEnabled() {
+		return
+	}
+
+	cnf := config.Get().Downloads
+	key := missingMediaKey(origin, mediaId)
+	expiresAt := time.Now().Add(time.Duration(cnf.NotFoundCacheSeconds) * time.Second)
+
+	missingLock.Lock()
+	defer missingLock.Unlock()
+
+	if el, ok := missingEntries[key]; ok {
+		el.Value.(*missingMediaEntry).expiresAt = expiresAt
+		missingList.MoveToFront(el)
+		return
+	}
+
+	missingEntries[key] = missingList.PushFront(&missingMediaEntry{key: key, expiresAt: expiresAt})
+	for missingList.Len() > cnf.NotFoundCacheMaxEntries {
+		oldest := missingList.Back()
+		missingList.Remove(oldest)
+		delete(missingEntries, oldest.Value.(*missingMediaEntry).key)
+	}
+}
+
+// IsMediaKnownMissing returns true if the given media was recently found to not exist.
+func IsMediaKnownMissing(origin string, mediaId string) bool {
+	if !missingMediaCacheEnabled() {
+		return false
+	}
+
+	key := missingMediaKey(origin, mediaId)
+
+	missingLock.Lock()
+	defer missingLock.Unlock()
+
+	el, ok := missingEntries[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(el.Value.(*missingMediaEntry).expiresAt) {
+		missingList.Remove(el)
+		delete(missingEntries, key)
+		return false
+	}
+	missingList.MoveToFront(el)
+	return true
+}
+
+// ClearMediaMissing removes the given media from the missing media cache, such as when it
+// is later uploaded.
+func ClearMediaMissing(origin string, mediaId string) {
+	key := missingMediaKey(origin, mediaId)
+
+	missingLock.Lock()
+	defer missingLock.Unlock()
+
+	if el, ok := missingEntries[key]; ok {
+		missingList.Remove(el)
+		delete(missingEntries, key)
+	}
+}
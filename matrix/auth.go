@@ -60,6 +60,15 @@ func GetUserIdFromToken(ctx rcontext.RequestContext, serverName string, accessTo
 	return response.UserId, nil
 }
 
+func GetJoinedRooms(ctx rcontext.RequestContext, serverName string, accessToken string, appserviceUserId string, ipAddr string) ([]string, error) {
+	response := &joinedRoomsResponse{}
+	err := doBreakerRequest(ctx, serverName, accessToken, appserviceUserId, ipAddr, "GET", "/_matrix/client/r0/joined_rooms", response)
+	if err != nil {
+		return nil, err
+	}
+	return response.JoinedRooms, nil
+}
+
 func Logout(ctx rcontext.RequestContext, serverName string, accessToken string, appserviceUserId string, ipAddr string) error {
 	response := &emptyResponse{}
 	err := doBreakerRequest(ctx, serverName, accessToken, appserviceUserId, ipAddr, "POST", "/_matrix/client/r0/logout", response)
@@ -10,6 +10,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/util"
 	"github.com/turt2live/matrix-media-repo/util/cleanup"
 )
 
@@ -41,9 +42,7 @@ func doRequest(ctx rcontext.RequestContext, method string, urlStr string, body i
 		req.Header.Set("X-Real-IP", ipAddr)
 	}
 
-	client := &http.Client{
-		Timeout: time.Duration(ctx.Config.TimeoutSeconds.ClientServer) * time.Second,
-	}
+	client := util.NewHttpClient(time.Duration(ctx.Config.TimeoutSeconds.ClientServer) * time.Second)
 	res, err := client.Do(req)
 	if err != nil {
 		return err
@@ -1,6 +1,7 @@
 package matrix
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -20,11 +21,14 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/turt2live/matrix-media-repo/common/config"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/acl"
 )
 
 var apiUrlCacheInstance *cache.Cache
 var apiUrlSingletonLock = &sync.Once{}
 var federationBreakers = &sync.Map{}
+var federationTransports = util.NewTransportPool()
 
 type cachedServer struct {
 	url      string
@@ -55,6 +59,57 @@ func getFederationBreaker(hostname string) *circuit.Breaker {
 	return cb
 }
 
+// getFederationTransport returns the transport used for requests to the given server name, which
+// checks the server's certificate is valid for that name.
+func getFederationTransport(serverName string) *http.Transport {
+	return federationTransports.Get(serverName, func() *http.Transport {
+		tr := util.NewHttpTransport()
+		tr.DialContext = dialFederationAddress
+		tr.TLSClientConfig = &tls.Config{
+			ServerName: serverName,
+		}
+		return tr
+	})
+}
+
+type federationDialContextKey struct{}
+
+// federationDial describes the request being dialed.
+type federationDial struct {
+	host string
+	ctx  rcontext.RequestContext
+}
+
+// dialFederationAddress connects to an address for the request attached to the context. Any host other
+// than the one the request was made to is reached through a redirect, so is checked against the network
+// restrictions. The checked IP is the one connected to, so the host can't resolve to somewhere else
+// between the check and the connection.
+func dialFederationAddress(ctx2 context.Context, network, addr string) (net.Conn, error) {
+	dial, ok := ctx2.Value(federationDialContextKey{}).(*federationDial)
+	if !ok {
+		return nil, errors.New("missing federation request: not safe to complete request")
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(config.Get().OutboundHttp.DialTimeoutSeconds) * time.Second,
+		KeepAlive: time.Duration(config.Get().OutboundHttp.KeepAliveSeconds) * time.Second,
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host == dial.host {
+		return dialer.DialContext(ctx2, network, addr)
+	}
+
+	safeIp, safePort, err := acl.GetSafeAddress(addr, dial.ctx)
+	if err != nil {
+		return nil, err
+	}
+	return dialer.DialContext(ctx2, network, net.JoinHostPort(safeIp.String(), safePort))
+}
+
 // Note: URL lookups are not covered by the breaker because otherwise it might never close.
 func GetServerApiUrl(hostname string) (string, string, error) {
 	logrus.Info("Getting server API URL for " + hostname)
@@ -101,7 +156,8 @@ func GetServerApiUrl(hostname string) (string, string, error) {
 	// Step 3: if the hostname is not an IP address and no explicit port is given, do .well-known
 	// Note that we have sprawling branches here because we need to fall through to step 4 if parsing fails
 	logrus.Debug("Doing .well-known lookup on " + h)
-	r, err := http.Get(fmt.Sprintf("https://%s/.well-known/matrix/server", h))
+	wkClient := util.NewHttpClient(time.Duration(config.Get().TimeoutSeconds.Federation) * time.Second)
+	r, err := wkClient.Get(fmt.Sprintf("https://%s/.well-known/matrix/server", h))
 	if err == nil && r.StatusCode == http.StatusOK {
 		// Try parsing .well-known
 		c, err2 := ioutil.ReadAll(r.Body)
@@ -208,6 +264,12 @@ func FederatedGet(url string, realHost string, ctx rcontext.RequestContext) (*ht
 		req.Header.Set("Host", realHost)
 		req.Header.Set("User-Agent", "matrix-media-repo")
 		req.Host = realHost
+		req = req.WithContext(context.WithValue(context.Background(), federationDialContextKey{}, &federationDial{host: req.URL.Hostname(), ctx: ctx}))
+
+		// Redirects could point anywhere, so are held to the same network restrictions as URL previews
+		checkRedirect := util.LimitRedirects(config.Get().Federation.MaxRedirects, func(req *http.Request) error {
+			return acl.CheckRedirect(req, ctx)
+		})
 
 		var client *http.Client
 		if os.Getenv("MEDIA_REPO_UNSAFE_FEDERATION") != "true" {
@@ -225,12 +287,9 @@ func FederatedGet(url string, realHost string, ctx rcontext.RequestContext) (*ht
 				realHost = h
 			}
 			client = &http.Client{
-				Transport: &http.Transport{
-					TLSClientConfig: &tls.Config{
-						ServerName: realHost,
-					},
-				},
-				Timeout: time.Duration(ctx.Config.TimeoutSeconds.Federation) * time.Second,
+				Transport:     getFederationTransport(realHost),
+				Timeout:       time.Duration(ctx.Config.TimeoutSeconds.Federation) * time.Second,
+				CheckRedirect: checkRedirect,
 			}
 		} else {
 			ctx.Log.Warn("Ignoring any certificate errors while making request")
@@ -238,8 +297,8 @@ func FederatedGet(url string, realHost string, ctx rcontext.RequestContext) (*ht
 				DisableKeepAlives: true,
 				TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
 				// Based on https://github.com/matrix-org/gomatrixserverlib/blob/51152a681e69a832efcd934b60080b92bc98b286/client.go#L74-L90
-				DialTLS: func(network, addr string) (net.Conn, error) {
-					rawconn, err := net.Dial(network, addr)
+				DialTLSContext: func(ctx2 context.Context, network, addr string) (net.Conn, error) {
+					rawconn, err := dialFederationAddress(ctx2, network, addr)
 					if err != nil {
 						return nil, err
 					}
@@ -255,8 +314,9 @@ func FederatedGet(url string, realHost string, ctx rcontext.RequestContext) (*ht
 				},
 			}
 			client = &http.Client{
-				Transport: tr,
-				Timeout:   time.Duration(ctx.Config.TimeoutSeconds.UrlPreviews) * time.Second,
+				Transport:     tr,
+				Timeout:       time.Duration(ctx.Config.TimeoutSeconds.UrlPreviews) * time.Second,
+				CheckRedirect: checkRedirect,
 			}
 		}
 
@@ -22,6 +22,10 @@ type mediaListResponse struct {
 	RemoteMxcs []string `json:"remote"`
 }
 
+type joinedRoomsResponse struct {
+	JoinedRooms []string `json:"joined_rooms"`
+}
+
 type wellknownServerResponse struct {
 	ServerAddr string `json:"m.server"`
 }
@@ -0,0 +1,331 @@
+package matrix
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/globals"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+type ServerSigningKeys struct {
+	ServerName    string
+	VerifyKeys    map[string]ed25519.PublicKey // key ID => key
+	OldVerifyKeys map[string]*OldVerifyKey     // key ID => key
+	ValidUntilTs  int64
+}
+
+// OldVerifyKey is a key the server no longer signs with, which is only valid for signatures made
+// before it expired.
+type OldVerifyKey struct {
+	Key       ed25519.PublicKey
+	ExpiredTs int64
+}
+
+type serverKeysResponse struct {
+	ServerName   string `json:"server_name"`
+	ValidUntilTs int64  `json:"valid_until_ts"`
+	VerifyKeys   map[string]struct {
+		Key string `json:"key"`
+	} `json:"verify_keys"`
+	OldVerifyKeys map[string]struct {
+		Key       string `json:"key"`
+		ExpiredTs int64  `json:"expired_ts"`
+	} `json:"old_verify_keys"`
+	Signatures map[string]map[string]string `json:"signatures"`
+}
+
+// GetVerifyKey returns the key with the given ID, provided it was valid at the given time.
+func (k *ServerSigningKeys) GetVerifyKey(keyId string, atTs int64) (ed25519.PublicKey, bool) {
+	if key, ok := k.VerifyKeys[keyId]; ok {
+		return key, true
+	}
+	if old, ok := k.OldVerifyKeys[keyId]; ok && atTs < old.ExpiredTs {
+		return old.Key, true
+	}
+	return nil, false
+}
+
+var serverKeysCache = cache.New(1*time.Hour, 2*time.Hour)
+var keyFetchSemaphore chan bool
+var keyFetchSemaphoreOnce = &sync.Once{}
+
+// GetServerSigningKeys returns the signing keys for the given server name, fetching them from the
+// server if they aren't cached. Concurrent calls for the same server share a single fetch.
+func GetServerSigningKeys(serverName string, ctx rcontext.RequestContext) (*ServerSigningKeys, error) {
+	if item, found := serverKeysCache.Get(serverName); found {
+		return item.(*ServerSigningKeys), nil
+	}
+
+	v, _, err := globals.DefaultRequestGroup.DoWithoutPost("keys:"+serverName, func() (interface{}, error) {
+		// Another fetch may have finished while we were waiting to get here
+		if item, found := serverKeysCache.Get(serverName); found {
+			return item.(*ServerSigningKeys), nil
+		}
+
+		// The fetch is shared, so it shouldn't be cancelled because the first caller went away
+		fetchCtx := rcontext.Initial().LogWithFields(logrus.Fields{"keysServerName": serverName})
+
+		release, err := acquireKeyFetch(fetchCtx)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+
+		keys, err := fetchServerSigningKeys(serverName, fetchCtx)
+		if err != nil {
+			return nil, err
+		}
+
+		ttl := time.Duration(config.Get().Federation.KeyFetching.CacheTtlSeconds) * time.Second
+		untilExpired := time.Duration(keys.ValidUntilTs-util.NowMillis()) * time.Millisecond
+		if untilExpired < ttl {
+			ttl = untilExpired
+		}
+		if ttl > 0 {
+			serverKeysCache.Set(serverName, keys, ttl)
+		}
+		return keys, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*ServerSigningKeys), nil
+}
+
+// acquireKeyFetch waits for a key fetch slot to become available, returning a function to release
+// the slot afterwards.
+func acquireKeyFetch(ctx rcontext.RequestContext) (func(), error) {
+	keyFetchSemaphoreOnce.Do(func() {
+		size := config.Get().Federation.KeyFetching.MaxConcurrentFetches
+		if size > 0 {
+			keyFetchSemaphore = make(chan bool, size)
+		}
+	})
+	if keyFetchSemaphore == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case keyFetchSemaphore <- true:
+		return func() { <-keyFetchSemaphore }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func fetchServerSigningKeys(serverName string, ctx rcontext.RequestContext) (*ServerSigningKeys, error) {
+	ctx.Log.Info("Fetching signing keys for " + serverName)
+
+	url, hostname, err := GetServerApiUrl(serverName)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := FederatedGet(url+"/_matrix/key/v2/server", hostname, ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup.DumpAndCloseStream(res.Body)
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("unexpected status code fetching keys: %d", res.StatusCode))
+	}
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed := &serverKeysResponse{}
+	err = json.Unmarshal(b, parsed)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.ServerName != serverName {
+		return nil, errors.New("keys are for " + parsed.ServerName + " instead of " + serverName)
+	}
+	if parsed.ValidUntilTs <= util.NowMillis() {
+		return nil, errors.New("keys for " + serverName + " have expired")
+	}
+
+	keys := &ServerSigningKeys{
+		ServerName:    serverName,
+		VerifyKeys:    make(map[string]ed25519.PublicKey),
+		OldVerifyKeys: make(map[string]*OldVerifyKey),
+		ValidUntilTs:  parsed.ValidUntilTs,
+	}
+	for keyId, verifyKey := range parsed.VerifyKeys {
+		if !strings.HasPrefix(keyId, "ed25519:") {
+			continue
+		}
+		key, err := decodeUnpaddedBase64(verifyKey.Key)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			ctx.Log.Warn("Ignoring invalid signing key " + keyId + " for " + serverName)
+			continue
+		}
+		keys.VerifyKeys[keyId] = key
+	}
+	for keyId, oldKey := range parsed.OldVerifyKeys {
+		if !strings.HasPrefix(keyId, "ed25519:") {
+			continue
+		}
+		key, err := decodeUnpaddedBase64(oldKey.Key)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			ctx.Log.Warn("Ignoring invalid old signing key " + keyId + " for " + serverName)
+			continue
+		}
+		keys.OldVerifyKeys[keyId] = &OldVerifyKey{Key: key, ExpiredTs: oldKey.ExpiredTs}
+	}
+
+	// The response must be signed by the keys it contains
+	signed, err := canonicalJsonWithoutSignatures(b)
+	if err != nil {
+		return nil, err
+	}
+	verified := false
+	for keyId, signature := range parsed.Signatures[serverName] {
+		key, ok := keys.VerifyKeys[keyId]
+		if !ok {
+			continue
+		}
+		sig, err := decodeUnpaddedBase64(signature)
+		if err != nil {
+			continue
+		}
+		if ed25519.Verify(key, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("keys for " + serverName + " are not signed by the server")
+	}
+
+	return keys, nil
+}
+
+// canonicalJsonWithoutSignatures returns the canonical JSON of an object, minus the fields which
+// are not covered by its signatures.
+func canonicalJsonWithoutSignatures(b []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	obj := make(map[string]interface{})
+	err := decoder.Decode(&obj)
+	if err != nil {
+		return nil, err
+	}
+	delete(obj, "signatures")
+	delete(obj, "unsigned")
+
+	buf := &bytes.Buffer{}
+	err = writeCanonicalJson(buf, obj)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeCanonicalJson encodes a decoded JSON value as canonical JSON: object keys are sorted, there
+// is no whitespace, and strings are only escaped where JSON requires it. encoding/json can't be used
+// for this because it always escapes U+2028 and U+2029.
+func writeCanonicalJson(buf *bytes.Buffer, v interface{}) error {
+	switch val := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		if val {
+			buf.WriteString("true")
+		} else {
+			buf.WriteString("false")
+		}
+	case json.Number:
+		i, err := val.Int64()
+		if err != nil {
+			return errors.New("canonical json only supports integers")
+		}
+		buf.WriteString(strconv.FormatInt(i, 10))
+	case string:
+		writeCanonicalJsonString(buf, val)
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, item := range val {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeCanonicalJson(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeCanonicalJsonString(buf, k)
+			buf.WriteByte(':')
+			if err := writeCanonicalJson(buf, val[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return fmt.Errorf("unexpected json type %T", v)
+	}
+	return nil
+}
+
+func writeCanonicalJsonString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			buf.WriteString("\\\"")
+		case '\\':
+			buf.WriteString("\\\\")
+		case '\b':
+			buf.WriteString("\\b")
+		case '\f':
+			buf.WriteString("\\f")
+		case '\n':
+			buf.WriteString("\\n")
+		case '\r':
+			buf.WriteString("\\r")
+		case '\t':
+			buf.WriteString("\\t")
+		default:
+			if r < 0x20 {
+				buf.WriteString(fmt.Sprintf("\\u%04x", r))
+			} else {
+				buf.WriteRune(r)
+			}
+		}
+	}
+	buf.WriteByte('"')
+}
+
+func decodeUnpaddedBase64(s string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(s, "="))
+}
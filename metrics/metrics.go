@@ -37,12 +37,21 @@ var CacheLiveNumBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 var ThumbnailsGenerated = prometheus.NewCounterVec(prometheus.CounterOpts{
 	Name: "media_thumbnails_generated_total",
 }, []string{"width", "height", "method", "animated", "origin"})
+var ThumbnailQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "media_thumbnail_generation_queue_depth",
+})
 var MediaDownloaded = prometheus.NewCounterVec(prometheus.CounterOpts{
 	Name: "media_downloaded_total",
 }, []string{"origin"})
 var UrlPreviewsGenerated = prometheus.NewCounterVec(prometheus.CounterOpts{
 	Name: "media_url_previews_generated_total",
 }, []string{"type"})
+var DatastoreReadFailovers = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "media_datastore_read_failovers_total",
+}, []string{"datastoreId", "replicaDatastoreId"})
+var ConcurrencyLimitRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "media_concurrency_limit_rejections_total",
+}, []string{"action"})
 
 func init() {
 	prometheus.MustRegister(HttpRequests)
@@ -56,6 +65,9 @@ func init() {
 	prometheus.MustRegister(CacheNumBytes)
 	prometheus.MustRegister(CacheLiveNumBytes)
 	prometheus.MustRegister(ThumbnailsGenerated)
+	prometheus.MustRegister(ThumbnailQueueDepth)
 	prometheus.MustRegister(MediaDownloaded)
 	prometheus.MustRegister(UrlPreviewsGenerated)
+	prometheus.MustRegister(DatastoreReadFailovers)
+	prometheus.MustRegister(ConcurrencyLimitRejections)
 }
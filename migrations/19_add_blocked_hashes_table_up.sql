@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS blocked_hashes (
+	sha256_hash TEXT PRIMARY KEY NOT NULL,
+	creation_ts BIGINT NOT NULL
+);
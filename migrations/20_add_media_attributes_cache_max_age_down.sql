@@ -0,0 +1 @@
+ALTER TABLE media_attributes DROP COLUMN cache_max_age;
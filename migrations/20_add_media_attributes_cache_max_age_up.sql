@@ -0,0 +1 @@
+ALTER TABLE media_attributes ADD COLUMN IF NOT EXISTS cache_max_age INT NOT NULL DEFAULT -1;
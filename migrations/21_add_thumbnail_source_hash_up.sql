@@ -0,0 +1,4 @@
+ALTER TABLE thumbnails ADD COLUMN IF NOT EXISTS source_sha256_hash TEXT NOT NULL DEFAULT '';
+UPDATE thumbnails AS t SET source_sha256_hash = m.sha256_hash FROM media AS m WHERE m.origin = t.origin AND m.media_id = t.media_id;
+DROP INDEX IF EXISTS thumbnails_index;
+CREATE UNIQUE INDEX IF NOT EXISTS thumbnails_index ON thumbnails (media_id, origin, width, height, method, animated, source_sha256_hash);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS last_access_count_index;
+ALTER TABLE last_access DROP COLUMN IF EXISTS access_count;
@@ -0,0 +1,2 @@
+ALTER TABLE last_access ADD COLUMN IF NOT EXISTS access_count BIGINT NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS last_access_count_index ON last_access (access_count);
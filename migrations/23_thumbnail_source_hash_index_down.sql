@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS thumbnails_location_index;
+DROP INDEX IF EXISTS thumbnails_source_hash_index;
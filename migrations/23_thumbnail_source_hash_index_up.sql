@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS thumbnails_source_hash_index ON thumbnails (source_sha256_hash, width, height, method, animated);
+CREATE INDEX IF NOT EXISTS thumbnails_location_index ON thumbnails (datastore_id, location);
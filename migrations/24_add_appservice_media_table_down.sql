@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS appservice_media_appservice_index;
+DROP INDEX IF EXISTS appservice_media_index;
+DROP TABLE IF EXISTS appservice_media;
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS appservice_media (
+	origin TEXT NOT NULL,
+	media_id TEXT NOT NULL,
+	appservice_id TEXT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS appservice_media_index ON appservice_media (media_id, origin);
+CREATE INDEX IF NOT EXISTS appservice_media_appservice_index ON appservice_media (appservice_id);
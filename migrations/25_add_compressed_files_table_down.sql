@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS compressed_files_index;
+DROP TABLE IF EXISTS compressed_files;
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS compressed_files (
+	datastore_id TEXT NOT NULL,
+	location TEXT NOT NULL,
+	encoding TEXT NOT NULL,
+	stored_size_bytes BIGINT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS compressed_files_index ON compressed_files (datastore_id, location);
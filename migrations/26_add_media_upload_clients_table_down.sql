@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS media_upload_clients_index;
+DROP TABLE IF EXISTS media_upload_clients;
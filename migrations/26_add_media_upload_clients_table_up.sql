@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS media_upload_clients (
+	origin TEXT NOT NULL,
+	media_id TEXT NOT NULL,
+	user_agent TEXT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS media_upload_clients_index ON media_upload_clients (media_id, origin);
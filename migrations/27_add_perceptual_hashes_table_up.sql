@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS perceptual_hashes (
+	sha256_hash TEXT PRIMARY KEY NOT NULL,
+	dhash BIGINT NOT NULL
+);
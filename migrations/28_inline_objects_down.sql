@@ -0,0 +1 @@
+DROP TABLE IF EXISTS inline_objects;
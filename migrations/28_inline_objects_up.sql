@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS inline_objects (
+	location TEXT PRIMARY KEY NOT NULL,
+	data BYTEA NOT NULL
+);
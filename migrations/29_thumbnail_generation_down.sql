@@ -0,0 +1,3 @@
+DROP INDEX thumbnails_index;
+CREATE UNIQUE INDEX IF NOT EXISTS thumbnails_index ON thumbnails (media_id, origin, width, height, method, animated, source_sha256_hash);
+ALTER TABLE thumbnails DROP COLUMN generation;
@@ -0,0 +1,3 @@
+ALTER TABLE thumbnails ADD COLUMN IF NOT EXISTS generation TEXT NOT NULL DEFAULT '';
+DROP INDEX IF EXISTS thumbnails_index;
+CREATE UNIQUE INDEX IF NOT EXISTS thumbnails_index ON thumbnails (media_id, origin, width, height, method, animated, source_sha256_hash, generation);
@@ -0,0 +1,2 @@
+ALTER TABLE url_previews ADD COLUMN IF NOT EXISTS expires_ts BIGINT NOT NULL DEFAULT 0;
+UPDATE url_previews SET expires_ts = bucket_ts + 3600000;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS media_reports_reporter_index;
+DROP INDEX IF EXISTS media_reports_media_index;
+DROP TABLE IF EXISTS media_reports;
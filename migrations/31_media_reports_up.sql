@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS media_reports (
+	origin TEXT NOT NULL,
+	media_id TEXT NOT NULL,
+	reporter TEXT NOT NULL,
+	reason TEXT NOT NULL,
+	report_ts BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS media_reports_media_index ON media_reports (media_id, origin);
+CREATE INDEX IF NOT EXISTS media_reports_reporter_index ON media_reports (reporter, report_ts);
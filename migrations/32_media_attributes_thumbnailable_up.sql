@@ -0,0 +1 @@
+ALTER TABLE media_attributes ADD COLUMN IF NOT EXISTS thumbnailable BOOLEAN NOT NULL DEFAULT TRUE;
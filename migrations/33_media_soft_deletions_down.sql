@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS media_soft_deletions_ts_index;
+DROP INDEX IF EXISTS media_soft_deletions_index;
+DROP TABLE IF EXISTS media_soft_deletions;
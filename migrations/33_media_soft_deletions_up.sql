@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS media_soft_deletions (
+	origin TEXT NOT NULL,
+	media_id TEXT NOT NULL,
+	deleted_by TEXT NOT NULL,
+	deleted_ts BIGINT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS media_soft_deletions_index ON media_soft_deletions (media_id, origin);
+CREATE INDEX IF NOT EXISTS media_soft_deletions_ts_index ON media_soft_deletions (deleted_ts);
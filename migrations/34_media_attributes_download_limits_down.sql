@@ -0,0 +1,2 @@
+ALTER TABLE media_attributes DROP COLUMN download_count;
+ALTER TABLE media_attributes DROP COLUMN max_downloads;
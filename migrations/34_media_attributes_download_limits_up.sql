@@ -0,0 +1,2 @@
+ALTER TABLE media_attributes ADD COLUMN IF NOT EXISTS max_downloads INT NOT NULL DEFAULT 0;
+ALTER TABLE media_attributes ADD COLUMN IF NOT EXISTS download_count INT NOT NULL DEFAULT 0;
@@ -0,0 +1 @@
+ALTER TABLE media_attributes ADD COLUMN IF NOT EXISTS force_attachment BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS polyglot_verdicts (
+	sha256_hash TEXT PRIMARY KEY NOT NULL,
+	polyglot BOOLEAN NOT NULL,
+	creation_ts BIGINT NOT NULL
+);
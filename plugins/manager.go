@@ -31,6 +31,11 @@ func ReloadPlugins() {
 	}
 }
 
+// IsSpamCheckingEnabled determines if any antispam plugins are loaded.
+func IsSpamCheckingEnabled() bool {
+	return len(existingPlugins) > 0
+}
+
 func StopPlugins() {
 	if len(existingPlugins) == 0 {
 		return
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 
 	"github.com/ryanuber/go-glob"
+	"github.com/turt2live/matrix-media-repo/common/config"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/storage"
 )
@@ -33,3 +34,17 @@ func IsUserWithinQuota(ctx rcontext.RequestContext, userId string) (bool, error)
 
 	return true, nil // no rules == no quota
 }
+
+// IsAppserviceWithinQuota checks the combined size of all media uploaded by the appservice against
+// its configured limit.
+func IsAppserviceWithinQuota(ctx rcontext.RequestContext, appservice *config.AppserviceConfig) (bool, error) {
+	if appservice == nil || appservice.MaxBytes <= 0 {
+		return true, nil
+	}
+
+	uploaded, err := storage.GetDatabase().GetMetadataStore(ctx).GetAppserviceUploadedBytes(appservice.Id)
+	if err != nil {
+		return false, err
+	}
+	return uploaded < appservice.MaxBytes, nil
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/turt2live/matrix-media-repo/common/config"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/util"
 )
 
 var ErrCacheMiss = errors.New("missed cache")
@@ -97,3 +98,30 @@ func (c *RedisCache) GetBytes(ctx rcontext.RequestContext, key string) ([]byte,
 	b, err := r.Bytes()
 	return b, err
 }
+
+// unlockScript deletes the lock only if it is still held with the given token, so a lock which
+// expired and was taken by another process isn't released.
+var unlockScript = redis.NewScript(`if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`)
+
+// TryLock attempts to take the lock with the given key, which is shared by all processes using the
+// same Redis shards. The lock expires after the ttl if it isn't unlocked. Returns the token to
+// unlock with, and false if the lock is held elsewhere.
+func (c *RedisCache) TryLock(ctx rcontext.RequestContext, key string, ttl time.Duration) (string, bool, error) {
+	if c.ring.PoolStats().TotalConns == 0 {
+		return "", false, ErrCacheDown
+	}
+	token, err := util.GenerateRandomString(16)
+	if err != nil {
+		return "", false, err
+	}
+	acquired, err := c.ring.SetNX(ctx.Context, key, token, ttl).Result()
+	if err != nil {
+		return "", false, err
+	}
+	return token, acquired, nil
+}
+
+// Unlock releases a lock taken with TryLock.
+func (c *RedisCache) Unlock(ctx rcontext.RequestContext, key string, token string) error {
+	return unlockScript.Run(ctx.Context, c.ring, []string{key}, token).Err()
+}
@@ -0,0 +1,164 @@
+package datastore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/ryanuber/go-glob"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+const EncodingGzip = "gzip"
+
+// Content types which are already compressed, and therefore never compressed again regardless
+// of configuration.
+var alreadyCompressedTypes = []string{
+	"application/gzip",
+	"application/x-gzip",
+	"application/zip",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/zstd",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"image/*",
+	"video/*",
+	"audio/*",
+}
+
+// Files are never re-compressed, so the encoding of a location doesn't change once known.
+var encodingCache = cache.New(5*time.Minute, 10*time.Minute)
+
+// ShouldCompress determines if media of the given content type and size should be compressed when
+// stored, per the upload compression config.
+func ShouldCompress(contentType string, sizeBytes int64, ctx rcontext.RequestContext) bool {
+	conf := ctx.Config.Uploads.Compression
+	if !conf.Enabled || sizeBytes < conf.MinBytes {
+		return false
+	}
+
+	contentType = util.FixContentType(contentType)
+	if contentType != "image/svg+xml" { // SVGs are text, despite being images
+		for _, t := range alreadyCompressedTypes {
+			if glob.Glob(t, contentType) {
+				return false
+			}
+		}
+	}
+	for _, t := range conf.Types {
+		if glob.Glob(t, contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// UploadCompressedPendingFile gzips the contents and uploads them as a pending file (see
+// UploadPendingFile). Returns nil if compressing the contents doesn't make them any smaller. The
+// returned object info describes the compressed file: callers are expected to record the hash and
+// size of the uncompressed contents on the media instead, and to call MarkCompressed before the
+// media is stored.
+func (d *DatastoreRef) UploadCompressedPendingFile(contents []byte, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
+	compressed := &bytes.Buffer{}
+	w := gzip.NewWriter(compressed)
+	_, err := w.Write(contents)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if compressed.Len() >= len(contents) {
+		ctx.Log.Info("Compressing did not reduce the file size - storing uncompressed")
+		return nil, nil
+	}
+
+	ctx.Log.Infof("Storing compressed file: %d bytes compressed to %d", len(contents), compressed.Len())
+	return d.UploadPendingFile(util.BufferToStream(compressed), int64(compressed.Len()), ctx)
+}
+
+// MarkCompressed records that the file at the given location is compressed, so it will be
+// decompressed when downloaded.
+func MarkCompressed(ctx rcontext.RequestContext, datastoreId string, location string, storedSizeBytes int64) error {
+	err := storage.GetDatabase().GetMetadataStore(ctx).InsertCompressedFile(datastoreId, location, EncodingGzip, storedSizeBytes)
+	if err != nil {
+		return err
+	}
+	encodingCache.Set(datastoreId+"/"+location, EncodingGzip, cache.DefaultExpiration)
+	return nil
+}
+
+func getEncoding(ctx rcontext.RequestContext, datastoreId string, location string) (string, error) {
+	key := datastoreId + "/" + location
+	if encoding, found := encodingCache.Get(key); found {
+		return encoding.(string), nil
+	}
+	encoding, err := storage.GetDatabase().GetMetadataStore(ctx).GetCompressedFileEncoding(datastoreId, location)
+	if err != nil {
+		return "", err
+	}
+	encodingCache.Set(key, encoding, cache.DefaultExpiration)
+	return encoding, nil
+}
+
+// DownloadEncodedStream opens the file as stored, without decompressing it, so it can be passed
+// through to clients which accept its encoding. Replicas aren't tried, as they may be stored with a
+// different encoding.
+func DownloadEncodedStream(ctx rcontext.RequestContext, datastoreId string, location string) (io.ReadCloser, error) {
+	stream, err := openEncodedStream(ctx, datastoreId, location)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.TimeReads("datastoreRead", stream), nil
+}
+
+func openEncodedStream(ctx rcontext.RequestContext, datastoreId string, location string) (io.ReadCloser, error) {
+	defer ctx.TimePhase("datastoreRead")()
+	ref, err := LocateDatastore(ctx, datastoreId)
+	if err != nil {
+		return nil, err
+	}
+	return ref.DownloadFile(location)
+}
+
+// decompressIfNeeded wraps the stream to decompress it if the file at the location is compressed.
+func decompressIfNeeded(ctx rcontext.RequestContext, datastoreId string, location string, stream io.ReadCloser) (io.ReadCloser, error) {
+	encoding, err := getEncoding(ctx, datastoreId, location)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	if encoding == "" {
+		return stream, nil
+	}
+	if encoding != EncodingGzip {
+		stream.Close()
+		return nil, fmt.Errorf("unknown file encoding: %s", encoding)
+	}
+
+	r, err := gzip.NewReader(stream)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return &gzipReadCloser{Reader: r, source: stream}, nil
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	source io.ReadCloser
+}
+
+func (r *gzipReadCloser) Close() error {
+	_ = r.Reader.Close()
+	return r.source.Close()
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/getsentry/sentry-go"
 	"github.com/turt2live/matrix-media-repo/common"
 	"io"
+	"io/ioutil"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -12,6 +13,9 @@ import (
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/storage"
 	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+	"github.com/turt2live/matrix-media-repo/util/util_byte_seeker"
 )
 
 func GetAvailableDatastores(ctx rcontext.RequestContext) ([]*types.Datastore, error) {
@@ -35,11 +39,20 @@ func GetAvailableDatastores(ctx rcontext.RequestContext) ([]*types.Datastore, er
 }
 
 func LocateDatastore(ctx rcontext.RequestContext, datastoreId string) (*DatastoreRef, error) {
-	ds, err := storage.GetDatabase().GetMediaStore(ctx).GetDatastore(datastoreId)
+	var ds *types.Datastore
+	err := withRetries(ctx.Log, "lookup", func() error {
+		var err error
+		ds, err = storage.GetDatabase().GetMediaStore(ctx).GetDatastore(datastoreId)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	if ds.Type == inlineDatastoreType {
+		return newInlineDatastoreRef(ds), nil
+	}
+
 	conf, err := GetDatastoreConfig(ds)
 	if err != nil {
 		return nil, err
@@ -49,11 +62,79 @@ func LocateDatastore(ctx rcontext.RequestContext, datastoreId string) (*Datastor
 }
 
 func DownloadStream(ctx rcontext.RequestContext, datastoreId string, location string) (io.ReadCloser, error) {
+	stream, err := openStream(ctx, datastoreId, location)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.TimeReads("datastoreRead", stream), nil
+}
+
+func openStream(ctx rcontext.RequestContext, datastoreId string, location string) (io.ReadCloser, error) {
+	defer ctx.TimePhase("datastoreRead")()
 	ref, err := LocateDatastore(ctx, datastoreId)
 	if err != nil {
 		return nil, err
 	}
-	return ref.DownloadFile(location)
+	stream, err := ref.DownloadFile(location)
+	if err != nil {
+		return downloadFromReplica(ctx, datastoreId, location, err)
+	}
+	return decompressIfNeeded(ctx, datastoreId, location, stream)
+}
+
+// DownloadSeekableStream opens the file so that it can be read from any offset, such as to serve a
+// range request, returning the stream and its size. Files which can't be seeked in place (such as
+// compressed files) are read into memory.
+func DownloadSeekableStream(ctx rcontext.RequestContext, datastoreId string, location string) (io.ReadSeekCloser, int64, error) {
+	stream, size, err := openSeekableStream(ctx, datastoreId, location)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ctx.TimeSeekableReads("datastoreRead", stream), size, nil
+}
+
+func openSeekableStream(ctx rcontext.RequestContext, datastoreId string, location string) (io.ReadSeekCloser, int64, error) {
+	defer ctx.TimePhase("datastoreRead")()
+	ref, err := LocateDatastore(ctx, datastoreId)
+	if err != nil {
+		return nil, 0, err
+	}
+	encoding, err := getEncoding(ctx, datastoreId, location)
+	if err != nil {
+		return nil, 0, err
+	}
+	if encoding != "" {
+		// Compressed files can't be seeked, so decompress the whole thing into memory instead
+		var stream io.ReadCloser
+		compressed, err := ref.DownloadFile(location)
+		if err != nil {
+			stream, err = downloadFromReplica(ctx, datastoreId, location, err)
+		} else {
+			stream, err = decompressIfNeeded(ctx, datastoreId, location, compressed)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		return bufferSeekable(stream)
+	}
+	seekable, size, err := ref.DownloadSeekableFile(location)
+	if err != nil {
+		stream, err := downloadFromReplica(ctx, datastoreId, location, err)
+		if err != nil {
+			return nil, 0, err
+		}
+		return bufferSeekable(stream)
+	}
+	return seekable, size, nil
+}
+
+func bufferSeekable(stream io.ReadCloser) (io.ReadSeekCloser, int64, error) {
+	defer cleanup.DumpAndCloseStream(stream)
+	b, err := ioutil.ReadAll(stream)
+	if err != nil {
+		return nil, 0, err
+	}
+	return util_byte_seeker.NewByteSeeker(b), int64(len(b)), nil
 }
 
 func GetDatastoreConfig(ds *types.Datastore) (config.DatastoreConfig, error) {
@@ -97,7 +178,15 @@ func GetUriForDatastore(dsConf config.DatastoreConfig) string {
 	return ""
 }
 
+// PickDatastore picks a datastore for the kind of media, where the media's content type is unknown.
 func PickDatastore(forKind string, ctx rcontext.RequestContext) (*DatastoreRef, error) {
+	return PickDatastoreForContentType(forKind, "", ctx)
+}
+
+// PickDatastoreForContentType picks a datastore for the kind of media. Datastores which list the
+// content type in their forContentTypes are preferred, followed by datastores without any content
+// type rules.
+func PickDatastoreForContentType(forKind string, contentType string, ctx rcontext.RequestContext) (*DatastoreRef, error) {
 	ctx.Log.Info("Finding a suitable datastore to pick for " + forKind)
 	confDatastores := ctx.Config.DataStores
 	mediaStore := storage.GetDatabase().GetMediaStore(ctx)
@@ -118,6 +207,7 @@ func PickDatastore(forKind string, ctx rcontext.RequestContext) (*DatastoreRef,
 
 		possibleDatastores = append(possibleDatastores, dsConf)
 	}
+	possibleDatastores = filterByContentType(possibleDatastores, contentType)
 
 	var targetDs *types.Datastore
 	var targetDsConf config.DatastoreConfig
@@ -157,6 +247,38 @@ func PickDatastore(forKind string, ctx rcontext.RequestContext) (*DatastoreRef,
 	return nil, errors.New("failed to pick a datastore: none available")
 }
 
+// filterByContentType returns the datastores with a content type rule matching the content type. If
+// there are none, the datastores without any rules are returned instead. If all of the datastores
+// have rules, none of which match, all of the datastores are returned so that the media can still
+// be stored somewhere.
+func filterByContentType(datastores []config.DatastoreConfig, contentType string) []config.DatastoreConfig {
+	matching := make([]config.DatastoreConfig, 0)
+	unrestricted := make([]config.DatastoreConfig, 0)
+	for _, dsConf := range datastores {
+		if len(dsConf.ContentTypes) == 0 {
+			unrestricted = append(unrestricted, dsConf)
+			continue
+		}
+		if contentType == "" {
+			continue
+		}
+		for _, pattern := range dsConf.ContentTypes {
+			if util.ContentTypeMatches(pattern, contentType) {
+				matching = append(matching, dsConf)
+				break
+			}
+		}
+	}
+
+	if len(matching) > 0 {
+		return matching
+	}
+	if len(unrestricted) > 0 {
+		return unrestricted
+	}
+	return datastores
+}
+
 func estimatedDatastoreSize(ds *types.Datastore, ctx rcontext.RequestContext) (int64, error) {
 	return storage.GetDatabase().GetMetadataStore(ctx).GetEstimatedSizeOfDatastore(ds.DatastoreId)
 }
@@ -3,8 +3,10 @@ package datastore
 import (
 	"errors"
 	"io"
-	"os"
+	"io/ioutil"
 	"path"
+	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	config2 "github.com/turt2live/matrix-media-repo/common/config"
@@ -14,6 +16,8 @@ import (
 	"github.com/turt2live/matrix-media-repo/storage/datastore/ds_s3"
 	"github.com/turt2live/matrix-media-repo/types"
 	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+	"github.com/turt2live/matrix-media-repo/util/util_byte_seeker"
 )
 
 type DatastoreRef struct {
@@ -36,25 +40,117 @@ func newDatastoreRef(ds *types.Datastore, config config2.DatastoreConfig) *Datas
 	}
 }
 
+func (d *DatastoreRef) logger() *logrus.Entry {
+	return logrus.WithFields(logrus.Fields{"datastoreId": d.DatastoreId, "datastoreUri": d.Uri})
+}
+
 func (d *DatastoreRef) UploadFile(file io.ReadCloser, expectedLength int64, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
+	return d.upload(file, expectedLength, false, ctx)
+}
+
+// UploadPendingFile uploads the file to a pending location where supported by the datastore. The
+// returned location must be committed with CommitObject once the media has been recorded in the
+// database, or deleted if that fails. Use FinalLocation to get the location the object will have
+// once committed.
+func (d *DatastoreRef) UploadPendingFile(file io.ReadCloser, expectedLength int64, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
+	return d.upload(file, expectedLength, true, ctx)
+}
+
+func (d *DatastoreRef) upload(file io.ReadCloser, expectedLength int64, pending bool, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
 	ctx = ctx.LogWithFields(logrus.Fields{"datastoreId": d.DatastoreId, "datastoreUri": d.Uri})
 
+	if !retriesEnabled() {
+		return d.uploadFile(file, expectedLength, pending, ctx)
+	}
+
+	// Buffer the upload so it can be replayed if a retry is needed
+	defer cleanup.DumpAndCloseStream(file)
+	b, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var info *types.ObjectInfo
+	err = withRetries(ctx.Log, "upload", func() error {
+		info, err = d.uploadFile(util.BytesToStream(b), expectedLength, pending, ctx)
+		return err
+	})
+	return info, err
+}
+
+func (d *DatastoreRef) uploadFile(file io.ReadCloser, expectedLength int64, pending bool, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
 	if d.Type == "file" {
+		if pending {
+			return ds_file.PersistPendingFile(d.Uri, file, ctx)
+		}
 		return ds_file.PersistFile(d.Uri, file, ctx)
 	} else if d.Type == "s3" {
 		s3, err := ds_s3.GetOrCreateS3Datastore(d.DatastoreId, d.config)
 		if err != nil {
 			return nil, err
 		}
+		if pending {
+			return s3.UploadPendingFile(file, expectedLength, ctx)
+		}
 		return s3.UploadFile(file, expectedLength, ctx)
 	} else if d.Type == "ipfs" {
 		return ds_ipfs.UploadFile(file, ctx)
+	} else if d.Type == inlineDatastoreType {
+		return uploadInlineObject(file, ctx)
 	} else {
 		return nil, errors.New("unknown datastore type")
 	}
 }
 
+// FinalLocation returns the location the object will have once committed.
+func (d *DatastoreRef) FinalLocation(location string) string {
+	if d.Type == "file" {
+		return strings.TrimSuffix(location, ds_file.PendingSuffix)
+	} else if d.Type == "s3" {
+		return strings.TrimPrefix(location, ds_s3.PendingPrefix)
+	}
+	return location
+}
+
+// CommitObject moves an object uploaded with UploadPendingFile to its final location. Datastores
+// without pending uploads have nothing to do.
+func (d *DatastoreRef) CommitObject(location string) error {
+	if d.Type == "file" {
+		_, err := ds_file.CommitPendingFile(d.Uri, location)
+		return err
+	} else if d.Type == "s3" {
+		s3, err := ds_s3.GetOrCreateS3Datastore(d.DatastoreId, d.config)
+		if err != nil {
+			return err
+		}
+		_, err = s3.CommitPendingObject(location)
+		return err
+	}
+	return nil
+}
+
+// pendingObjects lists the locations of the datastore's pending objects along with when they were
+// last modified. Datastores without pending uploads have none.
+func (d *DatastoreRef) pendingObjects() (map[string]time.Time, error) {
+	if d.Type == "file" {
+		return ds_file.GetPendingFiles(d.Uri)
+	} else if d.Type == "s3" {
+		s3, err := ds_s3.GetOrCreateS3Datastore(d.DatastoreId, d.config)
+		if err != nil {
+			return nil, err
+		}
+		return s3.GetPendingObjects()
+	}
+	return nil, nil
+}
+
 func (d *DatastoreRef) DeleteObject(location string) error {
+	return withRetries(d.logger(), "delete", func() error {
+		return d.deleteObject(location)
+	})
+}
+
+func (d *DatastoreRef) deleteObject(location string) error {
 	if d.Type == "file" {
 		return ds_file.DeletePersistedFile(d.Uri, location)
 	} else if d.Type == "s3" {
@@ -67,14 +163,30 @@ func (d *DatastoreRef) DeleteObject(location string) error {
 		// TODO: Support deleting from IPFS - will need a "delete reason" to avoid deleting duplicates
 		logrus.Warn("Unsupported operation: deleting from IPFS datastore")
 		return nil
+	} else if d.Type == inlineDatastoreType {
+		return deleteInlineObject(location)
 	} else {
 		return errors.New("unknown datastore type")
 	}
 }
 
 func (d *DatastoreRef) DownloadFile(location string) (io.ReadCloser, error) {
+	var stream io.ReadCloser
+	err := withRetries(d.logger(), "download", func() error {
+		var err error
+		stream, err = d.downloadFile(location)
+		return err
+	})
+	return stream, err
+}
+
+func (d *DatastoreRef) downloadFile(location string) (io.ReadCloser, error) {
 	if d.Type == "file" {
-		return os.Open(path.Join(d.Uri, location))
+		f, _, err := ds_file.OpenPersistedFile(d.Uri, location)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
 	} else if d.Type == "s3" {
 		s3, err := ds_s3.GetOrCreateS3Datastore(d.DatastoreId, d.config)
 		if err != nil {
@@ -83,11 +195,64 @@ func (d *DatastoreRef) DownloadFile(location string) (io.ReadCloser, error) {
 		return s3.DownloadObject(location)
 	} else if d.Type == "ipfs" {
 		return ds_ipfs.DownloadFile(location)
+	} else if d.Type == inlineDatastoreType {
+		b, err := downloadInlineObject(location)
+		if err != nil {
+			return nil, err
+		}
+		return util.BytesToStream(b), nil
 	} else {
 		return nil, errors.New("unknown datastore type")
 	}
 }
 
+// DownloadSeekableFile returns a seekable reader for the object along with its size in bytes. Datastores
+// which cannot seek natively have the whole object read into memory instead.
+func (d *DatastoreRef) DownloadSeekableFile(location string) (io.ReadSeekCloser, int64, error) {
+	var stream io.ReadSeekCloser
+	var size int64
+	err := withRetries(d.logger(), "download", func() error {
+		var err error
+		stream, size, err = d.downloadSeekableFile(location)
+		return err
+	})
+	return stream, size, err
+}
+
+func (d *DatastoreRef) downloadSeekableFile(location string) (io.ReadSeekCloser, int64, error) {
+	if d.Type == "file" {
+		f, stat, err := ds_file.OpenPersistedFile(d.Uri, location)
+		if err != nil {
+			return nil, 0, err
+		}
+		return f, stat.Size(), nil
+	} else if d.Type == "s3" {
+		s3, err := ds_s3.GetOrCreateS3Datastore(d.DatastoreId, d.config)
+		if err != nil {
+			return nil, 0, err
+		}
+		return s3.DownloadSeekableObject(location)
+	} else if d.Type == inlineDatastoreType {
+		b, err := downloadInlineObject(location)
+		if err != nil {
+			return nil, 0, err
+		}
+		return util_byte_seeker.NewByteSeeker(b), int64(len(b)), nil
+	}
+
+	// Fall back to buffering the whole stream
+	stream, err := d.downloadFile(location)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cleanup.DumpAndCloseStream(stream)
+	b, err := ioutil.ReadAll(stream)
+	if err != nil {
+		return nil, 0, err
+	}
+	return util_byte_seeker.NewByteSeeker(b), int64(len(b)), nil
+}
+
 func (d *DatastoreRef) ObjectExists(location string) bool {
 	if d.Type == "file" {
 		ok, err := util.FileExists(path.Join(d.Uri, location))
@@ -105,12 +270,32 @@ func (d *DatastoreRef) ObjectExists(location string) bool {
 		// TODO: Support checking file existence in IPFS
 		logrus.Warn("Unsupported operation: existence in IPFS datastore")
 		return false
+	} else if d.Type == inlineDatastoreType {
+		_, err := downloadInlineObject(location)
+		return err == nil
 	} else {
 		panic("unknown datastore type")
 	}
 }
 
 func (d *DatastoreRef) OverwriteObject(location string, stream io.ReadCloser, ctx rcontext.RequestContext) error {
+	if !retriesEnabled() {
+		return d.overwriteObject(location, stream, ctx)
+	}
+
+	// Buffer the stream so it can be replayed if a retry is needed
+	defer cleanup.DumpAndCloseStream(stream)
+	b, err := ioutil.ReadAll(stream)
+	if err != nil {
+		return err
+	}
+
+	return withRetries(d.logger(), "overwrite", func() error {
+		return d.overwriteObject(location, util.BytesToStream(b), ctx)
+	})
+}
+
+func (d *DatastoreRef) overwriteObject(location string, stream io.ReadCloser, ctx rcontext.RequestContext) error {
 	if d.Type == "file" {
 		_, _, err := ds_file.PersistFileAtLocation(path.Join(d.Uri, location), stream, ctx)
 		return err
@@ -124,6 +309,8 @@ func (d *DatastoreRef) OverwriteObject(location string, stream io.ReadCloser, ct
 		// TODO: Support overwriting in IPFS
 		logrus.Warn("Unsupported operation: overwriting file in IPFS datastore")
 		return errors.New("unsupported operation")
+	} else if d.Type == inlineDatastoreType {
+		return overwriteInlineObject(location, stream)
 	} else {
 		return errors.New("unknown datastore type")
 	}
@@ -6,14 +6,32 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/types"
 	"github.com/turt2live/matrix-media-repo/util"
 	"github.com/turt2live/matrix-media-repo/util/cleanup"
 )
 
+// PendingSuffix is appended to the location of files which have been written but not yet committed.
+const PendingSuffix = ".pending"
+
 func PersistFile(basePath string, file io.ReadCloser, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
+	return persistFile(basePath, file, "", ctx)
+}
+
+// PersistPendingFile is the same as PersistFile, though the file is written to a pending location
+// which must be committed with CommitPendingFile before it can be used at its final location.
+func PersistPendingFile(basePath string, file io.ReadCloser, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
+	return persistFile(basePath, file, PendingSuffix, ctx)
+}
+
+func persistFile(basePath string, file io.ReadCloser, suffix string, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
 	defer cleanup.DumpAndCloseStream(file)
 
 	exists := true
@@ -55,12 +73,12 @@ func PersistFile(basePath string, file io.ReadCloser, ctx rcontext.RequestContex
 		return nil, err
 	}
 
-	sizeBytes, hash, err := PersistFileAtLocation(targetFile, file, ctx)
+	sizeBytes, hash, err := PersistFileAtLocation(targetFile+suffix, file, ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	locationPath := path.Join(primaryContainer, secondaryContainer, fileName)
+	locationPath := path.Join(primaryContainer, secondaryContainer, fileName) + suffix
 	return &types.ObjectInfo{
 		Location:   locationPath,
 		Sha256Hash: hash,
@@ -127,3 +145,60 @@ func DeletePersistedFile(basePath string, location string) error {
 	}
 	return err
 }
+
+// OpenPersistedFile opens a file for reading, returning common.ErrNotRegularFile if the location
+// is a directory or other special file rather than something which can be served.
+func OpenPersistedFile(basePath string, location string) (*os.File, os.FileInfo, error) {
+	f, err := os.Open(path.Join(basePath, location))
+	if err != nil {
+		return nil, nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if !stat.Mode().IsRegular() {
+		f.Close()
+		logrus.WithFields(logrus.Fields{"basePath": basePath, "location": location, "mode": stat.Mode().String()}).Error("Refusing to read datastore object which is not a regular file")
+		return nil, nil, common.ErrNotRegularFile
+	}
+	return f, stat, nil
+}
+
+func IsPendingLocation(location string) bool {
+	return strings.HasSuffix(location, PendingSuffix)
+}
+
+// CommitPendingFile atomically moves a pending file to its final location, returning that location.
+func CommitPendingFile(basePath string, location string) (string, error) {
+	if !IsPendingLocation(location) {
+		return location, nil
+	}
+	finalLocation := strings.TrimSuffix(location, PendingSuffix)
+	err := os.Rename(path.Join(basePath, location), path.Join(basePath, finalLocation))
+	if err != nil {
+		return "", err
+	}
+	return finalLocation, nil
+}
+
+// GetPendingFiles lists the locations of all pending files along with when they were last modified.
+func GetPendingFiles(basePath string) (map[string]time.Time, error) {
+	locations := make(map[string]time.Time)
+	err := filepath.Walk(basePath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !IsPendingLocation(p) {
+			return nil
+		}
+		location, err := filepath.Rel(basePath, p)
+		if err != nil {
+			return err
+		}
+		locations[filepath.ToSlash(location)] = info.ModTime()
+		return nil
+	})
+	return locations, err
+}
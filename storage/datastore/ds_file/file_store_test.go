@@ -0,0 +1,104 @@
+package ds_file
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+func testContext(t *testing.T) rcontext.RequestContext {
+	return rcontext.RequestContext{
+		Context: context.Background(),
+		Log:     logrus.WithFields(logrus.Fields{"test": t.Name()}),
+	}
+}
+
+func persistPending(t *testing.T, basePath string) string {
+	info, err := PersistPendingFile(basePath, util.BytesToStream([]byte("pending contents")), testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsPendingLocation(info.Location) {
+		t.Fatalf("expected %s to be a pending location", info.Location)
+	}
+	return info.Location
+}
+
+func TestCommitPendingFile(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "media-repo-ds-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(basePath)
+
+	location := persistPending(t, basePath)
+
+	pending, err := GetPendingFiles(basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pending[location]; !ok || len(pending) != 1 {
+		t.Fatalf("expected only %s to be pending, found %v", location, pending)
+	}
+
+	finalLocation, err := CommitPendingFile(basePath, location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsPendingLocation(finalLocation) {
+		t.Errorf("expected %s not to be a pending location", finalLocation)
+	}
+
+	b, err := ioutil.ReadFile(path.Join(basePath, finalLocation))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "pending contents" {
+		t.Errorf("expected the committed file to hold the upload, got %q", string(b))
+	}
+
+	pending, err = GetPendingFiles(basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) > 0 {
+		t.Errorf("expected no pending files after committing, found %v", pending)
+	}
+
+	committedAgain, err := CommitPendingFile(basePath, finalLocation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if committedAgain != finalLocation {
+		t.Errorf("expected committing a committed file to leave it at %s, got %s", finalLocation, committedAgain)
+	}
+}
+
+func TestDeletePendingFile(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "media-repo-ds-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(basePath)
+
+	location := persistPending(t, basePath)
+
+	err = DeletePersistedFile(basePath, location)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := GetPendingFiles(basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) > 0 {
+		t.Errorf("expected no pending files after deleting, found %v", pending)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/minio/minio-go/v6"
 	"github.com/pkg/errors"
@@ -20,6 +21,9 @@ import (
 
 var stores = make(map[string]*s3Datastore)
 
+// PendingPrefix is prepended to the names of objects which have been uploaded but not yet committed.
+const PendingPrefix = "pending/"
+
 type s3Datastore struct {
 	conf     config.DatastoreConfig
 	dsId     string
@@ -128,12 +132,23 @@ func (s *s3Datastore) EnsureTempPathExists() error {
 }
 
 func (s *s3Datastore) UploadFile(file io.ReadCloser, expectedLength int64, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
+	return s.uploadFile(file, expectedLength, "", ctx)
+}
+
+// UploadPendingFile is the same as UploadFile, though the object is uploaded under PendingPrefix and
+// must be committed with CommitPendingObject before it can be used at its final location.
+func (s *s3Datastore) UploadPendingFile(file io.ReadCloser, expectedLength int64, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
+	return s.uploadFile(file, expectedLength, PendingPrefix, ctx)
+}
+
+func (s *s3Datastore) uploadFile(file io.ReadCloser, expectedLength int64, prefix string, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
 	defer cleanup.DumpAndCloseStream(file)
 
 	objectName, err := util.GenerateRandomString(512)
 	if err != nil {
 		return nil, err
 	}
+	objectName = prefix + objectName
 
 	var rs3 io.ReadCloser
 	var ws3 io.WriteCloser
@@ -210,6 +225,52 @@ func (s *s3Datastore) UploadFile(file io.ReadCloser, expectedLength int64, ctx r
 	return obj, nil
 }
 
+func IsPendingLocation(location string) bool {
+	return strings.HasPrefix(location, PendingPrefix)
+}
+
+// CommitPendingObject moves a pending object to its final location, returning that location. S3 can't
+// rename objects, so the object is copied within the bucket and the pending object is then deleted.
+func (s *s3Datastore) CommitPendingObject(location string) (string, error) {
+	if !IsPendingLocation(location) {
+		return location, nil
+	}
+	finalLocation := strings.TrimPrefix(location, PendingPrefix)
+
+	logrus.Info("Committing object in bucket ", s.bucket, ": ", location)
+	dst, err := minio.NewDestinationInfo(s.bucket, finalLocation, nil, map[string]string{"X-Amz-Storage-Class": s.storageClass})
+	if err != nil {
+		return "", err
+	}
+	err = s.client.CopyObject(dst, minio.NewSourceInfo(s.bucket, location, nil))
+	if err != nil {
+		return "", err
+	}
+
+	err = s.DeleteObject(location)
+	if err != nil {
+		// The object is committed, so only the pending copy is left behind. It is cleaned up by the
+		// pending upload recovery task later.
+		logrus.Warn("Error deleting committed pending object ", location, ": ", err)
+	}
+	return finalLocation, nil
+}
+
+// GetPendingObjects lists the locations of all pending objects along with when they were last modified.
+func (s *s3Datastore) GetPendingObjects() (map[string]time.Time, error) {
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+
+	results := make(map[string]time.Time)
+	for obj := range s.client.ListObjectsV2(s.bucket, PendingPrefix, true, doneCh) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		results[obj.Key] = obj.LastModified
+	}
+	return results, nil
+}
+
 func (s *s3Datastore) DeleteObject(location string) error {
 	logrus.Info("Deleting object from bucket ", s.bucket, ": ", location)
 	return s.client.RemoveObject(s.bucket, location)
@@ -220,6 +281,22 @@ func (s *s3Datastore) DownloadObject(location string) (io.ReadCloser, error) {
 	return s.client.GetObject(s.bucket, location, minio.GetObjectOptions{})
 }
 
+// DownloadSeekableObject returns a reader for the object which can be seeked. Seeking causes the
+// next read to use an HTTP Range request, so only the requested parts of the object are fetched.
+func (s *s3Datastore) DownloadSeekableObject(location string) (io.ReadSeekCloser, int64, error) {
+	logrus.Info("Downloading seekable object from bucket ", s.bucket, ": ", location)
+	obj, err := s.client.GetObject(s.bucket, location, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, 0, err
+	}
+	stat, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, 0, err
+	}
+	return obj, stat.Size, nil
+}
+
 func (s *s3Datastore) ObjectExists(location string) bool {
 	stat, err := s.client.StatObject(s.bucket, location, minio.StatObjectOptions{})
 	if err != nil {
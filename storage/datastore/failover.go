@@ -0,0 +1,85 @@
+package datastore
+
+import (
+	"io"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/metrics"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/types"
+)
+
+// downloadFromReplica tries to read the file at the given location from any other datastore which
+// holds a copy of it. The original error is returned if read failover is disabled or no copy could
+// be read.
+func downloadFromReplica(ctx rcontext.RequestContext, datastoreId string, location string, cause error) (io.ReadCloser, error) {
+	if !config.Get().DatastoreHealth.ReadFailover {
+		return nil, cause
+	}
+
+	replicas, err := findReplicas(ctx, datastoreId, location)
+	if err != nil {
+		ctx.Log.Warn("Error finding replicas for failover: ", err)
+		return nil, cause
+	}
+
+	for _, replica := range replicas {
+		rctx := ctx.LogWithFields(logrus.Fields{
+			"failedDatastoreId":  datastoreId,
+			"replicaDatastoreId": replica.DatastoreId,
+			"replicaLocation":    replica.Location,
+		})
+
+		ref, err := LocateDatastore(rctx, replica.DatastoreId)
+		if err != nil {
+			rctx.Log.Warn("Error locating replica datastore: ", err)
+			continue
+		}
+		stream, err := ref.DownloadFile(replica.Location)
+		if err != nil {
+			rctx.Log.Warn("Error reading from replica datastore: ", err)
+			continue
+		}
+
+		rctx.Log.Warn("Read failed on the primary datastore - served the file from a replica instead. Primary error: ", cause)
+		metrics.DatastoreReadFailovers.With(prometheus.Labels{
+			"datastoreId":        datastoreId,
+			"replicaDatastoreId": replica.DatastoreId,
+		}).Inc()
+		return decompressIfNeeded(rctx, replica.DatastoreId, replica.Location, stream)
+	}
+
+	return nil, cause
+}
+
+// findReplicas returns the media records for other locations which hold the same file as the given location.
+func findReplicas(ctx rcontext.RequestContext, datastoreId string, location string) ([]*types.Media, error) {
+	db := storage.GetDatabase().GetMediaStore(ctx)
+	records, err := db.GetMediaByLocation(datastoreId, location)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	sameHash, err := db.GetByHash(records[0].Sha256Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{datastoreId + "/" + location: true}
+	replicas := make([]*types.Media, 0)
+	for _, media := range sameHash {
+		key := media.DatastoreId + "/" + media.Location
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		replicas = append(replicas, media)
+	}
+	return replicas, nil
+}
@@ -0,0 +1,83 @@
+package datastore
+
+import (
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/storage/datastore/ds_s3"
+)
+
+var healthLock = &sync.RWMutex{}
+var unhealthyDatastores = make(map[string]string) // datastore ID => error
+
+// CheckHealth checks that each enabled datastore is reachable, updating the set of unhealthy datastores.
+func CheckHealth(ctx rcontext.RequestContext) {
+	unhealthy := make(map[string]string)
+	for _, dsConf := range config.UniqueDatastores() {
+		if !dsConf.Enabled {
+			continue
+		}
+
+		ds, err := storage.GetOrCreateDatastoreOfType(ctx, dsConf.Type, GetUriForDatastore(dsConf))
+		if err != nil {
+			ctx.Log.Error("Error getting datastore for health check: ", err)
+			sentry.CaptureException(err)
+			continue
+		}
+
+		ref := newDatastoreRef(ds, dsConf)
+		if err = ref.checkReachable(); err != nil {
+			ref.logger().Warn("Datastore failed health check: ", err)
+			unhealthy[ds.DatastoreId] = err.Error()
+		}
+	}
+
+	healthLock.Lock()
+	defer healthLock.Unlock()
+	for id := range unhealthyDatastores {
+		if _, stillUnhealthy := unhealthy[id]; !stillUnhealthy {
+			logrus.WithField("datastoreId", id).Info("Datastore is healthy again")
+		}
+	}
+	unhealthyDatastores = unhealthy
+}
+
+// UnhealthyDatastores returns the datastores which failed their most recent health check, mapped
+// to the reason why.
+func UnhealthyDatastores() map[string]string {
+	healthLock.RLock()
+	defer healthLock.RUnlock()
+	copied := make(map[string]string)
+	for id, reason := range unhealthyDatastores {
+		copied[id] = reason
+	}
+	return copied
+}
+
+func (d *DatastoreRef) checkReachable() error {
+	if d.Type == "file" {
+		stat, err := os.Stat(d.Uri)
+		if err != nil {
+			return err
+		}
+		if !stat.IsDir() {
+			return errors.New("datastore path is not a directory")
+		}
+		return nil
+	} else if d.Type == "s3" {
+		s3, err := ds_s3.GetOrCreateS3Datastore(d.DatastoreId, d.config)
+		if err != nil {
+			return err
+		}
+		return s3.EnsureBucketExists()
+	}
+
+	// IPFS runs alongside the media repo, so is assumed to be reachable
+	return nil
+}
@@ -0,0 +1,92 @@
+package datastore
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+// The inline datastore keeps small objects (such as tiny thumbnails) in the database itself, saving
+// a round trip to a real datastore when serving them. It is never picked for regular uploads, and
+// isn't offered to administrators as it can't hold anything else.
+const inlineDatastoreType = "inline"
+const inlineDatastoreUri = "inline://database"
+
+// GetInlineDatastore returns the datastore which keeps objects in the database.
+func GetInlineDatastore(ctx rcontext.RequestContext) (*DatastoreRef, error) {
+	ds, err := storage.GetOrCreateDatastoreOfType(ctx, inlineDatastoreType, inlineDatastoreUri)
+	if err != nil {
+		return nil, err
+	}
+	return newInlineDatastoreRef(ds), nil
+}
+
+// IsInlineDatastoreType returns true if the datastore type is for the datastore which keeps objects
+// in the database.
+func IsInlineDatastoreType(dsType string) bool {
+	return dsType == inlineDatastoreType
+}
+
+func newInlineDatastoreRef(ds *types.Datastore) *DatastoreRef {
+	return newDatastoreRef(ds, config.DatastoreConfig{
+		Type:       inlineDatastoreType,
+		Enabled:    true,
+		MediaKinds: []string{common.KindThumbnails},
+	})
+}
+
+func uploadInlineObject(file io.ReadCloser, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
+	defer cleanup.DumpAndCloseStream(file)
+	b, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	location, err := util.GenerateRandomString(64)
+	if err != nil {
+		return nil, err
+	}
+	err = storage.GetDatabase().GetMetadataStore(ctx).SetInlineObject(location, b)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(b)
+	return &types.ObjectInfo{
+		Location:   location,
+		Sha256Hash: hex.EncodeToString(hash[:]),
+		SizeBytes:  int64(len(b)),
+	}, nil
+}
+
+func downloadInlineObject(location string) ([]byte, error) {
+	b, err := storage.GetDatabase().GetMetadataStore(rcontext.Initial()).GetInlineObject(location)
+	if err == sql.ErrNoRows {
+		return nil, os.ErrNotExist
+	}
+	return b, err
+}
+
+func overwriteInlineObject(location string, stream io.ReadCloser) error {
+	defer cleanup.DumpAndCloseStream(stream)
+	b, err := ioutil.ReadAll(stream)
+	if err != nil {
+		return err
+	}
+	return storage.GetDatabase().GetMetadataStore(rcontext.Initial()).SetInlineObject(location, b)
+}
+
+func deleteInlineObject(location string) error {
+	return storage.GetDatabase().GetMetadataStore(rcontext.Initial()).DeleteInlineObject(location)
+}
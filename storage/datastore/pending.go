@@ -0,0 +1,58 @@
+package datastore
+
+import (
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+)
+
+// RecoverPendingUploads finishes uploads which were interrupted between being written to a
+// datastore and being committed. Pending files which are referenced by a media record are moved
+// to their final location, while unreferenced pending files older than maxAge are deleted.
+func RecoverPendingUploads(maxAge time.Duration, ctx rcontext.RequestContext) {
+	mediaStore := storage.GetDatabase().GetMediaStore(ctx)
+	for _, dsConf := range ctx.Config.DataStores {
+		if !dsConf.Enabled || (dsConf.Type != "file" && dsConf.Type != "s3") {
+			continue
+		}
+
+		uri := GetUriForDatastore(dsConf)
+		ds, err := mediaStore.GetDatastoreByUri(uri)
+		if err != nil {
+			ctx.Log.Error("Error getting datastore: ", err.Error())
+			sentry.CaptureException(err)
+			continue
+		}
+
+		ref := newDatastoreRef(ds, dsConf)
+		pending, err := ref.pendingObjects()
+		if err != nil {
+			ctx.Log.Error("Error listing pending files in ", uri, ": ", err.Error())
+			sentry.CaptureException(err)
+			continue
+		}
+
+		for location, modified := range pending {
+			records, err := mediaStore.GetMediaByLocation(ds.DatastoreId, ref.FinalLocation(location))
+			if err != nil {
+				ctx.Log.Error("Error checking for media at ", location, ": ", err.Error())
+				sentry.CaptureException(err)
+				continue
+			}
+
+			if len(records) > 0 {
+				ctx.Log.Info("Committing interrupted upload at ", location)
+				err = ref.CommitObject(location)
+			} else if time.Since(modified) > maxAge {
+				ctx.Log.Info("Deleting abandoned upload at ", location)
+				err = ref.DeleteObject(location)
+			}
+			if err != nil {
+				ctx.Log.Error("Error recovering pending upload at ", location, ": ", err.Error())
+				sentry.CaptureException(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package datastore
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/minio/minio-go/v6"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+)
+
+func retriesEnabled() bool {
+	return config.Get().DatastoreRetries.Attempts > 1
+}
+
+// withRetries runs fn until it succeeds, returns a non-retryable error, or the configured number
+// of attempts is exhausted. The backoff between attempts doubles each time.
+func withRetries(log *logrus.Entry, operation string, fn func() error) error {
+	attempts := config.Get().DatastoreRetries.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	backoff := time.Duration(config.Get().DatastoreRetries.BackoffMs) * time.Millisecond
+
+	var err error
+	for i := 1; i <= attempts; i++ {
+		err = fn()
+		if err == nil || !isRetryableError(err) {
+			return err
+		}
+		if i < attempts {
+			log.Warn(fmt.Sprintf("Transient error during datastore %s (attempt %d of %d), retrying in %s: %s", operation, i, attempts, backoff, err.Error()))
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return err
+}
+
+func isRetryableError(err error) bool {
+	if os.IsNotExist(err) || os.IsPermission(err) {
+		return false
+	}
+
+	if err == driver.ErrBadConn || err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	if pqErr, ok := err.(*pq.Error); ok {
+		// Connection exceptions, insufficient resources, and the server starting up or shutting down
+		class := string(pqErr.Code.Class())
+		return class == "08" || class == "53" || pqErr.Code == "57P01" || pqErr.Code == "57P03"
+	}
+
+	if netErr, ok := err.(net.Error); ok {
+		return netErr.Timeout() || netErr.Temporary()
+	}
+
+	s3Err := minio.ToErrorResponse(err)
+	if s3Err.Code != "" || s3Err.StatusCode != 0 {
+		switch s3Err.Code {
+		case "SlowDown", "RequestTimeout", "InternalError", "ServiceUnavailable", "OperationAborted":
+			return true
+		}
+		return s3Err.StatusCode == 429 || s3Err.StatusCode >= 500
+	}
+
+	return strings.Contains(err.Error(), "connection reset by peer")
+}
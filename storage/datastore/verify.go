@@ -0,0 +1,32 @@
+package datastore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+
+	"github.com/turt2live/matrix-media-repo/common"
+)
+
+// VerifyObject reads the object back from the datastore and checks that it has the expected size
+// and hash, returning common.ErrWriteVerificationFailed if it doesn't.
+func (d *DatastoreRef) VerifyObject(location string, sha256Hash string, sizeBytes int64) error {
+	stream, err := d.DownloadFile(location)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	hasher := sha256.New()
+	n, err := io.Copy(hasher, stream)
+	if err != nil {
+		return err
+	}
+
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	if n != sizeBytes || hash != sha256Hash {
+		d.logger().Errorf("Stored object %s does not match what was written: expected %d bytes with hash %s, got %d bytes with hash %s", location, sizeBytes, sha256Hash, n, hash)
+		return common.ErrWriteVerificationFailed
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+)
+
+var dbHealthLock = &sync.RWMutex{}
+var dbFailedChecks = 0
+var dbUnavailable = false
+
+// CheckDatabaseHealth pings the database, marking it as unavailable once it has failed the configured
+// number of checks in a row. The database is available again as soon as a check passes.
+func CheckDatabaseHealth(ctx rcontext.RequestContext) {
+	conf := config.Get().Database.CircuitBreaker
+	pingCtx, cancel := context.WithTimeout(ctx, time.Duration(conf.TimeoutSeconds)*time.Second)
+	defer cancel()
+	err := GetDatabase().db.PingContext(pingCtx)
+
+	dbHealthLock.Lock()
+	defer dbHealthLock.Unlock()
+	if err == nil {
+		if dbUnavailable {
+			ctx.Log.Info("Database is available again")
+		}
+		dbFailedChecks = 0
+		dbUnavailable = false
+		return
+	}
+
+	dbFailedChecks++
+	ctx.Log.Warn("Database failed health check: ", err)
+	if !dbUnavailable && dbFailedChecks >= conf.FailureThreshold {
+		ctx.Log.Error("Database is unavailable - requests which need it will be rejected until it recovers")
+		dbUnavailable = true
+	}
+}
+
+// IsDatabaseAvailable returns false if the database circuit breaker is enabled and the database has
+// failed its recent health checks.
+func IsDatabaseAvailable() bool {
+	if !config.Get().Database.CircuitBreaker.Enabled {
+		return true
+	}
+	dbHealthLock.RLock()
+	defer dbHealthLock.RUnlock()
+	return !dbUnavailable
+}
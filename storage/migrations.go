@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/DavidHuie/gomigrate"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+)
+
+type SchemaStatus struct {
+	CurrentVersion    uint64   `json:"current_version"`
+	LatestVersion     uint64   `json:"latest_version"`
+	AppliedVersions   []uint64 `json:"applied_versions,flow"`
+	PendingVersions   []uint64 `json:"pending_versions,flow"`
+	AvailableVersions []uint64 `json:"available_versions,flow"`
+}
+
+func newMigrator(db *sql.DB) (*gomigrate.Migrator, error) {
+	return gomigrate.NewMigratorWithLogger(db, gomigrate.Postgres{}, config.Runtime.MigrationsPath, logrus.StandardLogger())
+}
+
+func getSchemaStatus(migrator *gomigrate.Migrator) *SchemaStatus {
+	status := &SchemaStatus{
+		AppliedVersions:   make([]uint64, 0),
+		PendingVersions:   make([]uint64, 0),
+		AvailableVersions: make([]uint64, 0),
+	}
+	for _, migration := range migrator.Migrations(-1) {
+		status.AvailableVersions = append(status.AvailableVersions, migration.Id)
+		status.LatestVersion = migration.Id
+		if migration.Status == gomigrate.Active {
+			status.AppliedVersions = append(status.AppliedVersions, migration.Id)
+			status.CurrentVersion = migration.Id
+		} else {
+			status.PendingVersions = append(status.PendingVersions, migration.Id)
+		}
+	}
+	return status
+}
+
+// GetSchemaStatus reports which of the available migrations have been applied to the database.
+func (d *Database) GetSchemaStatus() (*SchemaStatus, error) {
+	migrator, err := newMigrator(d.db)
+	if err != nil {
+		return nil, err
+	}
+	return getSchemaStatus(migrator), nil
+}
+
+// ApplyMigrations applies any pending migrations to the database, returning the new schema status.
+func (d *Database) ApplyMigrations() (*SchemaStatus, error) {
+	migrator, err := newMigrator(d.db)
+	if err != nil {
+		return nil, err
+	}
+	err = migrator.Migrate()
+	if err != nil {
+		return nil, err
+	}
+	return getSchemaStatus(migrator), nil
+}
+
+// MigrateDatabase applies any pending migrations to the database without setting up the rest of
+// the media repo, for running migrations separately from starting the media repo.
+func MigrateDatabase(connectionString string) (*SchemaStatus, error) {
+	db, err := sql.Open("postgres", connectionString)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	migrator, err := newMigrator(db)
+	if err != nil {
+		return nil, err
+	}
+	err = migrator.Migrate()
+	if err != nil {
+		return nil, err
+	}
+	return getSchemaStatus(migrator), nil
+}
+
+func checkSchemaUpToDate(db *sql.DB) error {
+	migrator, err := newMigrator(db)
+	if err != nil {
+		return err
+	}
+	status := getSchemaStatus(migrator)
+	if len(status.PendingVersions) > 0 {
+		return fmt.Errorf("database schema is at version %d but version %d is required: run the migrations with -migrate or enable database.autoMigrate", status.CurrentVersion, status.LatestVersion)
+	}
+	return nil
+}
@@ -5,7 +5,6 @@ import (
 	"github.com/getsentry/sentry-go"
 	"sync"
 
-	"github.com/DavidHuie/gomigrate"
 	_ "github.com/lib/pq" // postgres driver
 	"github.com/sirupsen/logrus"
 	"github.com/turt2live/matrix-media-repo/common/config"
@@ -69,12 +68,16 @@ func OpenDatabase(connectionString string, maxConns int, maxIdleConns int) error
 	d.db.SetMaxIdleConns(maxIdleConns)
 
 	// Make sure the database is how we want it
-	migrator, err := gomigrate.NewMigratorWithLogger(d.db, gomigrate.Postgres{}, config.Runtime.MigrationsPath, logrus.StandardLogger())
-	if err != nil {
-		return err
-	}
-	err = migrator.Migrate()
-	if err != nil {
+	if config.Get().Database.AutoMigrate {
+		migrator, err := newMigrator(d.db)
+		if err != nil {
+			return err
+		}
+		err = migrator.Migrate()
+		if err != nil {
+			return err
+		}
+	} else if err = checkSchemaUpToDate(d.db); err != nil {
 		return err
 	}
 
@@ -0,0 +1,13 @@
+package stores
+
+import (
+	"github.com/lib/pq"
+)
+
+// IsUniqueViolation determines if the error was caused by a row conflicting with a unique index.
+func IsUniqueViolation(err error) bool {
+	if pqErr, ok := err.(*pq.Error); ok {
+		return pqErr.Code == "23505" // unique_violation
+	}
+	return false
+}
@@ -7,12 +7,22 @@ import (
 	"github.com/turt2live/matrix-media-repo/types"
 )
 
-const selectMediaAttributes = "SELECT origin, media_id, purpose FROM media_attributes WHERE origin = $1 AND media_id = $2;"
+const selectMediaAttributes = "SELECT origin, media_id, purpose, cache_max_age, thumbnailable, max_downloads, download_count, force_attachment FROM media_attributes WHERE origin = $1 AND media_id = $2;"
 const upsertMediaPurpose = "INSERT INTO media_attributes (origin, media_id, purpose) VALUES ($1, $2, $3) ON CONFLICT (origin, media_id) DO UPDATE SET purpose = $3;"
+const upsertMediaCacheMaxAge = "INSERT INTO media_attributes (origin, media_id, purpose, cache_max_age) VALUES ($1, $2, $3, $4) ON CONFLICT (origin, media_id) DO UPDATE SET cache_max_age = $4;"
+const upsertMediaThumbnailable = "INSERT INTO media_attributes (origin, media_id, purpose, thumbnailable) VALUES ($1, $2, $3, $4) ON CONFLICT (origin, media_id) DO UPDATE SET thumbnailable = $4;"
+const upsertMediaMaxDownloads = "INSERT INTO media_attributes (origin, media_id, purpose, max_downloads) VALUES ($1, $2, $3, $4) ON CONFLICT (origin, media_id) DO UPDATE SET max_downloads = $4;"
+const upsertMediaForceAttachment = "INSERT INTO media_attributes (origin, media_id, purpose, force_attachment) VALUES ($1, $2, $3, $4) ON CONFLICT (origin, media_id) DO UPDATE SET force_attachment = $4;"
+const incrementMediaDownloadCount = "UPDATE media_attributes SET download_count = download_count + 1 WHERE origin = $1 AND media_id = $2 AND download_count < max_downloads RETURNING download_count;"
 
 type mediaAttributesStoreStatements struct {
-	selectMediaAttributes *sql.Stmt
-	upsertMediaPurpose    *sql.Stmt
+	selectMediaAttributes       *sql.Stmt
+	upsertMediaPurpose          *sql.Stmt
+	upsertMediaCacheMaxAge      *sql.Stmt
+	upsertMediaThumbnailable    *sql.Stmt
+	upsertMediaMaxDownloads     *sql.Stmt
+	incrementMediaDownloadCount *sql.Stmt
+	upsertMediaForceAttachment  *sql.Stmt
 }
 
 type MediaAttributesStoreFactory struct {
@@ -38,6 +48,21 @@ func InitMediaAttributesStore(sqlDb *sql.DB) (*MediaAttributesStoreFactory, erro
 	if store.stmts.upsertMediaPurpose, err = store.sqlDb.Prepare(upsertMediaPurpose); err != nil {
 		return nil, err
 	}
+	if store.stmts.upsertMediaCacheMaxAge, err = store.sqlDb.Prepare(upsertMediaCacheMaxAge); err != nil {
+		return nil, err
+	}
+	if store.stmts.upsertMediaThumbnailable, err = store.sqlDb.Prepare(upsertMediaThumbnailable); err != nil {
+		return nil, err
+	}
+	if store.stmts.upsertMediaMaxDownloads, err = store.sqlDb.Prepare(upsertMediaMaxDownloads); err != nil {
+		return nil, err
+	}
+	if store.stmts.incrementMediaDownloadCount, err = store.sqlDb.Prepare(incrementMediaDownloadCount); err != nil {
+		return nil, err
+	}
+	if store.stmts.upsertMediaForceAttachment, err = store.sqlDb.Prepare(upsertMediaForceAttachment); err != nil {
+		return nil, err
+	}
 
 	return &store, nil
 }
@@ -57,6 +82,11 @@ func (s *MediaAttributesStore) GetAttributes(origin string, mediaId string) (*ty
 		&obj.Origin,
 		&obj.MediaId,
 		&obj.Purpose,
+		&obj.CacheMaxAge,
+		&obj.Thumbnailable,
+		&obj.MaxDownloads,
+		&obj.DownloadCount,
+		&obj.ForceAttachment,
 	)
 	return obj, err
 }
@@ -65,9 +95,11 @@ func (s *MediaAttributesStore) GetAttributesDefaulted(origin string, mediaId str
 	attr, err := s.GetAttributes(origin, mediaId)
 	if err == sql.ErrNoRows {
 		return &types.MediaAttributes{
-			Origin:  origin,
-			MediaId: mediaId,
-			Purpose: types.PurposeNone,
+			Origin:        origin,
+			MediaId:       mediaId,
+			Purpose:       types.PurposeNone,
+			CacheMaxAge:   types.NoCacheMaxAge,
+			Thumbnailable: true,
 		}, nil
 	}
 	return attr, err
@@ -77,3 +109,32 @@ func (s *MediaAttributesStore) UpsertPurpose(origin string, mediaId string, purp
 	_, err := s.statements.upsertMediaPurpose.ExecContext(s.ctx, origin, mediaId, purpose)
 	return err
 }
+
+func (s *MediaAttributesStore) UpsertCacheMaxAge(origin string, mediaId string, maxAgeSeconds int) error {
+	_, err := s.statements.upsertMediaCacheMaxAge.ExecContext(s.ctx, origin, mediaId, types.PurposeNone, maxAgeSeconds)
+	return err
+}
+
+func (s *MediaAttributesStore) UpsertThumbnailable(origin string, mediaId string, thumbnailable bool) error {
+	_, err := s.statements.upsertMediaThumbnailable.ExecContext(s.ctx, origin, mediaId, types.PurposeNone, thumbnailable)
+	return err
+}
+
+func (s *MediaAttributesStore) UpsertMaxDownloads(origin string, mediaId string, maxDownloads int) error {
+	_, err := s.statements.upsertMediaMaxDownloads.ExecContext(s.ctx, origin, mediaId, types.PurposeNone, maxDownloads)
+	return err
+}
+
+func (s *MediaAttributesStore) UpsertForceAttachment(origin string, mediaId string, forceAttachment bool) error {
+	_, err := s.statements.upsertMediaForceAttachment.ExecContext(s.ctx, origin, mediaId, types.PurposeNone, forceAttachment)
+	return err
+}
+
+// IncrementDownloadCount counts a download of the media, returning the new count. Returns
+// sql.ErrNoRows without counting the download if the media's download limit has been reached.
+func (s *MediaAttributesStore) IncrementDownloadCount(origin string, mediaId string) (int, error) {
+	r := s.statements.incrementMediaDownloadCount.QueryRowContext(s.ctx, origin, mediaId)
+	var count int
+	err := r.Scan(&count)
+	return count, err
+}
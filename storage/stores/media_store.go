@@ -7,10 +7,11 @@ import (
 	"github.com/lib/pq"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
 )
 
-const selectMedia = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined FROM media WHERE origin = $1 and media_id = $2;"
-const selectMediaByHash = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined FROM media WHERE sha256_hash = $1;"
+const selectMedia = "SELECT m.origin, m.media_id, m.upload_name, m.content_type, m.user_id, m.sha256_hash, m.size_bytes, m.datastore_id, m.location, m.creation_ts, m.quarantined, EXISTS (SELECT 1 FROM media_soft_deletions AS d WHERE d.origin = m.origin AND d.media_id = m.media_id), COALESCE((SELECT c.encoding FROM compressed_files AS c WHERE c.datastore_id = m.datastore_id AND c.location = m.location), '') FROM media AS m WHERE m.origin = $1 and m.media_id = $2;"
+const selectMediaByHash = "SELECT m.origin, m.media_id, m.upload_name, m.content_type, m.user_id, m.sha256_hash, m.size_bytes, m.datastore_id, m.location, m.creation_ts, m.quarantined, EXISTS (SELECT 1 FROM media_soft_deletions AS d WHERE d.origin = m.origin AND d.media_id = m.media_id), COALESCE((SELECT c.encoding FROM compressed_files AS c WHERE c.datastore_id = m.datastore_id AND c.location = m.location), '') FROM media AS m WHERE m.sha256_hash = $1;"
 const insertMedia = "INSERT INTO media (origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11);"
 const selectOldMedia = "SELECT m.origin, m.media_id, m.upload_name, m.content_type, m.user_id, m.sha256_hash, m.size_bytes, m.datastore_id, m.location, m.creation_ts, quarantined FROM media AS m WHERE m.origin <> ANY($1) AND m.creation_ts < $2 AND (SELECT COUNT(*) FROM media AS d WHERE d.sha256_hash = m.sha256_hash AND d.creation_ts >= $2) = 0 AND (SELECT COUNT(*) FROM media AS d WHERE d.sha256_hash = m.sha256_hash AND d.origin = ANY($1)) = 0;"
 const selectOrigins = "SELECT DISTINCT origin FROM media;"
@@ -32,35 +33,57 @@ const selectMediaByUserBefore = "SELECT origin, media_id, upload_name, content_t
 const selectMediaByDomainBefore = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined FROM media WHERE origin = $1 AND creation_ts <= $2"
 const selectMediaByLocation = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined FROM media WHERE datastore_id = $1 AND location = $2"
 const selectIfQuarantined = "SELECT 1 FROM media WHERE sha256_hash = $1 AND quarantined = $2 LIMIT 1;"
+const insertBlockedHash = "INSERT INTO blocked_hashes (sha256_hash, creation_ts) VALUES ($1, $2) ON CONFLICT (sha256_hash) DO NOTHING;"
+const selectIfHashBlocked = "SELECT 1 FROM blocked_hashes WHERE sha256_hash = $1 LIMIT 1;"
+const updateContentType = "UPDATE media SET content_type = $3 WHERE origin = $1 AND media_id = $2;"
+const selectReferenceCountsByHashes = "SELECT sha256_hash, COUNT(*) FROM media WHERE sha256_hash = ANY($1) GROUP BY sha256_hash;"
+const selectUserReferenceCountsByHashes = "SELECT sha256_hash, COUNT(DISTINCT user_id) FROM media WHERE sha256_hash = ANY($1) GROUP BY sha256_hash;"
+const insertMediaWithAttributes = "WITH m AS (INSERT INTO media (origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING origin, media_id) INSERT INTO media_attributes (origin, media_id, purpose, max_downloads, force_attachment) SELECT origin, media_id, $12, $13, $14 FROM m ON CONFLICT (origin, media_id) DO UPDATE SET purpose = $12, max_downloads = $13, force_attachment = $14;"
+const upsertPolyglotVerdict = "INSERT INTO polyglot_verdicts (sha256_hash, polyglot, creation_ts) VALUES ($1, $2, $3) ON CONFLICT (sha256_hash) DO UPDATE SET polyglot = $2, creation_ts = $3;"
+const selectPolyglotVerdict = "SELECT polyglot FROM polyglot_verdicts WHERE sha256_hash = $1;"
+const selectMediaForServerUserPage = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined FROM media WHERE origin = $1 AND user_id = $2 AND media_id > $3 ORDER BY media_id LIMIT $4;"
+const selectMediaForServerPage = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined FROM media WHERE origin = $1 AND media_id > $2 ORDER BY media_id LIMIT $3;"
+const selectUsersForServerPage = "SELECT DISTINCT user_id FROM media WHERE origin = $1 AND user_id > $2 ORDER BY user_id LIMIT $3;"
 
 var dsCacheByPath = sync.Map{} // [string] => Datastore
 var dsCacheById = sync.Map{}   // [string] => Datastore
 
 type mediaStoreStatements struct {
-	selectMedia                     *sql.Stmt
-	selectMediaByHash               *sql.Stmt
-	insertMedia                     *sql.Stmt
-	selectOldMedia                  *sql.Stmt
-	selectOrigins                   *sql.Stmt
-	deleteMedia                     *sql.Stmt
-	updateQuarantined               *sql.Stmt
-	selectDatastore                 *sql.Stmt
-	selectDatastoreByUri            *sql.Stmt
-	insertDatastore                 *sql.Stmt
-	selectMediaWithoutDatastore     *sql.Stmt
-	updateMediaDatastoreAndLocation *sql.Stmt
-	selectAllDatastores             *sql.Stmt
-	selectMediaInDatastoreOlderThan *sql.Stmt
-	selectAllMediaForServer         *sql.Stmt
-	selectAllMediaForServerUsers    *sql.Stmt
-	selectAllMediaForServerIds      *sql.Stmt
-	selectQuarantinedMedia          *sql.Stmt
-	selectServerQuarantinedMedia    *sql.Stmt
-	selectMediaByUser               *sql.Stmt
-	selectMediaByUserBefore         *sql.Stmt
-	selectMediaByDomainBefore       *sql.Stmt
-	selectMediaByLocation           *sql.Stmt
-	selectIfQuarantined             *sql.Stmt
+	selectMedia                       *sql.Stmt
+	selectMediaByHash                 *sql.Stmt
+	insertMedia                       *sql.Stmt
+	selectOldMedia                    *sql.Stmt
+	selectOrigins                     *sql.Stmt
+	deleteMedia                       *sql.Stmt
+	updateQuarantined                 *sql.Stmt
+	selectDatastore                   *sql.Stmt
+	selectDatastoreByUri              *sql.Stmt
+	insertDatastore                   *sql.Stmt
+	selectMediaWithoutDatastore       *sql.Stmt
+	updateMediaDatastoreAndLocation   *sql.Stmt
+	selectAllDatastores               *sql.Stmt
+	selectMediaInDatastoreOlderThan   *sql.Stmt
+	selectAllMediaForServer           *sql.Stmt
+	selectAllMediaForServerUsers      *sql.Stmt
+	selectAllMediaForServerIds        *sql.Stmt
+	selectQuarantinedMedia            *sql.Stmt
+	selectServerQuarantinedMedia      *sql.Stmt
+	selectMediaByUser                 *sql.Stmt
+	selectMediaByUserBefore           *sql.Stmt
+	selectMediaByDomainBefore         *sql.Stmt
+	selectMediaByLocation             *sql.Stmt
+	selectIfQuarantined               *sql.Stmt
+	insertBlockedHash                 *sql.Stmt
+	selectIfHashBlocked               *sql.Stmt
+	updateContentType                 *sql.Stmt
+	selectUserReferenceCountsByHashes *sql.Stmt
+	selectReferenceCountsByHashes     *sql.Stmt
+	selectMediaForServerPage          *sql.Stmt
+	selectMediaForServerUserPage      *sql.Stmt
+	selectUsersForServerPage          *sql.Stmt
+	insertMediaWithAttributes         *sql.Stmt
+	upsertPolyglotVerdict             *sql.Stmt
+	selectPolyglotVerdict             *sql.Stmt
 }
 
 type MediaStoreFactory struct {
@@ -149,6 +172,39 @@ func InitMediaStore(sqlDb *sql.DB) (*MediaStoreFactory, error) {
 	if store.stmts.selectIfQuarantined, err = store.sqlDb.Prepare(selectIfQuarantined); err != nil {
 		return nil, err
 	}
+	if store.stmts.insertBlockedHash, err = store.sqlDb.Prepare(insertBlockedHash); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectIfHashBlocked, err = store.sqlDb.Prepare(selectIfHashBlocked); err != nil {
+		return nil, err
+	}
+	if store.stmts.updateContentType, err = store.sqlDb.Prepare(updateContentType); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectUserReferenceCountsByHashes, err = store.sqlDb.Prepare(selectUserReferenceCountsByHashes); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectReferenceCountsByHashes, err = store.sqlDb.Prepare(selectReferenceCountsByHashes); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectMediaForServerPage, err = store.sqlDb.Prepare(selectMediaForServerPage); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectMediaForServerUserPage, err = store.sqlDb.Prepare(selectMediaForServerUserPage); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectUsersForServerPage, err = store.sqlDb.Prepare(selectUsersForServerPage); err != nil {
+		return nil, err
+	}
+	if store.stmts.insertMediaWithAttributes, err = store.sqlDb.Prepare(insertMediaWithAttributes); err != nil {
+		return nil, err
+	}
+	if store.stmts.upsertPolyglotVerdict, err = store.sqlDb.Prepare(upsertPolyglotVerdict); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectPolyglotVerdict, err = store.sqlDb.Prepare(selectPolyglotVerdict); err != nil {
+		return nil, err
+	}
 
 	return &store, nil
 }
@@ -179,6 +235,33 @@ func (s *MediaStore) Insert(media *types.Media) error {
 	return err
 }
 
+// InsertWithAttributes inserts the media along with its attributes in a single statement, so the
+// media is never visible without them.
+func (s *MediaStore) InsertWithAttributes(media *types.Media, attrs *types.MediaAttributes) error {
+	purpose := attrs.Purpose
+	if purpose == "" {
+		purpose = types.PurposeNone
+	}
+	_, err := s.statements.insertMediaWithAttributes.ExecContext(
+		s.ctx,
+		media.Origin,
+		media.MediaId,
+		media.UploadName,
+		media.ContentType,
+		media.UserId,
+		media.Sha256Hash,
+		media.SizeBytes,
+		media.DatastoreId,
+		media.Location,
+		media.CreationTs,
+		media.Quarantined,
+		purpose,
+		attrs.MaxDownloads,
+		attrs.ForceAttachment,
+	)
+	return err
+}
+
 func (s *MediaStore) GetByHash(hash string) ([]*types.Media, error) {
 	rows, err := s.statements.selectMediaByHash.QueryContext(s.ctx, hash)
 	if err != nil {
@@ -200,6 +283,8 @@ func (s *MediaStore) GetByHash(hash string) ([]*types.Media, error) {
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Quarantined,
+			&obj.SoftDeleted,
+			&obj.Encoding,
 		)
 		if err != nil {
 			return nil, err
@@ -224,6 +309,8 @@ func (s *MediaStore) Get(origin string, mediaId string) (*types.Media, error) {
 		&m.Location,
 		&m.CreationTs,
 		&m.Quarantined,
+		&m.SoftDeleted,
+		&m.Encoding,
 	)
 	return m, err
 }
@@ -288,6 +375,11 @@ func (s *MediaStore) SetQuarantined(origin string, mediaId string, isQuarantined
 	return err
 }
 
+func (s *MediaStore) SetContentType(origin string, mediaId string, contentType string) error {
+	_, err := s.statements.updateContentType.ExecContext(s.ctx, origin, mediaId, contentType)
+	return err
+}
+
 func (s *MediaStore) UpdateDatastoreAndLocation(media *types.Media) error {
 	_, err := s.statements.updateMediaDatastoreAndLocation.ExecContext(
 		s.ctx,
@@ -460,6 +552,93 @@ func (s *MediaStore) GetAllMediaForServer(serverName string) ([]*types.Media, er
 	return results, nil
 }
 
+// GetMediaForServerPage returns up to limit media records for the server, ordered by media ID,
+// starting after the given media ID. An empty media ID starts from the beginning.
+func (s *MediaStore) GetMediaForServerPage(serverName string, afterMediaId string, limit int) ([]*types.Media, error) {
+	rows, err := s.statements.selectMediaForServerPage.QueryContext(s.ctx, serverName, afterMediaId, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*types.Media
+	for rows.Next() {
+		obj := &types.Media{}
+		err = rows.Scan(
+			&obj.Origin,
+			&obj.MediaId,
+			&obj.UploadName,
+			&obj.ContentType,
+			&obj.UserId,
+			&obj.Sha256Hash,
+			&obj.SizeBytes,
+			&obj.DatastoreId,
+			&obj.Location,
+			&obj.CreationTs,
+			&obj.Quarantined,
+		)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
+
+// GetMediaForServerUserPage returns up to limit media uploaded by the user to the server, in order of
+// media ID, starting after the given media ID.
+func (s *MediaStore) GetMediaForServerUserPage(serverName string, userId string, afterMediaId string, limit int) ([]*types.Media, error) {
+	rows, err := s.statements.selectMediaForServerUserPage.QueryContext(s.ctx, serverName, userId, afterMediaId, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*types.Media
+	for rows.Next() {
+		obj := &types.Media{}
+		err = rows.Scan(
+			&obj.Origin,
+			&obj.MediaId,
+			&obj.UploadName,
+			&obj.ContentType,
+			&obj.UserId,
+			&obj.Sha256Hash,
+			&obj.SizeBytes,
+			&obj.DatastoreId,
+			&obj.Location,
+			&obj.CreationTs,
+			&obj.Quarantined,
+		)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
+
+// GetUsersForServerPage returns up to limit IDs of the users who uploaded media to the server,
+// ordered by user ID, starting after the given user ID. An empty user ID starts from the beginning.
+func (s *MediaStore) GetUsersForServerPage(serverName string, afterUserId string, limit int) ([]string, error) {
+	rows, err := s.statements.selectUsersForServerPage.QueryContext(s.ctx, serverName, afterUserId, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]string, 0)
+	for rows.Next() {
+		var userId string
+		err = rows.Scan(&userId)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, userId)
+	}
+
+	return results, nil
+}
+
 func (s *MediaStore) GetAllMediaForServerUsers(serverName string, userIds []string) ([]*types.Media, error) {
 	rows, err := s.statements.selectAllMediaForServerUsers.QueryContext(s.ctx, serverName, pq.Array(userIds))
 	if err != nil {
@@ -719,3 +898,80 @@ func (s *MediaStore) IsQuarantined(sha256hash string) (bool, error) {
 	}
 	return true, nil
 }
+
+func (s *MediaStore) BlockHash(sha256hash string) error {
+	_, err := s.statements.insertBlockedHash.ExecContext(s.ctx, sha256hash, util.NowMillis())
+	return err
+}
+
+func (s *MediaStore) IsHashBlocked(sha256hash string) (bool, error) {
+	r := s.statements.selectIfHashBlocked.QueryRowContext(s.ctx, sha256hash)
+	var i int
+	err := r.Scan(&i)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *MediaStore) SetPolyglotVerdict(sha256hash string, polyglot bool) error {
+	_, err := s.statements.upsertPolyglotVerdict.ExecContext(s.ctx, sha256hash, polyglot, util.NowMillis())
+	return err
+}
+
+// GetPolyglotVerdict returns whether the contents with the given hash were found to be a polyglot
+// file. Returns sql.ErrNoRows if the contents have not been checked.
+func (s *MediaStore) GetPolyglotVerdict(sha256hash string) (bool, error) {
+	r := s.statements.selectPolyglotVerdict.QueryRowContext(s.ctx, sha256hash)
+	var polyglot bool
+	err := r.Scan(&polyglot)
+	return polyglot, err
+}
+
+// GetUserReferenceCounts returns the number of distinct users which have uploaded media with each of
+// the given hashes, across all origins.
+func (s *MediaStore) GetUserReferenceCounts(hashes []string) (map[string]int64, error) {
+	rows, err := s.statements.selectUserReferenceCountsByHashes.QueryContext(s.ctx, pq.Array(hashes))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make(map[string]int64)
+	for rows.Next() {
+		var hash string
+		var count int64
+		err = rows.Scan(&hash, &count)
+		if err != nil {
+			return nil, err
+		}
+		results[hash] = count
+	}
+
+	return results, nil
+}
+
+// GetReferenceCounts returns the number of media records which use each of the given hashes, across
+// all origins.
+func (s *MediaStore) GetReferenceCounts(hashes []string) (map[string]int64, error) {
+	rows, err := s.statements.selectReferenceCountsByHashes.QueryContext(s.ctx, pq.Array(hashes))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make(map[string]int64)
+	for rows.Next() {
+		var hash string
+		var count int64
+		err = rows.Scan(&hash, &count)
+		if err != nil {
+			return nil, err
+		}
+		results[hash] = count
+	}
+
+	return results, nil
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"encoding/json"
 
+	"github.com/lib/pq"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/types"
 	"github.com/turt2live/matrix-media-repo/util"
@@ -20,18 +21,43 @@ const selectThumbnailsLastAccessedBeforeInDatastore = "SELECT m.sha256_hash, m.s
 const changeDatastoreOfMediaHash = "UPDATE media SET datastore_id = $1, location = $2 WHERE sha256_hash = $3"
 const changeDatastoreOfThumbnailHash = "UPDATE thumbnails SET datastore_id = $1, location = $2 WHERE sha256_hash = $3"
 const selectUploadCountsForServer = "SELECT COALESCE((SELECT COUNT(origin) FROM media WHERE origin = $1), 0) AS media, COALESCE((SELECT COUNT(origin) FROM thumbnails WHERE origin = $1), 0) AS thumbnails"
+const selectPhysicalUploadSizesForServer = "SELECT COALESCE((SELECT SUM(size_bytes) FROM (SELECT DISTINCT sha256_hash, size_bytes FROM media WHERE origin = $1) AS m), 0) AS media, COALESCE((SELECT SUM(size_bytes) FROM (SELECT DISTINCT sha256_hash, size_bytes FROM thumbnails WHERE origin = $1) AS t), 0) AS thumbnails"
 const selectUploadSizesForServer = "SELECT COALESCE((SELECT SUM(size_bytes) FROM media WHERE origin = $1), 0) AS media, COALESCE((SELECT SUM(size_bytes) FROM thumbnails WHERE origin = $1), 0) AS thumbnails"
 const selectUsersForServer = "SELECT DISTINCT user_id FROM media WHERE origin = $1 AND user_id IS NOT NULL AND LENGTH(user_id) > 0"
 const insertNewBackgroundTask = "INSERT INTO background_tasks (task, params, start_ts) VALUES ($1, $2, $3) RETURNING id;"
 const selectBackgroundTask = "SELECT id, task, params, start_ts, end_ts FROM background_tasks WHERE id = $1"
 const updateBackgroundTask = "UPDATE background_tasks SET end_ts = $2 WHERE id = $1"
 const selectAllBackgroundTasks = "SELECT id, task, params, start_ts, end_ts FROM background_tasks"
+const selectBackgroundTasksPage = "SELECT id, task, params, start_ts, end_ts FROM background_tasks WHERE id > $1 AND ($2 = false OR end_ts IS NULL OR end_ts <= 0) ORDER BY id LIMIT $3;"
 const insertReservation = "INSERT INTO reserved_media (origin, media_id, reason) VALUES ($1, $2, $3);"
 const selectReservation = "SELECT origin, media_id, reason FROM reserved_media WHERE origin = $1 AND media_id = $2;"
 const selectMediaLastAccessed = "SELECT m.sha256_hash, m.size_bytes, m.datastore_id, m.location, m.creation_ts, a.last_access_ts FROM media AS m JOIN last_access AS a ON m.sha256_hash = a.sha256_hash WHERE a.last_access_ts < $1;"
 const insertBlurhash = "INSERT INTO blurhashes (sha256_hash, blurhash) VALUES ($1, $2);"
 const selectBlurhash = "SELECT blurhash FROM blurhashes WHERE sha256_hash = $1;"
 const selectUserStats = "SELECT user_id, uploaded_bytes FROM user_stats WHERE user_id = $1;"
+const upsertAccessCount = "INSERT INTO last_access (sha256_hash, last_access_ts, access_count) VALUES ($1, $2, $3) ON CONFLICT (sha256_hash) DO UPDATE SET last_access_ts = GREATEST(last_access.last_access_ts, $2), access_count = last_access.access_count + $3;"
+const selectMostAccessed = "SELECT sha256_hash, last_access_ts, access_count FROM last_access ORDER BY access_count DESC, sha256_hash LIMIT $1 OFFSET $2;"
+const insertAppserviceMedia = "INSERT INTO appservice_media (origin, media_id, appservice_id) VALUES ($1, $2, $3) ON CONFLICT (media_id, origin) DO NOTHING;"
+const insertCompressedFile = "INSERT INTO compressed_files (datastore_id, location, encoding, stored_size_bytes) VALUES ($1, $2, $3, $4) ON CONFLICT (datastore_id, location) DO UPDATE SET encoding = $3, stored_size_bytes = $4;"
+const selectCompressedFileEncoding = "SELECT encoding FROM compressed_files WHERE datastore_id = $1 AND location = $2;"
+const insertMediaUploadClient = "INSERT INTO media_upload_clients (origin, media_id, user_agent) VALUES ($1, $2, $3) ON CONFLICT (media_id, origin) DO NOTHING;"
+const selectMediaUploadClients = "SELECT media_id, user_agent FROM media_upload_clients WHERE origin = $1 AND media_id = ANY($2);"
+const insertPerceptualHash = "INSERT INTO perceptual_hashes (sha256_hash, dhash) VALUES ($1, $2) ON CONFLICT (sha256_hash) DO NOTHING;"
+const selectPerceptualHash = "SELECT dhash FROM perceptual_hashes WHERE sha256_hash = $1;"
+const selectSimilarPerceptualHashes = "SELECT sha256_hash, dhash FROM (SELECT sha256_hash, dhash, length(replace(((dhash # $1)::bit(64))::text, '0', '')) AS distance FROM perceptual_hashes) AS p WHERE p.distance <= $2 ORDER BY p.distance ASC LIMIT $3;"
+const upsertInlineObject = "INSERT INTO inline_objects (location, data) VALUES ($1, $2) ON CONFLICT (location) DO UPDATE SET data = $2;"
+const selectInlineObject = "SELECT data FROM inline_objects WHERE location = $1;"
+const deleteInlineObject = "DELETE FROM inline_objects WHERE location = $1;"
+const insertMediaReport = "INSERT INTO media_reports (origin, media_id, reporter, reason, report_ts) VALUES ($1, $2, $3, $4, $5);"
+const selectMediaReporterCount = "SELECT COUNT(DISTINCT reporter) FROM media_reports WHERE origin = $1 AND media_id = $2;"
+const selectReportCountForReporter = "SELECT COUNT(*) FROM media_reports WHERE reporter = $1 AND report_ts >= $2;"
+const selectMediaReports = "SELECT origin, media_id, reporter, reason, report_ts FROM media_reports WHERE ($1 = '' OR origin = $1) ORDER BY report_ts DESC LIMIT $2 OFFSET $3;"
+const insertMediaSoftDeletion = "INSERT INTO media_soft_deletions (origin, media_id, deleted_by, deleted_ts) VALUES ($1, $2, $3, $4) ON CONFLICT (media_id, origin) DO NOTHING;"
+const selectMediaSoftDeletion = "SELECT origin, media_id, deleted_by, deleted_ts FROM media_soft_deletions WHERE origin = $1 AND media_id = $2;"
+const selectMediaSoftDeletionsBefore = "SELECT origin, media_id, deleted_by, deleted_ts FROM media_soft_deletions WHERE deleted_ts < $1;"
+const deleteMediaSoftDeletion = "DELETE FROM media_soft_deletions WHERE origin = $1 AND media_id = $2;"
+const selectTotalStoredBytes = "SELECT COALESCE(SUM(size_bytes), 0) FROM (SELECT datastore_id, location, size_bytes FROM media UNION SELECT datastore_id, location, size_bytes FROM thumbnails) AS f;"
+const selectAppserviceUploadedBytes = "SELECT COALESCE(SUM(m.size_bytes), 0) FROM appservice_media AS a JOIN media AS m ON m.origin = a.origin AND m.media_id = a.media_id WHERE a.appservice_id = $1;"
 
 type metadataStoreStatements struct {
 	upsertLastAccessed                            *sql.Stmt
@@ -42,17 +68,42 @@ type metadataStoreStatements struct {
 	changeDatastoreOfThumbnailHash                *sql.Stmt
 	selectUploadCountsForServer                   *sql.Stmt
 	selectUploadSizesForServer                    *sql.Stmt
+	selectPhysicalUploadSizesForServer            *sql.Stmt
 	selectUsersForServer                          *sql.Stmt
 	insertNewBackgroundTask                       *sql.Stmt
 	selectBackgroundTask                          *sql.Stmt
 	updateBackgroundTask                          *sql.Stmt
 	selectAllBackgroundTasks                      *sql.Stmt
+	selectBackgroundTasksPage                     *sql.Stmt
 	insertReservation                             *sql.Stmt
 	selectReservation                             *sql.Stmt
 	selectMediaLastAccessed                       *sql.Stmt
 	insertBlurhash                                *sql.Stmt
 	selectBlurhash                                *sql.Stmt
 	selectUserStats                               *sql.Stmt
+	upsertAccessCount                             *sql.Stmt
+	selectMostAccessed                            *sql.Stmt
+	insertAppserviceMedia                         *sql.Stmt
+	selectAppserviceUploadedBytes                 *sql.Stmt
+	insertCompressedFile                          *sql.Stmt
+	selectCompressedFileEncoding                  *sql.Stmt
+	insertMediaUploadClient                       *sql.Stmt
+	selectMediaUploadClients                      *sql.Stmt
+	insertPerceptualHash                          *sql.Stmt
+	selectPerceptualHash                          *sql.Stmt
+	selectSimilarPerceptualHashes                 *sql.Stmt
+	upsertInlineObject                            *sql.Stmt
+	selectInlineObject                            *sql.Stmt
+	deleteInlineObject                            *sql.Stmt
+	insertMediaReport                             *sql.Stmt
+	selectMediaReporterCount                      *sql.Stmt
+	selectReportCountForReporter                  *sql.Stmt
+	selectMediaReports                            *sql.Stmt
+	insertMediaSoftDeletion                       *sql.Stmt
+	selectMediaSoftDeletion                       *sql.Stmt
+	selectMediaSoftDeletionsBefore                *sql.Stmt
+	deleteMediaSoftDeletion                       *sql.Stmt
+	selectTotalStoredBytes                        *sql.Stmt
 }
 
 type MetadataStoreFactory struct {
@@ -96,6 +147,9 @@ func InitMetadataStore(sqlDb *sql.DB) (*MetadataStoreFactory, error) {
 	if store.stmts.selectUploadSizesForServer, err = store.sqlDb.Prepare(selectUploadSizesForServer); err != nil {
 		return nil, err
 	}
+	if store.stmts.selectPhysicalUploadSizesForServer, err = store.sqlDb.Prepare(selectPhysicalUploadSizesForServer); err != nil {
+		return nil, err
+	}
 	if store.stmts.selectUploadCountsForServer, err = store.sqlDb.Prepare(selectUploadCountsForServer); err != nil {
 		return nil, err
 	}
@@ -111,6 +165,9 @@ func InitMetadataStore(sqlDb *sql.DB) (*MetadataStoreFactory, error) {
 	if store.stmts.selectAllBackgroundTasks, err = store.sqlDb.Prepare(selectAllBackgroundTasks); err != nil {
 		return nil, err
 	}
+	if store.stmts.selectBackgroundTasksPage, err = store.sqlDb.Prepare(selectBackgroundTasksPage); err != nil {
+		return nil, err
+	}
 	if store.stmts.insertReservation, err = store.sqlDb.Prepare(insertReservation); err != nil {
 		return nil, err
 	}
@@ -129,6 +186,75 @@ func InitMetadataStore(sqlDb *sql.DB) (*MetadataStoreFactory, error) {
 	if store.stmts.selectUserStats, err = store.sqlDb.Prepare(selectUserStats); err != nil {
 		return nil, err
 	}
+	if store.stmts.upsertAccessCount, err = store.sqlDb.Prepare(upsertAccessCount); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectMostAccessed, err = store.sqlDb.Prepare(selectMostAccessed); err != nil {
+		return nil, err
+	}
+	if store.stmts.insertAppserviceMedia, err = store.sqlDb.Prepare(insertAppserviceMedia); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectAppserviceUploadedBytes, err = store.sqlDb.Prepare(selectAppserviceUploadedBytes); err != nil {
+		return nil, err
+	}
+	if store.stmts.insertCompressedFile, err = store.sqlDb.Prepare(insertCompressedFile); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectCompressedFileEncoding, err = store.sqlDb.Prepare(selectCompressedFileEncoding); err != nil {
+		return nil, err
+	}
+	if store.stmts.insertMediaUploadClient, err = store.sqlDb.Prepare(insertMediaUploadClient); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectMediaUploadClients, err = store.sqlDb.Prepare(selectMediaUploadClients); err != nil {
+		return nil, err
+	}
+	if store.stmts.insertPerceptualHash, err = store.sqlDb.Prepare(insertPerceptualHash); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectPerceptualHash, err = store.sqlDb.Prepare(selectPerceptualHash); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectSimilarPerceptualHashes, err = store.sqlDb.Prepare(selectSimilarPerceptualHashes); err != nil {
+		return nil, err
+	}
+	if store.stmts.upsertInlineObject, err = store.sqlDb.Prepare(upsertInlineObject); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectInlineObject, err = store.sqlDb.Prepare(selectInlineObject); err != nil {
+		return nil, err
+	}
+	if store.stmts.deleteInlineObject, err = store.sqlDb.Prepare(deleteInlineObject); err != nil {
+		return nil, err
+	}
+	if store.stmts.insertMediaReport, err = store.sqlDb.Prepare(insertMediaReport); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectMediaReporterCount, err = store.sqlDb.Prepare(selectMediaReporterCount); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectReportCountForReporter, err = store.sqlDb.Prepare(selectReportCountForReporter); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectMediaReports, err = store.sqlDb.Prepare(selectMediaReports); err != nil {
+		return nil, err
+	}
+	if store.stmts.insertMediaSoftDeletion, err = store.sqlDb.Prepare(insertMediaSoftDeletion); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectMediaSoftDeletion, err = store.sqlDb.Prepare(selectMediaSoftDeletion); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectMediaSoftDeletionsBefore, err = store.sqlDb.Prepare(selectMediaSoftDeletionsBefore); err != nil {
+		return nil, err
+	}
+	if store.stmts.deleteMediaSoftDeletion, err = store.sqlDb.Prepare(deleteMediaSoftDeletion); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectTotalStoredBytes, err = store.sqlDb.Prepare(selectTotalStoredBytes); err != nil {
+		return nil, err
+	}
 
 	return &store, nil
 }
@@ -242,6 +368,15 @@ func (s *MetadataStore) GetOldThumbnailsInDatastore(datastoreId string, beforeTs
 	return results, nil
 }
 
+// GetTotalStoredBytes returns the size of all the files stored for media and thumbnails, counting
+// files which are shared between records once.
+func (s *MetadataStore) GetTotalStoredBytes() (int64, error) {
+	r := s.statements.selectTotalStoredBytes.QueryRowContext(s.ctx)
+	var size int64
+	err := r.Scan(&size)
+	return size, err
+}
+
 func (s *MetadataStore) GetUsersForServer(serverName string) ([]string, error) {
 	rows, err := s.statements.selectUsersForServer.QueryContext(s.ctx, serverName)
 	if err != nil {
@@ -274,6 +409,20 @@ func (s *MetadataStore) GetByteUsageForServer(serverName string) (int64, int64,
 	return media, thumbs, nil
 }
 
+// GetPhysicalByteUsageForServer is like GetByteUsageForServer, though only counts each unique file once.
+func (s *MetadataStore) GetPhysicalByteUsageForServer(serverName string) (int64, int64, error) {
+	row := s.statements.selectPhysicalUploadSizesForServer.QueryRowContext(s.ctx, serverName)
+
+	media := int64(0)
+	thumbs := int64(0)
+	err := row.Scan(&media, &thumbs)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return media, thumbs, nil
+}
+
 func (s *MetadataStore) GetCountUsageForServer(serverName string) (int64, int64, error) {
 	row := s.statements.selectUploadCountsForServer.QueryRowContext(s.ctx, serverName)
 
@@ -341,7 +490,20 @@ func (s *MetadataStore) GetAllBackgroundTasks() ([]*types.BackgroundTask, error)
 	if err != nil {
 		return nil, err
 	}
+	return scanBackgroundTasks(rows)
+}
 
+// GetBackgroundTasksPage returns up to limit background tasks, ordered by ID, starting after the
+// given task ID. When unfinishedOnly is true, tasks which have finished are skipped.
+func (s *MetadataStore) GetBackgroundTasksPage(afterId int, unfinishedOnly bool, limit int) ([]*types.BackgroundTask, error) {
+	rows, err := s.statements.selectBackgroundTasksPage.QueryContext(s.ctx, afterId, unfinishedOnly, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanBackgroundTasks(rows)
+}
+
+func scanBackgroundTasks(rows *sql.Rows) ([]*types.BackgroundTask, error) {
 	results := make([]*types.BackgroundTask, 0)
 	for rows.Next() {
 		task := &types.BackgroundTask{}
@@ -427,3 +589,249 @@ func (s *MetadataStore) GetUserStats(userId string) (*types.UserStats, error) {
 	}
 	return stat, nil
 }
+
+func (s *MetadataStore) UpsertAccessCount(sha256Hash string, timestamp int64, count int64) error {
+	_, err := s.statements.upsertAccessCount.ExecContext(s.ctx, sha256Hash, timestamp, count)
+	return err
+}
+
+func (s *MetadataStore) GetMostAccessed(limit int, offset int) ([]*types.AccessStats, error) {
+	rows, err := s.statements.selectMostAccessed.QueryContext(s.ctx, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*types.AccessStats
+	for rows.Next() {
+		obj := &types.AccessStats{}
+		err = rows.Scan(
+			&obj.Sha256Hash,
+			&obj.LastAccessTs,
+			&obj.AccessCount,
+		)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
+
+func (s *MetadataStore) TagAppserviceMedia(origin string, mediaId string, appserviceId string) error {
+	_, err := s.statements.insertAppserviceMedia.ExecContext(s.ctx, origin, mediaId, appserviceId)
+	return err
+}
+
+func (s *MetadataStore) GetAppserviceUploadedBytes(appserviceId string) (int64, error) {
+	r := s.statements.selectAppserviceUploadedBytes.QueryRowContext(s.ctx, appserviceId)
+	var size int64
+	err := r.Scan(&size)
+	return size, err
+}
+
+func (s *MetadataStore) InsertCompressedFile(datastoreId string, location string, encoding string, storedSizeBytes int64) error {
+	_, err := s.statements.insertCompressedFile.ExecContext(s.ctx, datastoreId, location, encoding, storedSizeBytes)
+	return err
+}
+
+// GetCompressedFileEncoding returns the encoding of the stored file, or an empty string if the
+// file is not compressed.
+func (s *MetadataStore) GetCompressedFileEncoding(datastoreId string, location string) (string, error) {
+	r := s.statements.selectCompressedFileEncoding.QueryRowContext(s.ctx, datastoreId, location)
+	var encoding string
+	err := r.Scan(&encoding)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return encoding, err
+}
+
+func (s *MetadataStore) SetMediaUploadClient(origin string, mediaId string, userAgent string) error {
+	_, err := s.statements.insertMediaUploadClient.ExecContext(s.ctx, origin, mediaId, userAgent)
+	return err
+}
+
+// GetMediaUploadClients returns the user agents which uploaded the given media, keyed by media ID.
+// Media without a recorded user agent is not included.
+func (s *MetadataStore) GetMediaUploadClients(origin string, mediaIds []string) (map[string]string, error) {
+	rows, err := s.statements.selectMediaUploadClients.QueryContext(s.ctx, origin, pq.Array(mediaIds))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make(map[string]string)
+	for rows.Next() {
+		var mediaId string
+		var userAgent string
+		if err = rows.Scan(&mediaId, &userAgent); err != nil {
+			return nil, err
+		}
+		results[mediaId] = userAgent
+	}
+
+	return results, nil
+}
+
+func (s *MetadataStore) InsertPerceptualHash(sha256Hash string, dhash uint64) error {
+	_, err := s.statements.insertPerceptualHash.ExecContext(s.ctx, sha256Hash, int64(dhash))
+	return err
+}
+
+// GetPerceptualHash returns the perceptual hash of the file, or false if one hasn't been calculated.
+func (s *MetadataStore) GetPerceptualHash(sha256Hash string) (uint64, bool, error) {
+	r := s.statements.selectPerceptualHash.QueryRowContext(s.ctx, sha256Hash)
+	var dhash int64
+	err := r.Scan(&dhash)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return uint64(dhash), true, nil
+}
+
+// GetSimilarPerceptualHashes returns up to limit files (by SHA-256 hash) whose perceptual hash is
+// within maxDistance bits of the given hash, mapped to their own perceptual hash.
+func (s *MetadataStore) GetSimilarPerceptualHashes(dhash uint64, maxDistance int, limit int) (map[string]uint64, error) {
+	rows, err := s.statements.selectSimilarPerceptualHashes.QueryContext(s.ctx, int64(dhash), maxDistance, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make(map[string]uint64)
+	for rows.Next() {
+		var sha256Hash string
+		var match int64
+		if err = rows.Scan(&sha256Hash, &match); err != nil {
+			return nil, err
+		}
+		results[sha256Hash] = uint64(match)
+	}
+
+	return results, nil
+}
+
+// SetInlineObject stores (or replaces) an object kept directly in the database rather than a datastore.
+func (s *MetadataStore) SetInlineObject(location string, data []byte) error {
+	_, err := s.statements.upsertInlineObject.ExecContext(s.ctx, location, data)
+	return err
+}
+
+// GetInlineObject returns the contents of an object kept in the database, or sql.ErrNoRows if there
+// is no object at the location.
+func (s *MetadataStore) GetInlineObject(location string) ([]byte, error) {
+	r := s.statements.selectInlineObject.QueryRowContext(s.ctx, location)
+	var data []byte
+	err := r.Scan(&data)
+	return data, err
+}
+
+func (s *MetadataStore) DeleteInlineObject(location string) error {
+	_, err := s.statements.deleteInlineObject.ExecContext(s.ctx, location)
+	return err
+}
+
+func (s *MetadataStore) InsertMediaReport(report *types.MediaReport) error {
+	_, err := s.statements.insertMediaReport.ExecContext(s.ctx, report.Origin, report.MediaId, report.Reporter, report.Reason, report.ReportTs)
+	return err
+}
+
+// GetMediaReporterCount returns the number of different users who have reported the media.
+func (s *MetadataStore) GetMediaReporterCount(origin string, mediaId string) (int, error) {
+	r := s.statements.selectMediaReporterCount.QueryRowContext(s.ctx, origin, mediaId)
+	var count int
+	err := r.Scan(&count)
+	return count, err
+}
+
+// GetReportCountForReporter returns the number of reports the user has made since the given timestamp.
+func (s *MetadataStore) GetReportCountForReporter(reporter string, sinceTs int64) (int, error) {
+	r := s.statements.selectReportCountForReporter.QueryRowContext(s.ctx, reporter, sinceTs)
+	var count int
+	err := r.Scan(&count)
+	return count, err
+}
+
+// GetMediaReports returns the most recent reports, newest first, skipping the first offset reports.
+// An empty origin returns reports for media on any server.
+func (s *MetadataStore) GetMediaReports(origin string, limit int, offset int) ([]*types.MediaReport, error) {
+	rows, err := s.statements.selectMediaReports.QueryContext(s.ctx, origin, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*types.MediaReport, 0)
+	for rows.Next() {
+		obj := &types.MediaReport{}
+		err = rows.Scan(
+			&obj.Origin,
+			&obj.MediaId,
+			&obj.Reporter,
+			&obj.Reason,
+			&obj.ReportTs,
+		)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
+
+func (s *MetadataStore) InsertMediaSoftDeletion(deletion *types.MediaSoftDeletion) error {
+	_, err := s.statements.insertMediaSoftDeletion.ExecContext(s.ctx, deletion.Origin, deletion.MediaId, deletion.DeletedBy, deletion.DeletedTs)
+	return err
+}
+
+// GetMediaSoftDeletion returns the soft deletion of the media, or nil if the media is not soft deleted.
+func (s *MetadataStore) GetMediaSoftDeletion(origin string, mediaId string) (*types.MediaSoftDeletion, error) {
+	r := s.statements.selectMediaSoftDeletion.QueryRowContext(s.ctx, origin, mediaId)
+	obj := &types.MediaSoftDeletion{}
+	err := r.Scan(
+		&obj.Origin,
+		&obj.MediaId,
+		&obj.DeletedBy,
+		&obj.DeletedTs,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (s *MetadataStore) GetMediaSoftDeletionsBefore(beforeTs int64) ([]*types.MediaSoftDeletion, error) {
+	rows, err := s.statements.selectMediaSoftDeletionsBefore.QueryContext(s.ctx, beforeTs)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*types.MediaSoftDeletion, 0)
+	for rows.Next() {
+		obj := &types.MediaSoftDeletion{}
+		err = rows.Scan(
+			&obj.Origin,
+			&obj.MediaId,
+			&obj.DeletedBy,
+			&obj.DeletedTs,
+		)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
+
+func (s *MetadataStore) DeleteMediaSoftDeletion(origin string, mediaId string) error {
+	_, err := s.statements.deleteMediaSoftDeletion.ExecContext(s.ctx, origin, mediaId)
+	return err
+}
@@ -3,32 +3,43 @@ package stores
 import (
 	"database/sql"
 
+	"github.com/lib/pq"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/types"
 )
 
-const selectThumbnail = "SELECT origin, media_id, width, height, method, animated, content_type, size_bytes, datastore_id, location, creation_ts, sha256_hash FROM thumbnails WHERE origin = $1 and media_id = $2 and width = $3 and height = $4 and method = $5 and animated = $6;"
-const insertThumbnail = "INSERT INTO thumbnails (origin, media_id, width, height, method, animated, content_type, size_bytes, datastore_id, location, creation_ts, sha256_hash) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12);"
-const updateThumbnailHash = "UPDATE thumbnails SET sha256_hash = $7 WHERE origin = $1 and media_id = $2 and width = $3 and height = $4 and method = $5 and animated = $6;"
-const selectThumbnailsWithoutHash = "SELECT origin, media_id, width, height, method, animated, content_type, size_bytes, datastore_id, location, creation_ts, sha256_hash FROM thumbnails WHERE sha256_hash IS NULL OR sha256_hash = '';"
-const selectThumbnailsWithoutDatastore = "SELECT origin, media_id, width, height, method, animated, content_type, size_bytes, datastore_id, location, creation_ts, sha256_hash FROM thumbnails WHERE datastore_id IS NULL OR datastore_id = '';"
-const updateThumbnailDatastoreAndLocation = "UPDATE thumbnails SET location = $8, datastore_id = $7 WHERE origin = $1 and media_id = $2 and width = $3 and height = $4 and method = $5 and animated = $6;"
-const selectThumbnailsForMedia = "SELECT origin, media_id, width, height, method, animated, content_type, size_bytes, datastore_id, location, creation_ts, sha256_hash FROM thumbnails WHERE origin = $1 AND media_id = $2;"
+const selectThumbnail = "SELECT origin, media_id, width, height, method, animated, content_type, size_bytes, datastore_id, location, creation_ts, sha256_hash, source_sha256_hash, generation FROM thumbnails WHERE origin = $1 and media_id = $2 and width = $3 and height = $4 and method = $5 and animated = $6 and source_sha256_hash = $7 and generation = $8;"
+const insertThumbnail = "INSERT INTO thumbnails (origin, media_id, width, height, method, animated, content_type, size_bytes, datastore_id, location, creation_ts, sha256_hash, source_sha256_hash, generation) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14);"
+const updateThumbnailHash = "UPDATE thumbnails SET sha256_hash = $7 WHERE origin = $1 and media_id = $2 and width = $3 and height = $4 and method = $5 and animated = $6 and source_sha256_hash = $8 and generation = $9;"
+const selectThumbnailsWithoutHash = "SELECT origin, media_id, width, height, method, animated, content_type, size_bytes, datastore_id, location, creation_ts, sha256_hash, source_sha256_hash, generation FROM thumbnails WHERE sha256_hash IS NULL OR sha256_hash = '';"
+const selectThumbnailsWithoutDatastore = "SELECT origin, media_id, width, height, method, animated, content_type, size_bytes, datastore_id, location, creation_ts, sha256_hash, source_sha256_hash, generation FROM thumbnails WHERE datastore_id IS NULL OR datastore_id = '';"
+const updateThumbnailDatastoreAndLocation = "UPDATE thumbnails SET location = $8, datastore_id = $7 WHERE origin = $1 and media_id = $2 and width = $3 and height = $4 and method = $5 and animated = $6 and source_sha256_hash = $9 and generation = $10;"
+const selectThumbnailsForMedia = "SELECT origin, media_id, width, height, method, animated, content_type, size_bytes, datastore_id, location, creation_ts, sha256_hash, source_sha256_hash, generation FROM thumbnails WHERE origin = $1 AND media_id = $2;"
 const deleteThumbnailsForMedia = "DELETE FROM thumbnails WHERE origin = $1 AND media_id = $2;"
-const selectThumbnailsCreatedBefore = "SELECT origin, media_id, width, height, method, animated, content_type, size_bytes, datastore_id, location, creation_ts, sha256_hash FROM thumbnails WHERE creation_ts < $1;"
+const selectThumbnailsCreatedBefore = "SELECT origin, media_id, width, height, method, animated, content_type, size_bytes, datastore_id, location, creation_ts, sha256_hash, source_sha256_hash, generation FROM thumbnails WHERE creation_ts < $1;"
 const deleteThumbnailsWithHash = "DELETE FROM thumbnails WHERE sha256_hash = $1;"
+const selectThumbnailBySourceHash = "SELECT origin, media_id, width, height, method, animated, content_type, size_bytes, datastore_id, location, creation_ts, sha256_hash, source_sha256_hash, generation FROM thumbnails WHERE source_sha256_hash = $1 and width = $2 and height = $3 and method = $4 and animated = $5 and generation = $6 LIMIT 1;"
+const selectThumbnailsNotInGenerations = "SELECT origin, media_id, width, height, method, animated, content_type, size_bytes, datastore_id, location, creation_ts, sha256_hash, source_sha256_hash, generation FROM thumbnails WHERE generation <> ALL($1) ORDER BY creation_ts, origin, media_id, width, height, method, animated, source_sha256_hash LIMIT $2 OFFSET $3;"
+const deleteThumbnail = "DELETE FROM thumbnails WHERE origin = $1 and media_id = $2 and width = $3 and height = $4 and method = $5 and animated = $6 and source_sha256_hash = $7 and generation = $8;"
+const selectLatestThumbnailOfAnyGeneration = "SELECT origin, media_id, width, height, method, animated, content_type, size_bytes, datastore_id, location, creation_ts, sha256_hash, source_sha256_hash, generation FROM thumbnails WHERE origin = $1 and media_id = $2 and width = $3 and height = $4 and method = $5 and animated = $6 and source_sha256_hash = $7 ORDER BY creation_ts DESC LIMIT 1;"
+const selectOtherUsesOfThumbnailLocation = "SELECT COUNT(*) FROM thumbnails WHERE datastore_id = $1 AND location = $2 AND NOT (origin = $3 AND media_id = $4);"
 
 type thumbnailStatements struct {
-	selectThumbnail                     *sql.Stmt
-	insertThumbnail                     *sql.Stmt
-	updateThumbnailHash                 *sql.Stmt
-	selectThumbnailsWithoutHash         *sql.Stmt
-	selectThumbnailsWithoutDatastore    *sql.Stmt
-	updateThumbnailDatastoreAndLocation *sql.Stmt
-	selectThumbnailsForMedia            *sql.Stmt
-	deleteThumbnailsForMedia            *sql.Stmt
-	selectThumbnailsCreatedBefore       *sql.Stmt
-	deleteThumbnailsWithHash            *sql.Stmt
+	selectThumbnail                      *sql.Stmt
+	insertThumbnail                      *sql.Stmt
+	updateThumbnailHash                  *sql.Stmt
+	selectThumbnailsWithoutHash          *sql.Stmt
+	selectThumbnailsWithoutDatastore     *sql.Stmt
+	updateThumbnailDatastoreAndLocation  *sql.Stmt
+	selectThumbnailsForMedia             *sql.Stmt
+	deleteThumbnailsForMedia             *sql.Stmt
+	selectThumbnailsCreatedBefore        *sql.Stmt
+	deleteThumbnailsWithHash             *sql.Stmt
+	selectThumbnailBySourceHash          *sql.Stmt
+	selectOtherUsesOfThumbnailLocation   *sql.Stmt
+	selectThumbnailsNotInGenerations     *sql.Stmt
+	deleteThumbnail                      *sql.Stmt
+	selectLatestThumbnailOfAnyGeneration *sql.Stmt
 }
 
 type ThumbnailStoreFactory struct {
@@ -78,6 +89,21 @@ func InitThumbnailStore(sqlDb *sql.DB) (*ThumbnailStoreFactory, error) {
 	if store.stmts.deleteThumbnailsWithHash, err = store.sqlDb.Prepare(deleteThumbnailsWithHash); err != nil {
 		return nil, err
 	}
+	if store.stmts.selectThumbnailBySourceHash, err = store.sqlDb.Prepare(selectThumbnailBySourceHash); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectOtherUsesOfThumbnailLocation, err = store.sqlDb.Prepare(selectOtherUsesOfThumbnailLocation); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectThumbnailsNotInGenerations, err = store.sqlDb.Prepare(selectThumbnailsNotInGenerations); err != nil {
+		return nil, err
+	}
+	if store.stmts.deleteThumbnail, err = store.sqlDb.Prepare(deleteThumbnail); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectLatestThumbnailOfAnyGeneration, err = store.sqlDb.Prepare(selectLatestThumbnailOfAnyGeneration); err != nil {
+		return nil, err
+	}
 
 	return &store, nil
 }
@@ -105,14 +131,16 @@ func (s *ThumbnailStore) Insert(thumbnail *types.Thumbnail) error {
 		thumbnail.Location,
 		thumbnail.CreationTs,
 		thumbnail.Sha256Hash,
+		thumbnail.SourceSha256Hash,
+		thumbnail.Generation,
 	)
 
 	return err
 }
 
-func (s *ThumbnailStore) Get(origin string, mediaId string, width int, height int, method string, animated bool) (*types.Thumbnail, error) {
+func (s *ThumbnailStore) Get(origin string, mediaId string, width int, height int, method string, animated bool, sourceSha256Hash string, generation string) (*types.Thumbnail, error) {
 	t := &types.Thumbnail{}
-	err := s.statements.selectThumbnail.QueryRowContext(s.ctx, origin, mediaId, width, height, method, animated).Scan(
+	err := s.statements.selectThumbnail.QueryRowContext(s.ctx, origin, mediaId, width, height, method, animated, sourceSha256Hash, generation).Scan(
 		&t.Origin,
 		&t.MediaId,
 		&t.Width,
@@ -125,10 +153,68 @@ func (s *ThumbnailStore) Get(origin string, mediaId string, width int, height in
 		&t.Location,
 		&t.CreationTs,
 		&t.Sha256Hash,
+		&t.SourceSha256Hash,
+		&t.Generation,
 	)
 	return t, err
 }
 
+// GetLatestOfAnyGeneration is the same as Get, though returns the most recently generated thumbnail
+// regardless of the thumbnail configuration it was generated with.
+func (s *ThumbnailStore) GetLatestOfAnyGeneration(origin string, mediaId string, width int, height int, method string, animated bool, sourceSha256Hash string) (*types.Thumbnail, error) {
+	t := &types.Thumbnail{}
+	err := s.statements.selectLatestThumbnailOfAnyGeneration.QueryRowContext(s.ctx, origin, mediaId, width, height, method, animated, sourceSha256Hash).Scan(
+		&t.Origin,
+		&t.MediaId,
+		&t.Width,
+		&t.Height,
+		&t.Method,
+		&t.Animated,
+		&t.ContentType,
+		&t.SizeBytes,
+		&t.DatastoreId,
+		&t.Location,
+		&t.CreationTs,
+		&t.Sha256Hash,
+		&t.SourceSha256Hash,
+		&t.Generation,
+	)
+	return t, err
+}
+
+// GetBySourceHash finds a thumbnail of any media with the given source hash, for sharing thumbnails
+// between media with identical contents.
+func (s *ThumbnailStore) GetBySourceHash(sourceSha256Hash string, width int, height int, method string, animated bool, generation string) (*types.Thumbnail, error) {
+	t := &types.Thumbnail{}
+	err := s.statements.selectThumbnailBySourceHash.QueryRowContext(s.ctx, sourceSha256Hash, width, height, method, animated, generation).Scan(
+		&t.Origin,
+		&t.MediaId,
+		&t.Width,
+		&t.Height,
+		&t.Method,
+		&t.Animated,
+		&t.ContentType,
+		&t.SizeBytes,
+		&t.DatastoreId,
+		&t.Location,
+		&t.CreationTs,
+		&t.Sha256Hash,
+		&t.SourceSha256Hash,
+		&t.Generation,
+	)
+	return t, err
+}
+
+// IsLocationShared returns true if thumbnails of other media use the same file as the given thumbnail.
+func (s *ThumbnailStore) IsLocationShared(thumbnail *types.Thumbnail) (bool, error) {
+	var count int
+	err := s.statements.selectOtherUsesOfThumbnailLocation.QueryRowContext(s.ctx, thumbnail.DatastoreId, thumbnail.Location, thumbnail.Origin, thumbnail.MediaId).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
 func (s *ThumbnailStore) UpdateHash(thumbnail *types.Thumbnail) error {
 	_, err := s.statements.updateThumbnailHash.ExecContext(
 		s.ctx,
@@ -139,6 +225,8 @@ func (s *ThumbnailStore) UpdateHash(thumbnail *types.Thumbnail) error {
 		thumbnail.Method,
 		thumbnail.Animated,
 		thumbnail.Sha256Hash,
+		thumbnail.SourceSha256Hash,
+		thumbnail.Generation,
 	)
 
 	return err
@@ -155,6 +243,8 @@ func (s *ThumbnailStore) UpdateDatastoreAndLocation(thumbnail *types.Thumbnail)
 		thumbnail.Animated,
 		thumbnail.DatastoreId,
 		thumbnail.Location,
+		thumbnail.SourceSha256Hash,
+		thumbnail.Generation,
 	)
 
 	return err
@@ -182,6 +272,8 @@ func (s *ThumbnailStore) GetAllWithoutHash() ([]*types.Thumbnail, error) {
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Sha256Hash,
+			&obj.SourceSha256Hash,
+			&obj.Generation,
 		)
 		if err != nil {
 			return nil, err
@@ -214,6 +306,8 @@ func (s *ThumbnailStore) GetAllWithoutDatastore() ([]*types.Thumbnail, error) {
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Sha256Hash,
+			&obj.SourceSha256Hash,
+			&obj.Generation,
 		)
 		if err != nil {
 			return nil, err
@@ -246,6 +340,8 @@ func (s *ThumbnailStore) GetAllForMedia(origin string, mediaId string) ([]*types
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Sha256Hash,
+			&obj.SourceSha256Hash,
+			&obj.Generation,
 		)
 		if err != nil {
 			return nil, err
@@ -286,6 +382,8 @@ func (s *ThumbnailStore) GetOldThumbnails(beforeTs int64) ([]*types.Thumbnail, e
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Sha256Hash,
+			&obj.SourceSha256Hash,
+			&obj.Generation,
 		)
 		if err != nil {
 			return nil, err
@@ -303,3 +401,54 @@ func (s *ThumbnailStore) DeleteWithHash(sha256hash string) error {
 	}
 	return nil
 }
+
+// GetNotInGenerations returns up to limit thumbnails which were generated with a different thumbnail
+// configuration than the given generations, skipping the first offset of them.
+func (s *ThumbnailStore) GetNotInGenerations(generations []string, limit int, offset int) ([]*types.Thumbnail, error) {
+	rows, err := s.statements.selectThumbnailsNotInGenerations.QueryContext(s.ctx, pq.Array(generations), limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*types.Thumbnail
+	for rows.Next() {
+		obj := &types.Thumbnail{}
+		err = rows.Scan(
+			&obj.Origin,
+			&obj.MediaId,
+			&obj.Width,
+			&obj.Height,
+			&obj.Method,
+			&obj.Animated,
+			&obj.ContentType,
+			&obj.SizeBytes,
+			&obj.DatastoreId,
+			&obj.Location,
+			&obj.CreationTs,
+			&obj.Sha256Hash,
+			&obj.SourceSha256Hash,
+			&obj.Generation,
+		)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
+
+func (s *ThumbnailStore) Delete(thumbnail *types.Thumbnail) error {
+	_, err := s.statements.deleteThumbnail.ExecContext(
+		s.ctx,
+		thumbnail.Origin,
+		thumbnail.MediaId,
+		thumbnail.Width,
+		thumbnail.Height,
+		thumbnail.Method,
+		thumbnail.Animated,
+		thumbnail.SourceSha256Hash,
+		thumbnail.Generation,
+	)
+	return err
+}
@@ -8,8 +8,8 @@ import (
 	"github.com/turt2live/matrix-media-repo/util"
 )
 
-const selectUrlPreview = "SELECT url, error_code, bucket_ts, site_url, site_name, resource_type, description, title, image_mxc, image_type, image_size, image_width, image_height, language_header FROM url_previews WHERE url = $1 AND bucket_ts = $2 AND language_header = $3;"
-const insertUrlPreview = "INSERT INTO url_previews (url, error_code, bucket_ts, site_url, site_name, resource_type, description, title, image_mxc, image_type, image_size, image_width, image_height, language_header) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14);"
+const selectUrlPreview = "SELECT url, error_code, bucket_ts, site_url, site_name, resource_type, description, title, image_mxc, image_type, image_size, image_width, image_height, language_header, expires_ts FROM url_previews WHERE url = $1 AND bucket_ts <= $2 AND expires_ts > $2 AND language_header = $3 ORDER BY bucket_ts DESC LIMIT 1;"
+const insertUrlPreview = "INSERT INTO url_previews (url, error_code, bucket_ts, site_url, site_name, resource_type, description, title, image_mxc, image_type, image_size, image_width, image_height, language_header, expires_ts) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15) ON CONFLICT (url, error_code, bucket_ts) DO UPDATE SET site_url = $4, site_name = $5, resource_type = $6, description = $7, title = $8, image_mxc = $9, image_type = $10, image_size = $11, image_width = $12, image_height = $13, language_header = $14, expires_ts = $15;"
 const deletePreviewsOlderThan = "DELETE FROM url_previews WHERE bucket_ts <= $1;"
 
 type urlStatements struct {
@@ -56,11 +56,12 @@ func (f *UrlStoreFactory) Create(ctx rcontext.RequestContext) *UrlStore {
 	}
 }
 
+// GetPreview returns the most recent cached preview of the URL which had not expired at the given time.
 func (s *UrlStore) GetPreview(url string, ts int64, languageHeader string) (*types.CachedUrlPreview, error) {
 	r := &types.CachedUrlPreview{
 		Preview: &types.UrlPreview{},
 	}
-	err := s.statements.selectUrlPreview.QueryRowContext(s.ctx, url, GetBucketTs(ts), languageHeader).Scan(
+	err := s.statements.selectUrlPreview.QueryRowContext(s.ctx, url, ts, languageHeader).Scan(
 		&r.SearchUrl,
 		&r.ErrorCode,
 		&r.FetchedTs,
@@ -75,6 +76,7 @@ func (s *UrlStore) GetPreview(url string, ts int64, languageHeader string) (*typ
 		&r.Preview.ImageWidth,
 		&r.Preview.ImageHeight,
 		&r.Preview.LanguageHeader,
+		&r.ExpiresTs,
 	)
 
 	return r, err
@@ -97,17 +99,20 @@ func (s *UrlStore) InsertPreview(record *types.CachedUrlPreview) error {
 		record.Preview.ImageWidth,
 		record.Preview.ImageHeight,
 		record.Preview.LanguageHeader,
+		record.ExpiresTs,
 	)
 
 	return err
 }
 
 func (s *UrlStore) InsertPreviewError(url string, errorCode string) error {
+	now := util.NowMillis()
 	return s.InsertPreview(&types.CachedUrlPreview{
 		Preview:   &types.UrlPreview{},
 		SearchUrl: url,
 		ErrorCode: errorCode,
-		FetchedTs: util.NowMillis(),
+		FetchedTs: now,
+		ExpiresTs: GetBucketTs(now) + 3600000, // errors are remembered until the end of the bucket
 	})
 }
 
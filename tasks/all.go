@@ -2,12 +2,26 @@ package tasks
 
 func StartAll() {
 	StartRemoteMediaPurgeRecurring()
+	StartExpiredServerMediaPurgeRecurring()
 	StartThumbnailPurgeRecurring()
 	StartPreviewsPurgeRecurring()
+	StartAccessFlushRecurring()
+	StartPendingUploadsRecoveryRecurring()
+	StartDatastoreHealthCheckRecurring()
+	StartDatabaseHealthCheckRecurring()
+	StartStorageUsageCheckRecurring()
+	StartSoftDeletedMediaPurgeRecurring()
 }
 
 func StopAll() {
 	StopRemoteMediaPurgeRecurring()
+	StopExpiredServerMediaPurgeRecurring()
 	StopThumbnailPurgeRecurring()
 	StopPreviewsPurgeRecurring()
+	StopAccessFlushRecurring()
+	StopPendingUploadsRecoveryRecurring()
+	StopDatastoreHealthCheckRecurring()
+	StopDatabaseHealthCheckRecurring()
+	StopStorageUsageCheckRecurring()
+	StopSoftDeletedMediaPurgeRecurring()
 }
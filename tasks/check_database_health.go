@@ -0,0 +1,48 @@
+package tasks
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+)
+
+var databaseHealthDone chan bool
+var lastDatabaseHealthCheck time.Time
+
+func StartDatabaseHealthCheckRecurring() {
+	// Tick often so changes to the configured interval are picked up without a restart
+	ticker := time.NewTicker(1 * time.Second)
+	databaseHealthDone = make(chan bool)
+
+	go func() {
+		defer close(databaseHealthDone)
+		for {
+			select {
+			case <-databaseHealthDone:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				doRecurringDatabaseHealthCheck()
+			}
+		}
+	}()
+}
+
+func StopDatabaseHealthCheckRecurring() {
+	databaseHealthDone <- true
+}
+
+func doRecurringDatabaseHealthCheck() {
+	conf := config.Get().Database.CircuitBreaker
+	interval := time.Duration(conf.CheckIntervalSeconds) * time.Second
+	if !conf.Enabled || interval <= 0 || time.Since(lastDatabaseHealthCheck) < interval {
+		return
+	}
+	lastDatabaseHealthCheck = time.Now()
+
+	ctx := rcontext.Initial().LogWithFields(logrus.Fields{"task": "recurring_database_health_check"})
+	storage.CheckDatabaseHealth(ctx)
+}
@@ -0,0 +1,47 @@
+package tasks
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+)
+
+var datastoreHealthDone chan bool
+var lastDatastoreHealthCheck time.Time
+
+func StartDatastoreHealthCheckRecurring() {
+	// Tick often so changes to the configured interval are picked up without a restart
+	ticker := time.NewTicker(10 * time.Second)
+	datastoreHealthDone = make(chan bool)
+
+	go func() {
+		defer close(datastoreHealthDone)
+		for {
+			select {
+			case <-datastoreHealthDone:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				doRecurringDatastoreHealthCheck()
+			}
+		}
+	}()
+}
+
+func StopDatastoreHealthCheckRecurring() {
+	datastoreHealthDone <- true
+}
+
+func doRecurringDatastoreHealthCheck() {
+	interval := time.Duration(config.Get().DatastoreHealth.CheckIntervalSeconds) * time.Second
+	if interval <= 0 || time.Since(lastDatastoreHealthCheck) < interval {
+		return
+	}
+	lastDatastoreHealthCheck = time.Now()
+
+	ctx := rcontext.Initial().LogWithFields(logrus.Fields{"task": "recurring_datastore_health_check"})
+	datastore.CheckHealth(ctx)
+}
@@ -0,0 +1,54 @@
+package tasks
+
+import (
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/upload_controller"
+)
+
+var storageUsageDone chan bool
+var lastStorageUsageCheck time.Time
+
+func StartStorageUsageCheckRecurring() {
+	// Tick often so changes to the configured interval are picked up without a restart
+	ticker := time.NewTicker(10 * time.Second)
+	storageUsageDone = make(chan bool)
+
+	go func() {
+		defer close(storageUsageDone)
+		doRecurringStorageUsageCheck() // check straight away so the limit applies from startup
+		for {
+			select {
+			case <-storageUsageDone:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				doRecurringStorageUsageCheck()
+			}
+		}
+	}()
+}
+
+func StopStorageUsageCheckRecurring() {
+	storageUsageDone <- true
+}
+
+func doRecurringStorageUsageCheck() {
+	conf := config.Get().StorageLimit
+	interval := time.Duration(conf.CheckIntervalSeconds) * time.Second
+	if (conf.MaxBytes <= 0 && conf.WarnBytes <= 0) || time.Since(lastStorageUsageCheck) < interval {
+		return
+	}
+	lastStorageUsageCheck = time.Now()
+
+	ctx := rcontext.Initial().LogWithFields(logrus.Fields{"task": "recurring_storage_usage_check"})
+	err := upload_controller.UpdateStoredBytes(ctx)
+	if err != nil {
+		ctx.Log.Error("Error calculating storage usage: ", err)
+		sentry.CaptureException(err)
+	}
+}
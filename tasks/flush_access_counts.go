@@ -0,0 +1,44 @@
+package tasks
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/download_controller"
+)
+
+var accessFlushDone chan bool
+
+func StartAccessFlushRecurring() {
+	interval := config.Get().Downloads.AccessFlushSeconds
+	if interval <= 0 {
+		interval = 30
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	accessFlushDone = make(chan bool)
+
+	go func() {
+		defer close(accessFlushDone)
+		for {
+			select {
+			case <-accessFlushDone:
+				ticker.Stop()
+				doAccessFlush() // flush whatever is left before stopping
+				return
+			case <-ticker.C:
+				doAccessFlush()
+			}
+		}
+	}()
+}
+
+func StopAccessFlushRecurring() {
+	accessFlushDone <- true
+}
+
+func doAccessFlush() {
+	ctx := rcontext.Initial().LogWithFields(logrus.Fields{"task": "flush_access_counts"})
+	download_controller.FlushAccesses(ctx)
+}
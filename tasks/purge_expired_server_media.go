@@ -0,0 +1,62 @@
+package tasks
+
+import (
+	"github.com/getsentry/sentry-go"
+	"math/rand"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/maintenance_controller"
+)
+
+var expiredServerMediaPurgeDone chan bool
+
+func StartExpiredServerMediaPurgeRecurring() {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	ticker := time.NewTicker((1 * time.Hour) + (time.Duration(r.Intn(15)) * time.Minute))
+	expiredServerMediaPurgeDone = make(chan bool)
+
+	go func() {
+		defer close(expiredServerMediaPurgeDone)
+		for {
+			select {
+			case <-expiredServerMediaPurgeDone:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				doRecurringExpiredServerMediaPurge()
+			}
+		}
+	}()
+}
+
+func StopExpiredServerMediaPurgeRecurring() {
+	expiredServerMediaPurgeDone <- true
+}
+
+func doRecurringExpiredServerMediaPurge() {
+	for _, domain := range config.AllDomains() {
+		if domain.PurgeAllMediaAfterDays <= 0 {
+			continue
+		}
+
+		ctx := rcontext.Initial().LogWithFields(logrus.Fields{
+			"task":       "recurring_purge_expired_server_media",
+			"serverName": domain.Name,
+		})
+		ctx.Log.Info("Starting expired media purge task")
+
+		purged, bytesFreed, err := maintenance_controller.PurgeExpiredServerMedia(domain.Name, false, ctx)
+		if err != nil {
+			ctx.Log.Error(err)
+			sentry.CaptureException(err)
+			if len(purged) > 0 {
+				ctx.Log.Warnf("Purge task failed part way: removed %d media records, freeing %d bytes", len(purged), bytesFreed)
+			}
+			continue
+		}
+		ctx.Log.Infof("Purge task completed: removed %d media records, freeing %d bytes", len(purged), bytesFreed)
+	}
+}
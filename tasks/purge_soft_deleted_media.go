@@ -0,0 +1,55 @@
+package tasks
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/maintenance_controller"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+var softDeletedMediaPurgeDone chan bool
+
+func StartSoftDeletedMediaPurgeRecurring() {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	ticker := time.NewTicker((1 * time.Hour) + (time.Duration(r.Intn(15)) * time.Minute))
+	softDeletedMediaPurgeDone = make(chan bool)
+
+	go func() {
+		defer close(softDeletedMediaPurgeDone)
+		for {
+			select {
+			case <-softDeletedMediaPurgeDone:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				doRecurringSoftDeletedMediaPurge()
+			}
+		}
+	}()
+}
+
+func StopSoftDeletedMediaPurgeRecurring() {
+	softDeletedMediaPurgeDone <- true
+}
+
+func doRecurringSoftDeletedMediaPurge() {
+	// This runs even when soft deletion is disabled so media deleted before then is still purged
+	ctx := rcontext.Initial().LogWithFields(logrus.Fields{"task": "recurring_purge_soft_deleted_media"})
+
+	gracePeriod := time.Duration(config.Get().SoftDeletion.GracePeriodHours) * time.Hour
+	beforeTs := util.NowMillis() - gracePeriod.Milliseconds()
+	purged, err := maintenance_controller.PurgeSoftDeletedBefore(beforeTs, ctx)
+	if err != nil {
+		ctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return
+	}
+	if purged > 0 {
+		ctx.Log.Infof("Purged %d deleted media after their grace period", purged)
+	}
+}
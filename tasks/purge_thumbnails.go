@@ -8,6 +8,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/turt2live/matrix-media-repo/common/config"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/thumbnail_controller"
 	"github.com/turt2live/matrix-media-repo/storage"
 	"github.com/turt2live/matrix-media-repo/storage/datastore"
 	"github.com/turt2live/matrix-media-repo/util"
@@ -15,6 +16,8 @@ import (
 
 var thumbnailsPurgeDone chan bool
 
+const oldGenerationPurgeBatchSize = 500
+
 func StartThumbnailPurgeRecurring() {
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 	ticker := time.NewTicker((1 * time.Hour) + (time.Duration(r.Intn(15)) * time.Minute))
@@ -28,11 +31,12 @@ func StartThumbnailPurgeRecurring() {
 				ticker.Stop()
 				return
 			case <-ticker.C:
-				if config.Get().Thumbnails.ExpireDays <= 0 {
-					continue
+				if config.Get().Thumbnails.ExpireDays > 0 {
+					doRecurringThumbnailPurge()
+				}
+				if config.Get().Thumbnails.PurgeOldGenerations {
+					doRecurringOldThumbnailGenerationPurge()
 				}
-
-				doRecurringThumbnailPurge()
 			}
 		}
 	}()
@@ -97,3 +101,78 @@ func doRecurringThumbnailPurge() {
 
 	ctx.Log.Info("Purge task completed")
 }
+
+func doRecurringOldThumbnailGenerationPurge() {
+	ctx := rcontext.Initial().LogWithFields(logrus.Fields{"task": "recurring_purge_old_thumbnail_generations"})
+	ctx.Log.Info("Starting old thumbnail generation purge task")
+
+	db := storage.GetDatabase().GetThumbnailStore(ctx)
+	mediaDb := storage.GetDatabase().GetMediaStore(ctx)
+	generations := thumbnail_controller.CurrentGenerations()
+
+	// Purged thumbnails drop out of the results, so we only need to skip over the ones we've kept
+	skipped := 0
+	purged := 0
+	for {
+		thumbs, err := db.GetNotInGenerations(generations, oldGenerationPurgeBatchSize, skipped)
+		if err != nil {
+			ctx.Log.Error(err)
+			sentry.CaptureException(err)
+			return
+		}
+		if len(thumbs) == 0 {
+			break
+		}
+
+		for _, thumb := range thumbs {
+			// Double check that the thumbnail won't also delete some media
+			m, err := mediaDb.GetMediaByLocation(thumb.DatastoreId, thumb.Location)
+			if err != nil {
+				ctx.Log.Error(err)
+				sentry.CaptureException(err)
+				return
+			}
+			if len(m) > 0 {
+				ctx.Log.Warnf("Refusing to delete thumbnail with hash %s because it looks like other pieces of media are using it", thumb.Sha256Hash)
+				skipped++
+				continue
+			}
+
+			ctx.Log.Infof("Deleting %dx%d thumbnail of %s/%s from generation '%s'", thumb.Width, thumb.Height, thumb.Origin, thumb.MediaId, thumb.Generation)
+			err = db.Delete(thumb)
+			if err != nil {
+				ctx.Log.Error(err)
+				sentry.CaptureException(err)
+				return
+			}
+			purged++
+
+			// Other thumbnails (including newer generations) may have the same contents
+			shared, err := db.IsLocationShared(thumb)
+			if err != nil {
+				ctx.Log.Error(err)
+				sentry.CaptureException(err)
+				continue
+			}
+			if shared {
+				continue
+			}
+
+			ds, err := datastore.LocateDatastore(ctx, thumb.DatastoreId)
+			if err != nil {
+				ctx.Log.Error(err)
+				sentry.CaptureException(err)
+				continue
+			}
+
+			err = ds.DeleteObject(thumb.Location)
+			if err != nil {
+				ctx.Log.Error(err)
+				sentry.CaptureException(err)
+				// don't return on this one - we'll continue otherwise
+			}
+		}
+	}
+
+	ctx.Log.Infof("Old thumbnail generation purge task completed: removed %d thumbnails", purged)
+}
@@ -0,0 +1,42 @@
+package tasks
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+)
+
+// Uploads which haven't been committed after this long are assumed to have been abandoned
+const pendingUploadMaxAge = 1 * time.Hour
+
+var pendingUploadsRecoveryDone chan bool
+
+func StartPendingUploadsRecoveryRecurring() {
+	ticker := time.NewTicker(1 * time.Hour)
+	pendingUploadsRecoveryDone = make(chan bool)
+
+	go func() {
+		defer close(pendingUploadsRecoveryDone)
+		doPendingUploadsRecovery() // recover anything left over from a crash right away
+		for {
+			select {
+			case <-pendingUploadsRecoveryDone:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				doPendingUploadsRecovery()
+			}
+		}
+	}()
+}
+
+func StopPendingUploadsRecoveryRecurring() {
+	pendingUploadsRecoveryDone <- true
+}
+
+func doPendingUploadsRecovery() {
+	ctx := rcontext.Initial().LogWithFields(logrus.Fields{"task": "recover_pending_uploads"})
+	datastore.RecoverPendingUploads(pendingUploadMaxAge, ctx)
+}
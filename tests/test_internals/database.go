@@ -0,0 +1,77 @@
+package test_internals
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+)
+
+// DatabaseEnvVar names the environment variable holding the connection string for a Postgres
+// database which tests may freely write to. Tests which need a database are skipped without it.
+const DatabaseEnvVar = "MEDIA_REPO_TEST_DATABASE"
+
+var setupOnce = &sync.Once{}
+var setupErr error
+var datastorePath string
+
+// SetupDatabase configures the media repo to use the test database and a temporary file
+// datastore for all kinds of media, returning a context for the test to use. The test is
+// skipped if no test database is configured.
+func SetupDatabase(t *testing.T) rcontext.RequestContext {
+	connectionString := os.Getenv(DatabaseEnvVar)
+	if connectionString == "" {
+		t.Skip(DatabaseEnvVar + " is not set")
+	}
+
+	setupOnce.Do(func() {
+		setupErr = setup(connectionString)
+	})
+	if setupErr != nil {
+		t.Fatal(setupErr)
+	}
+
+	return rcontext.Initial()
+}
+
+// DatastorePath returns the directory of the temporary file datastore set up by SetupDatabase.
+func DatastorePath() string {
+	return datastorePath
+}
+
+func setup(connectionString string) error {
+	dir, err := ioutil.TempDir("", "media-repo-test")
+	if err != nil {
+		return err
+	}
+	datastorePath = path.Join(dir, "media")
+
+	conf := fmt.Sprintf(`database:
+  postgres: %q
+datastores:
+  - type: file
+    enabled: true
+    forKinds: ["thumbnails", "remote_media", "local_media", "archives"]
+    opts:
+      path: %q
+`, connectionString, datastorePath)
+	config.Path = path.Join(dir, "media-repo.yaml")
+	err = ioutil.WriteFile(config.Path, []byte(conf), 0644)
+	if err != nil {
+		return err
+	}
+
+	// Migrations are read from the repository, relative to this file
+	_, file, _, _ := runtime.Caller(0)
+	config.Runtime.MigrationsPath = filepath.Join(filepath.Dir(file), "..", "..", "migrations")
+
+	return storage.OpenDatabase(config.Get().Database.Postgres, config.Get().Database.Pool.MaxConnections, config.Get().Database.Pool.MaxIdle)
+}
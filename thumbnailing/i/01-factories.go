@@ -1,8 +1,12 @@
 package i
 
 import (
+	"bytes"
+	"image/gif"
+
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/thumbnailing/m"
+	"github.com/turt2live/matrix-media-repo/util"
 )
 
 type Generator interface {
@@ -57,3 +61,21 @@ func GetSupportedAnimationTypes() []string {
 	}
 	return a
 }
+
+// IsAnimated returns true if the image has more than one frame. Only the content types which can be
+// thumbnailed as animations are checked: anything else is assumed to be a still image.
+func IsAnimated(b []byte, contentType string) bool {
+	switch contentType {
+	case "image/gif":
+		g, err := gif.DecodeAll(bytes.NewReader(b))
+		return err == nil && len(g.Image) > 1
+	case "image/apng":
+		return true
+	case "image/png":
+		return util.IsAnimatedPNG(b)
+	case "image/webp":
+		anim, err := parseAnimatedWebp(b)
+		return err == nil && anim != nil
+	}
+	return false
+}
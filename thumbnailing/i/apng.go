@@ -46,6 +46,12 @@ func (d apngGenerator) GenerateThumbnail(b []byte, contentType string, width int
 		return nil, errors.New("apng: error decoding image: " + err.Error())
 	}
 
+	maxFrames := ctx.Config.Thumbnails.MaxAnimateFrames
+	if maxFrames > 0 && len(p.Frames) > maxFrames {
+		ctx.Log.Warnf("APNG has %d frames, which is more than the maximum of %d. Assuming animated=false", len(p.Frames), maxFrames)
+		return pngGenerator{}.GenerateThumbnail(b, "image/png", width, height, method, false, ctx)
+	}
+
 	// prepare a blank frame to use as swap space
 	frameImg := image.NewRGBA(p.Frames[0].Image.Bounds())
 
@@ -0,0 +1,76 @@
+package i
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io/ioutil"
+	"path"
+
+	"github.com/dhowden/tag"
+	"github.com/disintegration/imaging"
+	"github.com/faiface/beep"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/thumbnailing/m"
+	"github.com/turt2live/matrix-media-repo/thumbnailing/u"
+)
+
+type audioDecoder func(b []byte) (beep.StreamSeekCloser, beep.Format, error)
+
+// generateAudioThumbnail thumbnails the embedded cover art of the audio file if it has any. Otherwise
+// a waveform is rendered (if enabled), falling back to a generic placeholder image.
+func generateAudioThumbnail(b []byte, decode audioDecoder, width int, height int, method string, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+	meta := u.GetID3Tags(b)
+	if artwork := decodeArtwork(meta); artwork != nil {
+		ctx.Log.Info("Using embedded cover art for audio thumbnail")
+		return imageToThumbnail(artwork, width, height, method, ctx)
+	}
+
+	if ctx.Config.Thumbnails.AudioWaveforms {
+		audio, format, err := decode(b)
+		if err != nil {
+			return nil, err
+		}
+		defer audio.Close()
+		return mp3Generator{}.GenerateFromStream(audio, format, meta, width, height)
+	}
+
+	ctx.Log.Info("Using placeholder for audio thumbnail")
+	placeholder, err := ioutil.ReadFile(path.Join(config.Runtime.AssetsPath, "default-artwork.png"))
+	if err != nil {
+		return nil, errors.New("audio: error reading placeholder artwork: " + err.Error())
+	}
+	img, _, err := image.Decode(bytes.NewBuffer(placeholder))
+	if err != nil {
+		return nil, errors.New("audio: error decoding placeholder artwork: " + err.Error())
+	}
+	return imageToThumbnail(img, width, height, method, ctx)
+}
+
+func decodeArtwork(meta tag.Metadata) image.Image {
+	if meta == nil || meta.Picture() == nil {
+		return nil
+	}
+	artwork, _, _ := image.Decode(bytes.NewBuffer(meta.Picture().Data))
+	return artwork
+}
+
+func imageToThumbnail(src image.Image, width int, height int, method string, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+	thumb, err := pngGenerator{}.GenerateThumbnailOf(src, width, height, method, ctx)
+	if err != nil || thumb != nil {
+		return thumb, err
+	}
+
+	// The image is already smaller than the requested size, so just use it as-is
+	imgData := &bytes.Buffer{}
+	err = imaging.Encode(imgData, src, imaging.PNG)
+	if err != nil {
+		return nil, errors.New("audio: error encoding thumbnail: " + err.Error())
+	}
+	return &m.Thumbnail{
+		Animated:    false,
+		ContentType: "image/png",
+		Reader:      ioutil.NopCloser(imgData),
+	}, nil
+}
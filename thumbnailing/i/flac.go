@@ -7,7 +7,6 @@ import (
 	"github.com/faiface/beep/flac"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/thumbnailing/m"
-	"github.com/turt2live/matrix-media-repo/thumbnailing/u"
 	"github.com/turt2live/matrix-media-repo/util/util_byte_seeker"
 )
 
@@ -39,13 +38,7 @@ func (d flacGenerator) GetOriginDimensions(b []byte, contentType string, ctx rco
 }
 
 func (d flacGenerator) GenerateThumbnail(b []byte, contentType string, width int, height int, method string, animated bool, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
-	audio, format, err := d.decode(b)
-	if err != nil {
-		return nil, err
-	}
-
-	defer audio.Close()
-	return mp3Generator{}.GenerateFromStream(audio, format, u.GetID3Tags(b), width, height)
+	return generateAudioThumbnail(b, d.decode, width, height, method, ctx)
 }
 
 func (d flacGenerator) GetAudioData(b []byte, nKeys int, ctx rcontext.RequestContext) (*m.AudioInfo, error) {
@@ -39,6 +39,12 @@ func (d gifGenerator) GenerateThumbnail(b []byte, contentType string, width int,
 		return nil, errors.New("gif: error decoding image: " + err.Error())
 	}
 
+	maxFrames := ctx.Config.Thumbnails.MaxAnimateFrames
+	if animated && maxFrames > 0 && len(g.Image) > maxFrames {
+		ctx.Log.Warnf("GIF has %d frames, which is more than the maximum of %d. Assuming animated=false", len(g.Image), maxFrames)
+		animated = false
+	}
+
 	// Prepare a blank frame to use as swap space
 	frameImg := image.NewRGBA(image.Rectangle{Min: image.Point{X: 0, Y: 0}, Max: image.Point{X: g.Config.Width, Y: g.Config.Height}})
 
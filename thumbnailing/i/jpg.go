@@ -39,7 +39,7 @@ func (d jpgGenerator) GenerateThumbnail(b []byte, contentType string, width int,
 	}
 
 	var shouldThumbnail bool
-	shouldThumbnail, width, height, animated, method = u.AdjustProperties(src, width, height, animated, false, method)
+	shouldThumbnail, width, height, animated, method = u.AdjustProperties(src, width, height, animated, false, method, ctx.Config.Thumbnails.AllowUpscaling)
 	if !shouldThumbnail {
 		return nil, nil
 	}
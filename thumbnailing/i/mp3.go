@@ -18,7 +18,6 @@ import (
 	"github.com/turt2live/matrix-media-repo/common/config"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/thumbnailing/m"
-	"github.com/turt2live/matrix-media-repo/thumbnailing/u"
 	"github.com/turt2live/matrix-media-repo/util/util_audio"
 	"github.com/turt2live/matrix-media-repo/util/util_byte_seeker"
 )
@@ -51,13 +50,7 @@ func (d mp3Generator) GetOriginDimensions(b []byte, contentType string, ctx rcon
 }
 
 func (d mp3Generator) GenerateThumbnail(b []byte, contentType string, width int, height int, method string, animated bool, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
-	audio, format, err := d.decode(b)
-	if err != nil {
-		return nil, err
-	}
-	defer audio.Close()
-
-	return d.GenerateFromStream(audio, format, u.GetID3Tags(b), width, height)
+	return generateAudioThumbnail(b, d.decode, width, height, method, ctx)
 }
 
 func (d mp3Generator) GetAudioData(b []byte, nKeys int, ctx rcontext.RequestContext) (*m.AudioInfo, error) {
@@ -65,7 +65,7 @@ func (d pngGenerator) GenerateThumbnailOf(src image.Image, width int, height int
 
 func (d pngGenerator) GenerateThumbnailImageOf(src image.Image, width int, height int, method string, ctx rcontext.RequestContext) (image.Image, error) {
 	var shouldThumbnail bool
-	shouldThumbnail, width, height, _, method = u.AdjustProperties(src, width, height, false, false, method)
+	shouldThumbnail, width, height, _, method = u.AdjustProperties(src, width, height, false, false, method, ctx.Config.Thumbnails.AllowUpscaling)
 	if !shouldThumbnail {
 		return nil, nil
 	}
@@ -0,0 +1,80 @@
+package i
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+
+	"github.com/disintegration/imaging"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/thumbnailing/m"
+	"github.com/turt2live/matrix-media-repo/thumbnailing/u"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+type Preset struct {
+	Width  int
+	Height int
+	Method string
+}
+
+// SupportsPresets determines if GeneratePresets can be used for the given content type.
+func SupportsPresets(contentType string) bool {
+	return util.ArrayContains(jpgGenerator{}.supportedContentTypes(), contentType) ||
+		util.ArrayContains(pngGenerator{}.supportedContentTypes(), contentType)
+}
+
+// GeneratePresets generates a static thumbnail for each preset, decoding the source image only
+// once. The returned slice matches the order of the presets, with nil entries for presets which
+// are larger than the source image.
+func GeneratePresets(b []byte, contentType string, presets []Preset, ctx rcontext.RequestContext) ([]*m.Thumbnail, error) {
+	if !SupportsPresets(contentType) {
+		return nil, errors.New("presets: unsupported content type " + contentType)
+	}
+
+	src, err := imaging.Decode(bytes.NewBuffer(b))
+	if err != nil {
+		return nil, errors.New("presets: error decoding image: " + err.Error())
+	}
+
+	isJpeg := util.ArrayContains(jpgGenerator{}.supportedContentTypes(), contentType)
+	format := imaging.PNG
+	outputType := "image/png"
+	if isJpeg {
+		format = imaging.JPEG
+		outputType = "image/jpeg"
+	}
+
+	thumbs := make([]*m.Thumbnail, len(presets))
+	for idx, preset := range presets {
+		shouldThumbnail, width, height, _, method := u.AdjustProperties(src, preset.Width, preset.Height, false, false, preset.Method, ctx.Config.Thumbnails.AllowUpscaling)
+		if !shouldThumbnail {
+			continue
+		}
+
+		thumb, err := u.MakeThumbnail(src, method, width, height)
+		if err != nil {
+			return nil, errors.New("presets: error making thumbnail: " + err.Error())
+		}
+
+		if isJpeg {
+			thumb, err = u.IdentifyAndApplyOrientation(b, thumb)
+			if err != nil {
+				return nil, errors.New("presets: error applying orientation: " + err.Error())
+			}
+		}
+
+		imgData := &bytes.Buffer{}
+		err = imaging.Encode(imgData, thumb, format)
+		if err != nil {
+			return nil, errors.New("presets: error encoding thumbnail: " + err.Error())
+		}
+		thumbs[idx] = &m.Thumbnail{
+			Animated:    false,
+			ContentType: outputType,
+			Reader:      ioutil.NopCloser(imgData),
+		}
+	}
+
+	return thumbs, nil
+}
@@ -2,7 +2,15 @@ package i
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
+	"image"
+	"image/draw"
+	"io/ioutil"
+	"math"
+
+	"github.com/disintegration/imaging"
+	"github.com/kettek/apng"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/thumbnailing/m"
 	"golang.org/x/image/webp"
@@ -11,6 +19,21 @@ import (
 type webpGenerator struct {
 }
 
+type webpFrame struct {
+	x, y          int
+	width, height int
+	durationMs    int
+	blend         bool
+	dispose       bool
+	data          []byte // the frame's ALPH and VP8/VP8L chunks
+}
+
+type animatedWebp struct {
+	width, height int
+	loopCount     uint
+	frames        []webpFrame
+}
+
 func (d webpGenerator) supportedContentTypes() []string {
 	return []string{"image/webp"}
 }
@@ -32,6 +55,14 @@ func (d webpGenerator) GetOriginDimensions(b []byte, contentType string, ctx rco
 }
 
 func (d webpGenerator) GenerateThumbnail(b []byte, contentType string, width int, height int, method string, animated bool, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+	anim, err := parseAnimatedWebp(b)
+	if err != nil {
+		return nil, errors.New("webp: error parsing image: " + err.Error())
+	}
+	if anim != nil {
+		return d.generateAnimatedThumbnail(anim, width, height, method, animated, ctx)
+	}
+
 	src, err := webp.Decode(bytes.NewBuffer(b))
 	if err != nil {
 		return nil, errors.New("webp: error decoding thumbnail: " + err.Error())
@@ -40,6 +71,254 @@ func (d webpGenerator) GenerateThumbnail(b []byte, contentType string, width int
 	return pngGenerator{}.GenerateThumbnailOf(src, width, height, method, ctx)
 }
 
+func (d webpGenerator) generateAnimatedThumbnail(anim *animatedWebp, width int, height int, method string, animated bool, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+	maxFrames := ctx.Config.Thumbnails.MaxAnimateFrames
+	if animated && maxFrames > 0 && len(anim.frames) > maxFrames {
+		ctx.Log.Warnf("Animated WebP has %d frames, which is more than the maximum of %d. Assuming animated=false", len(anim.frames), maxFrames)
+		animated = false
+	}
+
+	targetStaticFrame := int(math.Floor(math.Min(1, math.Max(0, float64(ctx.Config.Thumbnails.StillFrame))) * float64(len(anim.frames))))
+	if targetStaticFrame >= len(anim.frames) {
+		targetStaticFrame = len(anim.frames) - 1
+	}
+
+	// Frames are drawn onto the canvas in turn, as each only covers the area which changed
+	canvas := image.NewRGBA(image.Rect(0, 0, anim.width, anim.height))
+	p := apng.APNG{
+		Frames:    make([]apng.Frame, 0, len(anim.frames)),
+		LoopCount: anim.loopCount,
+	}
+
+	for i, frame := range anim.frames {
+		img, err := frame.decode()
+		if err != nil {
+			return nil, errors.New("webp: error decoding frame: " + err.Error())
+		}
+
+		frameRect := image.Rect(frame.x, frame.y, frame.x+frame.width, frame.y+frame.height)
+		op := draw.Src
+		if frame.blend {
+			op = draw.Over
+		}
+		draw.Draw(canvas, frameRect, img, image.Point{X: 0, Y: 0}, op)
+
+		if !animated && i == targetStaticFrame {
+			t, err := pngGenerator{}.GenerateThumbnailOf(canvas, width, height, method, ctx)
+			if err != nil || t != nil {
+				return t, err
+			}
+
+			// The thumbnailer decided that it shouldn't thumbnail, so encode it ourselves
+			buf := &bytes.Buffer{}
+			err = imaging.Encode(buf, canvas, imaging.PNG)
+			if err != nil {
+				return nil, errors.New("webp: error encoding still frame thumbnail: " + err.Error())
+			}
+			return &m.Thumbnail{
+				Animated:    false,
+				ContentType: "image/png",
+				Reader:      ioutil.NopCloser(buf),
+			}, nil
+		}
+
+		if animated {
+			// Do the thumbnailing on the drawn frame
+			frameThumb, err := pngGenerator{}.GenerateThumbnailImageOf(canvas, width, height, method, ctx)
+			if err != nil {
+				return nil, errors.New("webp: error generating thumbnail frame: " + err.Error())
+			}
+			if frameThumb == nil {
+				tmpImg := image.NewRGBA(canvas.Bounds())
+				draw.Draw(tmpImg, tmpImg.Bounds(), canvas, image.Point{X: 0, Y: 0}, draw.Src)
+				frameThumb = tmpImg
+			}
+
+			delay := frame.durationMs
+			if delay > math.MaxUint16 {
+				delay = math.MaxUint16
+			}
+			p.Frames = append(p.Frames, apng.Frame{
+				Image:            frameThumb,
+				DelayNumerator:   uint16(delay),
+				DelayDenominator: 1000,
+				DisposeOp:        apng.DISPOSE_OP_NONE,
+				BlendOp:          apng.BLEND_OP_SOURCE,
+			})
+		}
+
+		if frame.dispose {
+			draw.Draw(canvas, frameRect, image.Transparent, image.Point{X: 0, Y: 0}, draw.Src)
+		}
+	}
+
+	// WebP can't be encoded here, so animated thumbnails are sent as APNG instead
+	buf := &bytes.Buffer{}
+	err := apng.Encode(buf, p)
+	if err != nil {
+		return nil, errors.New("webp: error encoding final thumbnail: " + err.Error())
+	}
+
+	return &m.Thumbnail{
+		ContentType: "image/png",
+		Animated:    true,
+		Reader:      ioutil.NopCloser(buf),
+	}, nil
+}
+
+// DecodeAnimatedWebp decodes every frame of an animated WebP image. Returns false if the image is not
+// animated.
+func DecodeAnimatedWebp(b []byte) (bool, error) {
+	anim, err := parseAnimatedWebp(b)
+	if err != nil || anim == nil {
+		return false, err
+	}
+	for _, frame := range anim.frames {
+		_, err = frame.decode()
+		if err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// decode decodes the frame by wrapping its chunks in a still WebP container.
+func (f webpFrame) decode() (image.Image, error) {
+	flags := byte(0)
+	if bytes.Equal(f.data[0:4], []byte("ALPH")) {
+		flags |= 1 << 4 // alpha
+	}
+	vp8x := make([]byte, 10)
+	vp8x[0] = flags
+	putUint24(vp8x[4:7], f.width-1)
+	putUint24(vp8x[7:10], f.height-1)
+
+	body := &bytes.Buffer{}
+	body.WriteString("WEBP")
+	writeWebpChunk(body, "VP8X", vp8x)
+	body.Write(f.data)
+
+	container := &bytes.Buffer{}
+	container.WriteString("RIFF")
+	_ = binary.Write(container, binary.LittleEndian, uint32(body.Len()))
+	container.Write(body.Bytes())
+
+	return webp.Decode(container)
+}
+
+// parseAnimatedWebp reads the frames of an animated WebP image. Returns nil if the image is not
+// animated.
+func parseAnimatedWebp(b []byte) (*animatedWebp, error) {
+	if len(b) < 12 || string(b[0:4]) != "RIFF" || string(b[8:12]) != "WEBP" {
+		return nil, errors.New("not a webp image")
+	}
+
+	var anim *animatedWebp
+	err := readWebpChunks(b[12:], func(id string, data []byte) error {
+		switch id {
+		case "VP8X":
+			if len(data) < 10 {
+				return errors.New("invalid VP8X chunk")
+			}
+			if data[0]&(1<<1) == 0 {
+				return errStopWebpChunks // not animated
+			}
+			anim = &animatedWebp{
+				width:  getUint24(data[4:7]) + 1,
+				height: getUint24(data[7:10]) + 1,
+				frames: make([]webpFrame, 0),
+			}
+		case "ANIM":
+			if anim == nil || len(data) < 6 {
+				return errors.New("invalid ANIM chunk")
+			}
+			anim.loopCount = uint(binary.LittleEndian.Uint16(data[4:6]))
+		case "ANMF":
+			if anim == nil || len(data) < 16 {
+				return errors.New("invalid ANMF chunk")
+			}
+			frame := webpFrame{
+				x:          getUint24(data[0:3]) * 2,
+				y:          getUint24(data[3:6]) * 2,
+				width:      getUint24(data[6:9]) + 1,
+				height:     getUint24(data[9:12]) + 1,
+				durationMs: getUint24(data[12:15]),
+				blend:      data[15]&(1<<1) == 0,
+				dispose:    data[15]&1 != 0,
+			}
+			if frame.x+frame.width > anim.width || frame.y+frame.height > anim.height {
+				return errors.New("frame is outside of the canvas")
+			}
+
+			// Only keep the chunks needed to decode the frame
+			frameData := &bytes.Buffer{}
+			err := readWebpChunks(data[16:], func(id string, data []byte) error {
+				if id == "ALPH" || id == "VP8 " || id == "VP8L" {
+					writeWebpChunk(frameData, id, data)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if frameData.Len() < 4 {
+				return errors.New("frame has no image data")
+			}
+			frame.data = frameData.Bytes()
+			anim.frames = append(anim.frames, frame)
+		}
+		return nil
+	})
+	if err != nil && err != errStopWebpChunks {
+		return nil, err
+	}
+	if anim == nil || len(anim.frames) == 0 {
+		return nil, nil
+	}
+	return anim, nil
+}
+
+var errStopWebpChunks = errors.New("stop reading chunks")
+
+func readWebpChunks(b []byte, fn func(id string, data []byte) error) error {
+	for len(b) >= 8 {
+		id := string(b[0:4])
+		size := int(binary.LittleEndian.Uint32(b[4:8]))
+		if size < 0 || 8+size > len(b) {
+			return errors.New("chunk " + id + " is truncated")
+		}
+		err := fn(id, b[8:8+size])
+		if err != nil {
+			return err
+		}
+		size += size & 1 // chunks are padded to an even size
+		if 8+size > len(b) {
+			break
+		}
+		b = b[8+size:]
+	}
+	return nil
+}
+
+func writeWebpChunk(buf *bytes.Buffer, id string, data []byte) {
+	buf.WriteString(id)
+	_ = binary.Write(buf, binary.LittleEndian, uint32(len(data)))
+	buf.Write(data)
+	if len(data)%2 == 1 {
+		buf.WriteByte(0)
+	}
+}
+
+func getUint24(b []byte) int {
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+}
+
+func putUint24(b []byte, v int) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+}
+
 func init() {
 	generators = append(generators, webpGenerator{})
 }
@@ -1,12 +1,14 @@
 package thumbnailing
 
 import (
+	"bytes"
 	"errors"
 	"github.com/turt2live/matrix-media-repo/common"
 	"io"
 	"io/ioutil"
 	"reflect"
 
+	"github.com/disintegration/imaging"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/thumbnailing/i"
 	"github.com/turt2live/matrix-media-repo/thumbnailing/m"
@@ -24,6 +26,10 @@ func IsAnimationSupported(contentType string) bool {
 	return util.ArrayContains(i.GetSupportedAnimationTypes(), contentType)
 }
 
+func IsAnimated(b []byte, contentType string) bool {
+	return i.IsAnimated(b, contentType)
+}
+
 func GenerateThumbnail(imgStream io.ReadCloser, contentType string, width int, height int, method string, animated bool, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
 	if !IsSupported(contentType) {
 		return nil, ErrUnsupported
@@ -47,12 +53,150 @@ func GenerateThumbnail(imgStream io.ReadCloser, contentType string, width int, h
 	if err != nil {
 		return nil, err
 	}
-	if dimensional && (w*h) >= ctx.Config.Thumbnails.MaxPixels {
+	if dimensional && util.ExceedsPixelCount(w, h, ctx.Config.Thumbnails.MaxPixels) {
+		ctx.Log.Warn("Image too large: too many pixels")
+		return nil, common.ErrMediaTooLarge
+	}
+	if dimensional && !ctx.Config.Thumbnails.AllowUpscaling && w <= width && h <= height {
+		ctx.Log.Info("Image is smaller than the requested size - using the original instead")
+		return originalAsThumbnail(b, contentType, animated, ctx)
+	}
+
+	thumb, err := generator.GenerateThumbnail(b, contentType, width, height, method, animated, ctx)
+	if err != nil || thumb == nil {
+		return thumb, err
+	}
+
+	outputType := PickOutputType(contentType, ctx)
+	if outputType != "" && !thumb.Animated && thumb.ContentType != outputType {
+		return convertThumbnail(thumb, outputType, ctx)
+	}
+	return thumb, nil
+}
+
+// SupportsPresets determines if GeneratePresetThumbnails can be used for the given content type.
+func SupportsPresets(contentType string) bool {
+	return i.SupportsPresets(contentType)
+}
+
+// GeneratePresetThumbnails generates a static thumbnail for each of the presets, decoding the source
+// image only once. Entries are nil where the source image is too small to thumbnail.
+func GeneratePresetThumbnails(imgStream io.ReadCloser, contentType string, presets []i.Preset, ctx rcontext.RequestContext) ([]*m.Thumbnail, error) {
+	if !SupportsPresets(contentType) {
+		return nil, ErrUnsupported
+	}
+
+	defer cleanup.DumpAndCloseStream(imgStream)
+	b, err := ioutil.ReadAll(imgStream)
+	if err != nil {
+		return nil, err
+	}
+
+	generator := i.GetGenerator(b, contentType, false)
+	if generator == nil {
+		return nil, ErrUnsupported
+	}
+	dimensional, w, h, err := generator.GetOriginDimensions(b, contentType, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if dimensional && util.ExceedsPixelCount(w, h, ctx.Config.Thumbnails.MaxPixels) {
 		ctx.Log.Warn("Image too large: too many pixels")
 		return nil, common.ErrMediaTooLarge
 	}
 
-	return generator.GenerateThumbnail(b, contentType, width, height, method, animated, ctx)
+	thumbs, err := i.GeneratePresets(b, contentType, presets, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	outputType := PickOutputType(contentType, ctx)
+	for idx, thumb := range thumbs {
+		if thumb != nil && outputType != "" && thumb.ContentType != outputType {
+			thumbs[idx], err = convertThumbnail(thumb, outputType, ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return thumbs, nil
+}
+
+// PickOutputType returns the configured output content type for thumbnails of the given source
+// content type, or an empty string if the thumbnailer should pick.
+func PickOutputType(contentType string, ctx rcontext.RequestContext) string {
+	for _, t := range ctx.Config.Thumbnails.OutputTypes {
+		if util.ContentTypeMatches(t.SourceType, contentType) {
+			return t.OutputType
+		}
+	}
+	return ""
+}
+
+// IsOriginalSuitable returns true if an original image with the given dimensions is no larger than
+// a thumbnail of the given size, so can be served in its place. Callers must also check that the
+// original is in the thumbnail's output format with OutputKeepsFormat.
+func IsOriginalSuitable(originalWidth int, originalHeight int, width int, height int, ctx rcontext.RequestContext) bool {
+	if ctx.Config.Thumbnails.AllowUpscaling {
+		return originalWidth == width && originalHeight == height
+	}
+	return originalWidth <= width && originalHeight <= height
+}
+
+// OutputKeepsFormat returns true if thumbnails of the given content type are output in the same
+// format, rather than being converted to another type by the outputTypes config.
+func OutputKeepsFormat(contentType string, ctx rcontext.RequestContext) bool {
+	outputType := PickOutputType(contentType, ctx)
+	return outputType == "" || outputType == contentType
+}
+
+func keepsOriginalFormat(contentType string, animated bool, ctx rcontext.RequestContext) bool {
+	return animated || OutputKeepsFormat(contentType, ctx)
+}
+
+// originalAsThumbnail converts the original image to the configured output type, if there is one.
+// Returns nil if the original can be used as-is.
+func originalAsThumbnail(b []byte, contentType string, animated bool, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+	if keepsOriginalFormat(contentType, animated, ctx) {
+		return nil, nil
+	}
+	outputType := PickOutputType(contentType, ctx)
+	return convertThumbnail(&m.Thumbnail{
+		Animated:    false,
+		ContentType: contentType,
+		Reader:      ioutil.NopCloser(bytes.NewReader(b)),
+	}, outputType, ctx)
+}
+
+func convertThumbnail(thumb *m.Thumbnail, outputType string, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+	var format imaging.Format
+	if outputType == "image/jpeg" {
+		format = imaging.JPEG
+	} else if outputType == "image/png" {
+		format = imaging.PNG
+	} else {
+		ctx.Log.Warn("Unsupported thumbnail output type, leaving thumbnail as " + thumb.ContentType + ": " + outputType)
+		return thumb, nil
+	}
+
+	defer cleanup.DumpAndCloseStream(thumb.Reader)
+	img, err := imaging.Decode(thumb.Reader, imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, errors.New("error decoding thumbnail for conversion: " + err.Error())
+	}
+
+	imgData := &bytes.Buffer{}
+	err = imaging.Encode(imgData, img, format)
+	if err != nil {
+		return nil, errors.New("error encoding converted thumbnail: " + err.Error())
+	}
+
+	ctx.Log.Info("Converted thumbnail from " + thumb.ContentType + " to " + outputType)
+	return &m.Thumbnail{
+		Animated:    false,
+		ContentType: outputType,
+		Reader:      ioutil.NopCloser(imgData),
+	}, nil
 }
 
 func GetGenerator(imgStream io.ReadCloser, contentType string, animated bool) (i.Generator, error) {
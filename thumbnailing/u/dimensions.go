@@ -4,7 +4,7 @@ import (
 	"image"
 )
 
-func AdjustProperties(img image.Image, desiredWidth int, desiredHeight int, wantAnimated bool, canAnimate bool, method string) (bool, int, int, bool, string) {
+func AdjustProperties(img image.Image, desiredWidth int, desiredHeight int, wantAnimated bool, canAnimate bool, method string, allowUpscaling bool) (bool, int, int, bool, string) {
 	srcWidth := img.Bounds().Max.X
 	srcHeight := img.Bounds().Max.Y
 
@@ -15,7 +15,7 @@ func AdjustProperties(img image.Image, desiredWidth int, desiredHeight int, want
 		method = "scale"
 	}
 
-	if srcWidth <= desiredWidth && srcHeight <= desiredHeight {
+	if !allowUpscaling && srcWidth <= desiredWidth && srcHeight <= desiredHeight {
 		if wantAnimated {
 			return true, srcWidth, srcHeight, true, method
 		} else if canAnimate {
@@ -14,6 +14,13 @@ type Media struct {
 	Location    string
 	CreationTs  int64
 	Quarantined bool
+
+	// SoftDeleted is only populated when the media is looked up by ID or hash.
+	SoftDeleted bool
+
+	// Encoding is the encoding the file is stored with (such as gzip), or empty if it is stored as
+	// uploaded. Only populated when the media is looked up by ID or hash.
+	Encoding string
 }
 
 type MinimalMedia struct {
@@ -1,11 +1,22 @@
 package types
 
 type MediaAttributes struct {
-	Origin  string
-	MediaId string
-	Purpose string
+	Origin      string
+	MediaId     string
+	Purpose     string
+	CacheMaxAge int
+	// False if thumbnails should never be generated for the media, such as for encrypted files
+	Thumbnailable bool
+	// The number of times the media can be downloaded, or zero for no limit
+	MaxDownloads  int
+	DownloadCount int
+	// True if the media must always be downloaded as an attachment, such as for suspected polyglot files
+	ForceAttachment bool
 }
 
+// NoCacheMaxAge indicates the media does not override the configured cache duration
+const NoCacheMaxAge = -1
+
 const PurposeNone = "none"
 const PurposePinned = "pinned"
 
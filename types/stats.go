@@ -4,3 +4,24 @@ type UserStats struct {
 	UserId        string
 	UploadedBytes int64
 }
+
+type AccessStats struct {
+	Sha256Hash   string
+	LastAccessTs int64
+	AccessCount  int64
+}
+
+type MediaReport struct {
+	Origin   string
+	MediaId  string
+	Reporter string
+	Reason   string
+	ReportTs int64
+}
+
+type MediaSoftDeletion struct {
+	Origin    string
+	MediaId   string
+	DeletedBy string
+	DeletedTs int64
+}
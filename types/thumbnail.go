@@ -17,6 +17,10 @@ type Thumbnail struct {
 	Location    string
 	CreationTs  int64
 	Sha256Hash  string
+	// The hash of the media the thumbnail was generated from
+	SourceSha256Hash string
+	// Identifies the thumbnail configuration the thumbnail was generated with
+	Generation string
 }
 
 type StreamedThumbnail struct {
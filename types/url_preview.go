@@ -19,4 +19,5 @@ type CachedUrlPreview struct {
 	SearchUrl string
 	ErrorCode string
 	FetchedTs int64
+	ExpiresTs int64
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/getsentry/sentry-go"
 	"net"
+	"net/http"
 
 	"github.com/sirupsen/logrus"
 	"github.com/turt2live/matrix-media-repo/common"
@@ -93,3 +94,17 @@ func inRange(ip net.IP, cidrs []string, ctx rcontext.RequestContext) bool {
 
 	return false
 }
+
+// CheckRedirect ensures that a redirect during a preview is to an allowed address, for use with
+// util.LimitRedirects.
+func CheckRedirect(req *http.Request, ctx rcontext.RequestContext) error {
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	_, _, err := GetSafeAddress(net.JoinHostPort(req.URL.Hostname(), port), ctx)
+	return err
+}
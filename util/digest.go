@@ -0,0 +1,85 @@
+package util
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var ErrDigestMismatch = errors.New("digest mismatch")
+
+type ExpectedDigest struct {
+	newHash  func() hash.Hash
+	expected []byte
+}
+
+// GetExpectedDigest parses the Digest (sha-256) or Content-MD5 headers of a request, preferring
+// the Digest header. Returns nil if neither header has a supported digest.
+func GetExpectedDigest(headers http.Header) (*ExpectedDigest, error) {
+	for _, header := range headers.Values("Digest") {
+		for _, part := range strings.Split(header, ",") {
+			kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+			if len(kv) != 2 || strings.ToLower(kv[0]) != "sha-256" {
+				continue
+			}
+			b, err := base64.StdEncoding.DecodeString(kv[1])
+			if err != nil || len(b) != sha256.Size {
+				return nil, errors.New("invalid sha-256 digest")
+			}
+			return &ExpectedDigest{newHash: sha256.New, expected: b}, nil
+		}
+	}
+
+	if header := headers.Get("Content-MD5"); header != "" {
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(header))
+		if err != nil || len(b) != md5.Size {
+			return nil, errors.New("invalid Content-MD5")
+		}
+		return &ExpectedDigest{newHash: md5.New, expected: b}, nil
+	}
+
+	return nil, nil
+}
+
+// DigestVerifier is implemented by streams which can check the contents read from them against an
+// expected digest.
+type DigestVerifier interface {
+	// VerifyDigest returns ErrDigestMismatch if the contents read so far do not match the digest.
+	VerifyDigest() error
+}
+
+type digestVerifyingReader struct {
+	r        io.ReadCloser
+	h        hash.Hash
+	expected []byte
+}
+
+// VerifyingReader wraps the stream so that the contents read from it can be checked against the
+// digest. The returned stream implements DigestVerifier: callers must check it after reading the
+// contents, as the stream may not be read to the end if it is longer than expected.
+func (d *ExpectedDigest) VerifyingReader(r io.ReadCloser) io.ReadCloser {
+	return &digestVerifyingReader{r: r, h: d.newHash(), expected: d.expected}
+}
+
+func (r *digestVerifyingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.h.Write(p[:n])
+	return n, err
+}
+
+func (r *digestVerifyingReader) VerifyDigest() error {
+	if !bytes.Equal(r.h.Sum(nil), r.expected) {
+		return ErrDigestMismatch
+	}
+	return nil
+}
+
+func (r *digestVerifyingReader) Close() error {
+	return r.r.Close()
+}
@@ -1,8 +1,11 @@
 package util
 
 import (
+	"fmt"
 	"net/http"
+	"regexp"
 	"strings"
+	"unicode"
 
 	"github.com/sirupsen/logrus"
 )
@@ -28,12 +31,103 @@ func GetAppserviceUserIdFromRequest(request *http.Request) string {
 	return request.URL.Query().Get("user_id")
 }
 
+// GetUserAgentFromRequest returns the client's User-Agent, stripped of control characters and
+// truncated to a reasonable length for storage.
+func GetUserAgentFromRequest(request *http.Request) string {
+	userAgent := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(request.UserAgent()))
+	if len(userAgent) > 512 {
+		userAgent = strings.ToValidUTF8(userAgent[:512], "")
+	}
+	return userAgent
+}
+
 func GetLogSafeQueryString(r *http.Request) string {
 	qs := r.URL.Query()
 
 	if qs.Get("access_token") != "" {
 		qs.Set("access_token", "redacted")
 	}
+	if qs.Get("io.t2bot.download_token") != "" {
+		qs.Set("io.t2bot.download_token", "redacted")
+	}
 
 	return qs.Encode()
 }
+
+var accessTokenRegex = regexp.MustCompile(`("access_token"\s*:\s*"|access_token[=:]\s*)[^"&\s,}]*`)
+
+// GetLogSafeBody redacts any access tokens from the body, truncating it to maxLength characters.
+func GetLogSafeBody(body string, maxLength int) string {
+	body = accessTokenRegex.ReplaceAllString(body, "${1}redacted")
+	if maxLength > 0 && len(body) > maxLength {
+		return body[:maxLength] + "... <truncated>"
+	}
+	return body
+}
+
+// ContentDispositionFilename builds the filename parameters for a Content-Disposition header. An
+// ASCII-only `filename` is always included for older clients, alongside an RFC 5987 `filename*`
+// for clients which can recover the original (Unicode) name. Control characters are stripped to
+// prevent header injection.
+func ContentDispositionFilename(fname string) string {
+	fname = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, fname)
+
+	ascii := strings.Builder{}
+	for _, r := range fname {
+		if r > unicode.MaxASCII {
+			ascii.WriteRune('_')
+		} else if r == '"' || r == '\\' {
+			ascii.WriteRune('\\')
+			ascii.WriteRune(r)
+		} else {
+			ascii.WriteRune(r)
+		}
+	}
+
+	encoded := strings.Builder{}
+	for _, b := range []byte(fname) {
+		if isRfc5987AttrChar(b) {
+			encoded.WriteByte(b)
+		} else {
+			encoded.WriteString(fmt.Sprintf("%%%02X", b))
+		}
+	}
+
+	return "filename=\"" + ascii.String() + "\"; filename*=UTF-8''" + encoded.String()
+}
+
+func isRfc5987AttrChar(b byte) bool {
+	if (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9') {
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
+
+// LimitRedirects returns a CheckRedirect function for an http.Client which fails once more than
+// maxRedirects redirects would be followed. Redirects to schemes other than http and https are
+// rejected. If given, checkHop is called for every redirect so the target can be validated before
+// it is requested.
+func LimitRedirects(maxRedirects int, checkHop func(req *http.Request) error) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) > maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("refusing to follow redirect to scheme %s", req.URL.Scheme)
+		}
+		if checkHop != nil {
+			return checkHop(req)
+		}
+		return nil
+	}
+}
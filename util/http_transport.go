@@ -0,0 +1,93 @@
+package util
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/turt2live/matrix-media-repo/common/config"
+)
+
+var sharedTransports = NewTransportPool()
+
+// NewHttpTransport creates a transport using the configured connection reuse settings. The transport
+// doesn't use a proxy: callers which are allowed to go through the proxy configured by the environment
+// must set one. Callers which need their own TLS or dialing behaviour should configure the returned
+// transport and then keep it in a TransportPool, otherwise connections cannot be reused.
+func NewHttpTransport() *http.Transport {
+	conf := config.Get().OutboundHttp
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(conf.DialTimeoutSeconds) * time.Second,
+		KeepAlive: time.Duration(conf.KeepAliveSeconds) * time.Second,
+	}
+	return &http.Transport{
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          conf.MaxIdleConns,
+		MaxIdleConnsPerHost:   conf.MaxIdleConnsPerHost,
+		IdleConnTimeout:       time.Duration(conf.IdleConnTimeoutSeconds) * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// TransportPool keeps transports by key so their connections can be reused. Transports which haven't
+// been used for an hour are dropped, as are all of them when the outbound HTTP config changes.
+type TransportPool struct {
+	lock       sync.Mutex
+	transports *cache.Cache
+	conf       config.OutboundHttpConfig
+}
+
+func NewTransportPool() *TransportPool {
+	transports := cache.New(1*time.Hour, 10*time.Minute)
+	transports.OnEvicted(func(key string, tr interface{}) {
+		tr.(*http.Transport).CloseIdleConnections()
+	})
+	return &TransportPool{transports: transports}
+}
+
+// Get returns the transport for the key, using create to make one if there isn't one already.
+func (p *TransportPool) Get(key string, create func() *http.Transport) *http.Transport {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	conf := config.Get().OutboundHttp
+	if conf != p.conf {
+		for _, item := range p.transports.Items() {
+			item.Object.(*http.Transport).CloseIdleConnections()
+		}
+		p.transports.Flush()
+		p.conf = conf
+	}
+
+	var tr *http.Transport
+	if item, found := p.transports.Get(key); found {
+		tr = item.(*http.Transport)
+	} else {
+		tr = create()
+	}
+	p.transports.Set(key, tr, cache.DefaultExpiration) // also pushes back the expiry
+	return tr
+}
+
+// SharedHttpTransport returns the transport shared by all outbound requests which don't need
+// special TLS or dialing behaviour. These requests use the proxy configured by the environment.
+func SharedHttpTransport() *http.Transport {
+	return sharedTransports.Get("", func() *http.Transport {
+		tr := NewHttpTransport()
+		tr.Proxy = http.ProxyFromEnvironment
+		return tr
+	})
+}
+
+// NewHttpClient creates a client which reuses connections from the shared transport.
+func NewHttpClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: SharedHttpTransport(),
+		Timeout:   timeout,
+	}
+}
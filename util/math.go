@@ -20,3 +20,11 @@ func MinFloat32(a float32, b float32) float32 {
 	}
 	return b
 }
+
+// ExceedsPixelCount returns true if width*height is greater than maxPixels, without overflowing.
+func ExceedsPixelCount(width int, height int, maxPixels int) bool {
+	if width <= 0 || height <= 0 {
+		return false
+	}
+	return width > maxPixels/height
+}
@@ -7,3 +7,12 @@ import (
 func FixContentType(ct string) string {
 	return strings.Split(ct, ";")[0]
 }
+
+// ContentTypeMatches returns true if the content type matches the pattern. Patterns ending
+// with `*` match any content type with the same prefix, such as `image/*`.
+func ContentTypeMatches(pattern string, ct string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(ct, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == ct
+}
@@ -6,6 +6,8 @@ import (
 	"encoding/hex"
 )
 
+const alphanumericChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
 func GenerateRandomBytes(n int) ([]byte, error) {
 	b := make([]byte, n)
 	_, err := rand.Read(b)
@@ -26,6 +28,30 @@ func GenerateRandomString(nBytes int) (string, error) {
 	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
+// GenerateRandomAlphanumeric returns a string of the given length made up of uniformly random
+// letters and digits, using a cryptographically secure source.
+func GenerateRandomAlphanumeric(length int) (string, error) {
+	result := make([]byte, 0, length)
+	buf := make([]byte, length)
+	for len(result) < length {
+		_, err := rand.Read(buf)
+		if err != nil {
+			return "", err
+		}
+		for _, b := range buf {
+			// Reject bytes past the last full multiple of the charset size to avoid a bias
+			if int(b) >= 256-(256%len(alphanumericChars)) {
+				continue
+			}
+			result = append(result, alphanumericChars[int(b)%len(alphanumericChars)])
+			if len(result) == length {
+				break
+			}
+		}
+	}
+	return string(result), nil
+}
+
 func GetSha1OfString(str string) (string, error) {
 	hasher := sha1.New()
 	hasher.Write([]byte(str))
@@ -0,0 +1,94 @@
+package util
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/idna"
+)
+
+// CanonicalServerName validates the given Matrix server name (a hostname with an optional port),
+// returning it in canonical form. Internationalized domain names are converted to their ASCII
+// (punycode) form; anything else is returned as given. In particular, the case of ASCII hostnames is
+// preserved as media is stored under the server name as given, unless general.lowercaseServerNames
+// is enabled (which lowercases the name before it gets here).
+func CanonicalServerName(serverName string) (string, error) {
+	if serverName == "" {
+		return "", errors.New("not a valid server name: empty")
+	}
+
+	host := serverName
+	port := ""
+	if strings.HasPrefix(host, "[") {
+		end := strings.Index(host, "]")
+		if end < 0 {
+			return "", errors.New("not a valid server name: unterminated IPv6 literal")
+		}
+		if !strings.Contains(host[1:end], ":") || net.ParseIP(host[1:end]) == nil {
+			return "", errors.New("not a valid server name: bad IPv6 literal")
+		}
+		rest := host[end+1:]
+		if rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return "", errors.New("not a valid server name: unexpected characters after IPv6 literal")
+			}
+			port = rest[1:]
+			if err := validatePort(port); err != nil {
+				return "", err
+			}
+		}
+		return serverName, nil
+	}
+
+	if idx := strings.LastIndex(host, ":"); idx >= 0 {
+		port = host[idx+1:]
+		host = host[:idx]
+		if err := validatePort(port); err != nil {
+			return "", err
+		}
+	}
+
+	if strings.IndexFunc(host, func(r rune) bool { return r > 127 }) >= 0 {
+		ascii, err := idna.Lookup.ToASCII(host)
+		if err != nil {
+			return "", errors.Wrap(err, "not a valid server name")
+		}
+		host = ascii
+	}
+
+	if len(host) == 0 || len(host) > 255 {
+		return "", errors.New("not a valid server name: hostname must be between 1 and 255 characters")
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" {
+			return "", errors.New("not a valid server name: empty label in hostname")
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') && c != '-' {
+				return "", errors.New("not a valid server name: invalid character in hostname")
+			}
+		}
+	}
+
+	if port != "" {
+		return host + ":" + port, nil
+	}
+	return host, nil
+}
+
+func validatePort(port string) error {
+	if len(port) == 0 || len(port) > 5 {
+		return errors.New("not a valid server name: port must be between 1 and 5 digits")
+	}
+	for _, c := range port {
+		if c < '0' || c > '9' {
+			return errors.New("not a valid server name: port must be numeric")
+		}
+	}
+	if p, _ := strconv.Atoi(port); p < 1 || p > 65535 {
+		return errors.New("not a valid server name: port out of range")
+	}
+	return nil
+}
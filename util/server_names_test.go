@@ -0,0 +1,67 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestCanonicalServerName(t *testing.T) {
+	tests := []struct {
+		name       string
+		serverName string
+		expected   string
+		valid      bool
+	}{
+		{"hostname", "example.org", "example.org", true},
+		{"hostname with port", "example.org:8448", "example.org:8448", true},
+		{"single label", "localhost", "localhost", true},
+		{"hyphens and digits", "matrix-1.example.org", "matrix-1.example.org", true},
+		{"uppercase", "Example.ORG", "Example.ORG", true},
+		{"uppercase with port", "EXAMPLE.org:443", "EXAMPLE.org:443", true},
+		{"ipv4", "127.0.0.1", "127.0.0.1", true},
+		{"ipv4 with port", "127.0.0.1:8008", "127.0.0.1:8008", true},
+		{"ipv6", "[::1]", "[::1]", true},
+		{"ipv6 with port", "[2001:db8::1]:8448", "[2001:db8::1]:8448", true},
+		{"idn", "bücher.example", "xn--bcher-kva.example", true},
+		{"idn with port", "bücher.example:8448", "xn--bcher-kva.example:8448", true},
+		{"uppercase idn", "BÜCHER.example", "xn--bcher-kva.example", true},
+		{"punycode", "xn--bcher-kva.example", "xn--bcher-kva.example", true},
+
+		{"empty", "", "", false},
+		{"trailing dot", "example.org.", "", false},
+		{"trailing dot with port", "example.org.:8448", "", false},
+		{"leading dot", ".example.org", "", false},
+		{"double dot", "example..org", "", false},
+		{"empty port", "example.org:", "", false},
+		{"port only", ":8448", "", false},
+		{"non-numeric port", "example.org:http", "", false},
+		{"port zero", "example.org:0", "", false},
+		{"port too large", "example.org:65536", "", false},
+		{"port too long", "example.org:000443", "", false},
+		{"unbracketed ipv6", "::1", "", false},
+		{"unterminated ipv6", "[::1", "", false},
+		{"ipv4 in brackets", "[127.0.0.1]", "", false},
+		{"bad ipv6", "[::g]", "", false},
+		{"ipv6 with junk", "[::1]x", "", false},
+		{"ipv6 with empty port", "[::1]:", "", false},
+		{"underscore", "exa_mple.org", "", false},
+		{"slash", "example.org/path", "", false},
+		{"space", "example .org", "", false},
+		{"invalid idn", "bücher..example", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			canonical, err := CanonicalServerName(tt.serverName)
+			if tt.valid {
+				if err != nil {
+					t.Fatalf("expected %q to be valid, got %v", tt.serverName, err)
+				}
+				if canonical != tt.expected {
+					t.Errorf("expected %q, got %q", tt.expected, canonical)
+				}
+			} else if err == nil {
+				t.Errorf("expected %q to be invalid, got %q", tt.serverName, canonical)
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/hex"
 	"io"
 	"io/ioutil"
+	"time"
 
 	"github.com/turt2live/matrix-media-repo/util/cleanup"
 	"github.com/turt2live/matrix-media-repo/util/util_byte_seeker"
@@ -58,4 +59,42 @@ func GetSha256HashOfStream(r io.ReadCloser) (string, error) {
 
 func ClonedBufReader(buf bytes.Buffer) util_byte_seeker.ByteSeeker {
 	return util_byte_seeker.NewByteSeeker(buf.Bytes())
-}
\ No newline at end of file
+}
+
+type throttledReader struct {
+	reader         io.Reader
+	bytesPerSecond int64
+	started        time.Time
+	bytesRead      int64
+}
+
+// ThrottleReader wraps the reader so that it is read no faster than the given rate.
+func ThrottleReader(r io.Reader, bytesPerSecond int64) io.Reader {
+	return &throttledReader{reader: r, bytesPerSecond: bytesPerSecond, started: time.Now()}
+}
+
+type throttledReadSeeker struct {
+	io.Reader
+	io.Seeker
+}
+
+// ThrottleReadSeeker is the same as ThrottleReader, though keeps the stream seekable.
+func ThrottleReadSeeker(r io.ReadSeeker, bytesPerSecond int64) io.ReadSeeker {
+	return &throttledReadSeeker{Reader: ThrottleReader(r, bytesPerSecond), Seeker: r}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > t.bytesPerSecond {
+		p = p[:t.bytesPerSecond]
+	}
+	n, err := t.reader.Read(p)
+	t.bytesRead += int64(n)
+
+	expected := time.Duration(float64(t.bytesRead) / float64(t.bytesPerSecond) * float64(time.Second))
+	elapsed := time.Since(t.started)
+	if expected > elapsed {
+		time.Sleep(expected - elapsed)
+	}
+
+	return n, err
+}